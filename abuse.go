@@ -0,0 +1,204 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colBlocked records actors that are shadow-blocked, see blockedActor.
+const colBlocked = "blocked"
+
+// An actor, i.e. an IP address or a visitor ID, that reports more than
+// abuseLimit visits of a host within abuseWindow inflates its counts and
+// is shadow-blocked for abuseBlock: its visits are accepted as usual but
+// not recorded, so that it does not notice and move on to another IP
+// address. The detector is configured by environment variables:
+//
+//	URLSTAT_ABUSE_LIMIT: the visits of an actor in 5 minutes, defaults to 1000, 0 disables it
+//	URLSTAT_ABUSE_BLOCK: how long an actor is blocked, defaults to 24h
+var (
+	abuseWindow = 5 * time.Minute
+	abuseLimit  = 1000
+	abuseBlock  = day
+)
+
+func init() {
+	if v := os.Getenv("URLSTAT_ABUSE_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid URLSTAT_ABUSE_LIMIT: %v", v)
+		}
+		abuseLimit = n
+	}
+	if v := os.Getenv("URLSTAT_ABUSE_BLOCK"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid URLSTAT_ABUSE_BLOCK: %v", v)
+		}
+		abuseBlock = d
+	}
+}
+
+// blockedActor is an actor that is shadow-blocked on a host. Its ID is
+// the kind, the actor, and the host, e.g. ip:203.0.113.1@changkun.de.
+type blockedActor struct {
+	ID      string    `json:"id"      bson:"_id"`
+	Host    string    `json:"host"    bson:"host"`
+	Kind    string    `json:"kind"    bson:"kind"` // ip or visitor
+	Actor   string    `json:"actor"   bson:"actor"`
+	Hits    int       `json:"hits"    bson:"hits"`
+	Time    time.Time `json:"time"    bson:"time"`
+	Expires time.Time `json:"expires" bson:"expires"`
+}
+
+// abuse counts the visits of actors per host in the current window, and
+// caches the blocked actors of all replicas, which abuseWorker refreshes.
+var abuse = struct {
+	sync.Mutex
+	hits    map[string]*abuseHits
+	blocked map[string]time.Time
+	swept   time.Time
+}{hits: map[string]*abuseHits{}, blocked: map[string]time.Time{}}
+
+type abuseHits struct {
+	start time.Time
+	n     int
+}
+
+// shadowBlocked counts a visit of a collection and reports whether its IP
+// address or visitor ID is blocked, which blocks them once they exceed the
+// limit.
+func shadowBlocked(ctx context.Context, col string, rep visitReport, now time.Time) bool {
+	if abuseLimit == 0 {
+		return false
+	}
+	actors := []blockedActor{{Kind: "ip", Actor: rep.IP}}
+	if rep.VisitorID != "" {
+		actors = append(actors, blockedActor{Kind: "visitor", Actor: rep.VisitorID})
+	}
+
+	abuse.Lock()
+	if now.Sub(abuse.swept) > abuseWindow {
+		for id, h := range abuse.hits {
+			if now.Sub(h.start) > abuseWindow {
+				delete(abuse.hits, id)
+			}
+		}
+		for id, expires := range abuse.blocked {
+			if !now.Before(expires) {
+				delete(abuse.blocked, id)
+			}
+		}
+		abuse.swept = now
+	}
+	var blocked bool
+	var block []blockedActor
+	for _, a := range actors {
+		a.ID = a.Kind + ":" + a.Actor + "@" + col
+		if now.Before(abuse.blocked[a.ID]) {
+			blocked = true
+			continue
+		}
+		h, ok := abuse.hits[a.ID]
+		if !ok || now.Sub(h.start) > abuseWindow {
+			h = &abuseHits{start: now}
+			abuse.hits[a.ID] = h
+		}
+		h.n++
+		if h.n > abuseLimit {
+			a.Host, a.Hits, a.Time, a.Expires = col, h.n, now, now.Add(abuseBlock)
+			abuse.blocked[a.ID] = a.Expires
+			delete(abuse.hits, a.ID)
+			block = append(block, a)
+			blocked = true
+		}
+	}
+	abuse.Unlock()
+
+	// Other replicas and the admin see the block once it is saved. The
+	// replica blocks the actor regardless.
+	for i := range block {
+		l.Printf("shadow-blocking %s: %d visits within %v", block[i].ID, block[i].Hits, abuseWindow)
+		if err := store.blockActor(ctx, &block[i]); err != nil {
+			l.Printf("failed to save block of %s: %v", block[i].ID, err)
+		}
+	}
+	return blocked
+}
+
+// blockActor saves a blocked actor.
+func blockActor(ctx context.Context, a *blockedActor) error {
+	_, err := db.Database(metaname).Collection(colBlocked).ReplaceOne(ctx,
+		bson.M{"_id": a.ID}, a, options.Replace().SetUpsert(true))
+	return err
+}
+
+// blockedActors returns the actors that are blocked, latest first.
+func blockedActors(ctx context.Context) ([]blockedActor, error) {
+	cur, err := db.Database(metaname).Collection(colBlocked).Find(ctx,
+		bson.M{"expires": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "time", Value: -1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find blocked actors: %w", err)
+	}
+	as := []blockedActor{}
+	if err := cur.All(ctx, &as); err != nil {
+		return nil, fmt.Errorf("failed to decode blocked actors: %w", err)
+	}
+	return as, nil
+}
+
+// unblockActor lifts the block of an actor. Other replicas lift it once
+// they refresh their blocked actors.
+func unblockActor(ctx context.Context, id string) error {
+	res, err := db.Database(metaname).Collection(colBlocked).DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("%w: %s", errNotBlocked, id)
+	}
+	abuse.Lock()
+	delete(abuse.blocked, id)
+	delete(abuse.hits, id)
+	abuse.Unlock()
+	return nil
+}
+
+// abuseWorker refreshes the blocked actors of all replicas every minute
+// until the context is canceled.
+func abuseWorker(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		as, err := blockedActors(ctx)
+		if err == nil {
+			m := make(map[string]time.Time, len(as))
+			for _, a := range as {
+				m[a.ID] = a.Expires
+			}
+			abuse.Lock()
+			abuse.blocked = m
+			abuse.Unlock()
+		} else if ctx.Err() == nil {
+			l.Printf("%v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
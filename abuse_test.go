@@ -0,0 +1,42 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestShadowBlocked(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	defer func(n int) { abuseLimit = n }(abuseLimit)
+	abuseLimit = 3
+
+	now := time.Now()
+	rep := visitReport{IP: "203.0.113.7"}
+	for i := 0; i < 3; i++ {
+		if shadowBlocked(context.Background(), "abuse.test", rep, now) {
+			t.Fatalf("visit %d is blocked within the limit", i+1)
+		}
+	}
+	if !shadowBlocked(context.Background(), "abuse.test", rep, now) {
+		t.Fatalf("visit over the limit is not blocked")
+	}
+	if len(m.blocked) != 1 || m.blocked[0].ID != "ip:203.0.113.7@abuse.test" {
+		t.Fatalf("blocked actors: %+v", m.blocked)
+	}
+	if !shadowBlocked(context.Background(), "abuse.test", rep, now.Add(abuseWindow)) {
+		t.Fatalf("blocked actor is not blocked in the next window")
+	}
+	if shadowBlocked(context.Background(), "abuse.test", rep, now.Add(abuseBlock+abuseWindow)) {
+		t.Fatalf("actor is blocked after the block expired")
+	}
+	// The actor is blocked per host.
+	if shadowBlocked(context.Background(), "other.test", rep, now) {
+		t.Fatalf("actor is blocked on another host")
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// viewer is who views reports of a multi-user instance: an admin views all
+// sites, a user the sites it has a role on.
+type viewer struct {
+	login string
+	admin bool
+}
+
+type viewerKey struct{}
+
+// scoped restricts the reports of a handler to the sites of the viewer if
+// the instance is multi-user, and requires a viewer. Visitors that are not
+// logged in are redirected to log in from the dashboard, and unauthorized
+// elsewhere. Handlers check access to a site by canView.
+func scoped(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !multiUser() {
+			h(w, r)
+			return
+		}
+		ok, err := isAdmin(r.Context(), adminKey(r))
+		if err != nil {
+			respondError(w, r, fmt.Errorf("failed to check admin key: %w", err))
+			return
+		}
+		v := &viewer{admin: ok}
+		if !ok {
+			v.login = sessionLogin(r, time.Now())
+		}
+		if !v.admin && v.login == "" {
+			if r.URL.Path == "/urlstat/dashboard" {
+				http.Redirect(w, r, "/urlstat/login", http.StatusFound)
+				return
+			}
+			respondError(w, r, errUnauthorized)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), viewerKey{}, v)))
+	}
+}
+
+// canView reports whether the viewer of the context may view the reports
+// of a host, which all viewers may if the instance is not multi-user.
+func canView(ctx context.Context, host string) (bool, error) {
+	if !multiUser() {
+		return true, nil
+	}
+	v, _ := ctx.Value(viewerKey{}).(*viewer)
+	if v == nil {
+		return false, nil
+	}
+	if v.admin {
+		return true, nil
+	}
+	s, err := settingsOf(ctx, host)
+	if err != nil {
+		return false, fmt.Errorf("failed to load settings: %w", err)
+	}
+	return s.roleOf(v.login) != "", nil
+}
+
+// checkView returns errForbidden if the viewer of the context may not view
+// the reports of a host.
+func checkView(ctx context.Context, host string) error {
+	ok, err := canView(ctx, host)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", errForbidden, host)
+	}
+	return nil
+}
+
+// viewableHosts returns the hosts that the viewer of the context may view.
+func viewableHosts(ctx context.Context, hosts []string) ([]string, error) {
+	if !multiUser() {
+		return hosts, nil
+	}
+	var viewable []string
+	for _, h := range hosts {
+		ok, err := canView(ctx, h)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			viewable = append(viewable, h)
+		}
+	}
+	return viewable, nil
+}
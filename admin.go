@@ -0,0 +1,601 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colKeys stores the hashes of admin API keys.
+const colKeys = "keys"
+
+// adminCookie carries the admin API key of the admin interface. It is sent
+// to all of /urlstat, so that the API docs and the operations panel of the
+// dashboard are available after logging in.
+const adminCookie = "urlstat_admin"
+
+// apiKey is an admin API key, only its SHA-256 hash is stored.
+type apiKey struct {
+	Hash    string    `bson:"_id"`
+	Created time.Time `bson:"created"`
+}
+
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// isAdmin reports whether the key is a valid admin API key. The key of
+// URLSTAT_ADMIN_TOKEN is always valid, so that the first key can be
+// rotated and access is never lost.
+func isAdmin(ctx context.Context, key string) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+	if token := os.Getenv("URLSTAT_ADMIN_TOKEN"); token != "" &&
+		subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+		return true, nil
+	}
+	n, err := db.Database(metaname).Collection(colKeys).CountDocuments(ctx,
+		bson.M{"_id": hashKey(key)}, options.Count().SetComment(requestID(ctx)))
+	return n > 0, err
+}
+
+// adminKey returns the admin API key of the request, which is either a
+// bearer token or the admin cookie.
+func adminKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if c, err := r.Cookie(adminCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// rotateKey creates a new admin API key and revokes all others.
+func rotateKey(ctx context.Context) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(b)
+	col := db.Database(metaname).Collection(colKeys)
+	k := apiKey{Hash: hashKey(key), Created: time.Now().UTC()}
+	if _, err := col.InsertOne(ctx, k); err != nil {
+		return "", err
+	}
+	if _, err := col.DeleteMany(ctx, bson.M{"_id": bson.M{"$ne": k.Hash}}); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// site is the settings and totals of a host.
+type site struct {
+	Host string `json:"host"`
+	// Aliases are hostnames whose visits are stored in the collection
+	// of the host.
+	Aliases  []string      `json:"aliases"`
+	PV       int64         `json:"pv"`
+	UV       int64         `json:"uv"`
+	Updated  string        `json:"updated"`
+	Settings *siteSettings `json:"settings"`
+	// Confirm is the token to delete the host in the admin interface.
+	Confirm string `json:"-"`
+}
+
+// sites returns the settings of all hosts that have visits.
+func sites(ctx context.Context) ([]site, error) {
+	hosts, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+	cur, err := db.Database(metaname).Collection(colTotals).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find totals: %w", err)
+	}
+	var totals []total
+	if err := cur.All(ctx, &totals); err != nil {
+		return nil, fmt.Errorf("failed to find totals: %w", err)
+	}
+	byHost := map[string]total{}
+	for _, t := range totals {
+		byHost[t.Host] = t
+	}
+
+	source.mu.RLock()
+	aliases := map[string][]string{}
+	for alias, host := range source.Alias {
+		aliases[host] = append(aliases[host], alias)
+	}
+	source.mu.RUnlock()
+
+	sort.Strings(hosts)
+	all := make([]site, 0, len(hosts))
+	for _, host := range hosts {
+		s := site{Host: host, Aliases: aliases[host]}
+		sort.Strings(s.Aliases)
+		if t, ok := byHost[host]; ok {
+			s.PV, s.UV = t.PV, t.UV
+			s.Updated = t.Updated.Format(time.RFC3339)
+		}
+		s.Settings, err = settingsOf(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, s)
+	}
+	return all, nil
+}
+
+// cleanupHost deletes the recorded visits of a host that are excluded
+// by the current configuration, i.e. visits from excluded IP addresses
+// or of blocked user agents, and returns the number of deleted visits.
+// If dryRun is set, the visits are only counted. Deleted visits are moved
+// into the trash, see tombstone.
+func cleanupHost(ctx context.Context, host string, dryRun bool) (int64, error) {
+	col := db.Database(dbname).Collection(host)
+	cur, err := col.Find(ctx, bson.M{},
+		options.Find().SetProjection(bson.M{"ip": 1, "ua": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	var deleted int64
+	var t *tombstone
+	ids := make([]primitive.ObjectID, 0, insertBatch)
+	flush := func() error {
+		if len(ids) == 0 {
+			return nil
+		}
+		if t == nil {
+			t, err = newTombstone(ctx, host, "cleanup")
+			if err != nil {
+				return err
+			}
+		}
+		filter := bson.M{"_id": bson.M{"$in": ids}}
+		if _, err := migrateVisits(ctx, col, t.collection("visits"), filter); err != nil {
+			return err
+		}
+		stored, _ := storedVisits(host)
+		r, err := stored.DeleteMany(ctx, filter)
+		if err != nil {
+			return err
+		}
+		deleted += r.DeletedCount
+		ids = ids[:0]
+		_, err = db.Database(metaname).Collection(colTombstones).UpdateOne(ctx,
+			bson.M{"_id": t.ID}, bson.M{"$set": bson.M{"visits": deleted}})
+		return err
+	}
+	for cur.Next(ctx) {
+		var v struct {
+			ID primitive.ObjectID `bson:"_id"`
+			IP string             `bson:"ip"`
+			UA string             `bson:"ua"`
+		}
+		if err := cur.Decode(&v); err != nil {
+			return deleted, err
+		}
+		if !source.isExcluded(v.IP) && !source.isBlockedUA(v.UA) {
+			continue
+		}
+		if dryRun {
+			deleted++
+			continue
+		}
+		ids = append(ids, v.ID)
+		if len(ids) == insertBatch {
+			if err := flush(); err != nil {
+				return deleted, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return deleted, err
+	}
+	return deleted, flush()
+}
+
+// adminRequest is a mutation of the admin interface or API.
+type adminRequest struct {
+	// Action is one of add-domain, remove-domain, add-github,
+	// remove-github, import-allowlist, register-host, merge-host,
+	// delete-host, cleanup, run-cleanup, restore, update-settings,
+	// rotate-key, ensure-indexes, and drain.
+	Action string `json:"action"`
+	// Value is the domain or GitHub user of an allow-list change, the
+	// tombstone ID of restore, or the host of other actions.
+	Value string `json:"value"`
+	// Settings are the new settings of update-settings.
+	Settings *siteSettings `json:"settings,omitempty"`
+	// Target is the host that merge-host merges the host into.
+	Target string `json:"target,omitempty"`
+	// Confirm is the confirmation token of delete-host.
+	Confirm string `json:"confirm,omitempty"`
+	// DryRun previews the result of run-cleanup without deleting, or the
+	// change of import-allowlist without saving it.
+	DryRun bool `json:"dry_run,omitempty"`
+	// AllowList is the new allow-list of import-allowlist.
+	AllowList *allowList `json:"allowlist,omitempty"`
+}
+
+// adminResult is the result of an admin mutation.
+type adminResult struct {
+	Deleted int64          `json:"deleted,omitempty"`
+	Key     string         `json:"key,omitempty"`
+	Cleanup *cleanupResult `json:"cleanup,omitempty"`
+	// Restored is the tombstone that restore restored.
+	Restored *tombstone `json:"restored,omitempty"`
+	// Queued is the number of visits that drain did not wait for.
+	Queued int `json:"queued,omitempty"`
+	// AllowList is the change of import-allowlist.
+	AllowList *allowListDiff `json:"allowlist,omitempty"`
+}
+
+// runAdmin runs an admin mutation of the request and records it in the
+// audit log.
+func runAdmin(r *http.Request, key string, req adminRequest) (res adminResult, err error) {
+	ctx := r.Context()
+	value := strings.TrimSpace(req.Value)
+	if value == "" && req.Action != "rotate-key" && req.Action != "ensure-indexes" && req.Action != "drain" &&
+		req.Action != "import-allowlist" {
+		return adminResult{}, fmt.Errorf("%w: missing value", errInvalidQuery)
+	}
+	defer func() {
+		e := auditEntry{
+			Actor:  actorOf(ctx, key),
+			IP:     readIP(r),
+			Action: req.Action,
+			Value:  value,
+		}
+		switch req.Action {
+		case "cleanup":
+			e.Result = fmt.Sprintf("deleted %d visits", res.Deleted)
+		case "run-cleanup":
+			if res.Cleanup != nil {
+				e.Result = res.Cleanup.String()
+			}
+		case "update-settings":
+			b, _ := json.Marshal(req.Settings)
+			e.Result = string(b)
+		case "merge-host":
+			e.Result = "merged into " + req.Target
+		case "drain":
+			e.Result = fmt.Sprintf("%d visits still queued", res.Queued)
+		case "import-allowlist":
+			if res.AllowList != nil {
+				e.Result = res.AllowList.String()
+				if req.DryRun {
+					e.Result += " (dry run)"
+				}
+			}
+		case "unblock":
+			e.Result = "unblocked"
+		case "restore":
+			if res.Restored != nil {
+				e.Result = fmt.Sprintf("restored %s of %s", res.Restored.Action, res.Restored.Host)
+			}
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		audit(ctx, e)
+	}()
+
+	switch req.Action {
+	case "add-domain":
+		err = source.update(value, true, true)
+		if u, perr := url.Parse(value); err == nil && perr == nil && u.Host != "" {
+			err = registerHost(ctx, source.collection(u.Host))
+		}
+	case "register-host":
+		err = registerHost(ctx, value)
+	case "merge-host":
+		err = mergeHosts(ctx, value, strings.TrimSpace(req.Target))
+	case "delete-host":
+		if !checkConfirmToken(key, req.Action, value, req.Confirm, time.Now()) {
+			return res, fmt.Errorf("%w: invalid or expired confirmation token", errInvalidQuery)
+		}
+		err = deleteHost(ctx, value)
+	case "remove-domain":
+		err = source.update(value, true, false)
+	case "add-github":
+		err = source.update(value, false, true)
+	case "remove-github":
+		err = source.update(value, false, false)
+	case "import-allowlist":
+		if req.AllowList == nil {
+			return res, fmt.Errorf("%w: missing allowlist", errInvalidQuery)
+		}
+		var d allowListDiff
+		d, err = source.replace(*req.AllowList, req.DryRun)
+		if err != nil {
+			return res, err
+		}
+		res.AllowList = &d
+		if req.DryRun {
+			break
+		}
+		// Sites of added domains are registered as by add-domain.
+		for _, v := range d.Added.Domain {
+			if u, perr := url.Parse(v); perr == nil {
+				if err = registerHost(ctx, source.collection(u.Host)); err != nil {
+					break
+				}
+			}
+		}
+	case "cleanup":
+		res.Deleted, err = cleanupHost(ctx, value, false)
+	case "run-cleanup":
+		p, ok := cleanupPolicyOf(value)
+		if !ok {
+			return res, fmt.Errorf("%w: unknown cleanup policy %q", errInvalidQuery, value)
+		}
+		var c cleanupResult
+		c, err = runCleanup(ctx, p, p.DryRun || req.DryRun)
+		res.Cleanup = &c
+	case "restore":
+		res.Restored, err = restoreTombstone(ctx, value)
+	case "unblock":
+		err = unblockActor(ctx, value)
+	case "update-settings":
+		if req.Settings == nil {
+			return res, fmt.Errorf("%w: missing settings", errInvalidQuery)
+		}
+		req.Settings.Host = value
+		err = saveSettings(ctx, req.Settings)
+	case "rotate-key":
+		res.Key, err = rotateKey(ctx)
+	case "drain":
+		res.Queued = drain(ctx)
+	case "ensure-indexes":
+		// Building indexes of large collections takes longer than a
+		// request, its progress is reported by the index status.
+		go func() {
+			if err := ensureIndexes(context.Background()); err != nil {
+				l.Printf("cannot ensure indexes: %v", err)
+			}
+		}()
+	default:
+		return res, fmt.Errorf("%w: unknown action %q", errInvalidQuery, req.Action)
+	}
+	if err != nil {
+		return res, fmt.Errorf("failed to %s: %w", req.Action, err)
+	}
+	return res, nil
+}
+
+// adminAPI serves the admin API, which requires an admin API key as a
+// bearer token:
+//
+//	GET  /urlstat/admin/api/sites      settings of all hosts
+//	GET  /urlstat/admin/api/allowlist  trusted domains and GitHub users
+//	GET  /urlstat/admin/api/audit      audit log, latest first, ?limit=100
+//	GET  /urlstat/admin/api/indexes    index status of all collections
+//	POST /urlstat/admin/api/indexes    create missing indexes in the background
+//	GET  /urlstat/admin/api/settings/<host>  ingest settings of a host
+//	PUT  /urlstat/admin/api/settings/<host>  {"count": "unique", "sample_rate": 0.5, ...}
+//	POST /urlstat/admin/api/actions    {"action": "add-domain", "value": "https://example.com"}
+func adminAPI(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+
+	key := adminKey(r)
+	ok, err := isAdmin(ctx, key)
+	if err != nil {
+		err = fmt.Errorf("failed to check admin key: %w", err)
+		return
+	}
+	if !ok {
+		err = errUnauthorized
+		return
+	}
+
+	var resp interface{}
+	switch path := strings.TrimPrefix(r.URL.Path, "/urlstat/admin/api/"); {
+	case path == "sites" && r.Method == http.MethodGet:
+		resp, err = sites(ctx)
+	case path == "allowlist" && r.Method == http.MethodGet:
+		resp = map[string][]string{
+			"domain": source.list(true),
+			"github": source.list(false),
+		}
+	case path == "audit" && r.Method == http.MethodGet:
+		limit := int64(100)
+		if v := r.URL.Query().Get("limit"); v != "" {
+			limit, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || limit < 1 || limit > 1000 {
+				err = fmt.Errorf("%w: limit must be between 1 and 1000", errInvalidQuery)
+				return
+			}
+		}
+		resp, err = auditLog(ctx, limit, 0)
+	case path == "indexes" && r.Method == http.MethodGet:
+		resp, err = indexStatuses(ctx)
+	case path == "indexes" && r.Method == http.MethodPost:
+		resp, err = runAdmin(r.WithContext(ctx), key, adminRequest{Action: "ensure-indexes"})
+	case strings.HasPrefix(path, "settings/") && r.Method == http.MethodGet:
+		resp, err = settingsOf(ctx, strings.TrimPrefix(path, "settings/"))
+	case strings.HasPrefix(path, "settings/") && r.Method == http.MethodPut:
+		settings := &siteSettings{}
+		if err = json.NewDecoder(r.Body).Decode(settings); err != nil {
+			err = fmt.Errorf("%w: %v", errInvalidQuery, err)
+			return
+		}
+		resp, err = runAdmin(r.WithContext(ctx), key, adminRequest{
+			Action:   "update-settings",
+			Value:    strings.TrimPrefix(path, "settings/"),
+			Settings: settings,
+		})
+	case path == "actions" && r.Method == http.MethodPost:
+		var req adminRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			err = fmt.Errorf("%w: %v", errInvalidQuery, err)
+			return
+		}
+		resp, err = runAdmin(r.WithContext(ctx), key, req)
+	default:
+		err = fmt.Errorf("%w: %s %s", errInvalidQuery, r.Method, r.URL.Path)
+	}
+	if err != nil {
+		return
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// admin serves the admin interface. It asks for an admin API key, which
+// is then kept in a cookie, and runs the mutations of its forms.
+func admin(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+
+	key := adminKey(r)
+	if r.Method == http.MethodPost && r.FormValue("action") == "login" {
+		key = r.FormValue("key")
+	}
+	ok, err := isAdmin(ctx, key)
+	if err != nil {
+		err = fmt.Errorf("failed to check admin key: %w", err)
+		return
+	}
+
+	var page struct {
+		LoggedIn  bool
+		LoginFail bool
+		Message   string
+		Sites     []site
+		Domains   []string
+		GitHub    []string
+		Audit     []auditEntry
+	}
+	if !ok {
+		page.LoginFail = r.Method == http.MethodPost
+		err = renderAdmin(w, page)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		// Earlier versions scoped the cookie to /urlstat/admin, where it
+		// would be sent before the cookie of /urlstat and shadow it, hence
+		// it is expired whenever the cookie is set or expired.
+		expireLegacyCookie := func() {
+			http.SetCookie(w, &http.Cookie{Name: adminCookie, Path: "/urlstat/admin", MaxAge: -1})
+		}
+		setAdminCookie := func(key string) {
+			expireLegacyCookie()
+			http.SetCookie(w, &http.Cookie{
+				Name:     adminCookie,
+				Value:    key,
+				Path:     "/urlstat",
+				HttpOnly: true,
+				Secure:   source.Production,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		switch action := r.FormValue("action"); action {
+		case "login":
+			setAdminCookie(key)
+		case "logout":
+			expireLegacyCookie()
+			http.SetCookie(w, &http.Cookie{Name: adminCookie, Path: "/urlstat", MaxAge: -1})
+			err = renderAdmin(w, page)
+			return
+		default:
+			var res adminResult
+			res, err = runAdmin(r.WithContext(ctx), key, adminRequest{
+				Action:  action,
+				Value:   r.FormValue("value"),
+				Target:  r.FormValue("target"),
+				Confirm: r.FormValue("confirm"),
+			})
+			if err != nil {
+				return
+			}
+			switch action {
+			case "cleanup":
+				page.Message = fmt.Sprintf("Deleted %d visits of %s.", res.Deleted, r.FormValue("value"))
+			case "merge-host":
+				page.Message = fmt.Sprintf("Merged %s into %s.", r.FormValue("value"), r.FormValue("target"))
+			case "delete-host":
+				page.Message = fmt.Sprintf("Deleted %s.", r.FormValue("value"))
+			case "rotate-key":
+				setAdminCookie(res.Key)
+				page.Message = "New admin API key, it is only shown once: " + res.Key
+			default:
+				page.Message = "Saved."
+			}
+		}
+	}
+
+	page.LoggedIn = true
+	page.Domains = source.list(true)
+	page.GitHub = source.list(false)
+	page.Sites, err = sites(ctx)
+	if err != nil {
+		return
+	}
+	for i := range page.Sites {
+		page.Sites[i].Confirm = confirmToken(key, "delete-host", page.Sites[i].Host, time.Now())
+	}
+	page.Audit, err = auditLog(ctx, 20, 0)
+	if err != nil {
+		err = fmt.Errorf("failed to find audit log: %w", err)
+		return
+	}
+	err = renderAdmin(w, page)
+}
+
+func renderAdmin(w http.ResponseWriter, data interface{}) error {
+	t, err := template.ParseFS(publicFS, "admin.html")
+	if err != nil {
+		return fmt.Errorf("failed to parse admin.html: %w", err)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if err := t.Execute(w, data); err != nil {
+		return fmt.Errorf("failed to render template: %w", err)
+	}
+	return nil
+}
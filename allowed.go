@@ -5,54 +5,507 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// allowedFile is the configuration of trusted sources and recording
+// policies. The admin interface edits it in place.
+const allowedFile = "./allowed.yml"
+
+// devDomains are allowed in addition to the configured domains if the
+// deployment is not in production.
+var devDomains = []string{"http://localhost", "http://0.0.0.0"}
+
 type allowed struct {
+	mu sync.RWMutex
+
 	Production bool     `yaml:"production"`
 	Domain     []string `yaml:"domain"`
-	GitHub     []string `yaml:"github"`
+	// GitHub lists trusted GitHub users, whose repositories are all
+	// trusted, and trusted repositories as owner/name.
+	GitHub []string `yaml:"github"`
+	// GitHubDeny lists glob patterns of GitHub repositories as owner/name,
+	// or of users, which are not trusted even if they are listed in
+	// GitHub, e.g. changkun/private-*.
+	GitHubDeny []string `yaml:"github_deny"`
+	// Alias maps a hostname to the hostname whose collection stores its
+	// visits, so that multiple subdomains can share a collection.
+	Alias map[string]string `yaml:"alias"`
+	// Exclude lists IP addresses and CIDR ranges whose visits are never
+	// recorded, e.g. the owner's own network or monitoring probes.
+	Exclude []string `yaml:"exclude"`
+	// BlockUA lists user agents whose visits are never recorded, e.g.
+	// scrapers or internal tools. An entry is a case-insensitive
+	// substring, or a regular expression if it is enclosed in slashes.
+	BlockUA []string `yaml:"block_ua"`
+	// Cleanup lists the cleanup policies, see cleanupPolicy.
+	Cleanup []cleanupPolicy `yaml:"cleanup"`
+
+	excluded  *ipTrie
+	blockedUA *regexp.Regexp
 }
 
 func (a *allowed) isAllowed(source string, isDomain bool) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
 	allow := false
 	if isDomain {
-		for idx := range a.Domain {
-			if strings.Contains(source, a.Domain[idx]) {
+		domains := a.Domain
+		if !a.Production {
+			domains = append(domains[:len(domains):len(domains)], devDomains...)
+		}
+		for idx := range domains {
+			if strings.Contains(source, domains[idx]) {
 				allow = true
 				break
 			}
 		}
 	} else {
-		for idx := range a.GitHub {
-			if strings.Contains(source, a.GitHub[idx]) {
-				allow = true
+		allow = a.trustsUser(source)
+	}
+	return allow
+}
+
+// isAllowedRepo reports whether a GitHub repository, i.e. owner/name, is
+// trusted: it or its owner is listed, and neither is denied.
+func (a *allowed) isAllowedRepo(repo string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.isDenied(repo) {
+		return false
+	}
+	for _, r := range a.GitHub {
+		if strings.Contains(r, "/") && strings.EqualFold(r, repo) {
+			return true
+		}
+	}
+	owner, _, _ := strings.Cut(repo, "/")
+	return a.trustsUser(owner)
+}
+
+// trustsUser reports whether a GitHub user is trusted. The lock must be
+// held.
+func (a *allowed) trustsUser(user string) bool {
+	if a.isDenied(user) {
+		return false
+	}
+	for _, u := range a.GitHub {
+		if !strings.Contains(u, "/") && strings.Contains(user, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDenied reports whether a GitHub user or repository matches a pattern
+// of GitHubDeny. Patterns of users deny all their repositories, patterns of
+// repositories do not deny their owners. The lock must be held.
+func (a *allowed) isDenied(name string) bool {
+	name = strings.ToLower(name)
+	owner, _, _ := strings.Cut(name, "/")
+	for _, p := range a.GitHubDeny {
+		p = strings.ToLower(p)
+		target := name
+		if !strings.Contains(p, "/") {
+			target = owner
+		} else if !strings.Contains(name, "/") {
+			continue
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// collection returns the name of the collection that stores the visits
+// of the given hostname.
+func (a *allowed) collection(host string) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if alias, ok := a.Alias[host]; ok {
+		return alias
+	}
+	return host
+}
+
+// isExcluded reports whether visits from the given IP address are not
+// recorded.
+func (a *allowed) isExcluded(ip string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.excluded == nil {
+		return false
+	}
+	addr := net.ParseIP(ip)
+	return addr != nil && a.excluded.contains(addr)
+}
+
+// isBlockedUA reports whether visits of the given user agent are not
+// recorded.
+func (a *allowed) isBlockedUA(ua string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.blockedUA != nil && a.blockedUA.MatchString(ua)
+}
+
+// compileUA compiles the user agent blocklist into a single regular
+// expression, or nil if the list is empty.
+func compileUA(list []string) (*regexp.Regexp, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	exprs := make([]string, 0, len(list))
+	for _, s := range list {
+		if len(s) > 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+			s = s[1 : len(s)-1]
+			if _, err := regexp.Compile(s); err != nil {
+				return nil, err
+			}
+		} else {
+			s = regexp.QuoteMeta(s)
+		}
+		exprs = append(exprs, "(?:"+s+")")
+	}
+	return regexp.Compile("(?i)" + strings.Join(exprs, "|"))
+}
+
+// list returns the trusted domains or GitHub users.
+func (a *allowed) list(isDomain bool) []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if isDomain {
+		return append([]string(nil), a.Domain...)
+	}
+	return append([]string(nil), a.GitHub...)
+}
+
+// allowList is the allow-list of trusted sources, which is exported and
+// imported as a whole, see allowed.replace.
+type allowList struct {
+	Domain     []string `json:"domain"`
+	GitHub     []string `json:"github"`
+	GitHubDeny []string `json:"github_deny"`
+}
+
+// allowListDiff is the change of an import of an allow-list.
+type allowListDiff struct {
+	Added   allowList `json:"added"`
+	Removed allowList `json:"removed"`
+}
+
+// String summarizes the change, e.g. for the audit log.
+func (d allowListDiff) String() string {
+	return fmt.Sprintf("domain +%d -%d, github +%d -%d, github_deny +%d -%d",
+		len(d.Added.Domain), len(d.Removed.Domain),
+		len(d.Added.GitHub), len(d.Removed.GitHub),
+		len(d.Added.GitHubDeny), len(d.Removed.GitHubDeny))
+}
+
+// validate trims and deduplicates the entries of the allow-list, and
+// checks them: domains are origins, i.e. http or https URLs without a
+// path, GitHub entries are users or repositories, and denied entries are
+// glob patterns.
+func (l *allowList) validate() error {
+	var err error
+	if l.Domain, err = normalizeList(l.Domain, func(d string) error {
+		u, err := url.Parse(d)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" ||
+			u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return errors.New("not an http or https origin")
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("%w: domain: %v", errInvalidQuery, err)
+	}
+	if l.GitHub, err = normalizeList(l.GitHub, func(g string) error {
+		owner, repo, isRepo := strings.Cut(g, "/")
+		if !githubName.MatchString(owner) || isRepo && !githubName.MatchString(repo) {
+			return errors.New("not a GitHub user or owner/name")
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("%w: github: %v", errInvalidQuery, err)
+	}
+	if l.GitHubDeny, err = normalizeList(l.GitHubDeny, func(p string) error {
+		_, err := path.Match(p, "")
+		return err
+	}); err != nil {
+		return fmt.Errorf("%w: github_deny: %v", errInvalidQuery, err)
+	}
+	return nil
+}
+
+// normalizeList trims the entries of a list and removes empty and
+// duplicate entries, keeping the order. It fails at the first entry that
+// is not valid.
+func normalizeList(list []string, valid func(string) error) ([]string, error) {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[v] {
+			continue
+		}
+		if err := valid(v); err != nil {
+			return nil, fmt.Errorf("%q: %w", v, err)
+		}
+		seen[v] = true
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// diffList returns the entries of the new list that the old list does not
+// have, and the entries of the old list that the new list does not have.
+func diffList(old, new []string) (added, removed []string) {
+	in := func(list []string, v string) bool {
+		for _, w := range list {
+			if w == v {
+				return true
+			}
+		}
+		return false
+	}
+	added, removed = []string{}, []string{}
+	for _, v := range new {
+		if !in(old, v) {
+			added = append(added, v)
+		}
+	}
+	for _, v := range old {
+		if !in(new, v) {
+			removed = append(removed, v)
+		}
+	}
+	return added, removed
+}
+
+// export returns the allow-list.
+func (a *allowed) export() allowList {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return allowList{
+		Domain:     append([]string{}, a.Domain...),
+		GitHub:     append([]string{}, a.GitHub...),
+		GitHubDeny: append([]string{}, a.GitHubDeny...),
+	}
+}
+
+// replace replaces the allow-list by a valid one, and saves it to the
+// configuration file unless it is a dry run. It returns the change.
+func (a *allowed) replace(l allowList, dryRun bool) (allowListDiff, error) {
+	if err := l.validate(); err != nil {
+		return allowListDiff{}, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var d allowListDiff
+	d.Added.Domain, d.Removed.Domain = diffList(a.Domain, l.Domain)
+	d.Added.GitHub, d.Removed.GitHub = diffList(a.GitHub, l.GitHub)
+	d.Added.GitHubDeny, d.Removed.GitHubDeny = diffList(a.GitHubDeny, l.GitHubDeny)
+	if dryRun {
+		return d, nil
+	}
+	err := saveLists(allowedFile, []string{"domain", "github", "github_deny"},
+		[][]string{l.Domain, l.GitHub, l.GitHubDeny})
+	if err != nil {
+		return d, err
+	}
+	a.Domain, a.GitHub, a.GitHubDeny = l.Domain, l.GitHub, l.GitHubDeny
+	return d, nil
+}
+
+// update adds or removes a trusted domain or GitHub user, and saves the
+// change to the configuration file.
+func (a *allowed) update(value string, isDomain, add bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key, list := "github", &a.GitHub
+	if isDomain {
+		key, list = "domain", &a.Domain
+	}
+	updated := make([]string, 0, len(*list)+1)
+	for _, v := range *list {
+		if v != value {
+			updated = append(updated, v)
+		}
+	}
+	if add {
+		updated = append(updated, value)
+	}
+	if err := saveList(allowedFile, key, updated); err != nil {
+		return err
+	}
+	*list = updated
+	return nil
+}
+
+// saveList replaces a list of the configuration file, see saveLists.
+func saveList(file, key string, values []string) error {
+	return saveLists(file, []string{key}, [][]string{values})
+}
+
+// saveLists replaces lists of the configuration file at once. The file is
+// edited as a YAML node tree to keep its comments.
+func saveLists(file string, keys []string, lists [][]string) error {
+	d, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(d, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("%s is not a mapping", file)
+	}
+	root := doc.Content[0]
+
+	for k, key := range keys {
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, v := range lists[k] {
+			seq.Content = append(seq.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v})
+		}
+		found := false
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == key {
+				seq.HeadComment = root.Content[i+1].HeadComment
+				seq.LineComment = root.Content[i+1].LineComment
+				root.Content[i+1] = seq
+				found = true
 				break
 			}
 		}
+		if !found {
+			root.Content = append(root.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, seq)
+		}
 	}
-	return allow
+
+	b := &bytes.Buffer{}
+	enc := yaml.NewEncoder(b)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	// Replace the file atomically, a crash must not leave a truncated
+	// configuration behind.
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
 }
 
 var source = &allowed{}
 
 func init() {
-	d, err := os.ReadFile("./allowed.yml")
-	if err != nil {
+	// The demo has its own trusted sources, see runDemo.
+	if demo {
+		return
+	}
+	if err := source.load(allowedFile); err != nil {
 		log.Fatalf("failed to load trusted sources: %v", err)
 	}
+}
 
-	err = yaml.Unmarshal(d, source)
+// load replaces the configuration with the content of the file.
+func (a *allowed) load(file string) error {
+	d, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	n := &allowed{}
+	if err := yaml.Unmarshal(d, n); err != nil {
+		return fmt.Errorf("failed to parse trusted sources: %w", err)
+	}
+	n.excluded, err = newIPTrie(n.Exclude)
 	if err != nil {
-		log.Fatalf("failed to parse trusted sources: %v", err)
+		return fmt.Errorf("failed to parse excluded IP ranges: %w", err)
+	}
+	n.blockedUA, err = compileUA(n.BlockUA)
+	if err != nil {
+		return fmt.Errorf("failed to parse blocked user agents: %w", err)
+	}
+	for _, p := range n.GitHubDeny {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("failed to parse denied GitHub repositories: %q: %w", p, err)
+		}
 	}
+	for _, p := range n.Cleanup {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("failed to parse cleanup policies: %w", err)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Production = n.Production
+	a.Domain = n.Domain
+	a.GitHub = n.GitHub
+	a.GitHubDeny = n.GitHubDeny
+	a.Alias = n.Alias
+	a.Exclude = n.Exclude
+	a.BlockUA = n.BlockUA
+	a.Cleanup = n.Cleanup
+	a.excluded = n.excluded
+	a.blockedUA = n.blockedUA
+	return nil
+}
 
-	if !source.Production {
-		source.Domain = append(source.Domain, "http://localhost")
-		source.Domain = append(source.Domain, "http://0.0.0.0")
+// watchAllowed reloads the configuration whenever the file changes until
+// the context is canceled. Replicas that share the file, e.g. on a shared
+// volume, thereby see the changes of the admin interface of each other.
+func watchAllowed(ctx context.Context, file string, interval time.Duration) {
+	var modTime time.Time
+	if fi, err := os.Stat(file); err == nil {
+		modTime = fi.ModTime()
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		fi, err := os.Stat(file)
+		if err != nil || fi.ModTime().Equal(modTime) {
+			continue
+		}
+		if err := source.load(file); err != nil {
+			l.Printf("failed to reload %s: %v", file, err)
+			continue
+		}
+		modTime = fi.ModTime()
+		l.Printf("reloaded %s", file)
 	}
 }
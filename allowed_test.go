@@ -0,0 +1,131 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompileUA(t *testing.T) {
+	re, err := compileUA([]string{"HeadlessChrome", "/^curl\\//", "a+b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ua   string
+		want bool
+	}{
+		{"Mozilla/5.0 (X11; Linux x86_64) HeadlessChrome/90.0", true},
+		{"mozilla/5.0 headlesschrome/90.0", true},
+		{"curl/7.68.0", true},
+		{"Wget curl/7.68.0", false},
+		{"a+b", true},
+		{"aab", false},
+		{"Mozilla/5.0 (Macintosh) Safari/605.1.15", false},
+	}
+	for _, tt := range tests {
+		if got := re.MatchString(tt.ua); got != tt.want {
+			t.Fatalf("match %q = %v, want %v", tt.ua, got, tt.want)
+		}
+	}
+
+	if _, err := compileUA([]string{"/(/"}); err == nil {
+		t.Fatalf("compileUA with invalid expression want error")
+	}
+	if re, err := compileUA(nil); re != nil || err != nil {
+		t.Fatalf("compileUA(nil) = %v, %v, want nil", re, err)
+	}
+}
+
+func TestAllowedRepo(t *testing.T) {
+	a := &allowed{
+		GitHub:     []string{"changkun", "golang-design/reflect"},
+		GitHubDeny: []string{"changkun/private-*", "Changkun/Secret", "golang-*"},
+	}
+	tests := []struct {
+		repo string
+		want bool
+	}{
+		{"changkun/urlstat", true},
+		{"changkun/private-notes", false},
+		{"changkun/secret", false},
+		{"golang-design/reflect", false},
+		{"qcrao/urlstat", false},
+	}
+	for _, tt := range tests {
+		if got := a.isAllowedRepo(tt.repo); got != tt.want {
+			t.Fatalf("isAllowedRepo(%q) = %v, want %v", tt.repo, got, tt.want)
+		}
+	}
+	if !a.isAllowed("changkun", false) || a.isAllowed("golang-design", false) {
+		t.Fatalf("repositories patterns deny users or user patterns do not")
+	}
+
+	a = &allowed{GitHub: []string{"golang-design/reflect"}}
+	if !a.isAllowedRepo("golang-design/reflect") || a.isAllowedRepo("golang-design/go2generics") || a.isAllowed("golang-design", false) {
+		t.Fatalf("a trusted repository trusts its owner or other repositories")
+	}
+}
+
+func TestAllowListImport(t *testing.T) {
+	a := &allowed{
+		Domain: []string{"https://changkun.de", "https://golang.design"},
+		GitHub: []string{"changkun"},
+	}
+	d, err := a.replace(allowList{
+		Domain:     []string{" https://changkun.de", "https://qcrao.com", "https://qcrao.com", ""},
+		GitHub:     []string{"changkun", "golang-design/reflect"},
+		GitHubDeny: []string{"changkun/private-*"},
+	}, true)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	want := "domain +1 -1, github +1 -0, github_deny +1 -0"
+	if d.String() != want || d.Added.Domain[0] != "https://qcrao.com" || d.Removed.Domain[0] != "https://golang.design" {
+		t.Fatalf("unexpected change %s: %+v", d, d)
+	}
+	if len(a.Domain) != 2 || len(a.GitHubDeny) != 0 {
+		t.Fatalf("dry run changed the allow-list: %+v", a.export())
+	}
+
+	for _, l := range []allowList{
+		{Domain: []string{"changkun.de"}},
+		{Domain: []string{"https://changkun.de/blog/"}},
+		{Domain: []string{"ftp://changkun.de"}},
+		{GitHub: []string{"changkun/urlstat/x"}},
+		{GitHub: []string{"chang kun"}},
+		{GitHubDeny: []string{"changkun/["}},
+	} {
+		if _, err := a.replace(l, true); !errors.Is(err, errInvalidQuery) {
+			t.Fatalf("%+v: got %v, want %v", l, err, errInvalidQuery)
+		}
+	}
+}
+
+func TestSaveLists(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "allowed.yml")
+	if err := os.WriteFile(file, []byte("# trusted\nproduction: true\ndomain:\n  - https://changkun.de\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := saveLists(file, []string{"domain", "github_deny"}, [][]string{{"https://golang.design"}, {"changkun/secret"}})
+	if err != nil {
+		t.Fatalf("failed to save lists: %v", err)
+	}
+	a := &allowed{}
+	if err := a.load(file); err != nil {
+		t.Fatalf("failed to load saved lists: %v", err)
+	}
+	l := a.export()
+	if !a.Production || len(l.Domain) != 1 || l.Domain[0] != "https://golang.design" || len(l.GitHubDeny) != 1 {
+		t.Fatalf("unexpected lists: %+v", l)
+	}
+	if b, _ := os.ReadFile(file); !strings.Contains(string(b), "# trusted") {
+		t.Fatalf("comments are lost: %s", b)
+	}
+}
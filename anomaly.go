@@ -0,0 +1,127 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The anomaly detector compares the page views of the last complete hour
+// of a host with a baseline, which is the median of the same hour over
+// the previous weeks. Traffic is abnormal if it is factor times higher or
+// lower than the baseline. Hours with less page views than the minimum on
+// both sides are ignored, as small numbers are noisy.
+//
+// The detector is configured by environment variables:
+//
+//	URLSTAT_ANOMALY_FACTOR: the factor of an abnormal change, defaults to 3
+//	URLSTAT_ANOMALY_MIN_PV: the minimum page views, defaults to 50
+var (
+	anomalyWeeks  = 4
+	anomalyFactor = 3.0
+	anomalyMinPV  = int64(50)
+)
+
+func init() {
+	if v := os.Getenv("URLSTAT_ANOMALY_FACTOR"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 1 {
+			log.Fatalf("invalid URLSTAT_ANOMALY_FACTOR: %v", v)
+		}
+		anomalyFactor = f
+	}
+	if v := os.Getenv("URLSTAT_ANOMALY_MIN_PV"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid URLSTAT_ANOMALY_MIN_PV: %v", v)
+		}
+		anomalyMinPV = n
+	}
+}
+
+// runAnomalies checks the traffic of all hosts in the given hour and
+// notifies abnormal changes.
+func runAnomalies(ctx context.Context, hour time.Time) error {
+	hosts, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	for _, host := range hosts {
+		a, err := detectAnomaly(ctx, host, hour)
+		if err != nil {
+			return fmt.Errorf("failed to detect anomaly of %s: %w", host, err)
+		}
+		if a != nil {
+			notify(ctx, *a)
+		}
+	}
+	return nil
+}
+
+// detectAnomaly returns an alert if the traffic of a host in the given
+// hour is abnormal, or nil otherwise.
+func detectAnomaly(ctx context.Context, host string, hour time.Time) (*alert, error) {
+	col := db.Database(dbname).Collection(host)
+	count := func(from time.Time) (int64, error) {
+		return col.CountDocuments(ctx, bson.M{"time": bson.M{
+			"$gte": from,
+			"$lt":  from.Add(time.Hour),
+		}})
+	}
+	pv, err := count(hour)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]int64, anomalyWeeks)
+	for i := range history {
+		history[i], err = count(hour.Add(-time.Duration(i+1) * week))
+		if err != nil {
+			return nil, err
+		}
+	}
+	baseline := median(history)
+	kind := classifyTraffic(pv, baseline, anomalyFactor, anomalyMinPV)
+	if kind == "" {
+		return nil, nil
+	}
+	return &alert{Host: host, Kind: kind, Hour: hour, PV: pv, Baseline: baseline}, nil
+}
+
+// classifyTraffic returns "spike" or "drop" if the page views differ
+// abnormally from the baseline, or an empty string otherwise.
+func classifyTraffic(pv int64, baseline, factor float64, min int64) string {
+	if float64(pv) < float64(min) && baseline < float64(min) {
+		return ""
+	}
+	switch {
+	case float64(pv) > baseline*factor:
+		return "spike"
+	case float64(pv)*factor < baseline:
+		return "drop"
+	}
+	return ""
+}
+
+// median returns the median of the given numbers.
+func median(xs []int64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	s := append([]int64(nil), xs...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	n := len(s)
+	if n%2 == 1 {
+		return float64(s[n/2])
+	}
+	return float64(s[n/2-1]+s[n/2]) / 2
+}
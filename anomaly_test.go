@@ -0,0 +1,28 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestClassifyTraffic(t *testing.T) {
+	tests := []struct {
+		pv      int64
+		history []int64
+		want    string
+	}{
+		{100, []int64{90, 110, 100, 95}, ""},
+		{1000, []int64{90, 110, 100, 95}, "spike"},
+		{10, []int64{90, 110, 100, 95}, "drop"},
+		{40, []int64{1, 2, 0, 3}, ""},
+		{0, []int64{0, 0, 0, 0}, ""},
+		{300, []int64{0, 0, 0, 0}, "spike"},
+	}
+	for _, tt := range tests {
+		got := classifyTraffic(tt.pv, median(tt.history), 3, 50)
+		if got != tt.want {
+			t.Fatalf("classifyTraffic(%v, %v) = %q, want %q", tt.pv, tt.history, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colAnonymous stores daily page views of visitors who denied consent,
+// see anonymousCount.
+const colAnonymous = "anonymous"
+
+// anonymousCount is the number of page views of a path on a day whose
+// visitors denied consent. Nothing about the visitors is stored. Host is
+// the collection of the visits, Name is the hostname that differs from
+// it if the hostname is an alias.
+type anonymousCount struct {
+	Host string    `bson:"host"`
+	Name string    `bson:"name"`
+	Path string    `bson:"path"`
+	Day  time.Time `bson:"day"`
+	PV   int64     `bson:"pv"`
+}
+
+// countAnonymous counts a page view without consent.
+func countAnonymous(ctx context.Context, colname, host, path string) error {
+	_, err := db.Database(metaname).Collection(colAnonymous).UpdateOne(ctx,
+		bson.M{
+			"host": colname,
+			"name": host,
+			"path": path,
+			"day":  time.Now().UTC().Truncate(day),
+		},
+		bson.M{"$inc": bson.M{"pv": 1}},
+		options.Update().SetUpsert(true).SetComment(requestID(ctx)))
+	return err
+}
+
+// anonymousPV returns the total page views without consent that match
+// the filter.
+func anonymousPV(ctx context.Context, filter bson.M) (int64, error) {
+	p := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{{Key: "$group", Value: bson.M{"_id": nil, "pv": bson.M{"$sum": "$pv"}}}},
+	}
+	cur, err := db.Database(metaname).Collection(colAnonymous).Aggregate(ctx, p,
+		options.Aggregate().SetComment(requestID(ctx)))
+	if err != nil {
+		return 0, err
+	}
+	var results []struct {
+		PV int64 `bson:"pv"`
+	}
+	if err := cur.All(ctx, &results); err != nil {
+		return 0, err
+	}
+	if len(results) == 0 {
+		return 0, nil
+	}
+	return results[0].PV, nil
+}
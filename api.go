@@ -0,0 +1,450 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// apiPrefix is the prefix of the versioned API. Endpoints under it only
+// change compatibly, whereas the unversioned endpoints may change.
+const apiPrefix = "/urlstat/api/v1/"
+
+// apiPage is a page of a list of the API. If NextCursor is not empty, the
+// next page is requested with ?cursor=<next_cursor>.
+type apiPage struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// Page sizes of lists of the API, which are requested by ?limit=.
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// api serves the versioned API. All endpoints require an admin API key as
+// a bearer token, and respond JSON, errors in the format of respondError.
+// Requests are limited per key, see apiLimiter, and responses carry the
+// X-RateLimit-Limit, X-RateLimit-Remaining, and X-RateLimit-Reset headers.
+// Stats reports are also available as CSV or XML, see serveReport:
+//
+//	GET    /urlstat/api/v1/hosts                          sites, paginated
+//	DELETE /urlstat/api/v1/hosts/<host>                   delete a host, see adminHost
+//	GET    /urlstat/api/v1/hosts/<host>/stats/<report>    a stats report, ?days=30&path=/&limit=10
+//	GET    /urlstat/api/v1/hosts/<host>/visits            raw visits, paginated, ?since=2021-03-01&until=2021-04-01
+//	GET    /urlstat/api/v1/visits?host=<host>&after=      the same as above
+//	GET    /urlstat/api/v1/feed?host=<host>&since=        visits in insertion order, see apiFeed
+//	GET    /urlstat/api/v1/hosts/<host>/settings          ingest settings
+//	PUT    /urlstat/api/v1/hosts/<host>/settings          replace ingest settings
+//	GET    /urlstat/api/v1/github/<owner>/<repo>/timeseries  daily views of the badge of a repository, ?days=30
+//	GET    /urlstat/api/v1/summary                        all-time pv and uv per host and of all hosts
+//	GET    /urlstat/api/v1/quota                          rate limit usage of the key
+//	GET    /urlstat/api/v1/allowlist                      trusted domains and GitHub users and repositories
+//	PUT    /urlstat/api/v1/allowlist                      replace the allow-list, ?dry_run=true previews the change
+//	GET    /urlstat/api/v1/audit                          audit log, latest first, paginated
+//	GET    /urlstat/api/v1/indexes                        index status
+//	POST   /urlstat/api/v1/indexes                        create missing indexes
+//	GET    /urlstat/api/v1/cleanup                        cleanup policies with their latest results
+//	POST   /urlstat/api/v1/cleanup/<policy>               run a cleanup policy now, ?dry_run=true previews it
+//	GET    /urlstat/api/v1/tombstones                     deleted data that can be restored
+//	POST   /urlstat/api/v1/tombstones/<id>/restore        restore deleted data
+//	GET    /urlstat/api/v1/blocked                        shadow-blocked actors, see shadowBlocked
+//	DELETE /urlstat/api/v1/blocked/<id>                   unblock an actor
+//	POST   /urlstat/api/v1/actions                        an admin action, see runAdmin
+//
+// The OpenAPI document of the API is served without authentication at
+// /urlstat/api/v1/openapi.json.
+func api(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	if r.URL.Path == apiPrefix+"openapi.json" && r.Method == http.MethodGet {
+		var b []byte
+		b, err = fs.ReadFile(publicFS, "openapi.json")
+		if err != nil {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	key := adminKey(r)
+	ok, err := isAdmin(ctx, key)
+	if err != nil {
+		err = fmt.Errorf("failed to check admin key: %w", err)
+		return
+	}
+	if !ok {
+		err = errUnauthorized
+		return
+	}
+	now := time.Now()
+	rate, ok := apiLimiter.take(hashKey(key), now)
+	rate.Key = actor(key)
+	rate.setHeaders(w, now)
+	if !ok {
+		err = fmt.Errorf("%w: %s used %d requests in %s", errRateLimited, rate.Key, rate.Used, rate.Window)
+		return
+	}
+
+	var resp interface{}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "hosts" && r.Method == http.MethodGet:
+		resp, err = apiHosts(r)
+	case len(parts) == 4 && parts[0] == "hosts" && parts[2] == "stats" && r.Method == http.MethodGet:
+		// Reports are also served as CSV or XML, and support conditional
+		// requests, see serveReport.
+		var q statsQuery
+		q, err = parseStatsValues(parts[1], r.URL.Query())
+		if err != nil {
+			return
+		}
+		err = serveReport(w, r, parts[3], q)
+		return
+	case len(parts) >= 2 && parts[0] == "hosts" && parts[1] != "":
+		resp, err = apiHost(r, key, parts[1], parts[2:])
+	case len(parts) == 1 && parts[0] == "visits" && r.Method == http.MethodGet:
+		host := r.URL.Query().Get("host")
+		if host == "" {
+			err = fmt.Errorf("%w: missing host", errInvalidQuery)
+			return
+		}
+		resp, err = apiVisits(r, host)
+	case len(parts) == 1 && parts[0] == "feed" && r.Method == http.MethodGet:
+		host := r.URL.Query().Get("host")
+		if host == "" {
+			err = fmt.Errorf("%w: missing host", errInvalidQuery)
+			return
+		}
+		resp, err = apiFeed(r, host)
+	case len(parts) == 4 && parts[0] == "github" && parts[3] == "timeseries" && r.Method == http.MethodGet:
+		resp, err = githubTimeseries(ctx, parts[1], parts[2], r.URL.Query())
+	case len(parts) == 1 && parts[0] == "summary" && r.Method == http.MethodGet:
+		resp, err = summarize(ctx)
+	case len(parts) == 1 && parts[0] == "quota" && r.Method == http.MethodGet:
+		resp = rate
+	case len(parts) == 1 && parts[0] == "allowlist" && r.Method == http.MethodGet:
+		resp = source.export()
+	case len(parts) == 1 && parts[0] == "allowlist" && r.Method == http.MethodPut:
+		var l allowList
+		if err = json.NewDecoder(r.Body).Decode(&l); err != nil {
+			err = fmt.Errorf("%w: %v", errInvalidQuery, err)
+			return
+		}
+		resp, err = runAdmin(r, key, adminRequest{
+			Action:    "import-allowlist",
+			AllowList: &l,
+			DryRun:    r.URL.Query().Get("dry_run") == "true",
+		})
+	case len(parts) == 1 && parts[0] == "audit" && r.Method == http.MethodGet:
+		var limit, offset int
+		limit, offset, err = parseOffsetPage(r)
+		if err != nil {
+			return
+		}
+		var entries []auditEntry
+		entries, err = auditLog(ctx, int64(limit)+1, int64(offset))
+		more := len(entries) > limit
+		if more {
+			entries = entries[:limit]
+		}
+		resp = offsetPage(entries, more, offset+limit)
+	case len(parts) == 1 && parts[0] == "indexes" && r.Method == http.MethodGet:
+		resp, err = indexStatuses(ctx)
+	case len(parts) == 1 && parts[0] == "indexes" && r.Method == http.MethodPost:
+		resp, err = runAdmin(r, key, adminRequest{Action: "ensure-indexes"})
+	case len(parts) == 1 && parts[0] == "cleanup" && r.Method == http.MethodGet:
+		resp, err = cleanupStatuses(ctx)
+	case len(parts) == 2 && parts[0] == "cleanup" && r.Method == http.MethodPost:
+		resp, err = runAdmin(r, key, adminRequest{
+			Action: "run-cleanup",
+			Value:  parts[1],
+			DryRun: r.URL.Query().Get("dry_run") == "true",
+		})
+	case len(parts) == 1 && parts[0] == "tombstones" && r.Method == http.MethodGet:
+		resp, err = tombstones(ctx)
+	case len(parts) == 3 && parts[0] == "tombstones" && parts[2] == "restore" && r.Method == http.MethodPost:
+		resp, err = runAdmin(r, key, adminRequest{Action: "restore", Value: parts[1]})
+	case len(parts) == 1 && parts[0] == "blocked" && r.Method == http.MethodGet:
+		resp, err = blockedActors(ctx)
+	case len(parts) == 2 && parts[0] == "blocked" && r.Method == http.MethodDelete:
+		resp, err = runAdmin(r, key, adminRequest{Action: "unblock", Value: parts[1]})
+	case len(parts) == 1 && parts[0] == "actions" && r.Method == http.MethodPost:
+		var req adminRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			err = fmt.Errorf("%w: %v", errInvalidQuery, err)
+			return
+		}
+		resp, err = runAdmin(r, key, req)
+	default:
+		err = fmt.Errorf("%w: %s %s", errInvalidQuery, r.Method, r.URL.Path)
+	}
+	if err != nil {
+		return
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// apiHosts returns a page of sites.
+func apiHosts(r *http.Request) (interface{}, error) {
+	limit, offset, err := parseOffsetPage(r)
+	if err != nil {
+		return nil, err
+	}
+	all, err := sites(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	n := len(all)
+	if offset > n {
+		offset = n
+	}
+	end := offset + limit
+	if end > n {
+		end = n
+	}
+	return offsetPage(all[offset:end], end < n, end), nil
+}
+
+// apiHost serves the endpoints of a host, the rest are the path segments
+// after the host.
+func apiHost(r *http.Request, key, host string, rest []string) (interface{}, error) {
+	ctx := r.Context()
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodDelete:
+		return confirmDeleteHost(r, key, host)
+	case len(rest) == 1 && rest[0] == "visits" && r.Method == http.MethodGet:
+		return apiVisits(r, host)
+	case len(rest) == 1 && rest[0] == "settings" && r.Method == http.MethodGet:
+		return settingsOf(ctx, host)
+	case len(rest) == 1 && rest[0] == "settings" && r.Method == http.MethodPut:
+		settings := &siteSettings{}
+		if err := json.NewDecoder(r.Body).Decode(settings); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidQuery, err)
+		}
+		return runAdmin(r, key, adminRequest{
+			Action:   "update-settings",
+			Value:    host,
+			Settings: settings,
+		})
+	}
+	return nil, fmt.Errorf("%w: %s %s", errInvalidQuery, r.Method, r.URL.Path)
+}
+
+// apiVisits returns a page of raw visits of a host in chronological
+// order. The cursor is the time and ID of the last visit of the previous
+// page, see visitCursor, hence pages neither skip nor repeat visits while
+// visits are recorded, and each page is an index seek rather than a scan
+// over all previous pages.
+func apiVisits(r *http.Request, host string) (interface{}, error) {
+	v := r.URL.Query()
+	limit, err := parseLimit(r)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.A{}
+	// The cursor is ?after=, or ?cursor= as of other lists.
+	c := v.Get("after")
+	if c == "" {
+		c = v.Get("cursor")
+	}
+	if c != "" {
+		after, err := parseVisitCursor(c)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid cursor", errInvalidQuery)
+		}
+		filter = append(filter, bson.M{"$or": bson.A{
+			bson.M{"time": bson.M{"$gt": after.Time}},
+			bson.M{"time": after.Time, "_id": bson.M{"$gt": after.ID}},
+		}})
+	}
+	timeRange := bson.M{}
+	for param, op := range map[string]string{"since": "$gte", "until": "$lt"} {
+		if s := v.Get(param); s != "" {
+			t, err := parseDate(s)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid %s, require yyyy-mm-dd", errInvalidQuery, param)
+			}
+			timeRange[op] = t
+		}
+	}
+	if len(timeRange) > 0 {
+		filter = append(filter, bson.M{"time": timeRange})
+	}
+	dims, err := queryDimensions(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(dims) > 0 {
+		filter = append(filter, dimensionFilter(dims))
+	}
+	query := bson.M{}
+	if len(filter) > 0 {
+		query["$and"] = filter
+	}
+
+	ctx := r.Context()
+	name := source.collection(host)
+	col, _ := storedVisits(name)
+	cur, err := col.Find(ctx, hostFilter(name, query), options.Find().
+		SetSort(bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(limit)+1).
+		SetComment(requestID(ctx)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find visits: %w", err)
+	}
+	var docs []struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		Visit visit              `bson:",inline"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to find visits: %w", err)
+	}
+
+	page := apiPage{}
+	if len(docs) > limit {
+		docs = docs[:limit]
+		last := docs[limit-1]
+		page.NextCursor = visitCursor{last.Visit.Time, last.ID}.String()
+	}
+	visits := make([]visit, 0, len(docs))
+	for _, d := range docs {
+		visits = append(visits, d.Visit)
+	}
+	page.Data = visits
+	return page, nil
+}
+
+// visitCursor is the position of a visit in chronological order. Visits
+// of the same millisecond, the precision of stored times, are ordered by
+// their IDs.
+type visitCursor struct {
+	Time time.Time
+	ID   primitive.ObjectID
+}
+
+// String returns the cursor as <unix milliseconds>.<id> in base64url.
+func (c visitCursor) String() string {
+	s := strconv.FormatInt(c.Time.UnixMilli(), 10) + "." + c.ID.Hex()
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func parseVisitCursor(s string) (visitCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return visitCursor{}, err
+	}
+	ms, hex, ok := strings.Cut(string(b), ".")
+	if !ok {
+		return visitCursor{}, errors.New("missing id")
+	}
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return visitCursor{}, err
+	}
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return visitCursor{}, err
+	}
+	return visitCursor{time.UnixMilli(n).UTC(), id}, nil
+}
+
+// parseLimit parses the page size of a list.
+func parseLimit(r *http.Request) (int, error) {
+	limit := apiDefaultLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > apiMaxLimit {
+			return 0, fmt.Errorf("%w: limit must be between 1 and %d", errInvalidQuery, apiMaxLimit)
+		}
+		limit = n
+	}
+	return limit, nil
+}
+
+// parseOffsetPage parses the page size and the cursor of a list whose
+// cursor is an offset.
+func parseOffsetPage(r *http.Request) (limit, offset int, err error) {
+	limit, err = parseLimit(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		b, err := base64.RawURLEncoding.DecodeString(c)
+		if err == nil {
+			offset, err = strconv.Atoi(string(b))
+		}
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("%w: invalid cursor", errInvalidQuery)
+		}
+	}
+	return limit, offset, nil
+}
+
+// offsetPage returns a page of a list whose cursor is an offset. If more
+// items follow, the cursor of the next page is the offset of the next item.
+func offsetPage(data interface{}, more bool, next int) apiPage {
+	p := apiPage{Data: data}
+	if more {
+		p.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(next)))
+	}
+	return p
+}
+
+// apiDocs serves the interactive documentation of the API, which requires
+// an admin API key, e.g. the cookie of the admin interface.
+func apiDocs(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	ok, err := isAdmin(r.Context(), adminKey(r))
+	if err != nil {
+		err = fmt.Errorf("failed to check admin key: %w", err)
+		return
+	}
+	if !ok {
+		http.Redirect(w, r, "/urlstat/admin", http.StatusFound)
+		return
+	}
+	b, err := fs.ReadFile(publicFS, "apidocs.html")
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b)
+}
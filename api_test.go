@@ -0,0 +1,97 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestOffsetPage(t *testing.T) {
+	p := offsetPage([]int{1, 2}, true, 42)
+	r := httptest.NewRequest("GET", "/urlstat/api/v1/hosts?limit=2&cursor="+p.NextCursor, nil)
+	limit, offset, err := parseOffsetPage(r)
+	if err != nil || limit != 2 || offset != 42 {
+		t.Fatalf("parseOffsetPage() = %d, %d, %v, want 2, 42", limit, offset, err)
+	}
+	if p := offsetPage(nil, false, 42); p.NextCursor != "" {
+		t.Fatalf("last page has next cursor %q", p.NextCursor)
+	}
+
+	for _, q := range []string{"limit=0", "limit=1001", "limit=x", "cursor=!", "cursor=LTE"} {
+		r := httptest.NewRequest("GET", "/urlstat/api/v1/hosts?"+q, nil)
+		if _, _, err := parseOffsetPage(r); err == nil {
+			t.Fatalf("parseOffsetPage(%s) want error", q)
+		}
+	}
+}
+
+func TestVisitCursor(t *testing.T) {
+	c := visitCursor{time.Date(2021, 3, 1, 12, 0, 0, 5e6, time.UTC), primitive.NewObjectID()}
+	got, err := parseVisitCursor(c.String())
+	if err != nil || got != c {
+		t.Fatalf("parseVisitCursor(%s) = %v, %v, want %v", c, got, err, c)
+	}
+	for _, s := range []string{"", "bm9wZQ", c.ID.Hex()} {
+		if _, err := parseVisitCursor(s); err == nil {
+			t.Fatalf("parseVisitCursor(%q) did not fail", s)
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	b, err := fs.ReadFile(publicFS, "openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("invalid OpenAPI document: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Fatalf("unexpected OpenAPI version %q", doc.OpenAPI)
+	}
+
+	ids := map[string]bool{}
+	for path, ops := range doc.Paths {
+		for method, raw := range ops {
+			var op struct {
+				OperationID string                     `json:"operationId"`
+				Responses   map[string]json.RawMessage `json:"responses"`
+			}
+			if err := json.Unmarshal(raw, &op); err != nil {
+				t.Fatalf("invalid operation %s %s: %v", method, path, err)
+			}
+			if op.OperationID == "" || ids[op.OperationID] || op.Responses["200"] == nil {
+				t.Fatalf("%s %s needs a unique operation ID and a 200 response", method, path)
+			}
+			ids[op.OperationID] = true
+		}
+	}
+}
+
+func TestGitHubTimeseries(t *testing.T) {
+	for _, repo := range []string{"changkun/url stat", "chang$kun/urlstat", "changkun/" + strings.Repeat("a", 101)} {
+		owner, name, _ := strings.Cut(repo, "/")
+		if _, err := githubTimeseries(context.Background(), owner, name, nil); !errors.Is(err, errInvalidRepo) {
+			t.Fatalf("%s: got %v, want %v", repo, err, errInvalidRepo)
+		}
+	}
+	if _, err := githubTimeseries(context.Background(), "changkun", "urlstat", url.Values{"days": {"0"}}); !errors.Is(err, errInvalidQuery) {
+		t.Fatalf("invalid days: got %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// archiveCommand moves visits older than the given number of months from
+// the database to object storage. Visits are stored as gzip compressed
+// JSON lines, one object per host per month:
+//
+//	<host>/<yyyy-mm>-<unix timestamp>.jsonl.gz
+//
+// Usage:
+//
+//	urlstat archive -months 12 [-host blog.changkun.de]
+func archiveCommand(args []string) error {
+	flags := flag.NewFlagSet("archive", flag.ExitOnError)
+	months := flags.Int("months", 12, "archive visits older than the given number of months")
+	host := flags.String("host", "", "only archive the given host, archive all hosts if empty")
+	flags.Parse(args)
+
+	if *months < 1 {
+		return errors.New("months must be positive")
+	}
+	store, err := newObjectStore()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	hosts := []string{*host}
+	if *host == "" {
+		hosts, err = db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+		if err != nil {
+			return fmt.Errorf("failed to list collections: %w", err)
+		}
+	}
+
+	// Only archive complete months.
+	now := time.Now().UTC()
+	before := time.Date(now.Year(), now.Month()-time.Month(*months), 1, 0, 0, 0, 0, time.UTC)
+	for _, h := range hosts {
+		col := db.Database(dbname).Collection(h)
+		n, err := archiveVisits(ctx, store, col, h, before)
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %w", h, err)
+		}
+		l.Printf("archived %d visits of %s before %v", n, h, before.Format("2006-01"))
+	}
+	return nil
+}
+
+// restoreCommand moves archived visits of a host from object storage back
+// to the database.
+//
+//	urlstat restore -host blog.changkun.de [-month 2021-03]
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	host := flags.String("host", "", "host to restore")
+	month := flags.String("month", "", "only restore the given month (yyyy-mm), restore all if empty")
+	flags.Parse(args)
+
+	if *host == "" {
+		return errors.New("usage: urlstat restore -host <hostname> [-month yyyy-mm]")
+	}
+	store, err := newObjectStore()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	keys, err := store.list(ctx, *host+"/"+*month)
+	if err != nil {
+		return fmt.Errorf("failed to list archives: %w", err)
+	}
+	col := db.Database(dbname).Collection(*host)
+	for _, key := range keys {
+		n, err := restoreVisits(ctx, store, col, key)
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", key, err)
+		}
+		l.Printf("restored %d visits from %s", n, key)
+	}
+	return nil
+}
+
+// archiveVisits uploads all visits of the collection before the given time
+// to the object storage and deletes them from the collection afterwards.
+// Visits are deleted month by month and only if the upload succeeded.
+func archiveVisits(ctx context.Context, store *objectStore, col *mongo.Collection, host string, before time.Time) (int, error) {
+	n := 0
+	filter := bson.M{"time": bson.M{"$lt": before}}
+	err := visitsByMonth(ctx, col, filter, func(month time.Time, next nextVisit) error {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		if err := writeJSONL(zw, next); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s/%s-%d.jsonl.gz", host, month.Format("2006-01"), time.Now().Unix())
+		if err := store.put(ctx, key, buf.Bytes(), "application/gzip"); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+
+		end := month.AddDate(0, 1, 0)
+		if end.After(before) {
+			end = before
+		}
+		stored, archived := storedVisits(host)
+		archived["time"] = bson.M{"$gte": month, "$lt": end}
+		r, err := stored.DeleteMany(ctx, archived)
+		if err != nil {
+			return fmt.Errorf("failed to delete archived visits: %w", err)
+		}
+		n += int(r.DeletedCount)
+		return nil
+	})
+	return n, err
+}
+
+// restoreVisits inserts the archived visits of the given object back to
+// the collection and deletes the object afterwards. Each visit is upserted
+// by an ID of its line of the object, see archivedVisitID, hence restoring
+// an object again, e.g. after a restore failed before the object was
+// deleted, does not duplicate its visits.
+func restoreVisits(ctx context.Context, store *objectStore, col *mongo.Collection, key string) (int, error) {
+	if !strings.HasSuffix(key, ".jsonl.gz") {
+		return 0, nil
+	}
+	rc, err := store.get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	batch := make([]mongo.WriteModel, 0, insertBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		stored, _ := storedVisits(col.Name())
+		if _, err := stored.BulkWrite(ctx, batch, options.BulkWrite().SetOrdered(false)); err != nil {
+			return fmt.Errorf("failed to insert records: %w", err)
+		}
+		n += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	s := bufio.NewScanner(zr)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 0; s.Scan(); line++ {
+		v := &visit{}
+		if err := json.Unmarshal(s.Bytes(), v); err != nil {
+			return n, fmt.Errorf("invalid archived visit: %w", err)
+		}
+		// Visits that were archived before hostnames were stored belong
+		// to the hostname of the collection.
+		if v.Host == "" {
+			v.Host = col.Name()
+		}
+		if layout == layoutSingle {
+			v.Site = col.Name()
+		}
+		batch = append(batch, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": archivedVisitID(key, line, v.Time)}).
+			SetReplacement(v).
+			SetUpsert(true))
+		if len(batch) == insertBatch {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return n, err
+	}
+	if err := flush(); err != nil {
+		return n, err
+	}
+	return n, store.del(ctx, key)
+}
+
+// archivedVisitID returns the ID of the visit of the given line of an
+// archived object, which is the same whenever the object is restored, as
+// archived visits do not keep their IDs. Like the IDs of recorded visits,
+// it begins with the time of the visit.
+func archivedVisitID(key string, line int, t time.Time) primitive.ObjectID {
+	var id primitive.ObjectID
+	binary.BigEndian.PutUint32(id[:4], uint32(t.Unix()))
+	h := sha256.Sum256([]byte(key + "\n" + strconv.Itoa(line)))
+	copy(id[4:], h[:])
+	return id
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestArchivedVisitID(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	id := archivedVisitID("changkun.de/2021-03-1.jsonl.gz", 0, now)
+	if id != archivedVisitID("changkun.de/2021-03-1.jsonl.gz", 0, now) {
+		t.Fatal("ID of the same line differs")
+	}
+	if !id.Timestamp().Equal(now) {
+		t.Fatalf("ID has time %v, want %v", id.Timestamp(), now)
+	}
+	for _, other := range []string{"changkun.de/2021-03-2.jsonl.gz", "blog.changkun.de/2021-03-1.jsonl.gz"} {
+		if id == archivedVisitID(other, 0, now) {
+			t.Fatalf("ID of %s equals the ID of another object", other)
+		}
+	}
+	if id == archivedVisitID("changkun.de/2021-03-1.jsonl.gz", 1, now) {
+		t.Fatal("IDs of different lines are equal")
+	}
+}
+
+// TestRestoreVisitsTwice restores the same archived object twice, e.g.
+// after the first restore failed to delete it, which requires a database,
+// e.g. URLSTAT_DB_URIS=mongodb://0.0.0.0:27017.
+func TestRestoreVisitsTwice(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	pctx, pcancel := context.WithTimeout(ctx, time.Second)
+	defer pcancel()
+	if err := db.Ping(pctx, nil); err != nil {
+		t.Skipf("database is not available: %v", err)
+	}
+	defer func(l string) { layout = l }(layout)
+	layout = layoutCollections
+
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	zw.Write([]byte(`{"visitor_id":"a","path":"/a","time":"2021-03-01T00:00:00Z"}` + "\n" +
+		`{"visitor_id":"b","path":"/b","time":"2021-03-02T00:00:00Z"}` + "\n"))
+	zw.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write(buf.Bytes())
+		}
+	}))
+	defer srv.Close()
+	store := &objectStore{endpoint: srv.URL, bucket: "urlstat-archive", region: "us-east-1", client: srv.Client()}
+
+	const host = "restore.urlstat.test"
+	col := db.Database(dbname).Collection(host)
+	defer col.Drop(ctx)
+	for i := 0; i < 2; i++ {
+		n, err := restoreVisits(ctx, store, col, host+"/2021-03-1.jsonl.gz")
+		if err != nil || n != 2 {
+			t.Fatalf("restored %d visits: %v", n, err)
+		}
+	}
+	if n, _ := col.CountDocuments(ctx, bson.M{}); n != 2 {
+		t.Fatalf("%d visits after restoring twice, want 2", n)
+	}
+}
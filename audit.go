@@ -0,0 +1,70 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colAudit stores the audit log of admin mutations, see auditEntry.
+const colAudit = "audit"
+
+// auditEntry is an admin mutation. Failed mutations are recorded as
+// well, with their error.
+type auditEntry struct {
+	Time      time.Time `json:"time"             bson:"time"`
+	Actor     string    `json:"actor"            bson:"actor"`
+	IP        string    `json:"ip"               bson:"ip"`
+	RequestID string    `json:"request_id"       bson:"request_id"`
+	Action    string    `json:"action"           bson:"action"`
+	Value     string    `json:"value,omitempty"  bson:"value,omitempty"`
+	Result    string    `json:"result,omitempty" bson:"result,omitempty"`
+	Error     string    `json:"error,omitempty"  bson:"error,omitempty"`
+}
+
+// actor identifies the holder of an admin API key without revealing it.
+func actor(key string) string {
+	if token := os.Getenv("URLSTAT_ADMIN_TOKEN"); token != "" &&
+		subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+		return "URLSTAT_ADMIN_TOKEN"
+	}
+	return "key:" + hashKey(key)[:12]
+}
+
+// audit records an admin mutation. The audit log is best effort, as the
+// mutation already happened.
+func audit(ctx context.Context, e auditEntry) {
+	e.Time = time.Now().UTC()
+	e.RequestID = requestID(ctx)
+	_, err := db.Database(metaname).Collection(colAudit).InsertOne(ctx, e)
+	if err != nil {
+		l.Printf("failed to audit %+v: %v", e, err)
+	}
+}
+
+// auditLog returns n entries of the audit log, latest first, after
+// skipping the given number of entries.
+func auditLog(ctx context.Context, n, skip int64) ([]auditEntry, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: -1}}).
+		SetSkip(skip).
+		SetLimit(n).
+		SetComment(requestID(ctx))
+	cur, err := db.Database(metaname).Collection(colAudit).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	entries := []auditEntry{}
+	if err := cur.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
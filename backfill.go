@@ -0,0 +1,155 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colBackfills stores the progress of rollup backfills per host, see
+// backfill.
+const colBackfills = "backfills"
+
+// backfill is the progress of the backfill of a host: the rollups of the
+// days since Since until Next are computed.
+type backfill struct {
+	Host    string    `bson:"_id"`
+	Since   time.Time `bson:"since"`
+	Until   time.Time `bson:"until"`
+	Next    time.Time `bson:"next"`
+	Updated time.Time `bson:"updated"`
+}
+
+// rollupCommand computes the daily rollups of past days from raw visits,
+// e.g. of visits that were recorded before rollups existed or that were
+// imported, so that reports of old days are served from rollups too. The
+// rollup worker only computes the recent days.
+//
+// Hosts are backfilled one after another, chunk days at a time, from the
+// day of their oldest visit until today by default. The progress of each
+// host is recorded after each chunk, hence an interrupted backfill
+// continues where it stopped when it runs again with the same range.
+//
+// Usage:
+//
+//	urlstat rollup [-host 'blog.*' ...] [-since 2021-01-01] [-until 2022-01-01] [-chunk 7] [-restart]
+func rollupCommand(args []string) error {
+	var hosts globs
+	flags := flag.NewFlagSet("rollup", flag.ExitOnError)
+	flags.Var(&hosts, "host", "only backfill hosts matching the glob, can be repeated")
+	since := flags.String("since", "", "the first day to backfill, defaults to the day of the oldest visit")
+	until := flags.String("until", "", "the day after the last day to backfill, defaults to today")
+	chunk := flags.Int("chunk", 7, "the number of days that are computed at a time")
+	restart := flags.Bool("restart", false, "ignore the recorded progress")
+	flags.Parse(args)
+
+	if *chunk < 1 {
+		return errors.New("-chunk must be positive")
+	}
+	var from, to time.Time
+	if *since != "" {
+		t, err := parseDate(*since)
+		if err != nil {
+			return fmt.Errorf("invalid -since: %w", err)
+		}
+		from = t.UTC().Truncate(day)
+	}
+	to = time.Now().UTC().Truncate(day)
+	if *until != "" {
+		t, err := parseDate(*until)
+		if err != nil {
+			return fmt.Errorf("invalid -until: %w", err)
+		}
+		to = t.UTC().Truncate(day)
+	}
+
+	ctx := context.Background()
+	all, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	for _, h := range all {
+		if !hosts.match(h) {
+			continue
+		}
+		start := time.Now()
+		if err := backfillHost(ctx, h, from, to, *chunk, *restart); err != nil {
+			return fmt.Errorf("failed to backfill %s: %w", h, err)
+		}
+		l.Printf("backfilled rollups of %s in %v", h, time.Since(start))
+	}
+	return nil
+}
+
+// backfillHost computes the rollups of a host since the given day, or the
+// day of its oldest visit if it is zero, until the given day.
+func backfillHost(ctx context.Context, host string, since, until time.Time, chunk int, restart bool) error {
+	if since.IsZero() {
+		v := visit{}
+		err := analyticsDB(dbname).Collection(host).FindOne(ctx, bson.M{},
+			options.FindOne().SetSort(bson.M{"time": 1}).SetProjection(bson.M{"time": 1})).Decode(&v)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to find oldest visit: %w", err)
+		}
+		since = v.Time.UTC().Truncate(day)
+	}
+
+	progress := db.Database(metaname).Collection(colBackfills)
+	b := backfill{Host: host, Since: since, Until: until, Next: since}
+	if !restart {
+		var prev backfill
+		err := progress.FindOne(ctx, bson.M{"_id": host}).Decode(&prev)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("failed to load progress: %w", err)
+		}
+		// Progress of another range does not apply.
+		if err == nil && prev.Since.Equal(since) && prev.Until.Equal(until) {
+			b.Next = prev.Next
+		}
+	}
+	if !b.Next.Before(until) {
+		l.Printf("rollups of %s are already backfilled until %s", host, until.Format("2006-01-02"))
+		return nil
+	}
+
+	days := int(until.Sub(since) / day)
+	for b.Next.Before(until) {
+		end := chunkEnd(b.Next, until, chunk)
+		if err := rollupHost(ctx, host, b.Next, end); err != nil {
+			return err
+		}
+		b.Next, b.Updated = end, time.Now().UTC()
+		_, err := progress.ReplaceOne(ctx, bson.M{"_id": host}, b, options.Replace().SetUpsert(true))
+		if err != nil {
+			return fmt.Errorf("failed to save progress: %w", err)
+		}
+		done := int(b.Next.Sub(since) / day)
+		l.Printf("backfilled %s until %s: %d/%d days (%.0f%%)",
+			host, end.Format("2006-01-02"), done, days, 100*float64(done)/float64(days))
+	}
+	// Reports of the host changed, see statsVersion.
+	return totalHost(ctx, host)
+}
+
+// chunkEnd returns the end of the chunk of days that starts at the given
+// day, which is at most the given end.
+func chunkEnd(next, until time.Time, days int) time.Time {
+	end := next.Add(time.Duration(days) * day)
+	if end.After(until) {
+		return until
+	}
+	return end
+}
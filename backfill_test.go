@@ -0,0 +1,28 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChunkEnd(t *testing.T) {
+	until := time.Date(2021, 3, 10, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		next time.Time
+		days int
+		want time.Time
+	}{
+		{time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), 7, time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC), 7, until},
+		{time.Date(2021, 3, 9, 0, 0, 0, 0, time.UTC), 1, until},
+	}
+	for _, tt := range tests {
+		if got := chunkEnd(tt.next, until, tt.days); !got.Equal(tt.want) {
+			t.Fatalf("chunk of %d days from %v: %v, want %v", tt.days, tt.next, got, tt.want)
+		}
+	}
+}
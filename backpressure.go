@@ -0,0 +1,119 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// limiter bounds the number of requests that are served concurrently and
+// the number of requests that wait for them. During a traffic spike,
+// requests beyond the queue are rejected immediately and waiting requests
+// give up after a while, so that the service degrades predictably rather
+// than piling up goroutines that all run into database timeouts.
+type limiter struct {
+	// running holds a token per request that is being served, and
+	// queued a token per request that is being served or waiting.
+	running chan struct{}
+	queued  chan struct{}
+	wait    time.Duration
+
+	rejected atomic.Int64
+	timedOut atomic.Int64
+}
+
+func newLimiter(concurrency, queue int, wait time.Duration) *limiter {
+	return &limiter{
+		running: make(chan struct{}, concurrency),
+		queued:  make(chan struct{}, concurrency+queue),
+		wait:    wait,
+	}
+}
+
+// acquire waits for a free slot and returns its release function. It
+// fails with errOverloaded if the queue is full, and with errUnavailable
+// if no slot is free within the wait time or the replica drains.
+func (lim *limiter) acquire(ctx context.Context) (func(), error) {
+	if draining.Load() {
+		return nil, fmt.Errorf("%w: draining for shutdown", errUnavailable)
+	}
+	select {
+	case lim.queued <- struct{}{}:
+	default:
+		lim.rejected.Add(1)
+		return nil, fmt.Errorf("%w: ingest queue is full", errOverloaded)
+	}
+
+	t := time.NewTimer(lim.wait)
+	defer t.Stop()
+	select {
+	case lim.running <- struct{}{}:
+		return func() {
+			<-lim.running
+			<-lim.queued
+		}, nil
+	case <-t.C:
+		<-lim.queued
+		lim.timedOut.Add(1)
+		return nil, fmt.Errorf("%w: waited %v for ingest queue", errUnavailable, lim.wait)
+	case <-ctx.Done():
+		<-lim.queued
+		return nil, ctx.Err()
+	}
+}
+
+// limit serves the handler within the limits.
+func (lim *limiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, err := lim.acquire(r.Context())
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		defer release()
+		next(w, r)
+	}
+}
+
+// ingestLimiter limits recording visits. It is configured by environment
+// variables:
+//
+//	URLSTAT_INGEST_CONCURRENCY: visits that are recorded concurrently, defaults to 64
+//	URLSTAT_INGEST_QUEUE: visits that wait to be recorded, defaults to 1024
+//	URLSTAT_INGEST_WAIT: the maximum wait of a visit, defaults to 2s
+var ingestLimiter *limiter
+
+func init() {
+	concurrency, queue, wait := 64, 1024, 2*time.Second
+	if v := os.Getenv("URLSTAT_INGEST_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid URLSTAT_INGEST_CONCURRENCY: %v", v)
+		}
+		concurrency = n
+	}
+	if v := os.Getenv("URLSTAT_INGEST_QUEUE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid URLSTAT_INGEST_QUEUE: %v", v)
+		}
+		queue = n
+	}
+	if v := os.Getenv("URLSTAT_INGEST_WAIT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid URLSTAT_INGEST_WAIT: %v", v)
+		}
+		wait = d
+	}
+	ingestLimiter = newLimiter(concurrency, queue, wait)
+}
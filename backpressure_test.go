@@ -0,0 +1,77 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	lim := newLimiter(1, 1, 10*time.Millisecond)
+	ctx := context.Background()
+
+	release, err := lim.acquire(ctx)
+	if err != nil {
+		t.Fatalf("first acquire failed: %v", err)
+	}
+
+	// The second request waits in the queue, which makes the third one
+	// being rejected immediately.
+	waited := make(chan error)
+	go func() {
+		_, err := lim.acquire(ctx)
+		waited <- err
+	}()
+	for len(lim.queued) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := lim.acquire(ctx); !errors.Is(err, errOverloaded) {
+		t.Fatalf("acquire on a full queue: got %v, want %v", err, errOverloaded)
+	}
+	if err := <-waited; !errors.Is(err, errUnavailable) {
+		t.Fatalf("acquire after waiting: got %v, want %v", err, errUnavailable)
+	}
+
+	release()
+	release, err = lim.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire after release failed: %v", err)
+	}
+	release()
+	if len(lim.running) != 0 || len(lim.queued) != 0 {
+		t.Fatalf("slots are not released: running %d, queued %d", len(lim.running), len(lim.queued))
+	}
+	if lim.rejected.Load() != 1 || lim.timedOut.Load() != 1 {
+		t.Fatalf("rejected %d and timed out %d, want 1 and 1", lim.rejected.Load(), lim.timedOut.Load())
+	}
+}
+
+func TestDrain(t *testing.T) {
+	defer func(lim *limiter) {
+		ingestLimiter = lim
+		draining.Store(false)
+	}(ingestLimiter)
+	ingestLimiter = newLimiter(1, 1, 10*time.Millisecond)
+
+	release, err := ingestLimiter.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*drainTick)
+	defer cancel()
+	if n := drain(ctx); n != 1 {
+		t.Fatalf("drain with a visit in progress = %d, want 1", n)
+	}
+	if _, err := ingestLimiter.acquire(context.Background()); !errors.Is(err, errUnavailable) {
+		t.Fatalf("acquire while draining: got %v, want %v", err, errUnavailable)
+	}
+	time.AfterFunc(drainTick, release)
+	if n := drain(context.Background()); n != 0 {
+		t.Fatalf("drain after release = %d, want 0", n)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// maxBatch is the maximum number of views of a batch.
+const maxBatch = 50
+
+// batch is a batch of page views of a visitor, which client.js collects
+// in single page applications, e.g. on route changes, and sends at once.
+type batch struct {
+	VisitorID string      `json:"visitor_id"`
+	UA        string      `json:"ua"`
+	Consent   string      `json:"consent"`
+	Views     []batchView `json:"views"`
+}
+
+type batchView struct {
+	URL        string            `json:"url"`
+	Referrer   string            `json:"referrer"`
+	Status     int               `json:"status"`
+	Dimensions map[string]string `json:"dimensions"`
+}
+
+// recordBatch records a batch of page views: POST /urlstat/batch. The
+// body is JSON, which is sent as text/plain by navigator.sendBeacon when
+// a page is hidden, hence the content type is not checked. All views must
+// be of the origin of the request. It responds the visitor ID and the
+// number of accepted views, which includes views that are not recorded,
+// e.g. of excluded visitors, like /urlstat does.
+func recordBatch(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && source.isAllowed(origin, true) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	}
+	if r.Method == http.MethodOptions {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	if r.Method != http.MethodPost {
+		err = fmt.Errorf("%w: %s %s", errInvalidQuery, r.Method, r.URL.Path)
+		return
+	}
+	var b batch
+	if err = json.NewDecoder(io.LimitReader(r.Body, grpcMaxMessage)).Decode(&b); err != nil {
+		err = fmt.Errorf("%w: %v", errInvalidQuery, err)
+		return
+	}
+	if len(b.Views) == 0 || len(b.Views) > maxBatch {
+		err = fmt.Errorf("%w: a batch must have 1 to %d views", errInvalidQuery, maxBatch)
+		return
+	}
+	if b.Consent != "" && b.Consent != "granted" && b.Consent != "denied" {
+		err = fmt.Errorf("%w: consent must be granted or denied", errInvalidQuery)
+		return
+	}
+
+	// Views are checked before any is recorded, so that an invalid batch
+	// records nothing.
+	reps := make([]visitReport, len(b.Views))
+	for i, v := range b.Views {
+		u, uerr := allowedURL(v.URL)
+		if uerr != nil {
+			err = uerr
+			return
+		}
+		if !sameOrigin(r, u) {
+			err = fmt.Errorf("%w: %s reported %s", errOriginMismatch, r.Header.Get("Origin"), u.Host)
+			return
+		}
+		if err = checkDimensions(v.Dimensions); err != nil {
+			return
+		}
+		reps[i] = visitReport{
+			URL:        u,
+			IP:         readIP(r),
+			Country:    readCountry(r),
+			UA:         b.UA,
+			ClientUA:   r.UserAgent(),
+			Hints:      readClientHints(r.Header),
+			Referer:    v.Referrer,
+			Status:     pageStatus(strconv.Itoa(v.Status)),
+			Consent:    b.Consent,
+			Dimensions: v.Dimensions,
+		}
+	}
+	// Without consent, no visitor ID is stored or responded.
+	vid := ""
+	if id, perr := uuid.Parse(b.VisitorID); perr == nil && b.Consent != "denied" {
+		vid = id.String()
+	}
+
+	release, err := ingestLimiter.acquire(r.Context())
+	if err != nil {
+		return
+	}
+	defer release()
+	accepted := 0
+	for _, rep := range reps {
+		rep.VisitorID = vid
+		id, rerr := recordVisit(r.Context(), rep)
+		if rerr != nil {
+			err = rerr
+			return
+		}
+		// Views without a visitor ID get the ID of the first saved one.
+		if vid == "" && id != "" {
+			vid = id
+		}
+		accepted++
+	}
+
+	resp, _ := json.Marshal(struct {
+		VisitorID string `json:"visitor_id,omitempty"`
+		Accepted  int    `json:"accepted"`
+	}{vid, accepted})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecordBatch(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{})
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   string
+		visits int
+	}{
+		{
+			name:   "empty batch",
+			body:   `{"views":[]}`,
+			status: http.StatusBadRequest,
+			want:   `"code":"invalid_query"`,
+		},
+		{
+			name:   "invalid view",
+			body:   `{"views":[{"url":"https://changkun.de/a"},{"url":"https://golang.design/"}]}`,
+			status: http.StatusForbidden,
+			want:   `"code":"origin_mismatch"`,
+		},
+		{
+			name:   "route changes",
+			body:   `{"ua":"Mozilla/5.0","views":[{"url":"https://changkun.de/a","referrer":"https://changkun.de/"},{"url":"https://changkun.de/b","referrer":"https://changkun.de/a","status":404}]}`,
+			status: http.StatusOK,
+			want:   `"accepted":2`,
+			visits: 2,
+		},
+		{
+			name:   "consent denied",
+			body:   `{"consent":"denied","visitor_id":"0b8a0a5e-8c9f-4a35-9a8c-59d1b41b8e4b","views":[{"url":"https://changkun.de/c"}]}`,
+			status: http.StatusOK,
+			want:   `{"accepted":1}`,
+			visits: 2,
+		},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/urlstat/batch", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "text/plain;charset=UTF-8")
+		r.Header.Set("Origin", "https://changkun.de")
+		w := httptest.NewRecorder()
+		recordBatch(w, r)
+
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.want) {
+			t.Fatalf("%s: got %d %s, want %d %s", tt.name, w.Code, w.Body.String(), tt.status, tt.want)
+		}
+		if got := len(m.visits["changkun.de"]); got != tt.visits {
+			t.Fatalf("%s: %d visits recorded, want %d", tt.name, got, tt.visits)
+		}
+	}
+	vs := m.visits["changkun.de"]
+	if vs[0].VisitorID == "" || vs[1].VisitorID != vs[0].VisitorID || vs[1].Status != 404 {
+		t.Fatalf("views of a batch: got %+v", vs)
+	}
+	if len(m.anonymous["changkun.de"]) != 1 {
+		t.Fatalf("view without consent is not counted anonymously")
+	}
+}
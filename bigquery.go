@@ -0,0 +1,464 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colExports stores the progress of the BigQuery export per host, see
+// bigqueryWorker.
+const colExports = "exports"
+
+// bigqueryAPI is the endpoint of the BigQuery API.
+var bigqueryAPI = "https://bigquery.googleapis.com/bigquery/v2"
+
+const (
+	// bigqueryTick is how often the worker exports the days that closed.
+	bigqueryTick = time.Hour
+	// bigqueryGrace is how long after its end a day is exported, so that
+	// visits that are recorded late are exported with their day.
+	bigqueryGrace = time.Hour
+	// bigqueryBatch is the number of rows that are inserted at a time.
+	bigqueryBatch = 500
+)
+
+// bigquery exports the visits of each closed day to the BigQuery table of
+// URLSTAT_BIGQUERY_TABLE, i.e. project.dataset.table or dataset.table of
+// the project of the service account, with the service account key file
+// of URLSTAT_BIGQUERY_CREDENTIALS, or GOOGLE_APPLICATION_CREDENTIALS. It
+// is nil if visits are not exported. The first day that is exported is
+// URLSTAT_BIGQUERY_SINCE, or yesterday without it.
+var (
+	bigquery      *bigqueryExporter
+	bigquerySince time.Time
+)
+
+func init() {
+	table := os.Getenv("URLSTAT_BIGQUERY_TABLE")
+	if table == "" {
+		return
+	}
+	file := os.Getenv("URLSTAT_BIGQUERY_CREDENTIALS")
+	if file == "" {
+		file = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if file == "" {
+		log.Fatalf("URLSTAT_BIGQUERY_TABLE requires URLSTAT_BIGQUERY_CREDENTIALS")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatalf("failed to read URLSTAT_BIGQUERY_CREDENTIALS: %v", err)
+	}
+	bigquery, err = newBigQueryExporter(table, b)
+	if err != nil {
+		log.Fatalf("invalid URLSTAT_BIGQUERY_TABLE: %v", err)
+	}
+	if s := os.Getenv("URLSTAT_BIGQUERY_SINCE"); s != "" {
+		t, err := parseDate(s)
+		if err != nil {
+			log.Fatalf("invalid URLSTAT_BIGQUERY_SINCE, require yyyy-mm-dd: %v", err)
+		}
+		bigquerySince = t.UTC().Truncate(day)
+	}
+}
+
+// serviceAccount is a key file of a Google Cloud service account.
+type serviceAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// bigqueryExporter inserts rows into a BigQuery table as a service
+// account.
+type bigqueryExporter struct {
+	project, dataset, table string
+	account                 serviceAccount
+	key                     *rsa.PrivateKey
+	client                  *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newBigQueryExporter returns the exporter to a table with the key file
+// of a service account.
+func newBigQueryExporter(table string, credentials []byte) (*bigqueryExporter, error) {
+	e := &bigqueryExporter{client: &http.Client{Timeout: time.Minute}}
+	if err := json.Unmarshal(credentials, &e.account); err != nil {
+		return nil, fmt.Errorf("invalid service account: %w", err)
+	}
+	if e.account.ClientEmail == "" || e.account.PrivateKey == "" {
+		return nil, errors.New("invalid service account: missing client_email or private_key")
+	}
+	if e.account.TokenURI == "" {
+		e.account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(e.account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("invalid service account: private_key is not PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid service account: %w", err)
+	}
+	var ok bool
+	if e.key, ok = key.(*rsa.PrivateKey); !ok {
+		return nil, errors.New("invalid service account: private_key is not RSA")
+	}
+
+	parts := strings.Split(table, ".")
+	if len(parts) == 2 {
+		parts = append([]string{e.account.ProjectID}, parts...)
+	}
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("table must be project.dataset.table, got %q", table)
+	}
+	e.project, e.dataset, e.table = parts[0], parts[1], parts[2]
+	return e, nil
+}
+
+// accessToken returns the OAuth access token of the service account, which
+// is requested by a JWT signed with its key and reused until it expires.
+func (e *bigqueryExporter) accessToken(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	if e.token != "" && now.Add(time.Minute).Before(e.expires) {
+		return e.token, nil
+	}
+
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   e.account.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/bigquery.insertdata",
+		"aud":   e.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, e.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return "", fmt.Errorf("failed to get access token: %s: %s", resp.Status, b)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil || tok.AccessToken == "" {
+		return "", fmt.Errorf("invalid access token response: %v", err)
+	}
+	e.token, e.expires = tok.AccessToken, now.Add(time.Duration(tok.ExpiresIn)*time.Second)
+	return e.token, nil
+}
+
+// bigqueryRow is a visit as a row of the table. The schema of the table
+// is that of the fields, see the README. Day partitions the table.
+type bigqueryRow struct {
+	ID         string `json:"id"`
+	Host       string `json:"host"`
+	Path       string `json:"path"`
+	VisitorID  string `json:"visitor_id"`
+	IP         string `json:"ip"`
+	UA         string `json:"ua"`
+	Referer    string `json:"referer"`
+	Time       string `json:"time"`
+	Day        string `json:"day"`
+	New        bool   `json:"new"`
+	Channel    string `json:"channel"`
+	Status     int    `json:"status"`
+	Country    string `json:"country"`
+	Browser    string `json:"browser"`
+	System     string `json:"os"`
+	Bot        bool   `json:"bot"`
+	Dimensions string `json:"dimensions"`
+}
+
+// bigqueryRowOf returns the row of a visit of a host. Custom dimensions
+// are a JSON object, which queries read by JSON_VALUE.
+func bigqueryRowOf(id primitive.ObjectID, host string, v *visit) bigqueryRow {
+	r := bigqueryRow{
+		ID:        id.Hex(),
+		Host:      v.Host,
+		Path:      v.Path,
+		VisitorID: v.VisitorID,
+		IP:        v.IP,
+		UA:        v.UA,
+		Referer:   v.Referer,
+		Time:      v.Time.UTC().Format("2006-01-02 15:04:05.000000"),
+		Day:       v.Time.UTC().Format("2006-01-02"),
+		New:       v.New,
+		Channel:   v.Channel,
+		Status:    v.Status,
+		Country:   v.Country,
+		Browser:   v.Browser,
+		System:    v.System,
+		Bot:       v.Bot,
+	}
+	if r.Host == "" {
+		r.Host = host
+	}
+	if len(v.Dimensions) > 0 {
+		b, _ := json.Marshal(v.Dimensions)
+		r.Dimensions = string(b)
+	}
+	return r
+}
+
+// insert appends rows to the table by streaming inserts. The ID of a row
+// is its insert ID, hence BigQuery drops the rows of a retried insert that
+// it received shortly before.
+func (e *bigqueryExporter) insert(ctx context.Context, rows []bigqueryRow) error {
+	token, err := e.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	type row struct {
+		InsertID string      `json:"insertId"`
+		JSON     bigqueryRow `json:"json"`
+	}
+	body := struct {
+		Rows []row `json:"rows"`
+	}{make([]row, 0, len(rows))}
+	for _, r := range rows {
+		body.Rows = append(body.Rows, row{r.ID, r})
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/projects/%s/datasets/%s/tables/%s/insertAll", bigqueryAPI,
+		url.PathEscape(e.project), url.PathEscape(e.dataset), url.PathEscape(e.table))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("bigquery returned %s: %s", resp.Status, b)
+	}
+	var res struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Reason  string `json:"reason"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("invalid insert response: %w", err)
+	}
+	if n := len(res.InsertErrors); n > 0 {
+		first := res.InsertErrors[0]
+		msg := "unknown error"
+		if len(first.Errors) > 0 {
+			msg = first.Errors[0].Reason + ": " + first.Errors[0].Message
+		}
+		return fmt.Errorf("bigquery rejected %d of %d rows, row %d: %s", n, len(rows), first.Index, msg)
+	}
+	return nil
+}
+
+// bigqueryProgress is the progress of the export of a host: the visits of
+// the days before Next are exported, and those of Next until the visit
+// After in the order of their IDs.
+type bigqueryProgress struct {
+	Host    string             `bson:"_id"`
+	Next    time.Time          `bson:"next"`
+	After   primitive.ObjectID `bson:"after"`
+	Updated time.Time          `bson:"updated"`
+}
+
+// bigqueryWorker appends the visits of each day to the BigQuery table once
+// the day closed, until the context is canceled. Like the rollup worker,
+// only the holder of the bigquery lease exports visits. The progress of
+// each host is recorded after each batch, hence an export that failed
+// continues after the last inserted batch on the next tick.
+func bigqueryWorker(ctx context.Context) {
+	t := time.NewTicker(bigqueryTick)
+	defer t.Stop()
+	for {
+		leader, err := acquireLease(ctx, "bigquery", 2*bigqueryTick)
+		if err != nil {
+			l.Printf("failed to acquire bigquery lease: %v", err)
+		}
+		if leader {
+			runBigQueryExport(ctx, time.Now())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// runBigQueryExport exports the days of all hosts that closed at the given
+// time and are not exported yet. A host that fails is logged and does not
+// stop the export of the others.
+func runBigQueryExport(ctx context.Context, now time.Time) {
+	hosts, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		l.Printf("failed to export to BigQuery: failed to list collections: %v", err)
+		return
+	}
+	for _, host := range hosts {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := exportHost(ctx, host, now); err != nil {
+			l.Printf("failed to export %s to BigQuery: %v", host, err)
+		}
+	}
+}
+
+// exportHost exports the days of a host that closed at the given time,
+// since its recorded progress, or since bigquerySince or yesterday if it
+// was never exported.
+func exportHost(ctx context.Context, host string, now time.Time) error {
+	progress := db.Database(metaname).Collection(colExports)
+	p := bigqueryProgress{Host: host}
+	err := progress.FindOne(ctx, bson.M{"_id": host}).Decode(&p)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("failed to load progress: %w", err)
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		p.Next = bigquerySince
+		if p.Next.IsZero() {
+			p.Next = now.UTC().Truncate(day).Add(-day)
+		}
+	}
+	save := func() error {
+		p.Updated = time.Now().UTC()
+		_, err := progress.ReplaceOne(ctx, bson.M{"_id": host}, p, options.Replace().SetUpsert(true))
+		if err != nil {
+			return fmt.Errorf("failed to save progress: %w", err)
+		}
+		return nil
+	}
+	for !p.Next.Add(day + bigqueryGrace).After(now) {
+		start := time.Now()
+		n, err := exportDay(ctx, &p, save)
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", p.Next.Format("2006-01-02"), err)
+		}
+		l.Printf("exported %d visits of %s on %s to BigQuery in %v", n, host, p.Next.Format("2006-01-02"), time.Since(start))
+		p.Next, p.After = p.Next.Add(day), primitive.NilObjectID
+		if err := save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportDay appends the visits of the day of the progress of a host after
+// its last exported visit to the table in batches, and saves the progress
+// after each batch. It returns the number of exported visits.
+func exportDay(ctx context.Context, p *bigqueryProgress, save func() error) (int, error) {
+	col, _ := storedVisits(p.Host)
+	filter := bson.M{
+		"time": bson.M{"$gte": p.Next, "$lt": p.Next.Add(day)},
+		"_id":  bson.M{"$gt": p.After},
+	}
+	cur, err := col.Find(ctx, hostFilter(p.Host, filter), options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+	n := 0
+	rows := make([]bigqueryRow, 0, bigqueryBatch)
+	var last primitive.ObjectID
+	flush := func() error {
+		if err := bigquery.insert(ctx, rows); err != nil {
+			return err
+		}
+		n, rows, p.After = n+len(rows), rows[:0], last
+		return save()
+	}
+	for cur.Next(ctx) {
+		var doc struct {
+			ID    primitive.ObjectID `bson:"_id"`
+			Visit visit              `bson:",inline"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return n, err
+		}
+		rows = append(rows, bigqueryRowOf(doc.ID, p.Host, &doc.Visit))
+		last = doc.ID
+		if len(rows) == bigqueryBatch {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return n, err
+	}
+	if len(rows) > 0 {
+		if err := flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
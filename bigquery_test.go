@@ -0,0 +1,120 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBigQueryExporter(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	tokens := 0
+	var got []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			tokens++
+			parts := strings.Split(r.FormValue("assertion"), ".")
+			sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+				t.Errorf("invalid assertion signature: %v", err)
+			}
+			w.Write([]byte(`{"access_token":"t0k3n","expires_in":3600}`))
+		case "/projects/p/datasets/analytics/tables/visits/insertAll":
+			if r.Header.Get("Authorization") != "Bearer t0k3n" {
+				t.Errorf("unexpected authorization %q", r.Header.Get("Authorization"))
+			}
+			var body struct {
+				Rows []map[string]interface{} `json:"rows"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			got = append(got, body.Rows...)
+			if len(got) > 2 {
+				w.Write([]byte(`{"insertErrors":[{"index":0,"errors":[{"reason":"invalid","message":"no such field"}]}]}`))
+				return
+			}
+			w.Write([]byte(`{}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer func(api string) { bigqueryAPI = api }(bigqueryAPI)
+	bigqueryAPI = srv.URL
+
+	creds, _ := json.Marshal(serviceAccount{
+		ProjectID:   "p",
+		ClientEmail: "urlstat@p.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    srv.URL + "/token",
+	})
+	e, err := newBigQueryExporter("analytics.visits", creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.project != "p" || e.dataset != "analytics" || e.table != "visits" {
+		t.Fatalf("table = %s.%s.%s, want p.analytics.visits", e.project, e.dataset, e.table)
+	}
+
+	v := &visit{Path: "/blog/", Time: time.Date(2021, 3, 1, 12, 0, 0, 5e6, time.UTC), Dimensions: map[string]string{"author": "changkun"}}
+	id := primitive.NewObjectID()
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := e.insert(ctx, []bigqueryRow{bigqueryRowOf(id, "changkun.de", v)}); err != nil {
+			t.Fatalf("insert() = %v", err)
+		}
+	}
+	if tokens != 1 {
+		t.Fatalf("requested %d tokens, want 1", tokens)
+	}
+	r := got[0]
+	if r["insertId"] != id.Hex() {
+		t.Fatalf("insertId = %v, want %s", r["insertId"], id.Hex())
+	}
+	row := r["json"].(map[string]interface{})
+	for k, want := range map[string]string{
+		"host":       "changkun.de",
+		"time":       "2021-03-01 12:00:00.005000",
+		"day":        "2021-03-01",
+		"dimensions": `{"author":"changkun"}`,
+	} {
+		if row[k] != want {
+			t.Fatalf("row %s = %v, want %s", k, row[k], want)
+		}
+	}
+	if err := e.insert(ctx, []bigqueryRow{bigqueryRowOf(id, "changkun.de", v)}); err == nil || !strings.Contains(err.Error(), "no such field") {
+		t.Fatalf("insert() = %v, want rejected rows", err)
+	}
+
+	for _, table := range []string{"visits", "p.analytics.", "a.b.c.d"} {
+		if _, err := newBigQueryExporter(table, creds); err == nil {
+			t.Fatalf("newBigQueryExporter(%q) did not fail", table)
+		}
+	}
+	if _, err := newBigQueryExporter("p.analytics.visits", []byte(`{"client_email":"a","private_key":"b"}`)); err == nil {
+		t.Fatal("newBigQueryExporter() with invalid key did not fail")
+	}
+}
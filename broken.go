@@ -0,0 +1,103 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// brokenPage is a page that was viewed with an error status, e.g. a dead
+// link, and the pages that linked to it most.
+type brokenPage struct {
+	Path      string
+	Status    int
+	Views     int64
+	Referrers []nameCount
+}
+
+// brokenRow is the number of views of a broken page from a referrer.
+type brokenRow struct {
+	Path    string `bson:"path"`
+	Status  int    `bson:"status"`
+	Referer string `bson:"referer"`
+	Count   int64  `bson:"count"`
+}
+
+// brokenPages returns the n pages of a host with the most views with an
+// error status since the given day, with their top referrers. The status
+// is only known if the page reports it, see client.js.
+func brokenPages(ctx context.Context, host string, since time.Time, n int) ([]brokenPage, error) {
+	p := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{
+			"time":   bson.M{"$gte": since},
+			"status": bson.M{"$gte": http.StatusBadRequest},
+		}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"path": "$path", "status": "$status", "referer": "$referer"},
+			"count": bson.M{"$sum": 1},
+		}}},
+		bson.D{{Key: "$replaceRoot", Value: bson.M{
+			"newRoot": bson.M{"$mergeObjects": bson.A{"$_id", bson.M{"count": "$count"}}},
+		}}},
+	}
+	col := analyticsDB(dbname).Collection(host)
+	cur, err := col.Aggregate(ctx, p, options.Aggregate().
+		SetAllowDiskUse(true).SetComment(requestID(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	var rows []brokenRow
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	return groupBroken(rows, n, 5), nil
+}
+
+// groupBroken groups the views of broken pages by page and status, and
+// keeps the top n pages with their top m referrers.
+func groupBroken(rows []brokenRow, n, m int) []brokenPage {
+	type key struct {
+		path   string
+		status int
+	}
+	pages := map[key]*brokenPage{}
+	refs := map[key]map[string]int64{}
+	for _, r := range rows {
+		k := key{r.Path, r.Status}
+		if pages[k] == nil {
+			pages[k] = &brokenPage{Path: r.Path, Status: r.Status}
+			refs[k] = map[string]int64{}
+		}
+		pages[k].Views += r.Count
+		if r.Referer != "" {
+			refs[k][r.Referer] += r.Count
+		}
+	}
+	broken := make([]brokenPage, 0, len(pages))
+	for k, p := range pages {
+		p.Referrers = sortCounts(refs[k], m)
+		broken = append(broken, *p)
+	}
+	sort.Slice(broken, func(i, j int) bool {
+		if broken[i].Views != broken[j].Views {
+			return broken[i].Views > broken[j].Views
+		}
+		if broken[i].Path != broken[j].Path {
+			return broken[i].Path < broken[j].Path
+		}
+		return broken[i].Status < broken[j].Status
+	})
+	if len(broken) > n {
+		broken = broken[:n]
+	}
+	return broken
+}
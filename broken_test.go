@@ -0,0 +1,36 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupBroken(t *testing.T) {
+	rows := []brokenRow{
+		{Path: "/old/", Status: 404, Referer: "https://example.com/a", Count: 3},
+		{Path: "/old/", Status: 404, Referer: "https://example.com/b", Count: 5},
+		{Path: "/old/", Status: 404, Referer: "", Count: 2},
+		{Path: "/api/", Status: 500, Referer: "https://golang.design/", Count: 1},
+		{Path: "/gone/", Status: 410, Count: 1},
+	}
+	got := groupBroken(rows, 2, 1)
+	want := []brokenPage{
+		{Path: "/old/", Status: 404, Views: 10, Referrers: []nameCount{{"https://example.com/b", 5}}},
+		{Path: "/api/", Status: 500, Views: 1, Referrers: []nameCount{{"https://golang.design/", 1}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("groupBroken() = %+v, want %+v", got, want)
+	}
+}
+
+func TestPageStatus(t *testing.T) {
+	for s, want := range map[string]int{"": 0, "404": 404, "200": 200, "99": 0, "600": 0, "x": 0} {
+		if got := pageStatus(s); got != want {
+			t.Errorf("pageStatus(%q) = %d, want %d", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Channels of visits, i.e. the kinds of their referrers.
+const (
+	channelDirect   = "direct"
+	channelInternal = "internal"
+	channelSearch   = "search"
+	channelSocial   = "social"
+	channelOther    = "other"
+)
+
+// referrerChannels maps referrer domains to channels. A domain matches
+// the hostname of a referrer and its subdomains, and a domain ending with
+// a dot matches any top-level domain, e.g. "google." matches google.com
+// and www.google.co.uk. Please keep the list sorted by channel and domain.
+var referrerChannels = map[string]string{
+	"baidu.com":            channelSearch,
+	"bing.com":             channelSearch,
+	"duckduckgo.com":       channelSearch,
+	"ecosia.org":           channelSearch,
+	"google.":              channelSearch,
+	"kagi.com":             channelSearch,
+	"naver.com":            channelSearch,
+	"search.brave.com":     channelSearch,
+	"search.yahoo.com":     channelSearch,
+	"sogou.com":            channelSearch,
+	"startpage.com":        channelSearch,
+	"yandex.":              channelSearch,
+	"bsky.app":             channelSocial,
+	"douban.com":           channelSocial,
+	"facebook.com":         channelSocial,
+	"instagram.com":        channelSocial,
+	"linkedin.com":         channelSocial,
+	"lnkd.in":              channelSocial,
+	"lobste.rs":            channelSocial,
+	"mastodon.social":      channelSocial,
+	"news.ycombinator.com": channelSocial,
+	"reddit.com":           channelSocial,
+	"t.co":                 channelSocial,
+	"t.me":                 channelSocial,
+	"twitter.com":          channelSocial,
+	"v2ex.com":             channelSocial,
+	"weibo.com":            channelSocial,
+	"x.com":                channelSocial,
+	"youtube.com":          channelSocial,
+	"zhihu.com":            channelSocial,
+}
+
+// channelOf classifies the referrer of a visit of a host. Visits without
+// a referrer are direct, and referrers of the host itself or of one of
+// its aliases are internal navigation.
+func channelOf(referrer, host string) string {
+	if referrer == "" {
+		return channelDirect
+	}
+	u, err := url.Parse(referrer)
+	if err != nil || u.Hostname() == "" {
+		return channelOther
+	}
+	name := strings.ToLower(u.Hostname())
+	if name == host || source.collection(name) == source.collection(host) {
+		return channelInternal
+	}
+	// Try the hostname and its parent domains, e.g. www.google.co.uk,
+	// google.co.uk, co.uk, and uk, against the exact domains and the
+	// domains of any top-level domain.
+	for d := name; d != ""; {
+		if c, ok := referrerChannels[d]; ok {
+			return c
+		}
+		if label, _, ok := strings.Cut(d, "."); ok {
+			if c, ok := referrerChannels[label+"."]; ok {
+				return c
+			}
+		}
+		_, d, _ = strings.Cut(d, ".")
+	}
+	return channelOther
+}
+
+// channelShare is the number of visits of a channel and its percentage
+// of all visits.
+type channelShare struct {
+	Name    string
+	Count   int64
+	Percent float64
+}
+
+// channelSplit returns the number of visits of a host since the given
+// day per channel. Visits recorded before channels were classified are
+// counted as unknown.
+func channelSplit(ctx context.Context, host string, since time.Time) ([]channelShare, error) {
+	channels, err := groupVisits(ctx, host, "channel", since, nil)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]int64{}
+	var sum int64
+	for _, c := range channels {
+		name := c.Name
+		if name == "" {
+			name = "unknown"
+		}
+		m[name] += c.Count
+		sum += c.Count
+	}
+	counts := sortCounts(m, len(m))
+	shares := make([]channelShare, len(counts))
+	for i, c := range counts {
+		shares[i] = channelShare{Name: c.Name, Count: c.Count, Percent: 100 * float64(c.Count) / float64(sum)}
+	}
+	return shares, nil
+}
@@ -0,0 +1,31 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestChannelOf(t *testing.T) {
+	tests := []struct {
+		referrer, want string
+	}{
+		{"", channelDirect},
+		{"https://golang.design/history/", channelInternal},
+		{"https://www.google.com/", channelSearch},
+		{"https://www.google.co.uk/search?q=go", channelSearch},
+		{"https://duckduckgo.com/", channelSearch},
+		{"https://news.ycombinator.com/item?id=1", channelSocial},
+		{"https://old.reddit.com/r/golang/", channelSocial},
+		{"https://t.co/abc", channelSocial},
+		{"https://github.com/golang/go/issues/1", channelOther},
+		{"https://notgoogle.com/", channelOther},
+		{"android-app://com.slack", channelOther},
+		{"not a url", channelOther},
+	}
+	for _, tt := range tests {
+		if got := channelOf(tt.referrer, "golang.design"); got != tt.want {
+			t.Errorf("channelOf(%q) = %q, want %q", tt.referrer, got, tt.want)
+		}
+	}
+}
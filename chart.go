@@ -0,0 +1,249 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chartDays is the default number of recent days of a chart.
+const chartDays = 90
+
+// Sizes of a chart and its plot area in pixels.
+const (
+	chartWidth  = 600
+	chartHeight = 200
+	chartLeft   = 48
+	chartRight  = 12
+	chartTop    = 36
+	chartBottom = 24
+)
+
+// chart serves the daily pv and uv of a page, or of the whole site without
+// a path, in recent days as an SVG line chart, which can be embedded in
+// READMEs and blog posts, e.g.
+//
+//	/urlstat/chart?host=changkun.de&path=/blog/&days=90
+//
+// The chart is read from rollups, hence it changes when rollups are
+// computed. Private statistics of the site are left out unless the request
+// may see them, see seesPrivate.
+func chart(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	q := r.URL.Query()
+	// Like badges, charts and counts that can be embedded anywhere are
+	// only served if they are signed, see badgeSecret.
+	if err = checkBadgeSignature(q); err != nil {
+		return
+	}
+	host, path := q.Get("host"), q.Get("path")
+	if host == "" {
+		err = fmt.Errorf("%w: missing host", errInvalidQuery)
+		return
+	}
+	days := chartDays
+	if s := q.Get("days"); s != "" {
+		days, err = strconv.Atoi(s)
+		if err != nil || days < 2 || days > 365 {
+			err = fmt.Errorf("%w: days must be between 2 and 365", errInvalidQuery)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	settings, err := store.settings(ctx, host)
+	if err != nil {
+		err = fmt.Errorf("failed to load settings: %w", err)
+		return
+	}
+	mode := "site"
+	if path != "" {
+		mode = "page"
+	}
+	showPV, showUV := !settings.isPrivate(mode+"_pv"), !settings.isPrivate(mode+"_uv")
+	if !showPV || !showUV {
+		var ok bool
+		ok, err = seesPrivate(r, settings)
+		if err != nil {
+			return
+		}
+		if ok {
+			showPV, showUV = true, true
+		}
+	}
+	if !showPV && !showUV {
+		err = fmt.Errorf("%w: statistics of %s are private", errForbidden, host)
+		return
+	}
+
+	since := time.Now().UTC().Truncate(day).Add(-time.Duration(days-1) * day)
+	format := fmt.Sprintf("svg\x00%t\x00%t", showPV, showUV)
+	sq := statsQuery{Host: host, Path: path, Since: since}
+	version, err := statsVersion(ctx, host)
+	if err != nil {
+		err = fmt.Errorf("failed to find version of %s: %w", host, err)
+		return
+	}
+	// Charts with private statistics must not be cached by shared caches,
+	// such as image proxies.
+	if len(settings.Private) > 0 {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "max-age=3600")
+	}
+	if !version.IsZero() {
+		etag := reportETag("chart", format, sq, version)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", version.Format(http.TimeFormat))
+		if notModified(r, etag, version) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	rollups, err := dailyRollups(ctx, host, path, since)
+	if err != nil {
+		err = fmt.Errorf("failed to find rollups: %w", err)
+		return
+	}
+	pv, uv := chartSeries(rollups, since, days)
+	if !showPV {
+		pv = nil
+	}
+	if !showUV {
+		uv = nil
+	}
+	svg, err := renderChart(host+path, since, pv, uv)
+	if err != nil {
+		err = fmt.Errorf("failed to render chart: %w", err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write(svg)
+}
+
+// chartSeries returns the daily pv and uv of the given number of days since
+// the given day from rollups. Days without rollups have no visits.
+func chartSeries(rollups []rollup, since time.Time, days int) (pv, uv []int64) {
+	pv, uv = make([]int64, days), make([]int64, days)
+	for _, r := range rollups {
+		i := int(r.Day.UTC().Sub(since) / day)
+		if i < 0 || i >= days {
+			continue
+		}
+		pv[i] += r.PV
+		uv[i] += r.UV
+	}
+	return pv, uv
+}
+
+// chartLine is a line of a chart.
+type chartLine struct {
+	Name   string
+	Color  string
+	Points string
+	// Last is the value of the last day.
+	Last int64
+}
+
+// chartView is what the chart template renders.
+type chartView struct {
+	Title         string
+	Width, Height int
+	Left, Right   int
+	Top, Bottom   int
+	Max           int64
+	From, To      string
+	Lines         []chartLine
+}
+
+// renderChart renders the daily series of pv and uv since the given day as
+// an SVG line chart. A nil series is not drawn. Both are scaled to the
+// largest value of either.
+func renderChart(title string, since time.Time, pv, uv []int64) ([]byte, error) {
+	n := len(pv)
+	if n == 0 {
+		n = len(uv)
+	}
+	var max int64 = 1
+	for _, s := range [][]int64{pv, uv} {
+		for _, v := range s {
+			if v > max {
+				max = v
+			}
+		}
+	}
+	v := chartView{
+		Title:  title,
+		Width:  chartWidth,
+		Height: chartHeight,
+		Left:   chartLeft,
+		Right:  chartWidth - chartRight,
+		Top:    chartTop,
+		Bottom: chartHeight - chartBottom,
+		Max:    max,
+		From:   since.Format("Jan 2, 2006"),
+		To:     since.Add(time.Duration(n-1) * day).Format("Jan 2, 2006"),
+	}
+	line := func(name, color string, s []int64) {
+		if s == nil {
+			return
+		}
+		dx := float64(v.Right-v.Left) / float64(n-1)
+		dy := float64(v.Bottom-v.Top) / float64(max)
+		points := make([]string, len(s))
+		for i, c := range s {
+			points[i] = fmt.Sprintf("%.1f,%.1f", float64(v.Left)+float64(i)*dx, float64(v.Bottom)-float64(c)*dy)
+		}
+		v.Lines = append(v.Lines, chartLine{Name: name, Color: color, Points: strings.Join(points, " "), Last: s[len(s)-1]})
+	}
+	line("pv", colorBlue.String(), pv)
+	line("uv", colorOrange.String(), uv)
+
+	buf := &bytes.Buffer{}
+	if err := chartTemplate.Execute(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var chartTemplate = template.Must(template.New("chart").Parse(strings.TrimSpace(`
+<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+  <title>{{.Title}}</title>
+  <rect width="{{.Width}}" height="{{.Height}}" rx="3" fill="#fff"/>
+  <g font-family="DejaVu Sans,Verdana,Geneva,sans-serif" font-size="11" fill="#555">
+    <text x="{{.Left}}" y="16">{{.Title}}</text>
+    {{- range $i, $l := .Lines}}
+    <text x="{{$.Right}}" y="{{if $i}}28{{else}}16{{end}}" text-anchor="end" fill="{{$l.Color}}">{{$l.Name}} {{$l.Last}}</text>
+    {{- end}}
+    <text x="{{.Left}}" y="{{.Top}}" dx="-4" dy="4" text-anchor="end">{{.Max}}</text>
+    <text x="{{.Left}}" y="{{.Bottom}}" dx="-4" dy="4" text-anchor="end">0</text>
+    <text x="{{.Left}}" y="{{.Height}}" dy="-6">{{.From}}</text>
+    <text x="{{.Right}}" y="{{.Height}}" dy="-6" text-anchor="end">{{.To}}</text>
+  </g>
+  <g stroke="#ddd" stroke-width="1">
+    <line x1="{{.Left}}" y1="{{.Top}}" x2="{{.Right}}" y2="{{.Top}}"/>
+    <line x1="{{.Left}}" y1="{{.Bottom}}" x2="{{.Right}}" y2="{{.Bottom}}"/>
+  </g>
+  {{- range .Lines}}
+  <polyline fill="none" stroke="{{.Color}}" stroke-width="1.5" points="{{.Points}}"/>
+  {{- end}}
+</svg>
+`)))
@@ -0,0 +1,62 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChart(t *testing.T) {
+	since := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	pv, uv := chartSeries([]rollup{
+		{Day: since, PV: 4, UV: 2},
+		{Day: since.Add(2 * day), PV: 8, UV: 3},
+		{Day: since.Add(3 * day), PV: 1, UV: 1},
+	}, since, 3)
+	if len(pv) != 3 || pv[0] != 4 || pv[1] != 0 || pv[2] != 8 || uv[2] != 3 {
+		t.Fatalf("unexpected series: %v %v", pv, uv)
+	}
+
+	svg, err := renderChart("changkun.de/<blog>", since, pv, nil)
+	if err != nil {
+		t.Fatalf("failed to render chart: %v", err)
+	}
+	for _, want := range []string{
+		`<title>changkun.de/&lt;blog&gt;</title>`,
+		`points="48.0,106.0 318.0,176.0 588.0,36.0"`,
+		`>pv 8</text>`,
+		`>Mar 1, 2021</text>`,
+		`>Mar 3, 2021</text>`,
+	} {
+		if !strings.Contains(string(svg), want) {
+			t.Fatalf("chart does not contain %s: %s", want, svg)
+		}
+	}
+	if strings.Contains(string(svg), ">uv ") {
+		t.Fatalf("chart contains a hidden series: %s", svg)
+	}
+
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{Private: []string{"site"}})
+	for _, tt := range []struct {
+		url  string
+		code int
+	}{
+		{"/urlstat/chart", http.StatusBadRequest},
+		{"/urlstat/chart?host=changkun.de&days=1", http.StatusBadRequest},
+		{"/urlstat/chart?host=changkun.de", http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		chart(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.code {
+			t.Fatalf("%s: got %d, want %d", tt.url, w.Code, tt.code)
+		}
+	}
+}
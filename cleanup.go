@@ -0,0 +1,327 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colCleanups stores the results of cleanup policies, see cleanupResult.
+const colCleanups = "cleanups"
+
+// Actions of cleanup policies.
+const (
+	// cleanupExcluded deletes the visits of all hosts that are excluded
+	// by the current configuration, see cleanupHost.
+	cleanupExcluded = "excluded"
+	// cleanupInactive deletes hosts whose newest visit is older than the
+	// inactive duration of the policy, see deleteHost.
+	cleanupInactive = "inactive-hosts"
+	// cleanupRetention deletes visits that are older than the retain
+	// duration of the policy, or the retention of their site, see
+	// siteSettings.retention.
+	cleanupRetention = "retention"
+)
+
+// cleanupTick is how often the cleanup worker checks for due policies.
+const cleanupTick = 10 * time.Minute
+
+// cleanupPolicy is a cleanup that runs periodically, which is configured
+// in the cleanup list of allowed.yml, for instance:
+//
+//	cleanup:
+//	  - name: blocked-visits
+//	    action: excluded
+//	    every: 24h
+//	  - name: inactive-hosts
+//	    action: inactive-hosts
+//	    inactive: 8760h
+//	    every: 168h
+//	    dry_run: true
+//	  - name: retention
+//	    action: retention
+//	    retain: 17520h
+//	    every: 24h
+//
+// A policy in dry run only records what it would delete, so that a new
+// policy can be previewed before it deletes anything.
+type cleanupPolicy struct {
+	Name     string        `yaml:"name"`
+	Action   string        `yaml:"action"`
+	Every    time.Duration `yaml:"every"`
+	Inactive time.Duration `yaml:"inactive"`
+	Retain   time.Duration `yaml:"retain"`
+	DryRun   bool          `yaml:"dry_run"`
+}
+
+// validate checks the policy.
+func (p cleanupPolicy) validate() error {
+	if p.Name == "" {
+		return errors.New("missing name")
+	}
+	switch p.Action {
+	case cleanupExcluded:
+	case cleanupInactive:
+		if p.Inactive < day {
+			return fmt.Errorf("policy %s: inactive must be at least 24h", p.Name)
+		}
+	case cleanupRetention:
+		if p.Retain < day {
+			return fmt.Errorf("policy %s: retain must be at least 24h", p.Name)
+		}
+	default:
+		return fmt.Errorf("policy %s: unknown action %q", p.Name, p.Action)
+	}
+	if p.Every < time.Hour {
+		return fmt.Errorf("policy %s: every must be at least 1h", p.Name)
+	}
+	return nil
+}
+
+// cleanupResult is the result of a run of a cleanup policy. Visits and
+// Hosts are the deleted visits and hosts, or the ones that would be
+// deleted in a dry run.
+type cleanupResult struct {
+	Policy string    `json:"policy"           bson:"policy"`
+	Time   time.Time `json:"time"             bson:"time"`
+	DryRun bool      `json:"dry_run"          bson:"dry_run"`
+	Visits int64     `json:"visits"           bson:"visits"`
+	Hosts  []string  `json:"hosts,omitempty"  bson:"hosts,omitempty"`
+	Error  string    `json:"error,omitempty"  bson:"error,omitempty"`
+}
+
+// String summarizes the result for logs and the audit log.
+func (r cleanupResult) String() string {
+	verb := "deleted"
+	if r.DryRun {
+		verb = "would delete"
+	}
+	s := fmt.Sprintf("%s %d visits", verb, r.Visits)
+	if len(r.Hosts) > 0 {
+		s += " of hosts " + strings.Join(r.Hosts, ", ")
+	}
+	return s
+}
+
+// cleanupStatus is a policy with its latest result.
+type cleanupStatus struct {
+	Name     string         `json:"name"`
+	Action   string         `json:"action"`
+	Every    string         `json:"every"`
+	Inactive string         `json:"inactive,omitempty"`
+	Retain   string         `json:"retain,omitempty"`
+	DryRun   bool           `json:"dry_run"`
+	Last     *cleanupResult `json:"last"`
+}
+
+// cleanupPolicies returns the configured cleanup policies.
+func (a *allowed) cleanupPolicies() []cleanupPolicy {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return append([]cleanupPolicy(nil), a.Cleanup...)
+}
+
+// cleanupPolicyOf returns the configured policy of the given name.
+func cleanupPolicyOf(name string) (cleanupPolicy, bool) {
+	for _, p := range source.cleanupPolicies() {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return cleanupPolicy{}, false
+}
+
+// cleanupStatuses returns all policies with their latest results.
+func cleanupStatuses(ctx context.Context) ([]cleanupStatus, error) {
+	policies := source.cleanupPolicies()
+	statuses := make([]cleanupStatus, 0, len(policies))
+	for _, p := range policies {
+		s := cleanupStatus{
+			Name:   p.Name,
+			Action: p.Action,
+			Every:  p.Every.String(),
+			DryRun: p.DryRun,
+		}
+		if p.Inactive > 0 {
+			s.Inactive = p.Inactive.String()
+		}
+		if p.Retain > 0 {
+			s.Retain = p.Retain.String()
+		}
+		last, err := lastCleanup(ctx, p.Name, true)
+		if err != nil {
+			return nil, err
+		}
+		s.Last = last
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// lastCleanup returns the latest result of a policy, or nil if it never
+// ran. Results of dry runs are skipped unless dryRuns is set.
+func lastCleanup(ctx context.Context, name string, dryRuns bool) (*cleanupResult, error) {
+	filter := bson.M{"policy": name}
+	if !dryRuns {
+		filter["dry_run"] = bson.M{"$ne": true}
+	}
+	r := &cleanupResult{}
+	err := db.Database(metaname).Collection(colCleanups).FindOne(ctx, filter,
+		options.FindOne().SetSort(bson.D{{Key: "time", Value: -1}})).Decode(r)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find cleanups of %s: %w", name, err)
+	}
+	return r, nil
+}
+
+// runCleanup runs a policy, which only counts what it would delete if
+// dryRun is set, and records the result.
+func runCleanup(ctx context.Context, p cleanupPolicy, dryRun bool) (cleanupResult, error) {
+	res := cleanupResult{Policy: p.Name, Time: time.Now().UTC(), DryRun: dryRun}
+	err := func() error {
+		hosts, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+		if err != nil {
+			return fmt.Errorf("failed to list collections: %w", err)
+		}
+		for _, host := range hosts {
+			switch p.Action {
+			case cleanupExcluded:
+				n, err := cleanupHost(ctx, host, dryRun)
+				res.Visits += n
+				if err != nil {
+					return fmt.Errorf("failed to clean up %s: %w", host, err)
+				}
+			case cleanupInactive:
+				newest, err := visitTime(ctx, host, -1)
+				if err != nil {
+					return fmt.Errorf("failed to find visits of %s: %w", host, err)
+				}
+				// Hosts without visits were just registered.
+				if newest.IsZero() || time.Since(newest) < p.Inactive {
+					continue
+				}
+				n, err := estimatedVisits(ctx, db.Database(dbname).Collection(host))
+				if err != nil {
+					return fmt.Errorf("failed to count visits of %s: %w", host, err)
+				}
+				if !dryRun {
+					if err := deleteHost(ctx, host); err != nil {
+						return fmt.Errorf("failed to delete %s: %w", host, err)
+					}
+				}
+				res.Visits += n
+				res.Hosts = append(res.Hosts, host)
+			case cleanupRetention:
+				s, err := settingsOf(ctx, host)
+				if err != nil {
+					return fmt.Errorf("failed to load settings of %s: %w", host, err)
+				}
+				keep := s.retention(p.Retain)
+				if keep == 0 {
+					continue
+				}
+				n, err := expireVisits(ctx, host, res.Time.Add(-keep).Truncate(day), dryRun)
+				if err != nil {
+					return fmt.Errorf("failed to expire visits of %s: %w", host, err)
+				}
+				if n > 0 {
+					res.Visits += n
+					res.Hosts = append(res.Hosts, host)
+				}
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	_, ierr := db.Database(metaname).Collection(colCleanups).InsertOne(ctx, res)
+	if ierr != nil {
+		l.Printf("failed to record cleanup %s: %v", p.Name, ierr)
+	}
+	l.Printf("cleanup %s: %v", p.Name, res)
+	return res, err
+}
+
+// expireVisits deletes the visits of a host before the given time, or only
+// counts them if dryRun is set. Expired visits are not kept as tombstones,
+// as they are deleted on purpose and may be many, and their rollups are
+// kept, hence reports of past days do not change.
+func expireVisits(ctx context.Context, host string, before time.Time, dryRun bool) (int64, error) {
+	filter := bson.M{"time": bson.M{"$lt": before}}
+	if dryRun {
+		return db.Database(dbname).Collection(host).CountDocuments(ctx, filter)
+	}
+	stored, _ := storedVisits(host)
+	r, err := stored.DeleteMany(ctx, hostFilter(host, filter))
+	if err != nil {
+		return 0, err
+	}
+	return r.DeletedCount, nil
+}
+
+// cleanupWorker runs the configured cleanup policies when they are due,
+// and purges expired tombstones, until the context is canceled. Policies are configured in allowed.yml,
+// hence they can be changed without a restart. Like the rollup worker,
+// only the holder of the cleanup lease runs policies.
+func cleanupWorker(ctx context.Context) {
+	t := time.NewTicker(cleanupTick)
+	defer t.Stop()
+	for {
+		leader, err := acquireLease(ctx, "cleanup", 2*cleanupTick)
+		if err != nil {
+			l.Printf("failed to acquire cleanup lease: %v", err)
+		}
+		if leader {
+			if err := purgeTombstones(ctx); err != nil {
+				l.Printf("%v", err)
+			}
+		}
+		for _, p := range source.cleanupPolicies() {
+			if !leader || ctx.Err() != nil {
+				break
+			}
+			// A dry run, e.g. of an admin who previews the policy, does
+			// not postpone the policy unless it is a dry run itself.
+			last, err := lastCleanup(ctx, p.Name, p.DryRun)
+			if err != nil {
+				l.Printf("%v", err)
+				continue
+			}
+			if last != nil && time.Since(last.Time) < p.Every {
+				continue
+			}
+			res, err := runCleanup(ctx, p, p.DryRun)
+			e := auditEntry{
+				Actor:  "scheduler",
+				Action: "run-cleanup",
+				Value:  p.Name,
+				Result: res.String(),
+			}
+			if err != nil {
+				e.Error = err.Error()
+			}
+			audit(ctx, e)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
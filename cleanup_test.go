@@ -0,0 +1,69 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanupPolicies(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "allowed.yml")
+	os.WriteFile(file, []byte(`cleanup:
+  - name: blocked-visits
+    action: excluded
+    every: 24h
+  - name: inactive-hosts
+    action: inactive-hosts
+    inactive: 8760h
+    every: 168h
+    dry_run: true
+`), 0o644)
+	a := &allowed{}
+	if err := a.load(file); err != nil {
+		t.Fatalf("cannot load policies: %v", err)
+	}
+	policies := a.cleanupPolicies()
+	if len(policies) != 2 || policies[0].Every != 24*time.Hour ||
+		policies[1].Inactive != 365*day || !policies[1].DryRun {
+		t.Fatalf("policies = %+v", policies)
+	}
+
+	for _, p := range []cleanupPolicy{
+		{Action: cleanupExcluded, Every: time.Hour},
+		{Name: "x", Action: "drop", Every: time.Hour},
+		{Name: "x", Action: cleanupExcluded, Every: time.Minute},
+		{Name: "x", Action: cleanupInactive, Every: time.Hour},
+	} {
+		if err := p.validate(); err == nil {
+			t.Fatalf("policy %+v is valid", p)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	p := cleanupPolicy{Name: "retention", Action: cleanupRetention, Every: day, Retain: 730 * day}
+	if err := p.validate(); err != nil {
+		t.Fatalf("policy %+v is invalid: %v", p, err)
+	}
+	if p.Retain = time.Hour; p.validate() == nil {
+		t.Fatalf("policy %+v is valid", p)
+	}
+
+	for days, want := range map[int]time.Duration{0: 730 * day, 180: 180 * day, keepForever: 0} {
+		s := &siteSettings{RetentionDays: days}
+		if err := s.validate(); err != nil {
+			t.Fatalf("retention days %d are invalid: %v", days, err)
+		}
+		if got := s.retention(730 * day); got != want {
+			t.Fatalf("retention of %d days = %v, want %v", days, got, want)
+		}
+	}
+	if err := (&siteSettings{RetentionDays: -2}).validate(); err == nil {
+		t.Fatalf("retention days -2 are valid")
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colCohorts stores the weekly retention cohorts per host, see cohort.
+const colCohorts = "cohorts"
+
+const (
+	// week is the length of a cohort. Weeks start on Monday, because
+	// time.Truncate counts from the zero time, which is a Monday.
+	week = 7 * day
+	// cohortWeeks is the number of weeks a cohort is followed after the
+	// week it was first seen.
+	cohortWeeks = 8
+	// cohortCount is the number of most recent cohorts that are computed.
+	cohortCount = 12
+)
+
+// cohort is the retention of visitors who were first seen on a host in a
+// week. Retained[i] is the number of them who visited the host again in
+// the (i+1)-th week after, and only covers weeks that have started.
+type cohort struct {
+	Host     string    `json:"host"     bson:"host"`
+	Week     time.Time `json:"week"     bson:"week"`
+	Size     int64     `json:"size"     bson:"size"`
+	Retained []int64   `json:"retained" bson:"retained"`
+}
+
+// Rates returns the retained visitors as percentages of the cohort size.
+func (c cohort) Rates() []string {
+	rates := make([]string, len(c.Retained))
+	for i, n := range c.Retained {
+		if c.Size == 0 {
+			rates[i] = "-"
+			continue
+		}
+		rates[i] = fmt.Sprintf("%.1f%%", float64(n)*100/float64(c.Size))
+	}
+	return rates
+}
+
+// runCohorts computes the recent cohorts of all hosts.
+func runCohorts(ctx context.Context, now time.Time) error {
+	hosts, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	for _, host := range hosts {
+		if err := cohortHost(ctx, host, now); err != nil {
+			return fmt.Errorf("failed to compute cohorts of %s: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// cohortHost computes the recent weekly cohorts of a host. Cohorts are
+// based on the first seen time of visitors, hence visits that were
+// recorded before visitors were tracked do not belong to any cohort.
+func cohortHost(ctx context.Context, host string, now time.Time) error {
+	current := now.UTC().Truncate(week)
+	since := current.Add(-(cohortCount - 1) * week)
+
+	cohorts := map[time.Time]*cohort{}
+	for w := since; !w.After(current); w = w.Add(week) {
+		n := int(current.Sub(w) / week)
+		if n > cohortWeeks {
+			n = cohortWeeks
+		}
+		cohorts[w] = &cohort{Host: host, Week: w, Retained: make([]int64, n)}
+	}
+
+	// The cohort week of every visitor that was first seen since then.
+	cur, err := db.Database(metaname).Collection(colVisitors).Find(ctx,
+		bson.M{"host": host, "first_seen": bson.M{"$gte": since}},
+		options.Find().SetProjection(bson.M{"visitor_id": 1, "first_seen": 1}))
+	if err != nil {
+		return err
+	}
+	firstWeek := map[string]time.Time{}
+	for cur.Next(ctx) {
+		var v struct {
+			VisitorID string    `bson:"visitor_id"`
+			FirstSeen time.Time `bson:"first_seen"`
+		}
+		if err := cur.Decode(&v); err != nil {
+			cur.Close(ctx)
+			return err
+		}
+		w := v.FirstSeen.UTC().Truncate(week)
+		if c, ok := cohorts[w]; ok {
+			firstWeek[v.VisitorID] = w
+			c.Size++
+		}
+	}
+	if err := cur.Err(); err != nil {
+		cur.Close(ctx)
+		return err
+	}
+	cur.Close(ctx)
+
+	// Visitors are retained in a week if they visited on any day of it.
+	p := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{"time": bson.M{"$gte": since}}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"vid": "$visitor_id", "day": bucketExpr(day.Milliseconds())},
+		}}},
+	}
+	col := analyticsDB(dbname).Collection(host)
+	cur, err = col.Aggregate(ctx, p, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	type retention struct {
+		vid string
+		n   int
+	}
+	retained := map[retention]bool{}
+	for cur.Next(ctx) {
+		var r struct {
+			ID struct {
+				VisitorID string `bson:"vid"`
+				Day       int64  `bson:"day"`
+			} `bson:"_id"`
+		}
+		if err := cur.Decode(&r); err != nil {
+			return err
+		}
+		w0, ok := firstWeek[r.ID.VisitorID]
+		if !ok {
+			continue
+		}
+		n := int(time.UnixMilli(r.ID.Day).UTC().Truncate(week).Sub(w0) / week)
+		if n < 1 || n > len(cohorts[w0].Retained) {
+			continue
+		}
+		rt := retention{r.ID.VisitorID, n}
+		if !retained[rt] {
+			retained[rt] = true
+			cohorts[w0].Retained[n-1]++
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	models := make([]mongo.WriteModel, 0, len(cohorts))
+	for _, c := range cohorts {
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"host": c.Host, "week": c.Week}).
+			SetReplacement(c).
+			SetUpsert(true))
+	}
+	_, err = db.Database(metaname).Collection(colCohorts).
+		BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return err
+	}
+	_, err = db.Database(metaname).Collection(colTotals).UpdateOne(ctx,
+		bson.M{"_id": host}, bson.M{"$set": bson.M{"version": time.Now().UTC()}})
+	return err
+}
+
+// recentCohorts returns the most recent cohorts of a host, the latest
+// first.
+func recentCohorts(ctx context.Context, host string) ([]cohort, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "week", Value: -1}}).
+		SetLimit(cohortCount).
+		SetComment(requestID(ctx))
+	cur, err := db.Database(metaname).Collection(colCohorts).Find(ctx, bson.M{"host": host}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var cohorts []cohort
+	if err := cur.All(ctx, &cohorts); err != nil {
+		return nil, err
+	}
+	return cohorts, nil
+}
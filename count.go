@@ -0,0 +1,101 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// countMaxAge is how long shared caches may serve a count, in seconds.
+const countMaxAge = 300
+
+// count serves a statistic of a page as a plain number without recording a
+// visit, which server side and edge includes embed in pages as a counter
+// without the client, e.g.
+//
+//	/urlstat/count?url=https://changkun.de/blog/&stat=page_uv
+//
+// The statistic is one of statNames and page_pv by default. Counts are
+// cached for countMaxAge seconds and served stale while they are
+// revalidated. Private statistics of the site are forbidden unless the
+// request may see them, see seesPrivate.
+func count(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	q := r.URL.Query()
+	// Like badges, charts and counts that can be embedded anywhere are
+	// only served if they are signed, see badgeSecret.
+	if err = checkBadgeSignature(q); err != nil {
+		return
+	}
+	u, err := url.Parse(q.Get("url"))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		err = fmt.Errorf("%w: url must be an absolute http(s) URL", errInvalidURL)
+		return
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	name := q.Get("stat")
+	if name == "" {
+		name = "page_pv"
+	}
+	mode, field, ok := strings.Cut(name, "_")
+	if !ok || !isStatName(name) {
+		err = fmt.Errorf("%w: stat must be one of %s", errInvalidQuery, strings.Join(statNames, ", "))
+		return
+	}
+	ori := fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+	if !source.isAllowed(ori, true) {
+		err = fmt.Errorf("%w: %s", errOriginNotAllowed, ori)
+		return
+	}
+
+	colname := source.collection(u.Host)
+	settings, err := store.settings(r.Context(), colname)
+	if err != nil {
+		err = fmt.Errorf("failed to load settings: %w", err)
+		return
+	}
+	if settings.isPrivate(name) {
+		ok, err = seesPrivate(r, settings)
+		if err != nil {
+			return
+		}
+		if !ok {
+			err = fmt.Errorf("%w: %s of %s is private", errForbidden, name, u.Host)
+			return
+		}
+	}
+	pv, uv, err := store.countVisit(r.Context(), colname, u.Host, u.Path, mode)
+	if err != nil {
+		err = fmt.Errorf("failed to count %s: %w", name, err)
+		return
+	}
+	n := pv
+	if field == "uv" {
+		n = uv
+	}
+
+	// Counts with private statistics must not be cached by shared caches.
+	if len(settings.Private) > 0 {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, stale-while-revalidate=%d", countMaxAge, 12*countMaxAge))
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(strconv.FormatInt(n, 10)))
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCount(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	for _, v := range []visit{
+		{Path: "/blog/", IP: "1.2.3.4"},
+		{Path: "/blog/", IP: "1.2.3.4"},
+		{Path: "/blog/", IP: "5.6.7.8"},
+		{Path: "/", IP: "5.6.7.8"},
+	} {
+		v := v
+		m.saveVisit(context.Background(), "changkun.de", &v)
+	}
+
+	for _, tt := range []struct {
+		url  string
+		code int
+		body string
+	}{
+		{"/urlstat/count", http.StatusBadRequest, ""},
+		{"/urlstat/count?url=/blog/", http.StatusBadRequest, ""},
+		{"/urlstat/count?url=https://changkun.de/blog/&stat=page", http.StatusBadRequest, ""},
+		{"/urlstat/count?url=https://changkun.de/blog/&stat=page_xv", http.StatusBadRequest, ""},
+		{"/urlstat/count?url=https://example.com/", http.StatusForbidden, ""},
+		{"/urlstat/count?url=https://changkun.de/blog/", http.StatusOK, "3"},
+		{"/urlstat/count?url=https://changkun.de/blog/&stat=page_uv", http.StatusOK, "2"},
+		{"/urlstat/count?url=https://changkun.de&stat=site_pv", http.StatusOK, "4"},
+	} {
+		w := httptest.NewRecorder()
+		count(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.code {
+			t.Fatalf("%s: got %d, want %d: %s", tt.url, w.Code, tt.code, w.Body)
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		if got := w.Body.String(); got != tt.body {
+			t.Fatalf("%s: got %q, want %q", tt.url, got, tt.body)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=300, stale-while-revalidate=3600" {
+			t.Fatalf("%s: unexpected Cache-Control: %s", tt.url, cc)
+		}
+	}
+
+	m.register("changkun.de", siteSettings{Private: []string{"page_uv"}})
+	w := httptest.NewRecorder()
+	count(w, httptest.NewRequest("GET", "/urlstat/count?url=https://changkun.de/blog/&stat=page_uv", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("private count: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
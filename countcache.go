@@ -0,0 +1,130 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countCache caches the counts of pages, sites, and hosts, which are
+// queried on every page view and every badge. Recording a visit
+// invalidates the counts that include it, i.e. the count of its page,
+// host, and site, so that the cache can have a long TTL without showing
+// stale counts right after a burst of visits. Replicas only invalidate
+// their own caches, hence the TTL bounds how long visits recorded by other
+// replicas are missing from the counts.
+//
+// The cache is enabled by URLSTAT_COUNT_CACHE_TTL, e.g. 1m.
+type countCache struct {
+	storage
+	ttl time.Duration
+
+	mu    sync.Mutex
+	m     map[countKey]cachedCount
+	swept time.Time
+
+	hits, misses atomic.Int64
+}
+
+// countKey identifies a count. The page count only depends on the path,
+// the host count on the host, and the site count on the collection.
+type countKey struct {
+	col, host, path, mode string
+}
+
+type cachedCount struct {
+	pv, uv  int64
+	expires time.Time
+}
+
+func newCountKey(col, host, path, mode string) countKey {
+	switch mode {
+	case "page":
+		return countKey{col: col, path: path, mode: mode}
+	case "host":
+		return countKey{col: col, host: host, mode: mode}
+	default:
+		return countKey{col: col, mode: mode}
+	}
+}
+
+func newCountCache(s storage, ttl time.Duration) *countCache {
+	return &countCache{storage: s, ttl: ttl, m: map[countKey]cachedCount{}}
+}
+
+func init() {
+	v := os.Getenv("URLSTAT_COUNT_CACHE_TTL")
+	if v == "" {
+		return
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl < 0 {
+		log.Fatalf("invalid URLSTAT_COUNT_CACHE_TTL: %v", v)
+	}
+	if ttl > 0 {
+		store = newCountCache(store, ttl)
+	}
+}
+
+func (c *countCache) countVisit(ctx context.Context, col, host, path, mode string) (int64, int64, error) {
+	key := newCountKey(col, host, path, mode)
+	c.mu.Lock()
+	e, ok := c.m[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		c.hits.Add(1)
+		return e.pv, e.uv, nil
+	}
+	c.misses.Add(1)
+
+	pv, uv, err := c.storage.countVisit(ctx, col, host, path, mode)
+	if err != nil {
+		return pv, uv, err
+	}
+	c.mu.Lock()
+	c.m[key] = cachedCount{pv, uv, time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return pv, uv, nil
+}
+
+func (c *countCache) saveVisit(ctx context.Context, col string, v *visit) (string, error) {
+	host := v.Host
+	if host == "" {
+		host = col
+	}
+	defer c.invalidate(col, host, v.Path)
+	return c.storage.saveVisit(ctx, col, v)
+}
+
+func (c *countCache) countAnonymous(ctx context.Context, col, host, path string) error {
+	defer c.invalidate(col, host, path)
+	return c.storage.countAnonymous(ctx, col, host, path)
+}
+
+// invalidate removes the counts that include a visit of the path of the
+// host, which is stored in the collection. Expired counts are removed once
+// per TTL as well, so that the cache does not grow with paths that are
+// not visited anymore.
+func (c *countCache) invalidate(col, host, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.m, newCountKey(col, host, path, "page"))
+	delete(c.m, newCountKey(col, host, path, "host"))
+	delete(c.m, newCountKey(col, host, path, "site"))
+	if now := time.Now(); now.Sub(c.swept) > c.ttl {
+		for k, e := range c.m {
+			if now.After(e.expires) {
+				delete(c.m, k)
+			}
+		}
+		c.swept = now
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCountCache(t *testing.T) {
+	ctx := context.Background()
+	m := newMemStorage()
+	c := newCountCache(m, time.Hour)
+	count := func(path, mode string) int64 {
+		pv, _, err := c.countVisit(ctx, "changkun.de", "changkun.de", path, mode)
+		if err != nil {
+			t.Fatalf("cannot count: %v", err)
+		}
+		return pv
+	}
+	visit := func(s storage, path string) {
+		if _, err := s.saveVisit(ctx, "changkun.de", &visit{Path: path, IP: "1.2.3.4", Time: time.Now()}); err != nil {
+			t.Fatalf("cannot save visit: %v", err)
+		}
+	}
+
+	visit(c, "/a")
+	if count("/a", "page") != 1 || count("/b", "page") != 0 || count("", "site") != 1 {
+		t.Fatalf("counts before caching are wrong")
+	}
+	// Visits that bypass the cache, e.g. of other replicas, are not
+	// counted until the counts expire.
+	visit(m, "/b")
+	if n := count("/b", "page"); n != 0 {
+		t.Fatalf("cached page pv = %d, want 0", n)
+	}
+	// A recorded visit invalidates the page and the site, but not other
+	// pages.
+	visit(c, "/a")
+	if n := count("/a", "page"); n != 2 {
+		t.Fatalf("page pv after a visit = %d, want 2", n)
+	}
+	if n := count("", "site"); n != 3 {
+		t.Fatalf("site pv after a visit = %d, want 3", n)
+	}
+	if n := count("/b", "page"); n != 0 {
+		t.Fatalf("pv of another page = %d, want the cached 0", n)
+	}
+	if c.hits.Load() != 2 || c.misses.Load() != 5 {
+		t.Fatalf("hits, misses = %d, %d, want 2, 5", c.hits.Load(), c.misses.Load())
+	}
+}
@@ -1,127 +1,179 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
-	"runtime"
-	"sync"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"golang.org/x/sync/errgroup"
 )
 
+// records are the statistics of a host in the dashboard.
+type records struct {
+	Host string
+	// Days is the number of recent days of Records, or zero for all time.
+	Days    int
+	Records []record
+	// Entries and Exits are the top landing and exit pages of the
+	// last 30 days.
+	Entries []pageCount
+	Exits   []pageCount
+	// Cohorts is the weekly retention of visitors, latest first.
+	Cohorts []cohort
+	// Channels is the split of visits of the last 30 days by channel.
+	Channels []channelShare
+	// Broken is the top pages viewed with an error status in the last
+	// 30 days.
+	Broken []brokenPage
+}
+
+type record struct {
+	Path string `bson:"_id"`
+	PV   int64  `bson:"pv"`
+	UV   int64  `bson:"uv"`
+	// Spark is the sparkline of the daily pv of the page in the last
+	// sparkDays days, see sparkline.
+	Spark template.HTML `bson:"-"`
+}
+
+// dashboardWait is the time limit of the queries of a host.
+const dashboardWait = 60 * time.Second
+
+// dashboardDays is the default number of recent days of the dashboard.
+// All-time statistics scan whole collections, which is slow and may exceed
+// the memory limit of aggregations for large hosts, hence they are only
+// computed on request with ?days=all.
+const dashboardDays = 30
+
+// parseDashboardDays parses the days query parameter of the dashboard,
+// which is a number of days or all, i.e. zero.
+func parseDashboardDays(r *http.Request) (int, error) {
+	switch v := r.URL.Query().Get("days"); v {
+	case "":
+		return dashboardDays, nil
+	case "all":
+		return 0, nil
+	default:
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 || days > 365 {
+			return 0, fmt.Errorf("%w: days must be between 1 and 365, or all", errInvalidQuery)
+		}
+		return days, nil
+	}
+}
+
 // dashboard returns a simple dashboard view to view all existing statistics.
+// The page is a shell that lists the hosts, and each host is loaded from
+// its fragment, so that a slow host does not block the others.
 func dashboard(w http.ResponseWriter, r *http.Request) {
 	var err error
 	defer func() {
 		if err == nil {
 			return
 		}
-		http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		respondError(w, r, err)
 	}()
-	wait := 60 * time.Second
 
-	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	days, err := parseDashboardDays(r)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	cols, err := db.Database(dbname).ListCollectionNames(ctx, bson.D{})
+	cols, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
 	if err != nil {
 		err = fmt.Errorf("failed to list collections: %w", err)
 		return
 	}
-	type record struct {
-		Path string `bson:"_id"`
-		PV   int64  `bson:"pv"`
-		UV   int64  `bson:"uv"`
-	}
-	type records struct {
-		Host    string
-		Records []record
-	}
-
-	all := make([]records, 0, len(cols))
-	mu := sync.Mutex{}
-
-	g, ctx := errgroup.WithContext(ctx)
-	g.SetLimit(runtime.NumCPU())
-	for _, hostname := range cols {
-		hostname := hostname
-		g.Go(func() error {
-			start := time.Now()
-			defer func() {
-				log.Printf("running for host %v took %v", hostname, time.Since(start))
-			}()
-
-			col := db.Database(dbname).Collection(hostname)
-			// mongodb query:
-			//
-			// db.getCollection('golang.design').aggregate([
-			// {"$group": {
-			//     _id: {path: "$path", ip:"$ip"},
-			//     count: {"$sum": 1}}
-			// },
-			// {"$group": {
-			//     _id: "$_id.path",
-			//     uv: {$sum: 1},
-			//     pv: {$sum: "$count"}}
-			// },
-			// {"$sort": {'pv': -1, 'uv': -1}}], { allowDiskUse: true })
-			//
-			// TODO: currently golang.design is the slowest query and should
-			// be further optimized. Maybe batched queries?
-			p := mongo.Pipeline{
-				bson.D{
-					primitive.E{
-						Key: "$group", Value: bson.M{
-							"_id":   bson.M{"path": "$path", "ip": "$ip"},
-							"count": bson.M{"$sum": 1},
-						},
-					},
-				},
-				bson.D{
-					primitive.E{
-						Key: "$group", Value: bson.M{
-							"_id": "$_id.path",
-							"uv":  bson.M{"$sum": 1},
-							"pv":  bson.M{"$sum": "$count"},
-						},
-					},
-				},
-				bson.D{
-					primitive.E{Key: "$sort", Value: bson.M{"pv": -1, "uv": -1}},
-				},
-			}
-			opts := options.Aggregate().SetMaxTime(wait).SetAllowDiskUse(true)
-			var cur *mongo.Cursor
-			cur, err = col.Aggregate(ctx, p, opts)
-			if err != nil {
-				err = fmt.Errorf("failed to count visit: %w", err)
-				return err
-			}
-			var results []record
-			err = cur.All(ctx, &results)
-			if err != nil {
-				err = fmt.Errorf("failed to count visit: %w", err)
-				return err
+	sort.Strings(cols)
+	if cols, err = viewableHosts(ctx, cols); err != nil {
+		return
+	}
+	// The all-time totals are shown on top, which are counted by the
+	// rollup worker and need no aggregation.
+	sum, err := summarize(ctx)
+	if err != nil {
+		return
+	}
+	if multiUser() {
+		sum = sum.of(cols)
+	}
+	totals := map[string]*total{}
+	for i := range sum.Hosts {
+		totals[sum.Hosts[i].Host] = &sum.Hosts[i]
+	}
+	trending, err := trendingPages(ctx, "", time.Now(), 10)
+	if err != nil {
+		err = fmt.Errorf("failed to find trending pages: %w", err)
+		return
+	}
+	if multiUser() {
+		viewable := trending[:0]
+		for _, t := range trending {
+			if _, ok := totals[t.Host]; ok {
+				viewable = append(viewable, t)
 			}
+		}
+		trending = viewable
+	}
 
-			mu.Lock()
-			all = append(all, records{
-				Host:    hostname,
-				Records: results,
-			})
-			mu.Unlock()
-			return nil
-		})
+	t, err := template.ParseFS(publicFS, "dashboard.html")
+	if err != nil {
+		err = fmt.Errorf("failed to parse dashboard.html: %w", err)
+		return
 	}
-	if err = g.Wait(); err != nil {
+	err = t.Execute(w, struct {
+		Hosts    []string
+		Totals   map[string]*total
+		Summary  summary
+		Trending []trend
+		Days     int
+		// Draining is set if the replica shuts down for maintenance.
+		Draining bool
+	}{cols, totals, sum, trending, days, draining.Load()})
+	if err != nil {
+		err = fmt.Errorf("failed to render template: %w", err)
+	}
+}
+
+// dashboardFragment renders the statistics of a host as an HTML fragment
+// of the dashboard: /urlstat/dashboard/fragment/golang.design
+func dashboardFragment(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	host := strings.TrimPrefix(r.URL.Path, "/urlstat/dashboard/fragment/")
+	if host == "" || strings.Contains(host, "/") {
+		err = fmt.Errorf("%w: invalid host %q", errInvalidQuery, host)
+		return
+	}
+	days, err := parseDashboardDays(r)
+	if err != nil {
+		return
+	}
+	if err = checkView(r.Context(), host); err != nil {
+		return
+	}
+	rs, err := hostRecords(r.Context(), host, days)
+	if err != nil {
 		return
 	}
 
@@ -130,8 +182,157 @@ func dashboard(w http.ResponseWriter, r *http.Request) {
 		err = fmt.Errorf("failed to parse dashboard.html: %w", err)
 		return
 	}
-	err = t.Execute(w, struct{ All []records }{all})
+
+	// Fragments of large hosts list thousands of pages.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	var out io.Writer = w
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Vary", "Accept-Encoding")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	if err := t.ExecuteTemplate(out, "host", rs); err != nil {
+		// The response is already committed.
+		l.Printf("%s failed to render host: %v", requestID(r.Context()), err)
+	}
+}
+
+// hostRecords returns the dashboard statistics of a host. Pages are
+// counted in the given number of recent days, or all time if days is zero.
+func hostRecords(ctx context.Context, hostname string, days int) (records, error) {
+	start := time.Now()
+	defer func() {
+		log.Printf("running for host %v took %v", hostname, time.Since(start))
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, dashboardWait)
+	defer cancel()
+
+	field, err := uvFieldOf(ctx, hostname)
 	if err != nil {
-		err = fmt.Errorf("failed to render template: %w", err)
+		return records{}, err
+	}
+	col := analyticsDB(dbname).Collection(hostname)
+	// mongodb query:
+	//
+	// db.getCollection('golang.design').aggregate([
+	// {"$group": {
+	//     _id: {path: "$path", ip:"$ip"},
+	//     count: {"$sum": 1}}
+	// },
+	// {"$group": {
+	//     _id: "$_id.path",
+	//     uv: {$sum: 1},
+	//     pv: {$sum: "$count"}}
+	// },
+	// {"$sort": {'pv': -1, 'uv': -1}}], { allowDiskUse: true })
+	//
+	// TODO: currently golang.design is the slowest query and should
+	// be further optimized. Maybe batched queries?
+	//
+	// Unless all time is requested, visits are first matched by the time
+	// index, so that only recent visits are grouped.
+	var p mongo.Pipeline
+	if days > 0 {
+		since := time.Now().UTC().Truncate(day).Add(-time.Duration(days-1) * day)
+		p = append(p, bson.D{{Key: "$match", Value: bson.M{"time": bson.M{"$gte": since}}}})
+	}
+	p = append(p,
+		bson.D{
+			primitive.E{
+				Key: "$group", Value: bson.M{
+					"_id":   bson.M{"path": "$path", "uv": "$" + field},
+					"count": bson.M{"$sum": 1},
+				},
+			},
+		},
+		bson.D{
+			primitive.E{
+				Key: "$group", Value: bson.M{
+					"_id": "$_id.path",
+					"uv":  bson.M{"$sum": 1},
+					"pv":  bson.M{"$sum": "$count"},
+				},
+			},
+		},
+		bson.D{
+			primitive.E{Key: "$sort", Value: bson.M{"pv": -1, "uv": -1}},
+		},
+	)
+	opts := options.Aggregate().
+		SetMaxTime(dashboardWait).
+		SetAllowDiskUse(true).
+		SetComment(requestID(ctx))
+	aggregate := func(ctx context.Context, col *mongo.Collection) ([]record, error) {
+		cur, err := col.Aggregate(ctx, p, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count visit: %w", err)
+		}
+		var results []record
+		if err := cur.All(ctx, &results); err != nil {
+			return nil, fmt.Errorf("failed to count visit: %w", err)
+		}
+		return results, nil
+	}
+	results, err := aggregate(ctx, col)
+	if err != nil {
+		return records{}, err
+	}
+	// Pages with equal pv and uv are in any order, hence only the totals
+	// are compared.
+	compareShadow(ctx, "dashboard", sumRecords(results), func(ctx context.Context, client *mongo.Client) (interface{}, error) {
+		results, err := aggregate(ctx, client.Database(dbname).Collection(hostname))
+		return sumRecords(results), err
+	})
+
+	since := time.Now().UTC().Truncate(day).Add(-29 * day)
+	entries, err := topPages(ctx, hostname, "entries", since, 10)
+	if err != nil {
+		return records{}, fmt.Errorf("failed to count entries: %w", err)
+	}
+	exits, err := topPages(ctx, hostname, "exits", since, 10)
+	if err != nil {
+		return records{}, fmt.Errorf("failed to count exits: %w", err)
+	}
+	cohorts, err := recentCohorts(ctx, hostname)
+	if err != nil {
+		return records{}, fmt.Errorf("failed to find cohorts: %w", err)
+	}
+	channels, err := channelSplit(ctx, hostname, since)
+	if err != nil {
+		return records{}, fmt.Errorf("failed to count channels: %w", err)
+	}
+	broken, err := brokenPages(ctx, hostname, since, 10)
+	if err != nil {
+		return records{}, fmt.Errorf("failed to find broken pages: %w", err)
+	}
+	series, err := pathSeries(ctx, hostname, since)
+	if err != nil {
+		return records{}, fmt.Errorf("failed to find page series: %w", err)
+	}
+	for i := range results {
+		results[i].Spark = sparkline(seriesOf(series, results[i].Path))
+	}
+	return records{
+		Host:     hostname,
+		Days:     days,
+		Records:  results,
+		Entries:  entries,
+		Exits:    exits,
+		Cohorts:  cohorts,
+		Channels: channels,
+		Broken:   broken,
+	}, nil
+}
+
+// sumRecords returns the number of pages and their total pv and uv.
+func sumRecords(rs []record) [3]int64 {
+	sum := [3]int64{int64(len(rs))}
+	for _, r := range rs {
+		sum[1] += r.PV
+		sum[2] += r.UV
 	}
+	return sum
 }
@@ -0,0 +1,263 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// demo is set if urlstat runs with -demo, which serves the dashboard and
+// badges of synthetic visits from memory without a database, so that it
+// can be tried out without MongoDB. It is decided before the database is
+// connected, see runDemo.
+var demo = hasDemoFlag(os.Args[1:])
+
+func hasDemoFlag(args []string) bool {
+	for _, a := range args {
+		if a == "-demo" || a == "--demo" {
+			return true
+		}
+	}
+	return false
+}
+
+// demoHosts are the hosts of the synthetic visits of the demo.
+var demoHosts = []string{"example.com", "blog.example.com"}
+
+// demoIndex is the page of the demo that records its own visits and
+// shows its counts and a badge.
+const demoIndex = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>urlstat demo</title></head>
+<body>
+<h1>urlstat demo</h1>
+<p>This page is viewed <span id="urlstat-page-pv">?</span> times by
+<span id="urlstat-page-uv">?</span> visitors.</p>
+<p><img src="/urlstat?mode=github&repo=changkun/urlstat" alt="badge"></p>
+<p>See the <a href="/urlstat/dashboard">dashboard</a>.</p>
+<script async src="/urlstat/client.js"></script>
+</body>
+</html>
+`
+
+// runDemo serves the demo until the process is stopped. Visits are stored
+// in memory and lost on exit. Any localhost page can record visits, and
+// GitHub badges are served to browsers for any repository of changkun.
+func runDemo() {
+	m := newMemStorage()
+	seedDemo(m, time.Now(), rand.New(rand.NewSource(1)))
+	store = m
+	source = &allowed{Domain: []string{"http://127.0.0.1"}, GitHub: []string{"changkun"}}
+	githubRepo = func(loc string) (string, error) { return "https://github.com/" + loc, nil }
+
+	r := http.NewServeMux()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(demoIndex))
+	})
+	r.HandleFunc("/urlstat", recording)
+	r.HandleFunc("/urlstat/batch", recordBatch)
+	// The script reports to the demo rather than to changkun.de.
+	r.HandleFunc("/urlstat/client.js", serveClient("location.origin + '/urlstat'"))
+	r.HandleFunc("/urlstat/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		demoDashboard(w, r, m)
+	})
+	r.HandleFunc("/urlstat/dashboard/fragment/", func(w http.ResponseWriter, r *http.Request) {
+		demoFragment(w, r, m)
+	})
+
+	addr := os.Getenv("URLSTAT_ADDR")
+	if len(addr) == 0 {
+		addr = "localhost:8080"
+	}
+	l.Printf("changkun.de/urlstat demo is serving on http://%s, visits are kept in memory", addr)
+	if err := http.ListenAndServe(addr, requestIDs(logging(l)(r))); err != nil {
+		l.Fatalf("cannot listen on %s, err: %v\n", addr, err)
+	}
+}
+
+// seedDemo records synthetic visits of the demo hosts in the last 30
+// days until now.
+func seedDemo(m *memStorage, now time.Time, rnd *rand.Rand) {
+	paths := []string{"/", "/", "/", "/about", "/blog/", "/blog/hello-world", "/blog/zero-alloc", "/docs/", "/docs/install", "/missing"}
+	referrers := []string{"", "", "https://www.google.com/", "https://duckduckgo.com/", "https://twitter.com/", "https://news.ycombinator.com/"}
+	uas := []string{
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.1 Safari/605.1.15",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.93 Safari/537.36",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:88.0) Gecko/20100101 Firefox/88.0",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 14_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.1 Mobile/15E148 Safari/604.1",
+	}
+	ctx := context.Background()
+	start := now.UTC().Truncate(day).Add(-29 * day)
+	for _, host := range demoHosts {
+		m.register(host, siteSettings{})
+		var visits []visit
+		for d := 0; d < 30; d++ {
+			// Traffic grows over the month.
+			n := 40 + d*3 + rnd.Intn(40)
+			for i := 0; i < n; i++ {
+				v := visit{
+					Path: paths[rnd.Intn(len(paths))],
+					IP:   fmt.Sprintf("203.0.113.%d", rnd.Intn(120)),
+					UA:   uas[rnd.Intn(len(uas))],
+					Time: start.Add(time.Duration(d)*day + time.Duration(rnd.Int63n(int64(day)))),
+				}
+				if v.Time.After(now) {
+					continue
+				}
+				v.VisitorID = "demo-" + v.IP
+				v.Referer = referrers[rnd.Intn(len(referrers))]
+				if v.Path != "/" && rnd.Intn(2) == 0 {
+					v.Referer = "https://" + host + "/"
+				}
+				v.Channel = channelOf(v.Referer, host)
+				if v.Path == "/missing" {
+					v.Status = http.StatusNotFound
+				}
+				visits = append(visits, v)
+			}
+		}
+		sort.Slice(visits, func(i, j int) bool { return visits[i].Time.Before(visits[j].Time) })
+		for i := range visits {
+			m.saveVisit(ctx, host, &visits[i])
+		}
+	}
+}
+
+// demoRecords returns the dashboard statistics of a host of the demo in
+// the given number of recent days, or all time if days is zero.
+func (m *memStorage) demoRecords(host string, days int, now time.Time) records {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var since time.Time
+	if days > 0 {
+		since = now.UTC().Truncate(day).Add(-time.Duration(days-1) * day)
+	}
+	recent := now.UTC().Truncate(day).Add(-29 * day)
+	pages := map[string]*record{}
+	ips := map[[2]string]bool{}
+	channels := map[string]int64{}
+	series := map[string][]int64{}
+	var n int64
+	for _, v := range m.visits[host] {
+		if !v.Time.Before(since) {
+			p, ok := pages[v.Path]
+			if !ok {
+				p = &record{Path: v.Path}
+				pages[v.Path] = p
+			}
+			p.PV++
+			if k := [2]string{v.Path, v.IP}; !ips[k] {
+				ips[k] = true
+				p.UV++
+			}
+		}
+		if !v.Time.Before(recent) {
+			c := v.Channel
+			if c == "" {
+				c = "unknown"
+			}
+			channels[c]++
+			n++
+			addSeries(series, v.Path, recent, v.Time, 1)
+		}
+	}
+
+	rs := records{Host: host, Days: days}
+	for _, p := range pages {
+		p.Spark = sparkline(seriesOf(series, p.Path))
+		rs.Records = append(rs.Records, *p)
+	}
+	sort.Slice(rs.Records, func(i, j int) bool {
+		a, b := rs.Records[i], rs.Records[j]
+		if a.PV != b.PV {
+			return a.PV > b.PV
+		}
+		return a.Path < b.Path
+	})
+	for name, c := range channels {
+		rs.Channels = append(rs.Channels, channelShare{name, c, 100 * float64(c) / float64(n)})
+	}
+	sort.Slice(rs.Channels, func(i, j int) bool { return rs.Channels[i].Count > rs.Channels[j].Count })
+	return rs
+}
+
+// demoDashboard serves the dashboard shell of the demo.
+func demoDashboard(w http.ResponseWriter, r *http.Request, m *memStorage) {
+	days, err := parseDashboardDays(r)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	m.mu.Lock()
+	hosts := make([]string, 0, len(m.visits))
+	for h := range m.visits {
+		hosts = append(hosts, h)
+	}
+	m.mu.Unlock()
+	sort.Strings(hosts)
+
+	sum := summary{Hosts: []total{}}
+	totals := map[string]*total{}
+	for _, h := range hosts {
+		pv, uv, _ := m.countVisit(r.Context(), h, h, "", "site")
+		sum.Hosts = append(sum.Hosts, total{Host: h, PV: pv, UV: uv})
+		sum.PV += pv
+		sum.UV += uv
+	}
+	for i := range sum.Hosts {
+		totals[sum.Hosts[i].Host] = &sum.Hosts[i]
+	}
+
+	t, err := template.ParseFS(publicFS, "dashboard.html")
+	if err != nil {
+		respondError(w, r, fmt.Errorf("failed to parse dashboard.html: %w", err))
+		return
+	}
+	err = t.Execute(w, struct {
+		Hosts    []string
+		Totals   map[string]*total
+		Summary  summary
+		Trending []trend
+		Days     int
+		Draining bool
+	}{hosts, totals, sum, nil, days, false})
+	if err != nil {
+		l.Printf("failed to render template: %v", err)
+	}
+}
+
+// demoFragment serves the statistics of a host of the demo as an HTML
+// fragment of the dashboard.
+func demoFragment(w http.ResponseWriter, r *http.Request, m *memStorage) {
+	host := strings.TrimPrefix(r.URL.Path, "/urlstat/dashboard/fragment/")
+	days, err := parseDashboardDays(r)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	t, err := template.ParseFS(publicFS, "dashboard.html")
+	if err != nil {
+		respondError(w, r, fmt.Errorf("failed to parse dashboard.html: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.ExecuteTemplate(w, "host", m.demoRecords(host, days, time.Now())); err != nil {
+		l.Printf("failed to render host: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestDemoRecords(t *testing.T) {
+	m := newMemStorage()
+	now := time.Date(2021, 3, 30, 12, 0, 0, 0, time.UTC)
+	seedDemo(m, now, rand.New(rand.NewSource(1)))
+
+	for _, host := range demoHosts {
+		visits := m.visits[host]
+		if len(visits) == 0 {
+			t.Fatalf("no demo visits of %s", host)
+		}
+		if last := visits[len(visits)-1].Time; last.After(now) {
+			t.Fatalf("demo visit of %s in the future: %v", host, last)
+		}
+
+		rs := m.demoRecords(host, 0, now)
+		var pv, channels int64
+		for _, r := range rs.Records {
+			if r.UV < 1 || r.UV > r.PV {
+				t.Fatalf("%s%s has pv %d and uv %d", host, r.Path, r.PV, r.UV)
+			}
+			pv += r.PV
+		}
+		for _, c := range rs.Channels {
+			channels += c.Count
+		}
+		if pv != int64(len(visits)) || channels != pv {
+			t.Fatalf("%s: pv %d and channels %d of %d visits", host, pv, channels, len(visits))
+		}
+		if week := m.demoRecords(host, 7, now); len(week.Records) == 0 || week.Records[0].PV >= rs.Records[0].PV {
+			t.Fatalf("%s: records of a week are not fewer than of all time", host)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Custom dimensions are key/value pairs that a site attaches to its
+// visits, e.g. author=changkun or logged_in=true. Keys are lower case
+// letters, digits, and underscores, as they are field names in the
+// database.
+const (
+	maxDimensions     = 10
+	maxDimensionKey   = 32
+	maxDimensionValue = 100
+)
+
+// parseDimensions parses custom dimensions in the form of a URL query,
+// e.g. author=changkun&category=go, which is how clients report them in
+// the urlstat-dims header.
+func parseDimensions(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	v, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid dimensions: %v", errInvalidQuery, err)
+	}
+	dims := make(map[string]string, len(v))
+	for k, vs := range v {
+		dims[k] = vs[len(vs)-1]
+	}
+	return dims, checkDimensions(dims)
+}
+
+// queryDimensions returns the custom dimensions that a query filters by,
+// which are the dim.<key>=<value> parameters.
+func queryDimensions(v url.Values) (map[string]string, error) {
+	var dims map[string]string
+	for k, vs := range v {
+		if key := strings.TrimPrefix(k, "dim."); key != k {
+			if dims == nil {
+				dims = map[string]string{}
+			}
+			dims[key] = vs[0]
+		}
+	}
+	return dims, checkDimensions(dims)
+}
+
+// parseDimensionEntry parses an entry of a map<string, string> field of
+// custom dimensions of a protobuf message into the dimensions.
+func parseDimensionEntry(b string, dims map[string]string) error {
+	var k, v string
+	err := parseProto([]byte(b), func(field int, s string, _ uint64) {
+		switch field {
+		case 1:
+			k = s
+		case 2:
+			v = s
+		}
+	})
+	dims[k] = v
+	return err
+}
+
+// checkDimensions checks the number, keys, and values of custom
+// dimensions.
+func checkDimensions(dims map[string]string) error {
+	if len(dims) > maxDimensions {
+		return fmt.Errorf("%w: at most %d dimensions", errInvalidQuery, maxDimensions)
+	}
+	for k, v := range dims {
+		if !isDimensionKey(k) {
+			return fmt.Errorf("%w: invalid dimension %q", errInvalidQuery, k)
+		}
+		if v == "" || len(v) > maxDimensionValue {
+			return fmt.Errorf("%w: dimension %s must have 1 to %d bytes", errInvalidQuery, k, maxDimensionValue)
+		}
+	}
+	return nil
+}
+
+func isDimensionKey(k string) bool {
+	if k == "" || len(k) > maxDimensionKey {
+		return false
+	}
+	for _, b := range []byte(k) {
+		if (b < 'a' || b > 'z') && (b < '0' || b > '9') && b != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// dimensionFilter returns the filter of visits with the given custom
+// dimensions.
+func dimensionFilter(dims map[string]string) bson.M {
+	filter := bson.M{}
+	for k, v := range dims {
+		filter["dims."+k] = v
+	}
+	return filter
+}
+
+// dimensionCount is the pv and uv of a value of a custom dimension.
+type dimensionCount struct {
+	Value string `json:"value" bson:"_id"`
+	PV    int64  `json:"pv"    bson:"pv"`
+	UV    int64  `json:"uv"    bson:"uv"`
+}
+
+// dimensionCounts returns the n values of a custom dimension of a host with
+// the most visits since the given day until today, of the visits with the
+// given dimensions. Like reports of rollups, it only changes once a day.
+func dimensionCounts(ctx context.Context, host, dim string, dims map[string]string, since time.Time, n int) ([]dimensionCount, error) {
+	if !isDimensionKey(dim) {
+		return nil, fmt.Errorf("%w: invalid dimension %q", errInvalidQuery, dim)
+	}
+	field, err := uvFieldOf(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	match := dimensionFilter(dims)
+	match["time"] = bson.M{"$gte": since, "$lt": time.Now().UTC().Truncate(day)}
+	if _, ok := match["dims."+dim]; !ok {
+		match["dims."+dim] = bson.M{"$exists": true}
+	}
+	p := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"value": "$dims." + dim, "uv": "$" + field},
+			"pv":  bson.M{"$sum": 1},
+		}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id": "$_id.value",
+			"pv":  bson.M{"$sum": "$pv"},
+			"uv":  bson.M{"$sum": 1},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "pv", Value: -1}, {Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: n}},
+	}
+	col := analyticsDB(dbname).Collection(host)
+	cur, err := col.Aggregate(ctx, p, options.Aggregate().
+		SetAllowDiskUse(true).SetComment(requestID(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	counts := []dimensionCount{}
+	if err := cur.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
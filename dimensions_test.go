@@ -0,0 +1,67 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDimensions(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+		err  bool
+	}{
+		{"", nil, false},
+		{"author=changkun&logged_in=true", map[string]string{"author": "changkun", "logged_in": "true"}, false},
+		{"Author=changkun", nil, true},
+		{"dims.x=1", nil, true},
+		{"author=", nil, true},
+		{"a=1&b=1&c=1&d=1&e=1&f=1&g=1&h=1&i=1&j=1&k=1", nil, true},
+		{"author=" + strings.Repeat("x", maxDimensionValue+1), nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDimensions(tt.in)
+		if tt.err {
+			if !errors.Is(err, errInvalidQuery) {
+				t.Fatalf("parseDimensions(%q): got %v, want %v", tt.in, err, errInvalidQuery)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("parseDimensions(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+
+	dims, err := queryDimensions(url.Values{"dim.category": {"go"}, "days": {"7"}})
+	if err != nil || !reflect.DeepEqual(dims, map[string]string{"category": "go"}) {
+		t.Fatalf("queryDimensions = %v, %v", dims, err)
+	}
+}
+
+func TestRecordDimensions(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{})
+
+	r := httptest.NewRequest("GET", "/urlstat", nil)
+	r.Header.Set("urlstat-url", "https://changkun.de/blog/")
+	r.Header.Set("urlstat-dims", "author=changkun&category=go")
+	w := httptest.NewRecorder()
+	recording(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body.String())
+	}
+	want := map[string]string{"author": "changkun", "category": "go"}
+	if vs := m.visits["changkun.de"]; len(vs) != 1 || !reflect.DeepEqual(vs[0].Dimensions, want) {
+		t.Fatalf("recorded visits: %+v", vs)
+	}
+}
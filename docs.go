@@ -0,0 +1,144 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// docSite is a documentation site of packages, which shows the badges of
+// package READMEs. Badges are requested by the browsers of its visitors,
+// which send the site as referrer, or by the image proxy of the site.
+type docSite struct {
+	// Host is the hostname of the site, which is also the collection of
+	// the badge visits.
+	Host string
+	// Param is the query parameter of the package name.
+	Param string
+	// Referers are the hostnames of the site.
+	Referers []string
+	// ProxyUA are case-insensitive substrings of user agents of image
+	// proxies of the site.
+	ProxyUA []string
+	// allowed reports whether the package name is valid and its author
+	// is trusted.
+	allowed func(pkg string) (valid, trusted bool)
+}
+
+// docSites are the documentation sites by their badge mode, e.g.
+// /urlstat?mode=go&module=golang.design/x/reflect.
+var docSites = map[string]docSite{
+	"go": {
+		Host:     "pkg.go.dev",
+		Param:    "module",
+		Referers: []string{"pkg.go.dev"},
+		allowed:  allowedGoModule,
+	},
+	"npm": {
+		Host:     "www.npmjs.com",
+		Param:    "package",
+		Referers: []string{"www.npmjs.com", "npmjs.com"},
+		ProxyUA:  []string{"camo"},
+		allowed:  allowedNPMPackage,
+	},
+}
+
+// docMode records a visit of the documentation page of a package and
+// responds its badge, see docSite.
+func docMode(w http.ResponseWriter, r *http.Request, site docSite) (err error) {
+	if !site.requested(r) {
+		err = fmt.Errorf("%w: badge not requested by %s", errDocsRequired, site.Host)
+		return
+	}
+	pkg := r.URL.Query().Get(site.Param)
+	valid, trusted := site.allowed(pkg)
+	if !valid {
+		err = fmt.Errorf("%w: invalid %s %q", errInvalidQuery, site.Param, pkg)
+		return
+	}
+	if !trusted {
+		err = fmt.Errorf("%w: %s", errUserNotAllowed, pkg)
+		return
+	}
+	return badgeVisit(w, r, site.Host, "https://"+site.Host+"/"+pkg)
+}
+
+// requested reports whether the request comes from a page or the image
+// proxy of the site.
+func (s docSite) requested(r *http.Request) bool {
+	if u, err := url.Parse(r.Referer()); err == nil {
+		for _, h := range s.Referers {
+			if u.Hostname() == h {
+				return true
+			}
+		}
+	}
+	ua := strings.ToLower(r.UserAgent())
+	for _, p := range s.ProxyUA {
+		if strings.Contains(ua, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedGoModule reports whether the module path is valid, and whether
+// it is trusted, i.e. it is hosted on a trusted domain or belongs to a
+// trusted GitHub user.
+func allowedGoModule(path string) (valid, trusted bool) {
+	elems := strings.Split(path, "/")
+	if len(path) > 300 || len(elems) < 2 || !strings.Contains(elems[0], ".") {
+		return false, false
+	}
+	for _, e := range elems {
+		if e == "" || e == "." || e == ".." || strings.HasPrefix(e, ".") {
+			return false, false
+		}
+		for _, c := range e {
+			if !isPackageChar(c) && (c < 'A' || c > 'Z') {
+				return false, false
+			}
+		}
+	}
+	if elems[0] == "github.com" {
+		if len(elems) > 2 {
+			return true, source.isAllowedRepo(elems[1] + "/" + elems[2])
+		}
+		return true, source.isAllowed(elems[1], false)
+	}
+	return true, source.isAllowed("https://"+elems[0], true)
+}
+
+// allowedNPMPackage reports whether the package name is valid, and whether
+// it is trusted, i.e. it is in the scope of a trusted GitHub user, e.g.
+// @changkun/package. Unscoped packages are not trusted, as their authors
+// are unknown.
+func allowedNPMPackage(name string) (valid, trusted bool) {
+	scope, pkg, scoped := strings.Cut(name, "/")
+	if !scoped {
+		scope, pkg = "", name
+	}
+	if len(name) > 214 || pkg == "" || scoped && (!strings.HasPrefix(scope, "@") || len(scope) < 2) {
+		return false, false
+	}
+	for _, c := range strings.TrimPrefix(scope, "@") + pkg {
+		if !isPackageChar(c) {
+			return false, false
+		}
+	}
+	if strings.HasPrefix(pkg, ".") || strings.HasPrefix(pkg, "_") {
+		return false, false
+	}
+	return true, scoped && source.isAllowed(scope[1:], false)
+}
+
+// isPackageChar reports whether c is a character of package names and
+// module path elements.
+func isPackageChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune("-._~", c)
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowedPackages(t *testing.T) {
+	tests := []struct {
+		allowed        func(string) (bool, bool)
+		pkg            string
+		valid, trusted bool
+	}{
+		{allowedGoModule, "github.com/changkun/urlstat", true, true},
+		{allowedGoModule, "golang.design/x/reflect", true, true},
+		{allowedGoModule, "github.com/someone/urlstat", true, false},
+		{allowedGoModule, "example.com/x", true, false},
+		{allowedGoModule, "urlstat", false, false},
+		{allowedGoModule, "github.com/changkun/../x", false, false},
+		{allowedGoModule, "github.com/changkun/url stat", false, false},
+		{allowedNPMPackage, "@changkun/urlstat", true, true},
+		{allowedNPMPackage, "@someone/urlstat", true, false},
+		{allowedNPMPackage, "urlstat", true, false},
+		{allowedNPMPackage, "changkun/urlstat", false, false},
+		{allowedNPMPackage, "@changkun/URLStat", false, false},
+		{allowedNPMPackage, "@changkun/", false, false},
+	}
+	for _, tt := range tests {
+		valid, trusted := tt.allowed(tt.pkg)
+		if valid != tt.valid || trusted != tt.trusted {
+			t.Fatalf("%s: valid %v and trusted %v, want %v and %v", tt.pkg, valid, trusted, tt.valid, tt.trusted)
+		}
+	}
+}
+
+func TestDocsBadge(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+
+	tests := []struct {
+		query, referer, ua string
+		status             int
+	}{
+		{"mode=go&module=golang.design/x/reflect", "", "Mozilla/5.0", http.StatusForbidden},
+		{"mode=go&module=golang.design/x/reflect", "https://pkg.go.dev/", "Mozilla/5.0", http.StatusOK},
+		{"mode=go&module=example.com/x", "https://pkg.go.dev/", "Mozilla/5.0", http.StatusForbidden},
+		{"mode=go&module=x", "https://pkg.go.dev/", "Mozilla/5.0", http.StatusBadRequest},
+		{"mode=npm&package=@changkun/urlstat", "https://pkg.go.dev/", "Mozilla/5.0", http.StatusForbidden},
+		{"mode=npm&package=@changkun/urlstat", "https://www.npmjs.com/", "Mozilla/5.0", http.StatusOK},
+		{"mode=npm&package=@changkun/urlstat", "", "Camo Asset Proxy", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/urlstat?"+tt.query, nil)
+		r.Header.Set("User-Agent", tt.ua)
+		if tt.referer != "" {
+			r.Header.Set("Referer", tt.referer)
+		}
+		w := httptest.NewRecorder()
+		recording(w, r)
+		if w.Code != tt.status {
+			t.Fatalf("badge of %s from %q by %s: got %d %s, want %d", tt.query, tt.referer, tt.ua, w.Code, w.Body.String(), tt.status)
+		}
+	}
+	if n := len(m.visits["pkg.go.dev"]); n != 1 {
+		t.Fatalf("recorded %d visits of pkg.go.dev, want 1", n)
+	}
+	if n := len(m.visits["www.npmjs.com"]); n != 2 {
+		t.Fatalf("recorded %d visits of www.npmjs.com, want 2", n)
+	}
+}
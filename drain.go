@@ -0,0 +1,107 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set once the replica stops recording visits before it shuts
+// down. Visits are rejected as unavailable, hence clients and load
+// balancers retry them on another replica.
+var draining atomic.Bool
+
+// drainTick is how often drain checks whether visits are still being
+// recorded.
+const drainTick = 50 * time.Millisecond
+
+// drain stops recording new visits and waits until the visits that are
+// being recorded or wait to be recorded are saved, and the saved visits
+// that wait to be published to the sink are published, see queueVisit,
+// or until the context is done. It returns the number of visits that are
+// still queued.
+func drain(ctx context.Context) int {
+	draining.Store(true)
+	t := time.NewTicker(drainTick)
+	defer t.Stop()
+	for {
+		n := queued()
+		if n == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return n
+		case <-t.C:
+		}
+	}
+}
+
+// queued returns the number of visits that are being recorded, wait to
+// be recorded, or wait to be published.
+func queued() int {
+	return len(ingestLimiter.queued) + int(sinkPending.Load())
+}
+
+// drainStatus is the response of the drain endpoint.
+type drainStatus struct {
+	Draining bool `json:"draining"`
+	// Queued is the number of visits that are still being recorded or
+	// published.
+	Queued int `json:"queued"`
+}
+
+// adminDrain drains the replica before an orchestrated deploy, which
+// requires an admin API key:
+//
+//	GET  /urlstat/admin/drain  whether the replica drains
+//	POST /urlstat/admin/drain  stop recording visits and wait up to 30s for the queues
+//
+// Draining cannot be undone, the replica is expected to be stopped
+// afterwards.
+func adminDrain(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	key := adminKey(r)
+	ok, err := isAdmin(ctx, key)
+	if err != nil {
+		err = fmt.Errorf("failed to check admin key: %w", err)
+		return
+	}
+	if !ok {
+		err = errUnauthorized
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		_, err = runAdmin(r.WithContext(ctx), key, adminRequest{Action: "drain"})
+		if err != nil {
+			return
+		}
+	default:
+		err = fmt.Errorf("%w: %s %s", errInvalidQuery, r.Method, r.URL.Path)
+		return
+	}
+
+	b, _ := json.Marshal(drainStatus{draining.Load(), queued()})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
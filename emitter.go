@@ -0,0 +1,180 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// emitter emits a metric for each recorded visit to an external metric
+// collector, so that traffic can be observed in real time without
+// touching the database.
+type emitter interface {
+	visit(host string)
+}
+
+// emitters are configured by environment variables:
+//
+//	URLSTAT_STATSD_ADDR: address of a StatsD server, e.g. localhost:8125
+//	URLSTAT_OTLP_ENDPOINT: OTLP/HTTP endpoint, e.g. http://localhost:4318
+var emitters []emitter
+
+func init() {
+	if addr := os.Getenv("URLSTAT_STATSD_ADDR"); addr != "" {
+		e, err := newStatsdEmitter(addr)
+		if err != nil {
+			log.Fatalf("cannot connect to statsd: %v", err)
+		}
+		emitters = append(emitters, e)
+	}
+	if endpoint := os.Getenv("URLSTAT_OTLP_ENDPOINT"); endpoint != "" {
+		emitters = append(emitters, newOTLPEmitter(endpoint, 10*time.Second))
+	}
+}
+
+// emitVisit emits a visit of the given host to all configured emitters.
+func emitVisit(host string) {
+	for _, e := range emitters {
+		e.visit(host)
+	}
+}
+
+// statsdEmitter sends a counter per visit tagged by host using the
+// DogStatsD tag extension, e.g. urlstat.visits:1|c|#host:changkun.de.
+type statsdEmitter struct {
+	conn net.Conn
+}
+
+func newStatsdEmitter(addr string) (*statsdEmitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdEmitter{conn: conn}, nil
+}
+
+func (e *statsdEmitter) visit(host string) {
+	// Metrics are best effort, a lost packet is not worth an error.
+	fmt.Fprintf(e.conn, "urlstat.visits:1|c|#host:%s", host)
+}
+
+// otlpEmitter accumulates visit counters per host and periodically exports
+// them as a cumulative sum to an OpenTelemetry collector using OTLP/HTTP
+// with JSON encoding.
+type otlpEmitter struct {
+	endpoint string
+	client   *http.Client
+
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newOTLPEmitter(endpoint string, interval time.Duration) *otlpEmitter {
+	e := &otlpEmitter{
+		endpoint: endpoint + "/v1/metrics",
+		client:   &http.Client{Timeout: interval},
+		counts:   map[string]int64{},
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := e.export(); err != nil {
+				l.Printf("failed to export otlp metrics: %v", err)
+			}
+		}
+	}()
+	return e
+}
+
+func (e *otlpEmitter) visit(host string) {
+	e.mu.Lock()
+	e.counts[host]++
+	e.mu.Unlock()
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func newOTLPAttribute(k, v string) otlpAttribute {
+	a := otlpAttribute{Key: k}
+	a.Value.StringValue = v
+	return a
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsInt             string          `json:"asInt"`
+}
+
+func (e *otlpEmitter) export() error {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	start := strconv.FormatInt(startTime.UnixNano(), 10)
+
+	e.mu.Lock()
+	points := make([]otlpDataPoint, 0, len(e.counts))
+	for host, n := range e.counts {
+		points = append(points, otlpDataPoint{
+			Attributes:        []otlpAttribute{newOTLPAttribute("host", host)},
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			AsInt:             strconv.FormatInt(n, 10),
+		})
+	}
+	e.mu.Unlock()
+	if len(points) == 0 {
+		return nil
+	}
+
+	// See https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+	type m = map[string]interface{}
+	body := m{"resourceMetrics": []m{{
+		// Counters are cumulative per process, replicas are told apart by
+		// their instance ID.
+		"resource": m{"attributes": []otlpAttribute{
+			newOTLPAttribute("service.name", "urlstat"),
+			newOTLPAttribute("service.instance.id", instanceID),
+		}},
+		"scopeMetrics": []m{{
+			"scope": m{"name": "changkun.de/x/urlstat"},
+			"metrics": []m{{
+				"name":        "urlstat.visits",
+				"description": "Recorded visits of a host.",
+				"unit":        "1",
+				"sum": m{
+					"aggregationTemporality": 2, // cumulative
+					"isMonotonic":            true,
+					"dataPoints":             points,
+				},
+			}},
+		}},
+	}}}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
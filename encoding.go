@@ -0,0 +1,251 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// responseFormat encodes responses in a media type.
+type responseFormat struct {
+	contentType string
+	encode      func(w io.Writer, v interface{}) error
+}
+
+// responseFormats are the formats of reports, which are requested by
+// ?format= or the Accept header. CSV and XML are tables of the rows of a
+// report, see tableOf.
+var responseFormats = map[string]responseFormat{
+	"json": {"application/json", func(w io.Writer, v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}},
+	"csv": {"text/csv; charset=utf-8", writeCSV},
+	"xml": {"application/xml; charset=utf-8", writeXML},
+}
+
+// mediaFormats maps media types of the Accept header to formats.
+var mediaFormats = map[string]string{
+	"application/json": "json",
+	"text/csv":         "csv",
+	"application/xml":  "xml",
+	"text/xml":         "xml",
+	"*/*":              "json",
+	"application/*":    "json",
+	"text/*":           "csv",
+}
+
+// negotiateFormat returns the requested format of a response. The format
+// parameter takes precedence over the Accept header, as spreadsheets and
+// browsers cannot set headers. JSON is the default: CSV and XML are only
+// picked if they are ranked above JSON, which wildcards stand for, and
+// above the types that are not supported. Browsers, which prefer HTML and
+// accept XML before */*, hence get JSON.
+func negotiateFormat(r *http.Request) (string, error) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		if _, ok := responseFormats[f]; !ok {
+			return "", fmt.Errorf("%w: unsupported format %s", errInvalidQuery, f)
+		}
+		return f, nil
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return "json", nil
+	}
+
+	// top is the format of the media type with the highest quality, the
+	// first one if several have the same, or empty if it is not supported.
+	// supported is the supported one with the highest quality.
+	top, topQ := "", 0.0
+	supported, supportedQ := "", 0.0
+	jsonQ := 0.0
+	for _, s := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		f := mediaFormats[mt]
+		if q > topQ {
+			top, topQ = f, q
+		}
+		if f != "" && q > supportedQ {
+			supported, supportedQ = f, q
+		}
+		if f == "json" && q > jsonQ {
+			jsonQ = q
+		}
+	}
+	switch {
+	case jsonQ > 0 && (top == "" || jsonQ >= topQ):
+		return "json", nil
+	case top != "":
+		return top, nil
+	case supported != "":
+		return supported, nil
+	}
+	return "", fmt.Errorf("%w: %s", errNotAcceptable, accept)
+}
+
+// respond writes a report in the requested format. Nothing is written if
+// it fails, so that the caller can respond the error.
+func respond(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	name, err := negotiateFormat(r)
+	if err != nil {
+		return err
+	}
+	f := responseFormats[name]
+	buf := &bytes.Buffer{}
+	if err := f.encode(buf, v); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Add("Vary", "Accept")
+	w.Write(buf.Bytes())
+	return nil
+}
+
+// tableOf returns a struct or a slice of structs as a table, whose
+// columns are the JSON names of the struct fields. Cells are the field
+// values, which are strings except for slices.
+func tableOf(v interface{}) (columns []string, rows [][]interface{}, err error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if !rv.IsValid() {
+		return nil, nil, fmt.Errorf("%w: no table", errNotAcceptable)
+	}
+	elems := []reflect.Value{rv}
+	if rv.Kind() == reflect.Slice {
+		elems = elems[:0]
+		for i := 0; i < rv.Len(); i++ {
+			elems = append(elems, reflect.Indirect(rv.Index(i)))
+		}
+	}
+	t := rv.Type()
+	if rv.Kind() == reflect.Slice {
+		t = t.Elem()
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, nil, fmt.Errorf("%w: %s is not a table", errNotAcceptable, t)
+	}
+
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		columns = append(columns, name)
+		fields = append(fields, i)
+	}
+	for _, e := range elems {
+		row := make([]interface{}, len(fields))
+		for j, i := range fields {
+			row[j] = cellOf(e.Field(i))
+		}
+		rows = append(rows, row)
+	}
+	return columns, rows, nil
+}
+
+// cellOf returns a value as a cell of a table. Times are formatted in
+// RFC 3339, slices are returned as slices of cells.
+func cellOf(v reflect.Value) interface{} {
+	switch x := v.Interface().(type) {
+	case time.Time:
+		return x.Format(time.RFC3339)
+	case fmt.Stringer:
+		return x.String()
+	}
+	if v.Kind() == reflect.Slice {
+		cells := make([]string, v.Len())
+		for i := range cells {
+			cells[i] = fmt.Sprint(cellOf(v.Index(i)))
+		}
+		return cells
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// writeCSV writes a table with a header. The cells of a slice are joined
+// by semicolons, e.g. the retained visitors of a cohort.
+func writeCSV(w io.Writer, v interface{}) error {
+	columns, rows, err := tableOf(v)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(columns)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, c := range row {
+			if cells, ok := c.([]string); ok {
+				record[i] = strings.Join(cells, ";")
+			} else {
+				record[i] = c.(string)
+			}
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeXML writes a table as <rows><row><column>cell</column>...</row></rows>.
+// The cells of a slice are repeated elements of the column.
+func writeXML(w io.Writer, v interface{}) error {
+	columns, rows, err := tableOf(v)
+	if err != nil {
+		return err
+	}
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	root := xml.StartElement{Name: xml.Name{Local: "rows"}}
+	enc.EncodeToken(root)
+	for _, row := range rows {
+		enc.EncodeToken(xml.StartElement{Name: xml.Name{Local: "row"}})
+		for i, c := range row {
+			cells, ok := c.([]string)
+			if !ok {
+				cells = []string{c.(string)}
+			}
+			for _, cell := range cells {
+				if err := enc.EncodeElement(cell, xml.StartElement{Name: xml.Name{Local: columns[i]}}); err != nil {
+					return err
+				}
+			}
+		}
+		enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: "row"}})
+	}
+	enc.EncodeToken(root.End())
+	return enc.Flush()
+}
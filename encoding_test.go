@@ -0,0 +1,72 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		query  string
+		accept string
+		want   string
+		err    error
+	}{
+		{"", "", "json", nil},
+		{"", "text/csv", "csv", nil},
+		{"", "application/xml;q=0.9, text/csv;q=0.5", "xml", nil},
+		{"", "text/html,application/xhtml+xml,*/*;q=0.8", "json", nil},
+		{"", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "json", nil},
+		{"", "application/xml;q=0.9, */*;q=0.8", "xml", nil},
+		{"", "text/csv, application/json", "json", nil},
+		{"", "text/html, text/csv;q=0.5", "csv", nil},
+		{"", "text/csv;q=0", "", errNotAcceptable},
+		{"", "image/png", "", errNotAcceptable},
+		{"?format=csv", "application/json", "csv", nil},
+		{"?format=yaml", "", "", errInvalidQuery},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/urlstat/stats/entries"+tt.query, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		got, err := negotiateFormat(r)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Fatalf("negotiateFormat(%q, %q) = %q, %v, want %q, %v",
+				tt.query, tt.accept, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestRespondFormats(t *testing.T) {
+	week := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	cohorts := []cohort{{Host: "golang.design", Week: week, Size: 10, Retained: []int64{4, 2}}}
+	tests := map[string]string{
+		"csv": "host,week,size,retained\ngolang.design,2021-03-01T00:00:00Z,10,4;2\n",
+		"xml": "<rows><row><host>golang.design</host><week>2021-03-01T00:00:00Z</week>" +
+			"<size>10</size><retained>4</retained><retained>2</retained></row></rows>",
+		"json": `[{"host":"golang.design","week":"2021-03-01T00:00:00Z","size":10,"retained":[4,2]}]`,
+	}
+	for format, want := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/urlstat/stats/cohorts?format="+format, nil)
+		if err := respond(w, r, cohorts); err != nil {
+			t.Fatalf("cannot respond %s: %v", format, err)
+		}
+		if got := strings.TrimPrefix(w.Body.String(), "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"); got != want {
+			t.Fatalf("%s response = %q, want %q", format, got, want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/urlstat/stats/entries?format=csv", nil)
+	if err := respond(httptest.NewRecorder(), r, map[string]int{}); !errors.Is(err, errNotAcceptable) {
+		t.Fatalf("respond CSV of a map: %v, want errNotAcceptable", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// enrichment is a stage of the enrichment pipeline, which adds what it
+// derives from the report of a visit to the visit before it is stored.
+// Stages run in the order of the pipeline, hence a stage sees what the
+// stages before it added.
+type enrichment struct {
+	name   string
+	enrich func(v *visit, rep *visitReport, s *siteSettings)
+}
+
+// enrichments are the stages that pipelines are composed of. A custom
+// stage is added by registering it here.
+var enrichments = []enrichment{
+	// channel classifies the referrer, see channelOf.
+	{"channel", func(v *visit, rep *visitReport, s *siteSettings) {
+		v.Channel = channelOf(v.Referer, rep.URL.Host)
+	}},
+	// hints stores the client hints under the sampling of the site, see
+	// siteSettings.ClientHints.
+	{"hints", func(v *visit, rep *visitReport, s *siteSettings) {
+		v.Hints = rep.Hints.sample(s.sampledHints())
+	}},
+	// country stores the country of the visitor that the CDN in front of
+	// urlstat found by GeoIP, see readCountry.
+	{"country", func(v *visit, rep *visitReport, s *siteSettings) {
+		v.Country = rep.Country
+	}},
+	// client stores the browser and the operating system from the client
+	// hints, or the user agent without them.
+	{"client", func(v *visit, rep *visitReport, s *siteSettings) {
+		v.Browser, v.System = browserOf(v.UA), systemOf(v.UA)
+		if h := rep.Hints; h != nil {
+			v.Browser = h.Brand
+			if h.Platform != "" {
+				v.System = h.Platform
+			}
+		}
+	}},
+	// bot flags visits of user agents that identify as bots, which are
+	// still recorded unless the user agent is blocked.
+	{"bot", func(v *visit, rep *visitReport, s *siteSettings) {
+		v.Bot = deviceOf(v.UA) == "bot"
+	}},
+}
+
+// defaultPipeline is the enrichment pipeline of a deployment that does
+// not configure one.
+const defaultPipeline = "channel,hints"
+
+// pipeline is the enrichment pipeline of the deployment, which is the
+// comma separated list of stages of URLSTAT_ENRICH, e.g.
+// URLSTAT_ENRICH=channel,hints,country,client,bot. An empty list disables
+// enrichment.
+var pipeline []enrichment
+
+func init() {
+	s, ok := os.LookupEnv("URLSTAT_ENRICH")
+	if !ok {
+		s = defaultPipeline
+	}
+	var err error
+	pipeline, err = parsePipeline(s)
+	if err != nil {
+		log.Fatalf("invalid URLSTAT_ENRICH: %v", err)
+	}
+}
+
+// parsePipeline returns the pipeline of a comma separated list of stages.
+func parsePipeline(s string) ([]enrichment, error) {
+	var p []enrichment
+	seen := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate stage %s", name)
+		}
+		seen[name] = true
+		i := 0
+		for i < len(enrichments) && enrichments[i].name != name {
+			i++
+		}
+		if i == len(enrichments) {
+			return nil, fmt.Errorf("unknown stage %s", name)
+		}
+		p = append(p, enrichments[i])
+	}
+	return p, nil
+}
+
+// enrich runs the enrichment pipeline on a visit.
+func enrich(v *visit, rep *visitReport, s *siteSettings) {
+	for _, e := range pipeline {
+		e.enrich(v, rep, s)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestParsePipeline(t *testing.T) {
+	p, err := parsePipeline(" country, client ,bot")
+	if err != nil || len(p) != 3 || p[0].name != "country" || p[1].name != "client" || p[2].name != "bot" {
+		t.Fatalf("unexpected pipeline: %v, %v", p, err)
+	}
+	if p, err := parsePipeline(""); err != nil || len(p) != 0 {
+		t.Fatalf("unexpected empty pipeline: %v, %v", p, err)
+	}
+	for _, s := range []string{"geo", "channel,channel"} {
+		if _, err := parsePipeline(s); err == nil {
+			t.Fatalf("invalid pipeline %q is accepted", s)
+		}
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{})
+	old := pipeline
+	defer func() { pipeline = old }()
+
+	u, _ := url.Parse("https://changkun.de/blog/")
+	rep := visitReport{
+		URL:     u,
+		IP:      "203.0.113.1",
+		Country: "DE",
+		UA:      "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+		Referer: "https://www.google.com/",
+		Hints:   &clientHints{Brand: "Brave", Version: "118", Platform: "Linux"},
+	}
+	for _, s := range []string{"", "channel,hints,country,client,bot"} {
+		pipeline, _ = parsePipeline(s)
+		if _, err := recordVisit(context.Background(), rep); err != nil {
+			t.Fatalf("cannot record visit: %v", err)
+		}
+	}
+	vs := m.visits["changkun.de"]
+	if v := vs[0]; v.Channel != "" || v.Hints != nil || v.Country != "" || v.Browser != "" || v.Bot {
+		t.Fatalf("visit without enrichment: %+v", v)
+	}
+	v := vs[1]
+	if v.Channel != channelOf(rep.Referer, u.Host) || v.Hints == nil || v.Country != "DE" ||
+		v.Browser != "Brave" || v.System != "Linux" || !v.Bot {
+		t.Fatalf("enriched visit: %+v", v)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// apiError is an error that is safe to respond to clients. Its code is
+// stable and can be relied on by clients, the message is human readable.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string { return e.message }
+
+// Errors that are responded to clients. Handlers wrap them with internal
+// details, e.g. fmt.Errorf("%w: %v", errInvalidURL, err), which are only
+// logged but never responded.
+var (
+	errInvalidURL       = &apiError{http.StatusBadRequest, "invalid_url", "cannot parse url"}
+	errInvalidQuery     = &apiError{http.StatusBadRequest, "invalid_query", "invalid query"}
+	errInvalidRepo      = &apiError{http.StatusBadRequest, "invalid_repo", "invalid input, require username/repo"}
+	errUnauthorized     = &apiError{http.StatusUnauthorized, "unauthorized", "unauthorized"}
+	errOriginNotAllowed = &apiError{http.StatusForbidden, "origin_not_allowed", "origin not allowed"}
+	errOriginMismatch   = &apiError{http.StatusForbidden, "origin_mismatch", "origin does not match reported url"}
+	errHostUnregistered = &apiError{http.StatusForbidden, "host_not_registered", "host is not registered"}
+	errGitHubRequired   = &apiError{http.StatusForbidden, "github_required", "origin not allowed, require github"}
+	errUserNotAllowed   = &apiError{http.StatusForbidden, "user_not_allowed", "username is not allowed, please contact @changkun"}
+	errDocsRequired     = &apiError{http.StatusForbidden, "docs_required", "badge not requested by a documentation site"}
+	errForbidden        = &apiError{http.StatusForbidden, "forbidden", "no access to the site"}
+	errBadSignature     = &apiError{http.StatusForbidden, "invalid_signature", "badge URL is not signed"}
+	errRepoNotFound     = &apiError{http.StatusNotFound, "repo_not_found", "not a GitHub repository"}
+	errNoTombstone      = &apiError{http.StatusNotFound, "tombstone_not_found", "deleted data not found or expired"}
+	errNotAcceptable    = &apiError{http.StatusNotAcceptable, "not_acceptable", "unsupported format, require json, csv, or xml"}
+	errNoInvite         = &apiError{http.StatusNotFound, "invite_not_found", "invite not found or expired"}
+	errNotBlocked       = &apiError{http.StatusNotFound, "actor_not_blocked", "actor is not blocked"}
+	errInternal         = &apiError{http.StatusInternalServerError, "internal_error", "internal server error"}
+	errGitHubFailed     = &apiError{http.StatusBadGateway, "github_unavailable", "failed to request github"}
+	errUnavailable      = &apiError{http.StatusServiceUnavailable, "unavailable", "service is temporarily unavailable"}
+	errOverloaded       = &apiError{http.StatusTooManyRequests, "overloaded", "too many requests, please retry later"}
+	errRateLimited      = &apiError{http.StatusTooManyRequests, "rate_limited", "rate limit of the API key exceeded"}
+)
+
+// retryAfter is the time after which clients may retry a request that
+// failed because the service was overloaded or unavailable.
+const retryAfter = 5 * time.Second
+
+// respondError logs the error of the request and responds it to the client
+// as a JSON error with the request ID, for instance:
+//
+//	{"code":"origin_not_allowed","message":"origin not allowed","request_id":"..."}
+//
+// Errors that are not an apiError are responded as internal errors without
+// any details.
+func respondError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *apiError
+	if !errors.As(err, &e) {
+		if errors.Is(err, context.DeadlineExceeded) ||
+			mongo.IsTimeout(err) || mongo.IsNetworkError(err) {
+			e = errUnavailable
+		} else {
+			e = errInternal
+		}
+	}
+
+	id := requestID(r.Context())
+	l.Printf("%s %s %s: %v", id, r.Method, r.URL.Path, err)
+
+	b, _ := json.Marshal(struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id"`
+	}{e.code, e.message, id})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Handlers that know when to retry set Retry-After themselves.
+	if (e.status == http.StatusTooManyRequests || e.status == http.StatusServiceUnavailable) &&
+		w.Header().Get("Retry-After") == "" {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	}
+	w.WriteHeader(e.status)
+	w.Write(b)
+}
+
+// joinErrors returns an error of all non-nil errors, or nil if there are
+// none, as errors.Join of Go 1.20 does.
+func joinErrors(errs ...error) error {
+	e := &joinedError{}
+	for _, err := range errs {
+		if err != nil {
+			e.errs = append(e.errs, err)
+		}
+	}
+	if len(e.errs) == 0 {
+		return nil
+	}
+	return e
+}
+
+// joinedError is the error of joinErrors, whose message has a line per
+// error.
+type joinedError struct{ errs []error }
+
+func (e *joinedError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e *joinedError) Unwrap() []error { return e.errs }
@@ -0,0 +1,178 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportCommand exports raw visits to files, one file per host per month:
+//
+//	<out>/<host>/<yyyy-mm>.<format>
+//
+// Parquet files can be queried directly by analytic tools, e.g. DuckDB:
+//
+//	SELECT path, count(*) FROM 'export/blog.changkun.de/*.parquet' GROUP BY path;
+//
+// Usage:
+//
+//	urlstat export -format parquet [-host blog.changkun.de] [-month 2021-03] -out export
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "jsonl", "export format, jsonl or parquet")
+	host := flags.String("host", "", "only export the given host, export all hosts if empty")
+	month := flags.String("month", "", "only export the given month (yyyy-mm), export all if empty")
+	out := flags.String("out", "export", "output directory")
+	flags.Parse(args)
+
+	write, ok := exportFormats[*format]
+	if !ok {
+		return fmt.Errorf("unsupported export format: %s", *format)
+	}
+
+	filter := bson.M{}
+	if *month != "" {
+		m, err := time.Parse("2006-01", *month)
+		if err != nil {
+			return errors.New("invalid month, require yyyy-mm")
+		}
+		filter["time"] = bson.M{"$gte": m, "$lt": m.AddDate(0, 1, 0)}
+	}
+
+	ctx := context.Background()
+	hosts := []string{*host}
+	if *host == "" {
+		var err error
+		hosts, err = db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+		if err != nil {
+			return fmt.Errorf("failed to list collections: %w", err)
+		}
+	}
+
+	for _, h := range hosts {
+		dir := filepath.Join(*out, h)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		col := db.Database(dbname).Collection(h)
+		err := visitsByMonth(ctx, col, filter, func(m time.Time, next nextVisit) error {
+			name := filepath.Join(dir, m.Format("2006-01")+"."+*format)
+			f, err := os.Create(name)
+			if err != nil {
+				return err
+			}
+			n := 0
+			bw := bufio.NewWriter(f)
+			err = write(bw, func() (*visit, error) {
+				v, err := next()
+				if v != nil {
+					n++
+				}
+				return v, err
+			})
+			if err == nil {
+				err = bw.Flush()
+			}
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("failed to write %s: %w", name, err)
+			}
+			l.Printf("exported %d visits to %s", n, name)
+			return f.Close()
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", h, err)
+		}
+	}
+	return nil
+}
+
+// nextVisit returns the next visit of a sequence of visits, or nil after
+// the last one.
+type nextVisit func() (*visit, error)
+
+// exportFormats are the supported file formats of exported visits.
+var exportFormats = map[string]func(w io.Writer, next nextVisit) error{
+	"jsonl":   writeJSONL,
+	"parquet": writeParquet,
+}
+
+// writeJSONL writes the visits of next as JSON lines.
+func writeJSONL(w io.Writer, next nextVisit) error {
+	enc := json.NewEncoder(w)
+	for {
+		v, err := next()
+		if err != nil || v == nil {
+			return err
+		}
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+}
+
+// visitsByMonth calls fn for each month that has visits matching the
+// filter, in chronological order, with the visits of the month. Visits are
+// read from the cursor as fn consumes them, hence months of any size are
+// processed without holding them in memory. Visits that fn does not
+// consume are skipped.
+func visitsByMonth(ctx context.Context, col *mongo.Collection, filter bson.M, fn func(month time.Time, next nextVisit) error) error {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: 1}}).
+		SetAllowDiskUse(true)
+	cur, err := col.Find(ctx, filter, opts)
+	if err != nil {
+		return fmt.Errorf("failed to find visits: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	read := func() (*visit, error) {
+		if !cur.Next(ctx) {
+			return nil, cur.Err()
+		}
+		v := &visit{}
+		if err := cur.Decode(v); err != nil {
+			return nil, fmt.Errorf("failed to decode visit: %w", err)
+		}
+		return v, nil
+	}
+	monthOf := func(v *visit) time.Time {
+		t := v.Time.UTC()
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	// pending is the visit that is read next, which begins the next month
+	// once the visits of a month are consumed.
+	pending, err := read()
+	for err == nil && pending != nil {
+		month := monthOf(pending)
+		err = fn(month, func() (*visit, error) {
+			if pending == nil || !monthOf(pending).Equal(month) {
+				return nil, nil
+			}
+			v := pending
+			var err error
+			pending, err = read()
+			return v, err
+		})
+		for err == nil && pending != nil && monthOf(pending).Equal(month) {
+			pending, err = read()
+		}
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Failover of the database is checked by pinging the connected database
+// every dbProbeInterval, and fails over after dbFailoverAfter failed pings
+// in a row.
+const (
+	dbProbeInterval = 10 * time.Second
+	dbProbeTimeout  = 2 * time.Second
+	dbFailoverAfter = 3
+)
+
+// dbURIs returns the URIs of the databases in the order of preference,
+// which are configured by URLSTAT_DB_URIS, e.g.
+//
+//	URLSTAT_DB_URIS=mongodb://redirdb:27017,mongodb://standby:27017
+//
+// Members of a replica set are better listed in a single URI, e.g.
+// mongodb://a:27017,b:27017/?replicaSet=rs0, in which case the driver fails
+// over to the new primary by itself. The list is for databases that do
+// not know each other, e.g. a standby that is restored from backups.
+func dbURIs() []string {
+	v := os.Getenv("URLSTAT_DB_URIS")
+	if v == "" {
+		return []string{dburi}
+	}
+	var uris []string
+	for _, uri := range strings.Split(v, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+// connectDB connects to the first database of the URIs that responds to
+// a ping, and returns its client and URI. If none responds, it connects to
+// the first one, as the driver reconnects once it is back, e.g. after a
+// restart of the database.
+func connectDB(ctx context.Context, uris []string) (*mongo.Client, string, error) {
+	if len(uris) == 0 {
+		return nil, "", fmt.Errorf("no database URI")
+	}
+	// A single database is not probed, there is no other to choose.
+	for i := 0; len(uris) > 1 && i < len(uris); i++ {
+		client, err := probeDB(ctx, uris[i])
+		if err != nil {
+			l.Printf("database %s is unavailable: %v", redactURI(uris[i]), err)
+			continue
+		}
+		return client, uris[i], nil
+	}
+	opts, err := clientOptions(uris[0])
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := mongo.Connect(ctx, opts)
+	return client, uris[0], err
+}
+
+// probeDB connects to the database of the URI and pings it. The client is
+// disconnected if the database does not respond.
+func probeDB(ctx context.Context, uri string) (*mongo.Client, error) {
+	opts, err := clientOptions(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	pctx, cancel := context.WithTimeout(ctx, dbProbeTimeout)
+	defer cancel()
+	if err := client.Ping(pctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
+
+// watchDB pings the connected database of the given URI until the context
+// is canceled, and returns true if it should fail over, i.e. the database
+// has not responded dbFailoverAfter times in a row while another database
+// of the URIs does. The service then shuts down and the orchestrator
+// restarts it, which connects to the database that responds, see
+// connectDB. Shutting down drains visits that are being recorded first,
+// whereas swapping the client of a running process would race with them.
+func watchDB(ctx context.Context, uri string, uris []string) bool {
+	if len(uris) < 2 {
+		return false
+	}
+	t := time.NewTicker(dbProbeInterval)
+	defer t.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.C:
+		}
+		pctx, cancel := context.WithTimeout(ctx, dbProbeTimeout)
+		err := db.Ping(pctx, nil)
+		cancel()
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		l.Printf("database %s did not respond (%d/%d): %v", redactURI(uri), failures, dbFailoverAfter, err)
+		if failures < dbFailoverAfter {
+			continue
+		}
+		for _, other := range uris {
+			if other == uri {
+				continue
+			}
+			client, err := probeDB(ctx, other)
+			if err != nil {
+				continue
+			}
+			client.Disconnect(context.Background())
+			l.Printf("failing over to database %s", redactURI(other))
+			return true
+		}
+	}
+}
+
+// redactURI returns the URI without its password for logs. URIs with
+// several hosts are not valid URLs, hence the user info is cut by hand.
+func redactURI(uri string) string {
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok {
+		return uri
+	}
+	if user, hosts, ok := strings.Cut(rest, "@"); ok {
+		name, _, _ := strings.Cut(user, ":")
+		return scheme + "://" + name + ":xxxxx@" + hosts
+	}
+	return uri
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// feedLag is how long visits are held back from the feed. IDs of visits
+// are assigned by the replicas that record them before they are inserted,
+// see saveVisit, hence a visit that a replica inserts late, e.g. after it
+// retried the insert during a failover, may have a smaller ID than a visit
+// that is already delivered. saveVisit gives up after 10 seconds, and the
+// lag leaves a generous margin over it for inserts that the server applies
+// after the client gave up, so that consumers do not miss visits.
+const feedLag = time.Minute
+
+// feedPage is a page of the change-data feed. NextCursor is always set,
+// also if the page is empty, and the next page is requested with
+// ?since=<next_cursor>. More reports whether visits follow right away,
+// otherwise consumers poll the cursor later.
+type feedPage struct {
+	Data       []feedVisit `json:"data"`
+	NextCursor string      `json:"next_cursor"`
+	More       bool        `json:"more"`
+}
+
+// feedVisit is a visit of the feed with its ID, by which consumers
+// deduplicate visits that they receive twice, e.g. if they crash before
+// they store the cursor.
+type feedVisit struct {
+	ID string `json:"id"`
+	visit
+}
+
+// apiFeed returns a page of the visits of a host in the order they were
+// inserted, after the visit of the cursor ?since=, or from the first visit
+// without it. Unlike apiVisits, which pages through visits by their time,
+// the feed delivers visits that are imported or recorded late too, hence
+// downstream systems process new visits by following the cursor.
+//
+// The feed only delivers inserts. Deleted visits, e.g. by retention or
+// cleanup, and updated visits, e.g. by recompute-uv, are not delivered,
+// and neither are visits that are restored from tombstones or archives or
+// migrated, as they keep their earlier IDs.
+func apiFeed(r *http.Request, host string) (interface{}, error) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		return nil, err
+	}
+	since := primitive.NilObjectID
+	if c := r.URL.Query().Get("since"); c != "" {
+		since, err = parseFeedCursor(c)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid cursor", errInvalidQuery)
+		}
+	}
+	until := feedUntil(time.Now())
+
+	ctx := r.Context()
+	col, _ := storedVisits(host)
+	cur, err := col.Find(ctx, hostFilter(host, bson.M{"_id": bson.M{"$gt": since, "$lt": until}}),
+		options.Find().
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetLimit(int64(limit)+1).
+			SetComment(requestID(ctx)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find visits: %w", err)
+	}
+	var docs []struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		Visit visit              `bson:",inline"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to find visits: %w", err)
+	}
+
+	page := feedPage{Data: make([]feedVisit, 0, len(docs))}
+	if len(docs) > limit {
+		docs, page.More = docs[:limit], true
+	}
+	for _, d := range docs {
+		page.Data = append(page.Data, feedVisit{ID: d.ID.Hex(), visit: d.Visit})
+		since = d.ID
+	}
+	page.NextCursor = feedCursor(since)
+	return page, nil
+}
+
+// feedUntil returns the bound of the IDs of visits that are delivered at
+// the given time, see feedLag. IDs of the same second as the bound are
+// larger than it, hence a second is delivered as a whole.
+func feedUntil(now time.Time) primitive.ObjectID {
+	return primitive.NewObjectIDFromTimestamp(now.Add(-feedLag))
+}
+
+// feedCursor returns the cursor after the visit of an ID in base64url. The
+// cursor of the beginning of the feed is that of the nil ID.
+func feedCursor(id primitive.ObjectID) string {
+	return base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+func parseFeedCursor(s string) (primitive.ObjectID, error) {
+	var id primitive.ObjectID
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != len(id) {
+		return id, fmt.Errorf("invalid cursor length %d", len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFeedCursor(t *testing.T) {
+	for _, id := range []primitive.ObjectID{primitive.NilObjectID, primitive.NewObjectID()} {
+		got, err := parseFeedCursor(feedCursor(id))
+		if err != nil || got != id {
+			t.Fatalf("parseFeedCursor(%s) = %v, %v, want %v", feedCursor(id), got, err, id)
+		}
+	}
+	for _, s := range []string{"!", "bm9wZQ", primitive.NewObjectID().Hex()} {
+		if _, err := parseFeedCursor(s); err == nil {
+			t.Fatalf("parseFeedCursor(%q) did not fail", s)
+		}
+	}
+}
+
+func TestFeedUntil(t *testing.T) {
+	now := time.Now()
+	until := feedUntil(now)
+	if old := primitive.NewObjectIDFromTimestamp(now.Add(-feedLag - time.Second)); old.Hex() >= until.Hex() {
+		t.Fatalf("visit before the lag is held back: %s >= %s", old.Hex(), until.Hex())
+	}
+	if recent := primitive.NewObjectID(); recent.Hex() <= until.Hex() {
+		t.Fatalf("recent visit is delivered: %s <= %s", recent.Hex(), until.Hex())
+	}
+}
+
+func TestFeedPageJSON(t *testing.T) {
+	b, err := json.Marshal(feedPage{
+		Data:       []feedVisit{{ID: "6060a1b2c3d4e5f601234567", visit: visit{Path: "/blog/"}}},
+		NextCursor: feedCursor(primitive.NilObjectID),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"id":"6060a1b2c3d4e5f601234567"`, `"path":"/blog/"`, `"next_cursor":"AAAAAAAAAAAAAAAA"`, `"more":false`} {
+		if !strings.Contains(string(b), want) {
+			t.Fatalf("feed page %s does not contain %s", b, want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Content blockers block requests to known analytics hosts and paths. A
+// site can instead serve urlstat as a first party, i.e. proxy paths of its
+// own origin to urlstat, which are configured by environment variables:
+//
+//	URLSTAT_SCRIPT_PATH: the path of client.js, e.g. /s.js
+//	URLSTAT_RECORD_PATH: the path of the recording endpoint, e.g. /p, batches are recorded at /p/batch
+//
+// client.js that is served at the script path reports to the record path
+// of the origin of the page.
+var (
+	scriptPath = os.Getenv("URLSTAT_SCRIPT_PATH")
+	recordPath = os.Getenv("URLSTAT_RECORD_PATH")
+)
+
+func init() {
+	for env, p := range map[string]string{
+		"URLSTAT_SCRIPT_PATH": scriptPath,
+		"URLSTAT_RECORD_PATH": recordPath,
+	} {
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") || p == "/urlstat" || strings.HasPrefix(p, "/urlstat/") {
+			log.Fatalf("invalid %s: %v", env, p)
+		}
+	}
+}
+
+// defaultEndpoint is the endpoint of client.js unless it is served at a
+// first-party path or the demo.
+const defaultEndpoint = "'https://www.changkun.de/urlstat'"
+
+// serveClient serves client.js, which reports to the given JavaScript
+// expression of its endpoint, or the default endpoint if it is empty.
+func serveClient(endpoint string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, _ := fs.ReadFile(publicFS, "client.js")
+		if endpoint != "" {
+			b = bytes.Replace(b, []byte(defaultEndpoint), []byte(endpoint), 1)
+		}
+		w.Header().Set("Content-Type", "text/javascript")
+		w.Header().Set("Accept-CH", acceptCH)
+		w.Write(b)
+	}
+}
+
+// handleFirstParty registers the first-party paths of client.js and the
+// recording endpoint if they are configured.
+func handleFirstParty(mux *http.ServeMux) {
+	if scriptPath != "" {
+		endpoint := ""
+		if recordPath != "" {
+			endpoint = "location.origin + '" + recordPath + "'"
+		}
+		mux.HandleFunc(scriptPath, serveClient(endpoint))
+	}
+	if recordPath != "" {
+		mux.HandleFunc(recordPath, ingestLimiter.limit(recording))
+		mux.HandleFunc(recordPath+"/batch", recordBatch)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeClient(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{"", defaultEndpoint},
+		{"location.origin + '/p'", "let endpoint = location.origin + '/p'"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		serveClient(tt.endpoint)(w, httptest.NewRequest(http.MethodGet, "/s.js", nil))
+		body := w.Body.String()
+		if !strings.Contains(body, tt.want) {
+			t.Fatalf("client.js with endpoint %q does not contain %q", tt.endpoint, tt.want)
+		}
+		if tt.endpoint != "" && strings.Contains(body, defaultEndpoint) {
+			t.Fatalf("client.js with endpoint %q still reports to %s", tt.endpoint, defaultEndpoint)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/javascript" {
+			t.Fatalf("unexpected content type: %v", ct)
+		}
+	}
+}
+
+func TestHandleFirstParty(t *testing.T) {
+	defer func(s, r string) { scriptPath, recordPath = s, r }(scriptPath, recordPath)
+	scriptPath, recordPath = "/s.js", "/p"
+
+	mux := http.NewServeMux()
+	handleFirstParty(mux)
+	for _, p := range []string{"/s.js", "/p", "/p/batch"} {
+		if _, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, p, nil)); pattern != p {
+			t.Fatalf("%s is not served, got pattern %q", p, pattern)
+		}
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/s.js", nil))
+	if !strings.Contains(w.Body.String(), "location.origin + '/p'") {
+		t.Fatalf("client.js at the script path does not report to the record path")
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// transition is a page to page navigation of visitors in a session.
+type transition struct {
+	From  string
+	To    string
+	Count int
+}
+
+// flow renders the most common page transitions of a host as a Sankey
+// diagram: /urlstat/dashboard/flow?host=golang.design&days=30
+func flow(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		err = fmt.Errorf("%w: missing host", errInvalidQuery)
+		return
+	}
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > 365 {
+			err = fmt.Errorf("%w: days must be between 1 and 365", errInvalidQuery)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	if err = checkView(ctx, host); err != nil {
+		return
+	}
+
+	col := analyticsDB(dbname).Collection(host)
+	since := time.Now().UTC().Add(-time.Duration(days) * day)
+	ts, err := countTransitions(ctx, col, since, 30)
+	if err != nil {
+		err = fmt.Errorf("failed to count transitions: %w", err)
+		return
+	}
+
+	t, err := template.ParseFS(publicFS, "flow.html")
+	if err != nil {
+		err = fmt.Errorf("failed to parse flow.html: %w", err)
+		return
+	}
+	err = t.Execute(w, struct {
+		Host string
+		Days int
+		Flow sankey
+	}{host, days, layoutSankey(ts, 960, 600)})
+	if err != nil {
+		err = fmt.Errorf("failed to render template: %w", err)
+	}
+}
+
+// countTransitions returns the n most common transitions between pages of
+// the collection in sessions since the given time.
+func countTransitions(ctx context.Context, col *mongo.Collection, since time.Time, n int) ([]transition, error) {
+	counts := map[[2]string]int{}
+	err := forEachSession(ctx, col, since, time.Time{}, func(session []visit) {
+		for i := 1; i < len(session); i++ {
+			if from, to := session[i-1].Path, session[i].Path; from != to {
+				counts[[2]string{from, to}]++
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ts := make([]transition, 0, len(counts))
+	for k, c := range counts {
+		ts = append(ts, transition{From: k[0], To: k[1], Count: c})
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		if ts[i].Count != ts[j].Count {
+			return ts[i].Count > ts[j].Count
+		}
+		return ts[i].From+ts[i].To < ts[j].From+ts[j].To
+	})
+	if len(ts) > n {
+		ts = ts[:n]
+	}
+	return ts, nil
+}
+
+// sankey is the layout of a two column Sankey diagram, where source pages
+// are on the left and target pages are on the right.
+type sankey struct {
+	Width  float64
+	Height float64
+	Nodes  []sankeyNode
+	Links  []sankeyLink
+}
+
+type sankeyNode struct {
+	Path  string
+	Count int
+	X, Y  float64
+	H     float64
+	Left  bool
+}
+
+type sankeyLink struct {
+	From, To string
+	Count    int
+	// Path is the SVG path of the link, stroked with Width.
+	Path  string
+	Width float64
+}
+
+const (
+	sankeyNodeWidth = 12
+	sankeyNodeGap   = 8
+	sankeyLabelRoom = 280
+)
+
+// layoutSankey computes the layout of the given transitions in a diagram
+// of the given size.
+func layoutSankey(ts []transition, width, height float64) sankey {
+	s := sankey{Width: width, Height: height}
+	if len(ts) == 0 {
+		return s
+	}
+
+	// Nodes are ordered by their total count, the largest on top.
+	var left, right []*sankeyNode
+	index := map[string]*sankeyNode{}
+	node := func(side *[]*sankeyNode, path string, isLeft bool) *sankeyNode {
+		key := strconv.FormatBool(isLeft) + path
+		if n, ok := index[key]; ok {
+			return n
+		}
+		n := &sankeyNode{Path: path, Left: isLeft}
+		index[key] = n
+		*side = append(*side, n)
+		return n
+	}
+	total := 0
+	for _, t := range ts {
+		node(&left, t.From, true).Count += t.Count
+		node(&right, t.To, false).Count += t.Count
+		total += t.Count
+	}
+	nodes := len(left)
+	if len(right) > nodes {
+		nodes = len(right)
+	}
+	scale := (height - float64(nodes-1)*sankeyNodeGap) / float64(total)
+
+	place := func(side []*sankeyNode, x float64) {
+		sort.SliceStable(side, func(i, j int) bool { return side[i].Count > side[j].Count })
+		y := 0.0
+		for _, n := range side {
+			n.X, n.Y, n.H = x, y, float64(n.Count)*scale
+			y += n.H + sankeyNodeGap
+		}
+	}
+	place(left, sankeyLabelRoom)
+	place(right, width-sankeyLabelRoom-sankeyNodeWidth)
+
+	// Links leave and enter nodes stacked in the order of transitions.
+	out := map[*sankeyNode]float64{}
+	in := map[*sankeyNode]float64{}
+	for _, t := range ts {
+		from, to := index["true"+t.From], index["false"+t.To]
+		w := float64(t.Count) * scale
+		y0 := from.Y + out[from] + w/2
+		y1 := to.Y + in[to] + w/2
+		out[from] += w
+		in[to] += w
+
+		x0, x1 := from.X+sankeyNodeWidth, to.X
+		mx := (x0 + x1) / 2
+		s.Links = append(s.Links, sankeyLink{
+			From:  t.From,
+			To:    t.To,
+			Count: t.Count,
+			Path:  fmt.Sprintf("M%.1f,%.1fC%.1f,%.1f %.1f,%.1f %.1f,%.1f", x0, y0, mx, y0, mx, y1, x1, y1),
+			Width: w,
+		})
+	}
+	for _, n := range append(left, right...) {
+		s.Nodes = append(s.Nodes, *n)
+	}
+	return s
+}
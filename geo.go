@@ -0,0 +1,46 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// countryHeaders are the headers with the country of the visitor that CDNs
+// and load balancers in front of urlstat set from their GeoIP data, in the
+// order of preference. Like X-Forwarded-For, they are trusted as is.
+var countryHeaders = []string{
+	"CF-IPCountry",              // Cloudflare
+	"CloudFront-Viewer-Country", // Amazon CloudFront
+	"X-Appengine-Country",       // Google App Engine
+	"X-Country-Code",            // e.g. nginx with the GeoIP2 module
+}
+
+// readCountry returns the ISO 3166-1 alpha-2 code of the country of the
+// visitor of the request, or an empty string if it is unknown.
+func readCountry(r *http.Request) string {
+	for _, h := range countryHeaders {
+		if c := parseCountry(r.Header.Get(h)); c != "" {
+			return c
+		}
+	}
+	return ""
+}
+
+// parseCountry returns the upper case country code, or an empty string if
+// it is not a code. XX and ZZ are used for unknown countries.
+func parseCountry(v string) string {
+	c := strings.ToUpper(strings.TrimSpace(v))
+	if len(c) != 2 || c == "XX" || c == "ZZ" {
+		return ""
+	}
+	for _, b := range []byte(c) {
+		if (b < 'A' || b > 'Z') && (b < '0' || b > '9') {
+			return ""
+		}
+	}
+	return c
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadCountry(t *testing.T) {
+	tests := []struct {
+		header, value, want string
+	}{
+		{"CF-IPCountry", "de", "DE"},
+		{"CF-IPCountry", "XX", ""},
+		{"CF-IPCountry", "T1", "T1"},
+		{"CloudFront-Viewer-Country", "CN", "CN"},
+		{"X-Country-Code", "Germany", ""},
+		{"X-Forwarded-For", "203.0.113.1", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/urlstat", nil)
+		r.Header.Set(tt.header, tt.value)
+		if got := readCountry(r); got != tt.want {
+			t.Fatalf("readCountry(%s: %s) = %q, want %q", tt.header, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestExcludeCountries(t *testing.T) {
+	s := siteSettings{ExcludeCountries: []string{"vn", "T1"}}
+	if err := s.validate(); err != nil {
+		t.Fatalf("cannot validate settings: %v", err)
+	}
+	if !s.excludes("203.0.113.1", "VN", "/") || !s.excludes("203.0.113.1", "T1", "/") {
+		t.Fatalf("visits of excluded countries are recorded")
+	}
+	if s.excludes("203.0.113.1", "DE", "/") || s.excludes("203.0.113.1", "", "/") {
+		t.Fatalf("visits of other or unknown countries are excluded")
+	}
+
+	s = siteSettings{ExcludeCountries: []string{"Vietnam"}}
+	if err := s.validate(); err == nil {
+		t.Fatalf("invalid country code is valid")
+	}
+}
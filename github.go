@@ -1,11 +1,18 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
 	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func githubMode(w http.ResponseWriter, r *http.Request) (err error) {
@@ -13,47 +20,48 @@ func githubMode(w http.ResponseWriter, r *http.Request) (err error) {
 
 	// GitHub uses camo, see:
 	// https://docs.github.com/en/authentication/keeping-your-account-and-data-secure/about-anonymized-urls
-	if !strings.Contains(ua, "github-camo") {
-		err = errors.New("origin not allowed, require github")
+	// The demo serves badges to browsers.
+	if !demo && !strings.Contains(ua, "github-camo") {
+		err = fmt.Errorf("%w: %s", errGitHubRequired, ua)
 		return
 	}
 
 	locs, ok := r.URL.Query()["repo"]
 	if !ok {
-		err = errors.New("missing location query parameter")
+		err = fmt.Errorf("%w: missing repo query parameter", errInvalidRepo)
 		return
 	}
 	loc := locs[0]
 	ss := strings.Split(loc, "/")
 	if len(ss) != 2 {
-		err = errors.New("invalid input, require username/repo")
+		err = fmt.Errorf("%w: %s", errInvalidRepo, loc)
 		return
 	}
 
-	// Only allow specified users, maybe allow more in the future.
-	if !source.isAllowed(ss[0], false) {
-		err = errors.New("username is not allowed, please contact @changkun")
+	// Only allow specified users and repositories, see allowed.GitHub.
+	if !source.isAllowedRepo(loc) {
+		err = fmt.Errorf("%w: %s", errUserNotAllowed, loc)
 		return
 	}
 
-	// Currently we always perform a reuqest to github and double check
-	// if the repo exists. This is necessary because a repo might not
-	// exist, moved, or deleted.
-	repoPath := fmt.Sprintf("%s/%s", "https://github.com", loc)
-	resp, err := http.Get(repoPath)
+	repoPath, err := githubRepo(loc)
 	if err != nil {
-		err = fmt.Errorf("failed to request github: %w", err)
 		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK &&
-		resp.StatusCode != http.StatusMovedPermanently {
-		err = fmt.Errorf("%s is not a GitHub repository", repoPath)
+
+	return badgeVisit(w, r, "github.com", repoPath)
+}
+
+// badgeVisit records a visit of a badge of the page in the collection,
+// and responds the badge with the pv of the page.
+func badgeVisit(w http.ResponseWriter, r *http.Request, col, page string) (err error) {
+	label, err := badgeLabel(r.URL.Query())
+	if err != nil {
 		return
 	}
-	// Figure out the new location if the repo is moved
-	if resp.StatusCode == http.StatusMovedPermanently {
-		repoPath = resp.Header.Get("Location")
+	theme, err := badgeThemeOf(r.URL.Query())
+	if err != nil {
+		return
 	}
 
 	var cookieVid string
@@ -65,12 +73,11 @@ func githubMode(w http.ResponseWriter, r *http.Request) (err error) {
 	}
 
 	var vid string
-	col := db.Database(dbname).Collection("github.com")
-	vid, err = saveVisit(r.Context(), col, &visit{
+	vid, err = store.saveVisit(r.Context(), col, &visit{
 		VisitorID: cookieVid,
-		Path:      repoPath,
+		Path:      page,
 		IP:        readIP(r),
-		UA:        ua,
+		UA:        r.UserAgent(),
 		Time:      time.Now().UTC(),
 	})
 	if err != nil {
@@ -81,13 +88,13 @@ func githubMode(w http.ResponseWriter, r *http.Request) (err error) {
 		w.Header().Set("Set-Cookie", urlstatCookieVid+"="+vid)
 	}
 
-	pv, _, err := countVisit(r.Context(), col, repoPath, "page")
+	pv, _, err := store.countVisit(r.Context(), col, col, page, "page")
 	if err != nil {
 		err = fmt.Errorf("failed to count visit: %w", err)
 		return
 	}
 
-	badge, err := drawer.RenderBytes("visitors", fmt.Sprintf("%d", pv), colorBlue)
+	badge, err := drawer.RenderBytes(label, fmt.Sprintf("%d", pv), colorBlue, theme)
 	if err != nil {
 		err = fmt.Errorf("failed to render stat badge: %w", err)
 		return
@@ -96,3 +103,83 @@ func githubMode(w http.ResponseWriter, r *http.Request) (err error) {
 	w.Write(badge)
 	return nil
 }
+
+// githubRepo returns the URL of a GitHub repository, i.e. username/repo.
+//
+// Currently we always perform a reuqest to github and double check
+// if the repo exists. This is necessary because a repo might not
+// exist, moved, or deleted. Tests replace it to not depend on GitHub.
+var githubRepo = func(loc string) (string, error) {
+	repoPath := fmt.Sprintf("%s/%s", "https://github.com", loc)
+	resp, err := http.Get(repoPath)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errGitHubFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusMovedPermanently {
+		return "", fmt.Errorf("%w: %s", errRepoNotFound, repoPath)
+	}
+	// Figure out the new location if the repo is moved
+	if resp.StatusCode == http.StatusMovedPermanently {
+		repoPath = resp.Header.Get("Location")
+	}
+	return repoPath, nil
+}
+
+// githubName matches the names of GitHub users and repositories.
+var githubName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,100}$`)
+
+// githubTimeseries returns the daily badge views of a GitHub repository in
+// recent days, see parseStatsValues, from the rollups of github.com, whose
+// paths are the URLs of repositories. GitHub names are case-insensitive
+// and badges keep the case of their URL, hence the rollups of all cases of
+// the repository are summed, where a visitor of two cases counts twice.
+// Days without views are included, so that they can be charted as is.
+func githubTimeseries(ctx context.Context, owner, repo string, v url.Values) ([]rollup, error) {
+	if !githubName.MatchString(owner) || !githubName.MatchString(repo) {
+		return nil, fmt.Errorf("%w: %s/%s", errInvalidRepo, owner, repo)
+	}
+	q, err := parseStatsValues("github.com", v)
+	if err != nil {
+		return nil, err
+	}
+	page := "https://github.com/" + owner + "/" + repo
+	p := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{
+			"host": q.Host,
+			"day":  bson.M{"$gte": q.Since},
+			"path": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(page) + "$", Options: "i"},
+		}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id": "$day",
+			"pv":  bson.M{"$sum": "$pv"},
+			"uv":  bson.M{"$sum": "$uv"},
+		}}},
+	}
+	col := db.Database(metaname).Collection(colRollups)
+	cur, err := col.Aggregate(ctx, p, options.Aggregate().SetComment(requestID(ctx)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate rollups: %w", err)
+	}
+	var days []struct {
+		Day time.Time `bson:"_id"`
+		PV  int64     `bson:"pv"`
+		UV  int64     `bson:"uv"`
+	}
+	if err := cur.All(ctx, &days); err != nil {
+		return nil, fmt.Errorf("failed to aggregate rollups: %w", err)
+	}
+	today := time.Now().UTC().Truncate(day)
+	series := make([]rollup, 0, int(today.Sub(q.Since)/day)+1)
+	for d := q.Since; !d.After(today); d = d.Add(day) {
+		series = append(series, rollup{Host: q.Host, Path: page, Day: d})
+	}
+	for _, d := range days {
+		if i := int(d.Day.UTC().Sub(q.Since) / day); i >= 0 && i < len(series) {
+			series[i].PV += d.PV
+			series[i].UV += d.UV
+		}
+	}
+	return series, nil
+}
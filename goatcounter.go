@@ -0,0 +1,171 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// importCommand imports visits exported from another statistic service
+// into the collection of the given host.
+//
+//	urlstat import -format goatcounter -host blog.changkun.de export.csv
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "goatcounter", "format of the import file")
+	host := flags.String("host", "", "hostname that the imported visits belong to")
+	flags.Parse(args)
+
+	if *host == "" || flags.NArg() != 1 {
+		return errors.New("usage: urlstat import -format goatcounter -host <hostname> <file>")
+	}
+	if *format != "goatcounter" {
+		return fmt.Errorf("unsupported import format: %s", *format)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("cannot open import file: %w", err)
+	}
+	defer f.Close()
+
+	col := db.Database(dbname).Collection(*host)
+	n, err := importGoatCounter(context.Background(), col, f)
+	if err != nil {
+		return err
+	}
+	l.Printf("imported %d visits to %s", n, *host)
+	return nil
+}
+
+// goatcounterNamespace is used to derive stable visitor IDs from GoatCounter
+// session IDs, so that importing the same export twice maps a session to
+// the same visitor.
+var goatcounterNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://www.goatcounter.com"))
+
+// importGoatCounter reads a GoatCounter CSV export (format version 2) and
+// saves its pageviews to the given collection, see readGoatCounter.
+func importGoatCounter(ctx context.Context, col *mongo.Collection, r io.Reader) (int, error) {
+	stored, _ := storedVisits(col.Name())
+	site := ""
+	if layout == layoutSingle {
+		site = col.Name()
+	}
+	n := 0
+	batch := make([]interface{}, 0, insertBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+		if _, err := stored.InsertMany(ctx, batch); err != nil {
+			return fmt.Errorf("failed to insert records: %w", err)
+		}
+		n += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	err := readGoatCounter(r, col.Name(), func(v *visit) error {
+		v.Site = site
+		batch = append(batch, v)
+		if len(batch) == insertBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+// readGoatCounter reads the pageviews of a GoatCounter CSV export (format
+// version 2) as visits of a host. Events and bot hits are skipped.
+// GoatCounter does not export IP addresses, hence visits carry a visitor
+// ID and a pseudo IP address that are derived from the GoatCounter
+// session, see goatcounterIP, so that uv are counted by sessions rather
+// than as a single visitor. Pageviews without a session are counted as a
+// visitor each.
+func readGoatCounter(r io.Reader, host string, save func(v *visit) error) error {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("cannot read csv header: %w", err)
+	}
+	if len(header) == 0 || !strings.HasPrefix(header[0], "2") {
+		return errors.New("unsupported goatcounter export, require format version 2")
+	}
+	header[0] = strings.TrimPrefix(header[0], "2")
+	idx := map[string]int{}
+	for i, name := range header {
+		idx[name] = i
+	}
+	for _, name := range []string{"Path", "Event", "UserAgent", "Session", "Bot", "Referrer", "Date"} {
+		if _, ok := idx[name]; !ok {
+			return fmt.Errorf("missing column %q in goatcounter export", name)
+		}
+	}
+
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read csv line %d: %w", line, err)
+		}
+		if row[idx["Event"]] == "true" {
+			continue
+		}
+		if bot := row[idx["Bot"]]; bot != "" && bot != "0" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, row[idx["Date"]])
+		if err != nil {
+			return fmt.Errorf("invalid date at line %d: %w", line, err)
+		}
+
+		vid := uuid.New()
+		if session := row[idx["Session"]]; session != "" {
+			vid = uuid.NewSHA1(goatcounterNamespace, []byte(session))
+		}
+		err = save(&visit{
+			VisitorID: vid.String(),
+			Path:      row[idx["Path"]],
+			IP:        goatcounterIP(vid),
+			UA:        row[idx["UserAgent"]],
+			Referer:   row[idx["Referrer"]],
+			Time:      t.UTC(),
+			Host:      host,
+			Channel:   channelOf(row[idx["Referrer"]], host),
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// goatcounterIP returns the pseudo IP address of the visitor of a
+// GoatCounter session, which is in the discard prefix 100::/64, hence it
+// is a valid address that no actual visitor has.
+func goatcounterIP(vid uuid.UUID) string {
+	ip := make(net.IP, net.IPv6len)
+	ip[0] = 0x01
+	copy(ip[8:], vid[:8])
+	return ip.String()
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadGoatCounter(t *testing.T) {
+	f, err := os.Open("testdata/goatcounter.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var vs []*visit
+	err = readGoatCounter(f, "blog.changkun.de", func(v *visit) error {
+		vs = append(vs, v)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("cannot read export: %v", err)
+	}
+	// The event and the bot hit are skipped.
+	if len(vs) != 4 {
+		t.Fatalf("read %d visits, want 4", len(vs))
+	}
+	if vs[0].Path != "/blog/" || vs[0].Host != "blog.changkun.de" || vs[0].Channel != channelSearch {
+		t.Fatalf("first visit: %+v", vs[0])
+	}
+	// Pageviews of a session are of the same visitor, and the others of
+	// a visitor each.
+	if vs[0].VisitorID != vs[1].VisitorID || vs[0].IP != vs[1].IP {
+		t.Fatalf("visits of a session are of different visitors: %+v, %+v", vs[0], vs[1])
+	}
+	seen := map[string]bool{}
+	for _, v := range vs[1:] {
+		ip := net.ParseIP(v.IP)
+		if ip == nil || !strings.HasPrefix(v.IP, "100::") {
+			t.Fatalf("pseudo IP %q is not in 100::/64", v.IP)
+		}
+		if seen[v.IP] || seen[v.VisitorID] {
+			t.Fatalf("visitor %s, %s is not unique", v.VisitorID, v.IP)
+		}
+		seen[v.IP], seen[v.VisitorID] = true, true
+	}
+
+	// Importing the export again maps sessions to the same visitors.
+	f.Seek(0, 0)
+	var again []*visit
+	readGoatCounter(f, "blog.changkun.de", func(v *visit) error {
+		again = append(again, v)
+		return nil
+	})
+	if again[0].VisitorID != vs[0].VisitorID || again[0].IP != vs[0].IP {
+		t.Fatalf("session is mapped to %s, %s, want %s, %s", again[0].VisitorID, again[0].IP, vs[0].VisitorID, vs[0].IP)
+	}
+
+	err = readGoatCounter(strings.NewReader("Path,Date\n"), "blog.changkun.de", func(*visit) error { return nil })
+	if err == nil {
+		t.Fatal("export of format version 1 is accepted")
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// grafana implements the protocol of Grafana's SimpleJSON and JSON data
+// source plugins under /urlstat/grafana, so that PV/UV time series can be
+// graphed in Grafana dashboards. See:
+// https://github.com/grafana/simple-json-datasource
+//
+// Targets are named "<metric>:<host>" or "<metric>:<host><path>", where
+// metric is either pv or uv, e.g. "pv:blog.changkun.de" or
+// "uv:golang.design/research/".
+//
+// If URLSTAT_GRAFANA_TOKEN is set, requests must carry the token as a
+// bearer token, which can be configured as a custom HTTP header of the
+// data source, and may query all hosts. Otherwise, requests of a
+// multi-user instance only query the hosts that their viewer may view,
+// see scoped.
+func grafana(w http.ResponseWriter, r *http.Request) {
+	token := os.Getenv("URLSTAT_GRAFANA_TOKEN")
+	if token == "" {
+		scoped(serveGrafana)(w, r)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+		respondError(w, r, errUnauthorized)
+		return
+	}
+	// The token is a data source of the operator, which views all hosts.
+	r = r.WithContext(context.WithValue(r.Context(), viewerKey{}, &viewer{admin: true}))
+	serveGrafana(w, r)
+}
+
+// serveGrafana serves the endpoints of the data source.
+func serveGrafana(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	var resp interface{}
+	switch strings.TrimPrefix(r.URL.Path, "/urlstat/grafana") {
+	case "", "/":
+		// Grafana tests the connection of a data source with this endpoint.
+		w.Write([]byte("ok"))
+		return
+	case "/search":
+		resp, err = grafanaSearch(r.Context())
+	case "/query":
+		resp, err = grafanaQuery(r)
+	case "/annotations":
+		// There are no annotations for visits, but the endpoint is
+		// required by the protocol.
+		resp = []struct{}{}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// grafanaSearch returns the targets of the hosts that the viewer of the
+// context may view.
+func grafanaSearch(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	cols, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+	sort.Strings(cols)
+	if cols, err = viewableHosts(ctx, cols); err != nil {
+		return nil, err
+	}
+	targets := make([]string, 0, 2*len(cols))
+	for _, col := range cols {
+		targets = append(targets, "pv:"+col, "uv:"+col)
+	}
+	return targets, nil
+}
+
+type grafanaTimeseries struct {
+	Target string `json:"target"`
+	// Datapoints are pairs of value and unix timestamp in milliseconds.
+	Datapoints [][2]int64 `json:"datapoints"`
+}
+
+// grafanaQuery returns the time series of the requested targets.
+func grafanaQuery(r *http.Request) ([]grafanaTimeseries, error) {
+	var q struct {
+		Range struct {
+			From time.Time `json:"from"`
+			To   time.Time `json:"to"`
+		} `json:"range"`
+		IntervalMs    int64 `json:"intervalMs"`
+		MaxDataPoints int64 `json:"maxDataPoints"`
+		Targets       []struct {
+			Target string `json:"target"`
+		} `json:"targets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidQuery, err)
+	}
+	if !q.Range.To.After(q.Range.From) {
+		return nil, fmt.Errorf("%w: invalid range", errInvalidQuery)
+	}
+
+	// Use at least one minute buckets and never return more data points
+	// than requested, which keeps the aggregation cheap for large ranges.
+	interval := q.IntervalMs
+	if q.MaxDataPoints > 0 {
+		if floor := q.Range.To.Sub(q.Range.From).Milliseconds() / q.MaxDataPoints; interval < floor {
+			interval = floor
+		}
+	}
+	if interval < time.Minute.Milliseconds() {
+		interval = time.Minute.Milliseconds()
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+
+	series := make([]grafanaTimeseries, 0, len(q.Targets))
+	for _, t := range q.Targets {
+		if t.Target == "" {
+			continue
+		}
+		metric, loc, ok := strings.Cut(t.Target, ":")
+		if !ok || (metric != "pv" && metric != "uv") {
+			return nil, fmt.Errorf("%w: invalid target %s", errInvalidQuery, t.Target)
+		}
+		host, path := loc, ""
+		if i := strings.Index(loc, "/"); i >= 0 {
+			host, path = loc[:i], loc[i:]
+		}
+
+		if err := checkView(ctx, host); err != nil {
+			return nil, err
+		}
+		mode := "site"
+		if path != "" {
+			mode = "page"
+		}
+		if err := checkPrivate(r, host, mode+"_"+metric); err != nil {
+			return nil, err
+		}
+
+		col := analyticsDB(dbname).Collection(host)
+		points, err := countVisitSeries(ctx, col, path, q.Range.From, q.Range.To, interval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count visit: %w", err)
+		}
+		ts := grafanaTimeseries{Target: t.Target, Datapoints: make([][2]int64, 0, len(points))}
+		for _, p := range points {
+			v := p.PV
+			if metric == "uv" {
+				v = p.UV
+			}
+			ts.Datapoints = append(ts.Datapoints, [2]int64{v, p.Time})
+		}
+		series = append(series, ts)
+	}
+	return series, nil
+}
+
+// seriesPoint is the pv and uv of a time bucket that starts at Time, in
+// unix milliseconds.
+type seriesPoint struct {
+	Time int64 `bson:"_id"`
+	PV   int64 `bson:"pv"`
+	UV   int64 `bson:"uv"`
+}
+
+// countVisitSeries reports the pv and uv of the given collection between
+// from and to in buckets of the given interval in milliseconds. If path is
+// not empty, only visits of the path are counted.
+func countVisitSeries(ctx context.Context, col *mongo.Collection, path string, from, to time.Time, interval int64) ([]seriesPoint, error) {
+	field, err := uvFieldOf(ctx, col.Name())
+	if err != nil {
+		return nil, err
+	}
+	match := bson.M{"time": bson.M{"$gte": from, "$lt": to}}
+	if path != "" {
+		match["path"] = path
+	}
+	p := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"t":  bucketExpr(interval),
+				"uv": "$" + field,
+			},
+			"count": bson.M{"$sum": 1},
+		}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id": "$_id.t",
+			"uv":  bson.M{"$sum": 1},
+			"pv":  bson.M{"$sum": "$count"},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	opts := options.Aggregate().SetAllowDiskUse(true).SetComment(requestID(ctx))
+	cur, err := col.Aggregate(ctx, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	var points []seriesPoint
+	if err := cur.All(ctx, &points); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
@@ -0,0 +1,1027 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// graphqlSchema is the schema served by /urlstat/graphql/schema. Paths
+// and time series are computed from rollups, hence the uv of a path over
+// several days is the sum of its daily uv. Referrers, devices, browsers,
+// and systems are counted from visits.
+const graphqlSchema = `type Query {
+  hosts: [Host!]!
+  host(name: String!): Host
+}
+
+type Host {
+  name: String!
+  pv: Int!
+  uv: Int!
+  paths(days: Int = 30, limit: Int = 10): [Path!]!
+  timeseries(days: Int = 30, path: String = ""): [Day!]!
+  referrers(days: Int = 30, limit: Int = 10, internal: Boolean = false): [Count!]!
+  devices(days: Int = 30): [Count!]!
+  browsers(days: Int = 30): [Count!]!
+  systems(days: Int = 30): [Count!]!
+}
+
+type Path {
+  path: String!
+  pv: Int!
+  uv: Int!
+}
+
+type Day {
+  day: String!
+  pv: Int!
+  uv: Int!
+  entries: Int!
+  exits: Int!
+  new: Int!
+  returning: Int!
+}
+
+type Count {
+  name: String!
+  count: Int!
+}
+`
+
+// Limits of GraphQL requests. Each field of a host may aggregate visits,
+// and hosts multiplies the fields of a host by the number of hosts, hence
+// queries are bounded in size, depth, fields, and aliases, which repeat
+// the same field with other arguments.
+const (
+	gqlMaxQuery   = 16 << 10
+	gqlMaxDepth   = 4
+	gqlMaxFields  = 64
+	gqlMaxAliases = 16
+)
+
+// graphql serves queries of the statistics of hosts, so that dashboards
+// can fetch exactly the slices they need in one request, e.g.
+//
+//	{ host(name: "golang.design") { pv uv paths(days: 7) { path pv } devices { name count } } }
+//
+// Queries are sent as POST {"query": "...", "variables": {...}} or as
+// GET ?query=...&variables=.... Fields, aliases, arguments, and variables
+// are supported, fragments, directives, and mutations are not. Errors of
+// fields are reported in the errors of the response, along with the data
+// of the other fields.
+func graphql(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	if r.URL.Path == "/urlstat/graphql/schema" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(graphqlSchema))
+		return
+	}
+
+	var req struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if e := json.Unmarshal([]byte(v), &req.Variables); e != nil {
+				err = fmt.Errorf("%w: invalid variables: %v", errInvalidQuery, e)
+				return
+			}
+		}
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, 2*gqlMaxQuery)
+		if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+			err = fmt.Errorf("%w: %v", errInvalidQuery, e)
+			return
+		}
+	default:
+		err = fmt.Errorf("%w: %s %s", errInvalidQuery, r.Method, r.URL.Path)
+		return
+	}
+
+	if len(req.Query) > gqlMaxQuery {
+		err = fmt.Errorf("%w: query exceeds %d bytes", errInvalidQuery, gqlMaxQuery)
+		return
+	}
+	sel, err := parseGraphQL(req.Query, req.Variables)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", errInvalidQuery, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	ex := &gqlExecutor{ctx: ctx}
+	resp := struct {
+		Data   gqlResult  `json:"data"`
+		Errors []gqlError `json:"errors,omitempty"`
+	}{Data: ex.object(gqlQuery{r: r}, sel, nil)}
+	resp.Errors = ex.errs
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// gqlField is a field of a selection set.
+type gqlField struct {
+	Alias string
+	Name  string
+	Args  map[string]interface{}
+	Sel   []gqlField
+}
+
+// key returns the key of the field in the result.
+func (f gqlField) key() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+// gqlObject is an object of the schema that resolves its fields.
+type gqlObject interface {
+	typename() string
+	resolve(ctx context.Context, f gqlField) (interface{}, error)
+}
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlResult is an object of a response. Its keys are ordered as selected,
+// which a map would not preserve.
+type gqlResult []gqlEntry
+
+type gqlEntry struct {
+	Key   string
+	Value interface{}
+}
+
+func (res gqlResult) MarshalJSON() ([]byte, error) {
+	if res == nil {
+		return []byte("null"), nil
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, e := range res {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(e.Key)
+		v, err := json.Marshal(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// gqlExecutor executes a query and collects the errors of its fields.
+type gqlExecutor struct {
+	ctx  context.Context
+	errs []gqlError
+}
+
+func (ex *gqlExecutor) fail(path []interface{}, err error) {
+	ex.errs = append(ex.errs, gqlError{Message: err.Error(), Path: path})
+}
+
+// object resolves the selected fields of an object. A field that fails is
+// null in the result.
+func (ex *gqlExecutor) object(o gqlObject, sel []gqlField, path []interface{}) gqlResult {
+	res := gqlResult{}
+	for _, f := range sel {
+		p := append(path[:len(path):len(path)], f.key())
+		var v interface{}
+		var err error
+		if f.Name == "__typename" {
+			v = o.typename()
+		} else {
+			v, err = o.resolve(ex.ctx, f)
+		}
+		if err == nil {
+			v, err = ex.value(v, f, p)
+		}
+		if err != nil {
+			ex.fail(p, err)
+			v = nil
+		}
+		res = append(res, gqlEntry{f.key(), v})
+	}
+	return res
+}
+
+// value completes a resolved value of a field.
+func (ex *gqlExecutor) value(v interface{}, f gqlField, path []interface{}) (interface{}, error) {
+	var list []gqlObject
+	switch v := v.(type) {
+	case gqlObject:
+		if len(f.Sel) == 0 {
+			return nil, fmt.Errorf("field %s of type %s must have a selection", f.Name, v.typename())
+		}
+		return ex.object(v, f.Sel, path), nil
+	case []gqlObject:
+		list = v
+	default:
+		if len(f.Sel) > 0 {
+			return nil, fmt.Errorf("field %s must not have a selection", f.Name)
+		}
+		return v, nil
+	}
+	if len(f.Sel) == 0 {
+		return nil, fmt.Errorf("field %s must have a selection", f.Name)
+	}
+	res := make([]gqlResult, len(list))
+	for i, o := range list {
+		res[i] = ex.object(o, f.Sel, append(path[:len(path):len(path)], i))
+	}
+	return res, nil
+}
+
+// gqlArgs checks the arguments of a field against their defaults, which
+// also determine their types, and returns the arguments with defaults
+// applied.
+func gqlArgs(f gqlField, defaults map[string]interface{}) (map[string]interface{}, error) {
+	args := make(map[string]interface{}, len(defaults))
+	for k, v := range defaults {
+		args[k] = v
+	}
+	for k, v := range f.Args {
+		def, ok := defaults[k]
+		if !ok {
+			return nil, fmt.Errorf("unknown argument %s of field %s", k, f.Name)
+		}
+		if v == nil {
+			continue
+		}
+		switch def.(type) {
+		case int:
+			// Numbers are parsed as float64, see gqlParser.value.
+			n, ok := v.(float64)
+			if !ok || n != float64(int(n)) {
+				return nil, fmt.Errorf("argument %s of field %s must be an integer", k, f.Name)
+			}
+			args[k] = int(n)
+		case string:
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("argument %s of field %s must be a string", k, f.Name)
+			}
+			args[k] = s
+		case bool:
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("argument %s of field %s must be a boolean", k, f.Name)
+			}
+			args[k] = b
+		}
+	}
+	return args, nil
+}
+
+// gqlSince returns the first day of the days argument, see
+// parseStatsValues.
+func gqlSince(f gqlField, days int) (time.Time, error) {
+	if days < 1 || days > 3650 {
+		return time.Time{}, fmt.Errorf("argument days of field %s must be between 1 and 3650", f.Name)
+	}
+	return time.Now().UTC().Truncate(day).Add(-time.Duration(days-1) * day), nil
+}
+
+func gqlLimit(f gqlField, n int) error {
+	if n < 1 || n > 1000 {
+		return fmt.Errorf("argument limit of field %s must be between 1 and 1000", f.Name)
+	}
+	return nil
+}
+
+// gqlQuery is the root of queries. The request decides whether private
+// statistics of hosts are resolved, see checkPrivate.
+type gqlQuery struct {
+	r *http.Request
+}
+
+func (gqlQuery) typename() string { return "Query" }
+
+func (q gqlQuery) resolve(ctx context.Context, f gqlField) (interface{}, error) {
+	switch f.Name {
+	case "hosts":
+		if _, err := gqlArgs(f, nil); err != nil {
+			return nil, err
+		}
+		hosts, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(hosts)
+		if hosts, err = viewableHosts(ctx, hosts); err != nil {
+			return nil, err
+		}
+		list := make([]gqlObject, len(hosts))
+		for i, h := range hosts {
+			list[i] = &gqlHost{name: h, r: q.r}
+		}
+		return list, nil
+	case "host":
+		args, err := gqlArgs(f, map[string]interface{}{"name": ""})
+		if err != nil {
+			return nil, err
+		}
+		name := args["name"].(string)
+		if name == "" {
+			return nil, errors.New("missing argument name of field host")
+		}
+		// Unknown hosts are null, as their collections do not exist, and
+		// so are hosts that the viewer may not view.
+		names, err := db.Database(dbname).ListCollectionNames(ctx, bson.M{"name": name})
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, nil
+		}
+		if ok, err := canView(ctx, name); err != nil || !ok {
+			return nil, err
+		}
+		return &gqlHost{name: name, r: q.r}, nil
+	}
+	return nil, fmt.Errorf("unknown field %s of type Query", f.Name)
+}
+
+// gqlHost is a host, whose totals are loaded once if pv or uv are
+// selected.
+type gqlHost struct {
+	name   string
+	r      *http.Request
+	total  *total
+	totalE error
+}
+
+func (h *gqlHost) typename() string { return "Host" }
+
+func (h *gqlHost) resolve(ctx context.Context, f gqlField) (interface{}, error) {
+	switch f.Name {
+	case "name":
+		return h.name, nil
+	case "pv", "uv":
+		if err := checkPrivate(h.r, h.name, "site_"+f.Name); err != nil {
+			return nil, err
+		}
+		if h.total == nil && h.totalE == nil {
+			h.total = &total{Host: h.name}
+			err := db.Database(metaname).Collection(colTotals).FindOne(ctx, bson.M{"_id": h.name},
+				options.FindOne().SetComment(requestID(ctx))).Decode(h.total)
+			if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+				h.totalE = err
+			}
+		}
+		if h.totalE != nil {
+			return nil, h.totalE
+		}
+		if f.Name == "pv" {
+			return h.total.PV, nil
+		}
+		return h.total.UV, nil
+	case "paths":
+		args, err := gqlArgs(f, map[string]interface{}{"days": 30, "limit": 10})
+		if err != nil {
+			return nil, err
+		}
+		since, err := gqlSince(f, args["days"].(int))
+		if err != nil {
+			return nil, err
+		}
+		if err := gqlLimit(f, args["limit"].(int)); err != nil {
+			return nil, err
+		}
+		if err := checkPrivate(h.r, h.name, "page_pv", "page_uv"); err != nil {
+			return nil, err
+		}
+		paths, err := pathStats(ctx, h.name, since, args["limit"].(int))
+		if err != nil {
+			return nil, err
+		}
+		list := make([]gqlObject, len(paths))
+		for i, p := range paths {
+			list[i] = gqlFields{"Path", map[string]interface{}{"path": p.Path, "pv": p.PV, "uv": p.UV}}
+		}
+		return list, nil
+	case "timeseries":
+		args, err := gqlArgs(f, map[string]interface{}{"days": 30, "path": ""})
+		if err != nil {
+			return nil, err
+		}
+		since, err := gqlSince(f, args["days"].(int))
+		if err != nil {
+			return nil, err
+		}
+		mode := "site"
+		if args["path"].(string) != "" {
+			mode = "page"
+		}
+		if err := checkPrivate(h.r, h.name, mode+"_pv", mode+"_uv"); err != nil {
+			return nil, err
+		}
+		rollups, err := dailyRollups(ctx, h.name, args["path"].(string), since)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]gqlObject, len(rollups))
+		for i, r := range rollups {
+			list[i] = gqlFields{"Day", map[string]interface{}{
+				"day":       r.Day.Format("2006-01-02"),
+				"pv":        r.PV,
+				"uv":        r.UV,
+				"entries":   r.Entries,
+				"exits":     r.Exits,
+				"new":       r.New,
+				"returning": r.Returning,
+			}}
+		}
+		return list, nil
+	case "referrers":
+		args, err := gqlArgs(f, map[string]interface{}{"days": 30, "limit": 10, "internal": false})
+		if err != nil {
+			return nil, err
+		}
+		since, err := gqlSince(f, args["days"].(int))
+		if err != nil {
+			return nil, err
+		}
+		if err := gqlLimit(f, args["limit"].(int)); err != nil {
+			return nil, err
+		}
+		if err := checkPrivate(h.r, h.name, reportStats...); err != nil {
+			return nil, err
+		}
+		refs, err := topReferrers(ctx, h.name, since, args["limit"].(int), args["internal"].(bool))
+		if err != nil {
+			return nil, err
+		}
+		return gqlCounts(refs), nil
+	case "devices":
+		args, err := gqlArgs(f, map[string]interface{}{"days": 30})
+		if err != nil {
+			return nil, err
+		}
+		since, err := gqlSince(f, args["days"].(int))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPrivate(h.r, h.name, reportStats...); err != nil {
+			return nil, err
+		}
+		devices, err := deviceCounts(ctx, h.name, since)
+		if err != nil {
+			return nil, err
+		}
+		return gqlCounts(devices), nil
+	case "browsers", "systems":
+		args, err := gqlArgs(f, map[string]interface{}{"days": 30})
+		if err != nil {
+			return nil, err
+		}
+		since, err := gqlSince(f, args["days"].(int))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPrivate(h.r, h.name, reportStats...); err != nil {
+			return nil, err
+		}
+		shares, err := clientSplit(ctx, h.name, nil, since, f.Name == "systems")
+		if err != nil {
+			return nil, err
+		}
+		counts := make([]nameCount, len(shares))
+		for i, s := range shares {
+			counts[i] = nameCount{s.Name, s.Count}
+		}
+		return gqlCounts(counts), nil
+	}
+	return nil, fmt.Errorf("unknown field %s of type Host", f.Name)
+}
+
+// gqlFields is an object of scalar fields.
+type gqlFields struct {
+	name   string
+	fields map[string]interface{}
+}
+
+func (o gqlFields) typename() string { return o.name }
+
+func (o gqlFields) resolve(ctx context.Context, f gqlField) (interface{}, error) {
+	v, ok := o.fields[f.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %s of type %s", f.Name, o.name)
+	}
+	if len(f.Args) > 0 {
+		return nil, fmt.Errorf("field %s of type %s has no arguments", f.Name, o.name)
+	}
+	return v, nil
+}
+
+// nameCount is a counter of a name, e.g. a referrer or a device.
+type nameCount struct {
+	Name  string
+	Count int64
+}
+
+func gqlCounts(counts []nameCount) []gqlObject {
+	list := make([]gqlObject, len(counts))
+	for i, c := range counts {
+		list[i] = gqlFields{"Count", map[string]interface{}{"name": c.Name, "count": c.Count}}
+	}
+	return list
+}
+
+// pathStat is the pv and uv of a path over several days.
+type pathStat struct {
+	Path string `bson:"_id"`
+	PV   int64  `bson:"pv"`
+	UV   int64  `bson:"uv"`
+}
+
+// pathStats returns the n paths of a host with most page views since the
+// given day.
+func pathStats(ctx context.Context, host string, since time.Time, n int) ([]pathStat, error) {
+	p := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{
+			"host": host,
+			"day":  bson.M{"$gte": since},
+			"path": bson.M{"$ne": ""},
+		}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id": "$path",
+			"pv":  bson.M{"$sum": "$pv"},
+			"uv":  bson.M{"$sum": "$uv"},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "pv", Value: -1}, {Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: n}},
+	}
+	col := db.Database(metaname).Collection(colRollups)
+	cur, err := col.Aggregate(ctx, p, options.Aggregate().SetComment(requestID(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	paths := []pathStat{}
+	if err := cur.All(ctx, &paths); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// groupVisits counts the visits of a host since the given day by a field.
+// If a filter is given, only matching visits are counted.
+func groupVisits(ctx context.Context, host, field string, since time.Time, filter bson.M) ([]nameCount, error) {
+	match := bson.M{"time": bson.M{"$gte": since}}
+	for k, v := range filter {
+		match[k] = v
+	}
+	p := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$group", Value: bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}}},
+	}
+	col := analyticsDB(dbname).Collection(host)
+	cur, err := col.Aggregate(ctx, p, options.Aggregate().
+		SetAllowDiskUse(true).SetComment(requestID(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Name  string `bson:"_id"`
+		Count int64  `bson:"count"`
+	}
+	if err := cur.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	counts := make([]nameCount, len(results))
+	for i, r := range results {
+		counts[i] = nameCount{r.Name, r.Count}
+	}
+	return counts, nil
+}
+
+// topReferrers returns the n hostnames that referred most visits of a
+// host since the given day. Referrers of the host itself are internal
+// navigation and are only counted if internal is set.
+func topReferrers(ctx context.Context, host string, since time.Time, n int, internal bool) ([]nameCount, error) {
+	var filter bson.M
+	if !internal {
+		filter = bson.M{"channel": bson.M{"$ne": channelInternal}}
+	}
+	refs, err := groupVisits(ctx, host, "referer", since, filter)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]int64{}
+	for _, r := range refs {
+		u, err := url.Parse(r.Name)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		// Visits recorded before channels were classified are matched
+		// by their referrers.
+		if !internal && channelOf(r.Name, host) == channelInternal {
+			continue
+		}
+		m[u.Hostname()] += r.Count
+	}
+	return sortCounts(m, n), nil
+}
+
+// deviceCounts returns the number of visits of a host since the given day
+// per device class, see deviceOf.
+func deviceCounts(ctx context.Context, host string, since time.Time) ([]nameCount, error) {
+	uas, err := groupVisits(ctx, host, "ua", since, nil)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]int64{}
+	for _, ua := range uas {
+		m[deviceOf(ua.Name)] += ua.Count
+	}
+	return sortCounts(m, len(m)), nil
+}
+
+// sortCounts returns the n names with the highest counts.
+func sortCounts(m map[string]int64, n int) []nameCount {
+	counts := make([]nameCount, 0, len(m))
+	for k, v := range m {
+		counts = append(counts, nameCount{k, v})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// deviceOf classifies a user agent as bot, tablet, mobile, desktop, or
+// unknown if the user agent is not stored, e.g. under reduced privacy.
+func deviceOf(ua string) string {
+	s := strings.ToLower(ua)
+	switch {
+	case s == "":
+		return "unknown"
+	case strings.Contains(s, "bot") || strings.Contains(s, "crawler") ||
+		strings.Contains(s, "spider") || strings.Contains(s, "headless"):
+		return "bot"
+	case strings.Contains(s, "ipad") || strings.Contains(s, "tablet") ||
+		(strings.Contains(s, "android") && !strings.Contains(s, "mobile")):
+		return "tablet"
+	case strings.Contains(s, "mobi") || strings.Contains(s, "iphone"):
+		return "mobile"
+	default:
+		return "desktop"
+	}
+}
+
+// parseGraphQL parses a query document with a single anonymous or named
+// query operation, and returns its selection set with variables
+// substituted.
+func parseGraphQL(query string, vars map[string]interface{}) ([]gqlField, error) {
+	p := &gqlParser{src: query, vars: vars}
+	p.next()
+	if p.tok == "query" {
+		p.next()
+		if p.kind == gqlName {
+			p.next()
+		}
+		if p.tok == "(" {
+			if err := p.varDefs(); err != nil {
+				return nil, err
+			}
+		}
+	} else if p.kind == gqlName {
+		return nil, fmt.Errorf("unsupported operation %s", p.tok)
+	}
+	sel, err := p.selection()
+	if err != nil {
+		return nil, err
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.kind != gqlEOF {
+		return nil, fmt.Errorf("unexpected %q after the operation", p.tok)
+	}
+	var fields, aliases int
+	if err := gqlCheckLimits(sel, 1, &fields, &aliases); err != nil {
+		return nil, err
+	}
+	return sel, nil
+}
+
+// gqlCheckLimits checks a selection at a depth against the limits of
+// queries, and counts its fields and aliases.
+func gqlCheckLimits(sel []gqlField, depth int, fields, aliases *int) error {
+	if depth > gqlMaxDepth {
+		return fmt.Errorf("query exceeds the depth of %d", gqlMaxDepth)
+	}
+	for _, f := range sel {
+		if *fields++; *fields > gqlMaxFields {
+			return fmt.Errorf("query exceeds %d fields", gqlMaxFields)
+		}
+		if f.Alias != "" {
+			if *aliases++; *aliases > gqlMaxAliases {
+				return fmt.Errorf("query exceeds %d aliases", gqlMaxAliases)
+			}
+		}
+		if err := gqlCheckLimits(f.Sel, depth+1, fields, aliases); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Token kinds of the GraphQL lexer.
+const (
+	gqlEOF = iota
+	gqlPunct
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+	gqlVariable
+)
+
+type gqlParser struct {
+	src  string
+	pos  int
+	tok  string
+	kind int
+	err  error
+	vars map[string]interface{}
+}
+
+// next reads the next token, skipping whitespace, commas, and comments.
+func (p *gqlParser) next() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.tok, p.kind = "", gqlEOF
+		return
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c == '"':
+		p.pos++
+		var b strings.Builder
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			if p.src[p.pos] == '\\' && p.pos+1 < len(p.src) {
+				p.pos++
+				switch e := p.src[p.pos]; e {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(e)
+				}
+			} else {
+				b.WriteByte(p.src[p.pos])
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.src) {
+			p.setErr(errors.New("unterminated string"))
+			p.tok, p.kind = "", gqlEOF
+			return
+		}
+		p.pos++
+		p.tok, p.kind = b.String(), gqlString
+		return
+	case c == '$':
+		p.pos++
+		for p.pos < len(p.src) && isNameByte(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok, p.kind = p.src[start+1:p.pos], gqlVariable
+		return
+	case c == '-' || (c >= '0' && c <= '9'):
+		p.pos++
+		p.kind = gqlInt
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			if c == '.' || c == 'e' || c == 'E' || c == '+' || c == '-' {
+				p.kind = gqlFloat
+			} else if c < '0' || c > '9' {
+				break
+			}
+			p.pos++
+		}
+	case isNameByte(c):
+		for p.pos < len(p.src) && isNameByte(p.src[p.pos]) {
+			p.pos++
+		}
+		p.kind = gqlName
+	default:
+		p.pos++
+		p.kind = gqlPunct
+	}
+	p.tok = p.src[start:p.pos]
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (p *gqlParser) setErr(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *gqlParser) expect(tok string) error {
+	if p.kind == gqlString || p.tok != tok {
+		return fmt.Errorf("expected %q, got %q", tok, p.tok)
+	}
+	p.next()
+	return nil
+}
+
+// varDefs parses variable definitions and applies their defaults.
+func (p *gqlParser) varDefs() error {
+	p.next()
+	for p.tok != ")" {
+		if p.kind != gqlVariable {
+			return fmt.Errorf("expected a variable, got %q", p.tok)
+		}
+		name := p.tok
+		p.next()
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		// Types are not checked, arguments check their values.
+		for p.tok == "[" || p.tok == "]" || p.tok == "!" || p.kind == gqlName {
+			p.next()
+		}
+		if p.tok == "=" {
+			p.next()
+			def, err := p.value()
+			if err != nil {
+				return err
+			}
+			if _, ok := p.vars[name]; !ok {
+				if p.vars == nil {
+					p.vars = map[string]interface{}{}
+				}
+				p.vars[name] = def
+			}
+		}
+		if p.kind == gqlEOF {
+			return errors.New("unterminated variable definitions")
+		}
+	}
+	p.next()
+	return nil
+}
+
+// selection parses a selection set.
+func (p *gqlParser) selection() ([]gqlField, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sel []gqlField
+	for p.tok != "}" {
+		if p.tok == "..." || p.tok == "." {
+			return nil, errors.New("fragments are not supported")
+		}
+		if p.tok == "@" {
+			return nil, errors.New("directives are not supported")
+		}
+		if p.kind != gqlName {
+			return nil, fmt.Errorf("expected a field, got %q", p.tok)
+		}
+		f := gqlField{Name: p.tok}
+		p.next()
+		if p.tok == ":" {
+			p.next()
+			if p.kind != gqlName {
+				return nil, fmt.Errorf("expected a field, got %q", p.tok)
+			}
+			f.Alias, f.Name = f.Name, p.tok
+			p.next()
+		}
+		if p.tok == "(" {
+			p.next()
+			f.Args = map[string]interface{}{}
+			for p.tok != ")" {
+				if p.kind != gqlName {
+					return nil, fmt.Errorf("expected an argument, got %q", p.tok)
+				}
+				name := p.tok
+				p.next()
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				v, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				f.Args[name] = v
+			}
+			p.next()
+		}
+		if p.tok == "{" {
+			var err error
+			f.Sel, err = p.selection()
+			if err != nil {
+				return nil, err
+			}
+		}
+		sel = append(sel, f)
+		if p.kind == gqlEOF {
+			return nil, errors.New("unterminated selection set")
+		}
+	}
+	p.next()
+	if len(sel) == 0 {
+		return nil, errors.New("empty selection set")
+	}
+	return sel, p.err
+}
+
+// value parses a constant or variable value. Numbers are float64 as
+// variables decoded from JSON.
+func (p *gqlParser) value() (interface{}, error) {
+	tok, kind := p.tok, p.kind
+	p.next()
+	switch kind {
+	case gqlString:
+		return tok, nil
+	case gqlInt, gqlFloat:
+		f, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok)
+		}
+		return f, nil
+	case gqlVariable:
+		v, ok := p.vars[tok]
+		if !ok {
+			return nil, fmt.Errorf("undefined variable $%s", tok)
+		}
+		return v, nil
+	case gqlName:
+		switch tok {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		// Enum values are passed as strings.
+		return tok, nil
+	}
+	return nil, fmt.Errorf("unexpected %q in value", tok)
+}
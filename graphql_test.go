@@ -0,0 +1,109 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	q := `query Stats($days: Int = 7, $path: String) {
+		h: host(name: "golang.design") { # a comment
+			paths(days: $days, limit: 5) { path pv }
+			timeseries(path: $path) { day }
+		}
+	}`
+	sel, err := parseGraphQL(q, map[string]interface{}{"path": "/"})
+	if err != nil {
+		t.Fatalf("cannot parse query: %v", err)
+	}
+	want := []gqlField{{
+		Alias: "h",
+		Name:  "host",
+		Args:  map[string]interface{}{"name": "golang.design"},
+		Sel: []gqlField{
+			{Name: "paths", Args: map[string]interface{}{"days": 7.0, "limit": 5.0},
+				Sel: []gqlField{{Name: "path"}, {Name: "pv"}}},
+			{Name: "timeseries", Args: map[string]interface{}{"path": "/"},
+				Sel: []gqlField{{Name: "day"}}},
+		},
+	}}
+	if !reflect.DeepEqual(sel, want) {
+		t.Fatalf("parseGraphQL = %+v, want %+v", sel, want)
+	}
+
+	for _, q := range []string{
+		"",
+		"{}",
+		"{ hosts { name }",
+		"{ hosts(limit: $n) { name } }",
+		"{ ...F }",
+		"mutation { hosts }",
+		`{ host(name: "x) { name } }`,
+		"{ hosts } }",
+		"{ a { b { c { d { e } } } } }",
+		"{ hosts { " + strings.Repeat("name ", gqlMaxFields) + "} }",
+		"{ " + strings.Repeat("a: hosts { name } ", gqlMaxAliases+1) + "}",
+	} {
+		if _, err := parseGraphQL(q, nil); err == nil {
+			t.Fatalf("parseGraphQL(%q) did not fail", q)
+		}
+	}
+}
+
+func TestGraphQLExecutor(t *testing.T) {
+	o := gqlFields{"Count", map[string]interface{}{"name": "mobile", "count": int64(3)}}
+	sel, err := parseGraphQL("{ __typename n: name count name(x: 1) }", nil)
+	if err != nil {
+		t.Fatalf("cannot parse query: %v", err)
+	}
+	ex := &gqlExecutor{ctx: context.Background()}
+	b, _ := json.Marshal(ex.object(o, sel, nil))
+	if want := `{"__typename":"Count","n":"mobile","count":3,"name":null}`; string(b) != want {
+		t.Fatalf("result = %s, want %s", b, want)
+	}
+	if len(ex.errs) != 1 || ex.errs[0].Path[0] != "name" {
+		t.Fatalf("errors = %+v, want an error of name", ex.errs)
+	}
+}
+
+func TestGQLArgs(t *testing.T) {
+	defaults := map[string]interface{}{"limit": 10, "internal": false}
+	sel, err := parseGraphQL("{ referrers(internal: true) r: referrers(internal: 1) }", nil)
+	if err != nil {
+		t.Fatalf("cannot parse query: %v", err)
+	}
+	args, err := gqlArgs(sel[0], defaults)
+	if err != nil {
+		t.Fatalf("gqlArgs failed: %v", err)
+	}
+	if args["internal"] != true || args["limit"] != 10 {
+		t.Fatalf("gqlArgs = %v, want internal and the default limit", args)
+	}
+	if _, err := gqlArgs(sel[1], defaults); err == nil {
+		t.Fatalf("gqlArgs accepted an integer as a boolean")
+	}
+}
+
+func TestDeviceOf(t *testing.T) {
+	tests := map[string]string{
+		"": "unknown",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.1 Safari/605.1.15": "desktop",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 16_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148":         "mobile",
+		"Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/107.0 Mobile Safari/537.36":     "mobile",
+		"Mozilla/5.0 (iPad; CPU OS 16_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148":                  "tablet",
+		"Mozilla/5.0 (Linux; Android 12; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/107.0 Safari/537.36":            "tablet",
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                                              "bot",
+	}
+	for ua, want := range tests {
+		if got := deviceOf(ua); got != want {
+			t.Fatalf("deviceOf(%q) = %s, want %s", ua, got, want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// contentGroup is a section of a site, e.g. its blog or its docs, which
+// groups the visits of its pages. A group is either pages whose path
+// matches a pattern, in which * matches any characters including slashes,
+// e.g. /blog/*, or visits with a custom dimension, e.g. category=blog.
+// Rules of the same name form a single group.
+type contentGroup struct {
+	Name      string `json:"name"                bson:"name"`
+	Path      string `json:"path,omitempty"      bson:"path,omitempty"`
+	Dimension string `json:"dimension,omitempty" bson:"dimension,omitempty"`
+}
+
+// validate checks that the group has a name and exactly one rule.
+func (g contentGroup) validate() error {
+	if g.Name == "" {
+		return errors.New("content group without name")
+	}
+	if (g.Path == "") == (g.Dimension == "") {
+		return fmt.Errorf("content group %s must have either a path or a dimension", g.Name)
+	}
+	if g.Path != "" && !strings.HasPrefix(g.Path, "/") {
+		return fmt.Errorf("path of content group %s must start with /", g.Name)
+	}
+	if g.Dimension != "" {
+		k, v, ok := strings.Cut(g.Dimension, "=")
+		if !ok || !isDimensionKey(k) || v == "" {
+			return fmt.Errorf("dimension of content group %s must be key=value", g.Name)
+		}
+	}
+	return nil
+}
+
+// pathPattern returns the regular expression of a path pattern.
+func pathPattern(p string) string {
+	return "^" + strings.ReplaceAll(regexp.QuoteMeta(p), `\*`, ".*") + "$"
+}
+
+// cond returns the aggregation expression whether a visit is in the
+// group.
+func (g contentGroup) cond() bson.M {
+	if g.Path != "" {
+		return bson.M{"$regexMatch": bson.M{"input": "$path", "regex": pathPattern(g.Path)}}
+	}
+	k, v, _ := strings.Cut(g.Dimension, "=")
+	return bson.M{"$eq": bson.A{"$dims." + k, v}}
+}
+
+// groupCount is the pv and uv of a content group.
+type groupCount struct {
+	Group string `json:"group" bson:"_id"`
+	PV    int64  `json:"pv"    bson:"pv"`
+	UV    int64  `json:"uv"    bson:"uv"`
+}
+
+// contentGroupCounts returns the pv and uv of the content groups of a host
+// since the given day until today, of the visits with the given custom
+// dimensions. A visit counts for the first group whose rule it matches.
+// Like reports of rollups, it only changes once a day.
+func contentGroupCounts(ctx context.Context, host string, dims map[string]string, since time.Time) ([]groupCount, error) {
+	settings, err := settingsOf(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load settings: %w", err)
+	}
+	counts := []groupCount{}
+	if len(settings.ContentGroups) == 0 {
+		return counts, nil
+	}
+	branches := bson.A{}
+	for _, g := range settings.ContentGroups {
+		branches = append(branches, bson.M{"case": g.cond(), "then": g.Name})
+	}
+
+	match := dimensionFilter(dims)
+	match["time"] = bson.M{"$gte": since, "$lt": time.Now().UTC().Truncate(day)}
+	p := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$project", Value: bson.M{
+			"group": bson.M{"$switch": bson.M{"branches": branches, "default": ""}},
+			"uv":    "$" + settings.uvField(),
+		}}},
+		bson.D{{Key: "$match", Value: bson.M{"group": bson.M{"$ne": ""}}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"group": "$group", "uv": "$uv"},
+			"pv":  bson.M{"$sum": 1},
+		}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id": "$_id.group",
+			"pv":  bson.M{"$sum": "$pv"},
+			"uv":  bson.M{"$sum": 1},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "pv", Value: -1}, {Key: "_id", Value: 1}}}},
+	}
+	col := analyticsDB(dbname).Collection(host)
+	cur, err := col.Aggregate(ctx, p, options.Aggregate().
+		SetAllowDiskUse(true).SetComment(requestID(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	if err := cur.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestPathPattern(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/blog/*", "/blog/", true},
+		{"/blog/*", "/blog/2021/zero-alloc/", true},
+		{"/blog/*", "/blog", false},
+		{"/blog/*", "/docs/blog/", false},
+		{"/*.html", "/a/b.html", true},
+		{"/v1.0/*", "/v100/", false},
+	}
+	for _, tt := range tests {
+		re := regexp.MustCompile(pathPattern(tt.pattern))
+		if got := re.MatchString(tt.path); got != tt.want {
+			t.Fatalf("pattern %s matches %s: %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestValidateContentGroups(t *testing.T) {
+	tests := []struct {
+		group contentGroup
+		ok    bool
+	}{
+		{contentGroup{Name: "Blog", Path: "/blog/*"}, true},
+		{contentGroup{Name: "Go", Dimension: "category=go"}, true},
+		{contentGroup{Path: "/blog/*"}, false},
+		{contentGroup{Name: "Blog", Path: "blog/*"}, false},
+		{contentGroup{Name: "Blog", Path: "/blog/*", Dimension: "category=blog"}, false},
+		{contentGroup{Name: "Go", Dimension: "category"}, false},
+	}
+	for _, tt := range tests {
+		s := siteSettings{ContentGroups: []contentGroup{tt.group}}
+		if err := s.validate(); (err == nil) != tt.ok {
+			t.Fatalf("validate %+v: %v, want ok %v", tt.group, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// The gRPC service of urlstat.proto is served without a gRPC library: a
+// call is an HTTP/2 POST of a length-prefixed protobuf message, and the
+// response is a length-prefixed message followed by the grpc-status
+// trailer. The messages only consist of strings and integers, which are
+// encoded by hand. As net/http only serves HTTP/2 over TLS, the service is
+// configured by environment variables:
+//
+//	URLSTAT_GRPC_ADDR: the address to serve on, e.g. 0.0.0.0:8443
+//	URLSTAT_GRPC_CERT: the certificate file
+//	URLSTAT_GRPC_KEY: the private key file
+const grpcService = "/urlstat.v1.Urlstat/"
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html.
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// grpcMaxMessage is the maximum size of a request message.
+const grpcMaxMessage = 1 << 20
+
+// serveGRPC serves a gRPC call.
+func serveGRPC(w http.ResponseWriter, r *http.Request) {
+	status, msg, resp := grpcOK, "", []byte(nil)
+	defer func() {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(status))
+		if msg != "" {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(msg))
+		}
+	}()
+	w.Header().Set("Content-Type", "application/grpc+proto")
+
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 ||
+		!strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		status, msg = grpcInvalidArgument, "not a gRPC request"
+		return
+	}
+	handle, ok := grpcMethods[strings.TrimPrefix(r.URL.Path, grpcService)]
+	if !ok || !strings.HasPrefix(r.URL.Path, grpcService) {
+		status, msg = grpcUnimplemented, "unknown method "+r.URL.Path
+		return
+	}
+
+	req, err := readGRPCMessage(r.Body)
+	if err == nil {
+		var ok bool
+		ok, err = isAdmin(r.Context(), adminKey(r))
+		if err == nil && !ok {
+			err = errUnauthorized
+		}
+	}
+	if err == nil {
+		resp, err = handle(r, req)
+	}
+	if err != nil {
+		status, msg = grpcStatus(err)
+		l.Printf("%s gRPC %s: %v", requestID(r.Context()), r.URL.Path, err)
+		return
+	}
+
+	frame := make([]byte, 5, 5+len(resp))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+	w.Write(append(frame, resp...))
+}
+
+// readGRPCMessage reads the single message of a unary call.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(body, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidQuery, err)
+	}
+	if header[0] != 0 {
+		return nil, fmt.Errorf("%w: compressed messages are not supported", errInvalidQuery)
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > grpcMaxMessage {
+		return nil, fmt.Errorf("%w: message of %d bytes is too large", errInvalidQuery, n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidQuery, err)
+	}
+	return msg, nil
+}
+
+// grpcStatus returns the gRPC status and message of an error, which
+// correspond to the HTTP status of the apiError.
+func grpcStatus(err error) (int, string) {
+	var e *apiError
+	if !errors.As(err, &e) {
+		return grpcInternal, errInternal.message
+	}
+	switch e.status {
+	case http.StatusBadRequest:
+		return grpcInvalidArgument, e.message
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated, e.message
+	case http.StatusForbidden:
+		return grpcPermissionDenied, e.message
+	case http.StatusNotFound:
+		return grpcNotFound, e.message
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted, e.message
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable, e.message
+	}
+	return grpcInternal, e.message
+}
+
+// grpcMethods are the methods of the service.
+var grpcMethods = map[string]func(r *http.Request, req []byte) ([]byte, error){
+	"RecordVisit": grpcRecordVisit,
+	"GetStats":    grpcGetStats,
+}
+
+// grpcRecordVisit records a RecordVisitRequest.
+func grpcRecordVisit(r *http.Request, req []byte) ([]byte, error) {
+	var rawURL string
+	rep := visitReport{ClientUA: r.UserAgent(), Dimensions: map[string]string{}}
+	var derr error
+	err := parseProto(req, func(field int, s string, n uint64) {
+		switch field {
+		case 1:
+			rawURL = s
+		case 2:
+			rep.IP = s
+		case 3:
+			rep.UA = s
+		case 4:
+			rep.Referer = s
+		case 5:
+			if id, err := uuid.Parse(s); err == nil {
+				rep.VisitorID = id.String()
+			}
+		case 6:
+			rep.Consent = s
+		case 7:
+			if n >= 100 && n <= 599 {
+				rep.Status = int(n)
+			}
+		case 8:
+			rep.Country = parseCountry(s)
+		case 9:
+			rep.Protocol = pageProtocol(s)
+		case 10:
+			if err := parseDimensionEntry(s, rep.Dimensions); err != nil {
+				derr = err
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if derr != nil {
+		return nil, derr
+	}
+	if err := checkDimensions(rep.Dimensions); err != nil {
+		return nil, err
+	}
+	if rep.Consent != "" && rep.Consent != "granted" && rep.Consent != "denied" {
+		return nil, fmt.Errorf("%w: consent must be granted or denied", errInvalidQuery)
+	}
+	rep.URL, err = allowedURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := ingestLimiter.acquire(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	vid, err := recordVisit(r.Context(), rep)
+	if err != nil {
+		return nil, err
+	}
+	return appendProtoString(nil, 1, vid), nil
+}
+
+// grpcGetStats reports the statistics of a GetStatsRequest.
+func grpcGetStats(r *http.Request, req []byte) ([]byte, error) {
+	var rawURL string
+	var modes []string
+	err := parseProto(req, func(field int, s string, _ uint64) {
+		switch field {
+		case 1:
+			rawURL = s
+		case 2:
+			modes = append(modes, s)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	u, err := allowedURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := countStats(r.Context(), source.collection(u.Host), u, modes)
+	if err != nil {
+		return nil, err
+	}
+	return appendStats(nil, stat), nil
+}
+
+// allowedURL parses the URL of a page whose origin is allowed.
+func allowedURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%w: %q", errInvalidURL, rawURL)
+	}
+	ori := fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+	if !source.isAllowed(ori, true) {
+		return nil, fmt.Errorf("%w: %s", errOriginNotAllowed, ori)
+	}
+	return u, nil
+}
+
+// parseProto parses the fields of a protobuf message, and calls fn with
+// the value of each string or varint field. Other fields are skipped.
+func parseProto(b []byte, fn func(field int, s string, n uint64)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("%w: malformed message", errInvalidQuery)
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0: // varint
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("%w: malformed message", errInvalidQuery)
+			}
+			b = b[n:]
+			fn(field, "", v)
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return fmt.Errorf("%w: malformed message", errInvalidQuery)
+			}
+			b = b[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return fmt.Errorf("%w: malformed message", errInvalidQuery)
+			}
+			fn(field, string(b[n:n+int(l)]), 0)
+			b = b[n+int(l):]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return fmt.Errorf("%w: malformed message", errInvalidQuery)
+			}
+			b = b[4:]
+		default:
+			return fmt.Errorf("%w: unsupported wire type %d", errInvalidQuery, key&7)
+		}
+	}
+	return nil
+}
+
+// appendProtoString appends a string field, which is omitted if empty.
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendProtoInt appends an int64 field, which is omitted if zero.
+func appendProtoInt(b []byte, field int, n int64) []byte {
+	if n == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, uint64(n))
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGRPC(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{})
+	t.Setenv("URLSTAT_ADMIN_TOKEN", "secret")
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(serveGRPC))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	call := func(method, token string, req []byte) (int, []byte) {
+		frame := make([]byte, 5, 5+len(req))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(req)))
+		r, _ := http.NewRequest(http.MethodPost, s.URL+grpcService+method, bytes.NewReader(append(frame, req...)))
+		r.Header.Set("Content-Type", "application/grpc")
+		r.Header.Set("Authorization", "Bearer "+token)
+		resp, err := s.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		var status int
+		if v := resp.Trailer.Get("Grpc-Status"); v != "" {
+			status = int(v[0] - '0')
+			if len(v) == 2 {
+				status = status*10 + int(v[1]-'0')
+			}
+		}
+		if len(b) >= 5 {
+			b = b[5:]
+		}
+		return status, b
+	}
+
+	record := appendProtoString(nil, 1, "https://changkun.de/blog/")
+	record = appendProtoString(record, 2, "203.0.113.7")
+	if status, _ := call("RecordVisit", "", record); status != grpcUnauthenticated {
+		t.Fatalf("RecordVisit without a key: status %d, want %d", status, grpcUnauthenticated)
+	}
+	if status, _ := call("Unknown", "secret", nil); status != grpcUnimplemented {
+		t.Fatalf("unknown method: status %d, want %d", status, grpcUnimplemented)
+	}
+	denied := appendProtoString(nil, 1, "https://example.com/")
+	if status, _ := call("RecordVisit", "secret", denied); status != grpcPermissionDenied {
+		t.Fatalf("RecordVisit of a disallowed origin: status %d, want %d", status, grpcPermissionDenied)
+	}
+
+	status, resp := call("RecordVisit", "secret", record)
+	if status != grpcOK {
+		t.Fatalf("RecordVisit: status %d", status)
+	}
+	var vid string
+	parseProto(resp, func(field int, s string, _ uint64) { vid = s })
+	if vid == "" {
+		t.Fatalf("RecordVisit did not assign a visitor ID")
+	}
+
+	stats := appendProtoString(nil, 1, "https://changkun.de/blog/")
+	stats = appendProtoString(stats, 2, "page")
+	stats = appendProtoString(stats, 2, "site")
+	status, resp = call("GetStats", "secret", stats)
+	if status != grpcOK {
+		t.Fatalf("GetStats: status %d", status)
+	}
+	got := map[int]uint64{}
+	parseProto(resp, func(field int, _ string, n uint64) { got[field] = n })
+	if got[1] != 1 || got[2] != 1 || got[3] != 1 || got[4] != 1 || got[5] != 0 {
+		t.Fatalf("GetStats = %v, want page and site pv/uv of 1", got)
+	}
+}
@@ -11,12 +11,16 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type stat struct {
@@ -24,6 +28,8 @@ type stat struct {
 	PageUV int64 `json:"page_uv"`
 	SitePV int64 `json:"site_pv"`
 	SiteUV int64 `json:"site_uv"`
+	HostPV int64 `json:"host_pv"`
+	HostUV int64 `json:"host_uv"`
 }
 
 type visit struct {
@@ -33,18 +39,117 @@ type visit struct {
 	UA        string    `json:"ua"      bson:"ua"`
 	Referer   string    `json:"referer" bson:"referer"`
 	Time      time.Time `json:"time"    bson:"time"`
+	// Host is the hostname of the visit, which may be an alias that shares
+	// the collection of another hostname. Visits of the hostname of the
+	// collection that were recorded before hostnames were stored lack it,
+	// see backfillHostnames.
+	Host string `json:"host,omitempty" bson:"host,omitempty"`
+	// New is set if the visitor was seen on the host for the first time.
+	New bool `json:"new,omitempty" bson:"new,omitempty"`
+	// Channel is the kind of the referrer, see channelOf.
+	Channel string `json:"channel,omitempty" bson:"channel,omitempty"`
+	// Status is the HTTP status of the page if the client reported one
+	// other than 200, e.g. 404 for a dead link.
+	Status int `json:"status,omitempty" bson:"status,omitempty"`
+	// Dimensions are the custom dimensions of the visit, see
+	// parseDimensions.
+	Dimensions map[string]string `json:"dimensions,omitempty" bson:"dims,omitempty"`
+	// Protocol is the HTTP version of the page if the client reported
+	// one, see pageProtocol, and TLS is set if it was served over TLS.
+	Protocol string `json:"protocol,omitempty" bson:"protocol,omitempty"`
+	TLS      bool   `json:"tls,omitempty"      bson:"tls,omitempty"`
+	// Site is the host of the collection of the visit in the single
+	// layout, see layoutSingle.
+	Site string `json:"-" bson:"site,omitempty"`
+	// Fingerprint is the daily fingerprint of the visitor, only stored if
+	// the uv of the site is counted by fingerprints, see fingerprint.
+	Fingerprint string `json:"fp,omitempty" bson:"fp,omitempty"`
+	// Hints are the client hints of the browser if it sent them, see
+	// readClientHints.
+	Hints *clientHints `json:"hints,omitempty" bson:"ch,omitempty"`
+	// Country, Browser, System, and Bot are added by the stages of the
+	// enrichment pipeline of the same names, see enrichments.
+	Country string `json:"country,omitempty" bson:"country,omitempty"`
+	Browser string `json:"browser,omitempty" bson:"browser,omitempty"`
+	System  string `json:"os,omitempty"      bson:"os,omitempty"`
+	Bot     bool   `json:"bot,omitempty"     bson:"bot,omitempty"`
 }
 
 const urlstatCookieVid = "urlstat_vid"
 
+// exactSitePV counts the site pv exactly, which scans the collection on
+// every report. By default the pv is estimated from collection metadata,
+// which is accurate enough for a badge. It is enabled by setting
+// URLSTAT_EXACT_SITE_PV=true.
+var exactSitePV = os.Getenv("URLSTAT_EXACT_SITE_PV") == "true"
+
+// insertBatch is the number of visits inserted per database round trip
+// when visits are saved in bulk, e.g. by imports.
+const insertBatch = 1000
+
+// referer returns the referrer of the reported page, which the client
+// reports in the urlstat-ref header, which is empty if the page has none.
+// Older clients do not report it, in which case the Referer header is the
+// referrer of the request, i.e. the reported page itself or its origin,
+// depending on the referrer policy of the page, which is not a referrer of
+// the page.
+func referer(r *http.Request, page *url.URL) string {
+	if refs, ok := r.Header[http.CanonicalHeaderKey("urlstat-ref")]; ok {
+		return refs[0]
+	}
+	if ref, err := url.Parse(r.Referer()); err != nil || ref.Host == page.Host {
+		return ""
+	}
+	return r.Referer()
+}
+
+// sourceParams are the query parameters of landing pages that name the
+// source of a visit, e.g. ?ref=news.ycombinator.com, in the order of
+// precedence.
+var sourceParams = []string{"ref", "utm_source", "source"}
+
+// campaignSource returns the source of a visit of the page that is named
+// by its query, see sourceParams, as a referrer, which is used when the
+// referrer is stripped, e.g. by the referrer policy of the referring page
+// or by apps. A hostname is a referrer of the host, e.g. twitter.com is
+// https://twitter.com/, hence it is classified into its channel.
+func campaignSource(page *url.URL) string {
+	q := page.Query()
+	for _, p := range sourceParams {
+		v := strings.TrimSpace(q.Get(p))
+		switch {
+		case v == "":
+			continue
+		case strings.Contains(v, "://"):
+			return v
+		case strings.Contains(v, ".") && !strings.ContainsAny(v, "/ "):
+			return "https://" + strings.ToLower(v) + "/"
+		default:
+			return v
+		}
+	}
+	return ""
+}
+
+// pageStatus returns the HTTP status of the page as an integer, or zero if
+// the status is unknown or invalid.
+func pageStatus(s string) int {
+	status, err := strconv.Atoi(s)
+	if err != nil || status < 100 || status > 599 {
+		return 0
+	}
+	return status
+}
+
 // recording implmenets a very basic pv/uv statistic function. client script
 // is distributed from /urlstat/client.js endpoint.
 func recording(w http.ResponseWriter, r *http.Request) {
 	if origin := r.Header.Get("Origin"); origin != "" {
 		if source.isAllowed(origin, true) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "urlstat-ua, urlstat-url")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "urlstat-ua, urlstat-url, urlstat-vid, urlstat-ref, urlstat-status, urlstat-proto, urlstat-dims, Content-Type")
+			w.Header().Set("Access-Control-Expose-Headers", "urlstat-vid")
 		}
 	}
 	if r.Method == "OPTIONS" {
@@ -52,32 +157,53 @@ func recording(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("Cache-Control", "max-age=0")
+	w.Header().Set("Accept-CH", acceptCH)
 
 	var err error
 	defer func() {
 		if err == nil {
 			return
 		}
-		http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		respondError(w, r, err)
 	}()
 
+	if r.Method == http.MethodPost {
+		if err = applyPayload(r); err != nil {
+			return
+		}
+	}
+
 	keys, ok := r.URL.Query()["mode"]
 	if ok && len(keys[0]) > 0 && keys[0] == "github" {
+		if err = checkBadgeSignature(r.URL.Query()); err != nil {
+			return
+		}
 		err = githubMode(w, r)
 		return
 	}
+	if site, ok := docSites[r.URL.Query().Get("mode")]; ok {
+		if err = checkBadgeSignature(r.URL.Query()); err != nil {
+			return
+		}
+		err = docMode(w, r, site)
+		return
+	}
 
-	loc := r.Header.Get("urlstat-url")
-	u, err := url.Parse(loc)
+	u, err := reportedURL(r)
 	if err != nil {
-		err = fmt.Errorf("cannot parse url: %w", err)
+		err = fmt.Errorf("%w: %v", errInvalidURL, err)
 		return
 	}
 
 	// Double check origin, only allow expected
 	ori := fmt.Sprintf("%s://%s", u.Scheme, u.Host)
 	if !source.isAllowed(ori, true) {
-		err = errors.New("origin not allowed")
+		err = fmt.Errorf("%w: %s", errOriginNotAllowed, ori)
+		return
+	}
+	// An allowed site must not report visits of another site.
+	if !sameOrigin(r, u) {
+		err = fmt.Errorf("%w: %s reported %s", errOriginMismatch, r.Header.Get("Origin"), u.Host)
 		return
 	}
 
@@ -89,50 +215,374 @@ func recording(w http.ResponseWriter, r *http.Request) {
 	} else {
 		cookieVid = c.Value
 	}
+	// Cross-origin requests do not carry the cookie, therefore client.js
+	// keeps the visitor ID in the local storage of the page instead.
+	if cookieVid == "" {
+		if id, err := uuid.Parse(r.Header.Get("urlstat-vid")); err == nil {
+			cookieVid = id.String()
+		}
+	}
+
+	consent := r.URL.Query().Get("consent")
+	if consent != "" && consent != "granted" && consent != "denied" {
+		err = fmt.Errorf("%w: consent must be granted or denied", errInvalidQuery)
+		return
+	}
 
-	var vid string
-	col := db.Database(dbname).Collection(u.Host)
-	vid, err = saveVisit(r.Context(), col, &visit{
-		VisitorID: cookieVid,
-		Path:      u.Path,
-		IP:        readIP(r),
-		UA:        r.Header.Get("urlstat-ua"),
-		Referer:   r.Referer(),
-		Time:      time.Now().UTC(),
+	dims, err := parseDimensions(r.Header.Get("urlstat-dims"))
+	if err != nil {
+		return
+	}
+
+	colname := source.collection(u.Host)
+	vid, err := recordVisit(r.Context(), visitReport{
+		URL:        u,
+		IP:         readIP(r),
+		Country:    readCountry(r),
+		UA:         r.Header.Get("urlstat-ua"),
+		ClientUA:   r.UserAgent(),
+		Hints:      readClientHints(r.Header),
+		Referer:    referer(r, u),
+		Status:     pageStatus(r.Header.Get("urlstat-status")),
+		Protocol:   pageProtocol(r.Header.Get("urlstat-proto")),
+		Dimensions: dims,
+		VisitorID:  cookieVid,
+		Consent:    consent,
+		Prefetch:   isPrefetch(r),
 	})
 	if err != nil {
-		err = fmt.Errorf("failed to save visit: %w", err)
 		return
 	}
 	if cookieVid == "" && vid != "" {
 		w.Header().Set("Set-Cookie", urlstatCookieVid+"="+vid)
+		w.Header().Set("urlstat-vid", vid)
 	}
 
 	// Report page statistics
-	var stat stat
+	var modes []string
 	for _, value := range r.URL.Query()["report"] {
-		args := strings.Split(value, " ")
-		for _, arg := range args {
-			var pv, uv int64
-			pv, uv, err = countVisit(r.Context(), col, u.Path, arg)
+		modes = append(modes, strings.Split(value, " ")...)
+	}
+	stat, err := countStats(r.Context(), colname, u, modes)
+	if err != nil {
+		return
+	}
+	stat, private, err := redactStats(r, colname, stat)
+	if err != nil {
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), protobufType) {
+		w.Header().Set("Content-Type", protobufType)
+		w.Write(appendStats(nil, stat))
+		return
+	}
+	b, _ := json.Marshal(stat)
+	if len(private) > 0 {
+		// Private statistics are left out rather than reported as zero.
+		m := map[string]int64{}
+		json.Unmarshal(b, &m)
+		for _, name := range private {
+			delete(m, name)
+		}
+		b, _ = json.Marshal(m)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// countStats reports the statistics of the given modes, i.e. page, site,
+// or host, of the page of the URL.
+func countStats(ctx context.Context, colname string, u *url.URL, modes []string) (stat, error) {
+	var stat stat
+	for _, mode := range modes {
+		pv, uv, err := store.countVisit(ctx, colname, u.Host, u.Path, mode)
+		if err != nil {
+			return stat, fmt.Errorf("failed to count user view count: %w", err)
+		}
+		switch mode {
+		case "page":
+			stat.PagePV = pv
+			stat.PageUV = uv
+		case "site":
+			stat.SitePV = pv
+			stat.SiteUV = uv
+		case "host":
+			stat.HostPV = pv
+			stat.HostUV = uv
+		}
+	}
+	return stat, nil
+}
+
+// statNames are the JSON names of the statistics of stat.
+var statNames = []string{"page_pv", "page_uv", "site_pv", "site_uv", "host_pv", "host_uv"}
+
+// isStatName reports whether the name is a statistic or its mode, e.g.
+// page_pv or page.
+func isStatName(name string) bool {
+	for _, n := range statNames {
+		if name == n || strings.HasPrefix(n, name+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// redactStats zeros the private statistics of a host, see
+// siteSettings.Private, unless the request is authenticated by an admin
+// API key or a session of a user with a role on the site. It returns the
+// names of the zeroed statistics.
+func redactStats(r *http.Request, colname string, st stat) (stat, []string, error) {
+	settings, err := store.settings(r.Context(), colname)
+	if err != nil {
+		return st, nil, fmt.Errorf("failed to load settings: %w", err)
+	}
+	if len(settings.Private) == 0 {
+		return st, nil, nil
+	}
+	ok, err := seesPrivate(r, settings)
+	if err != nil || ok {
+		return st, nil, err
+	}
+	var private []string
+	fields := []*int64{&st.PagePV, &st.PageUV, &st.SitePV, &st.SiteUV, &st.HostPV, &st.HostUV}
+	for i, name := range statNames {
+		if settings.isPrivate(name) {
+			*fields[i] = 0
+			private = append(private, name)
+		}
+	}
+	return st, private, nil
+}
+
+// reportStats are the statistics that reports break down, e.g. by path or
+// referrer, hence a report is private if any of them is private.
+var reportStats = []string{"page_pv", "page_uv", "site_pv", "site_uv"}
+
+// checkPrivate returns errForbidden if any of the statistics of a host is
+// private, see siteSettings.Private, and the request may not see it, see
+// seesPrivate.
+func checkPrivate(r *http.Request, host string, names ...string) error {
+	settings, err := store.settings(r.Context(), host)
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %w", err)
+	}
+	for _, name := range names {
+		if !settings.isPrivate(name) {
+			continue
+		}
+		ok, err := seesPrivate(r, settings)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: %s of %s is private", errForbidden, name, host)
+		}
+		return nil
+	}
+	return nil
+}
+
+// seesPrivate reports whether the request may see the private statistics
+// of a site, i.e. it is authenticated by an admin API key or a session of
+// a user with a role on the site.
+func seesPrivate(r *http.Request, settings *siteSettings) (bool, error) {
+	ok, err := isAdmin(r.Context(), adminKey(r))
+	if err != nil {
+		return false, fmt.Errorf("failed to check admin key: %w", err)
+	}
+	if ok {
+		return true, nil
+	}
+	if multiUser() {
+		if login := sessionLogin(r, time.Now()); login != "" && settings.roleOf(login) != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// visitReport is a visit that a page or a backend reports.
+type visitReport struct {
+	URL *url.URL
+	IP  string
+	// Country is the country code of the visitor, or empty if unknown.
+	Country string
+	// UA is the user agent of the visitor, and ClientUA is the user agent
+	// of the client that reports, which differ for backends.
+	UA       string
+	ClientUA string
+	// Hints are the client hints of the visitor, or nil if unknown.
+	Hints     *clientHints
+	Referer   string
+	VisitorID string
+	// Status is the HTTP status of the page, or zero if unknown.
+	Status int
+	// Protocol is the HTTP version of the page, or empty if unknown.
+	Protocol string
+	// Dimensions are the custom dimensions of the visit.
+	Dimensions map[string]string
+	// Consent is granted, denied, or empty if the site does not ask.
+	Consent string
+	// Prefetch is set if the page is not actually seen yet.
+	Prefetch bool
+}
+
+// recordVisit records a reported visit according to the settings of its host,
+// and returns the visitor ID if the visit was saved. The origin of the
+// URL must be checked before.
+func recordVisit(ctx context.Context, rep visitReport) (string, error) {
+	u := rep.URL
+	colname := source.collection(u.Host)
+	settings, err := store.settings(ctx, colname)
+	if err != nil {
+		return "", fmt.Errorf("failed to load settings: %w", err)
+	}
+	// Only registered hosts get a collection. Development deployments
+	// record any host.
+	if !settings.registered && source.Production {
+		return "", fmt.Errorf("%w: %s", errHostUnregistered, colname)
+	}
+
+	switch {
+	case source.isExcluded(rep.IP) || source.isBlockedUA(rep.UA) || source.isBlockedUA(rep.ClientUA) ||
+		settings.excludes(rep.IP, rep.Country, u.Path):
+		// Visits from excluded IP addresses and countries or of blocked
+		// user agents are not recorded, but still get the statistics
+		// reported.
+	case rep.Prefetch:
+		// A prefetched or prerendered page may never be seen. client.js
+		// reports prerendered pages again once they are activated.
+	case shadowBlocked(ctx, colname, rep, time.Now()):
+		// Actors that inflate the counts are accepted as usual, but not
+		// recorded.
+	case !settings.sampled():
+		// Visits that are not sampled are not recorded.
+	case rep.Consent == "denied" || settings.Privacy == privacyAnonymous:
+		// Without consent, only the page view is counted. Nothing about
+		// the visitor is stored, and no visitor ID is assigned.
+		err = store.countAnonymous(ctx, colname, u.Host, u.Path)
+		if err != nil {
+			return "", fmt.Errorf("failed to count anonymous visit: %w", err)
+		}
+	default:
+		if rep.Referer == "" {
+			rep.Referer = campaignSource(u)
+		}
+		v := &visit{
+			VisitorID: rep.VisitorID,
+			Path:      u.Path,
+			IP:        settings.visitorIP(rep.IP),
+			UA:        rep.UA,
+			Referer:   rep.Referer,
+			Time:      time.Now().UTC(),
+		}
+		if rep.Status != http.StatusOK {
+			v.Status = rep.Status
+		}
+		if rep.Protocol != "" {
+			v.Protocol, v.TLS = rep.Protocol, u.Scheme == "https"
+		}
+		if len(rep.Dimensions) > 0 {
+			v.Dimensions = rep.Dimensions
+		}
+		v.Host = u.Host
+		ua, referer := v.UA, v.Referer
+		enrich(v, &rep, settings)
+		if !script.run(v) {
+			// Visits that the ingest script drops are not recorded, but
+			// still get the statistics reported.
+			return "", nil
+		}
+		// The script reads what the pipeline derived, which is derived
+		// again from the user agent and referrer that the script wrote,
+		// and so is the fingerprint.
+		if v.UA != ua || v.Referer != referer {
+			enrich(v, &rep, settings)
+		}
+		if settings.UV == uvFingerprint {
+			v.Fingerprint = fingerprint(colname, v.IP, v.UA, v.Time)
+		}
+		settings.reduce(v)
+		// Visits without a visitor ID, e.g. of browsers without cookies,
+		// are identified by their IP address, as backfillUV identifies
+		// earlier visits, rather than each as a new visitor.
+		if settings.UV == uvVisitor && v.VisitorID == "" {
+			v.VisitorID = "ip:" + v.IP
+		}
+		if settings.Count == countUnique {
+			seen, err := store.viewedRecently(ctx, colname, v)
 			if err != nil {
-				err = fmt.Errorf("failed to count user view count: %w", err)
-				return
+				return "", fmt.Errorf("failed to check recent views: %w", err)
 			}
-			switch arg {
-			case "page":
-				stat.PagePV = pv
-				stat.PageUV = uv
-			case "site":
-				stat.SitePV = pv
-				stat.SiteUV = uv
+			if seen {
+				return "", nil
 			}
 		}
+		admit, err := admitQuota(ctx, colname, settings, v.Time)
+		if err != nil {
+			return "", err
+		}
+		if !admit {
+			return "", nil
+		}
+		vid, err := store.saveVisit(ctx, colname, v)
+		if err != nil {
+			return "", fmt.Errorf("failed to save visit: %w", err)
+		}
+		return vid, nil
 	}
+	return "", nil
+}
 
-	b, _ := json.Marshal(stat)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(b)
+// reportedURL returns the URL of the page that reports a visit. Pages
+// report their URL in the urlstat-url header. Some setups strip custom
+// headers, in which case the Referer header, or the Origin header if the
+// referrer is not sent, is used instead. The path of an Origin is unknown
+// and hence reported as the root path.
+func reportedURL(r *http.Request) (*url.URL, error) {
+	if loc := r.Header.Get("urlstat-url"); loc != "" {
+		return url.Parse(loc)
+	}
+	if ref := r.Referer(); ref != "" {
+		return url.Parse(ref)
+	}
+	if ori := r.Header.Get("Origin"); ori != "" && ori != "null" {
+		u, err := url.Parse(ori)
+		if err != nil {
+			return nil, err
+		}
+		u.Path = "/"
+		return u, nil
+	}
+	return nil, errors.New("missing urlstat-url header")
+}
+
+// isPrefetch reports whether the request is a prefetch or a prerender
+// of the browser rather than a visit.
+func isPrefetch(r *http.Request) bool {
+	for _, h := range []string{"Sec-Purpose", "Purpose", "X-Purpose", "X-Moz"} {
+		v := strings.ToLower(r.Header.Get(h))
+		if strings.Contains(v, "prefetch") || strings.Contains(v, "prerender") || strings.Contains(v, "preview") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether the Origin header of the request, if present,
+// has the same host as the reported URL.
+func sameOrigin(r *http.Request, u *url.URL) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	o, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(o.Host, u.Host)
 }
 
 // saveVisit saves a visit to storage.
@@ -144,48 +594,140 @@ func saveVisit(ctx context.Context, col *mongo.Collection, v *visit) (string, er
 	if v.VisitorID == "" {
 		v.VisitorID = uuid.New().String()
 	}
+	var isNew bool
+	err := retry(ctx, "first_seen", true, func(ctx context.Context) (err error) {
+		isNew, err = firstSeen(ctx, col.Name(), v.VisitorID, v.Time)
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to record visitor: %w", err)
+		return "", err
+	}
+	v.New = isNew
 
-	_, err := col.InsertOne(ctx, v)
+	// Visits that are not recorded from a page, e.g. badges, belong to
+	// the hostname of the collection.
+	if v.Host == "" {
+		v.Host = col.Name()
+	}
+	stored, _ := storedVisits(col.Name())
+	if layout == layoutSingle {
+		v.Site = col.Name()
+	}
+
+	// The ID is assigned here rather than by the database, which makes the
+	// insert idempotent: if a retried insert conflicts, a previous attempt
+	// was inserted although its response was lost.
+	doc := struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		Visit *visit             `bson:",inline"`
+	}{primitive.NewObjectID(), v}
+	attempt := 0
+	err = retry(ctx, "insert_visit", true, func(ctx context.Context) error {
+		attempt++
+		_, err := stored.InsertOne(ctx, doc, options.InsertOne().SetComment(requestID(ctx)))
+		if attempt > 1 && mongo.IsDuplicateKeyError(err) {
+			return nil
+		}
+		return err
+	})
 	if err != nil {
 		err = fmt.Errorf("failed to insert record: %w", err)
 		return "", err
 	}
+	emitVisit(col.Name())
 	return v.VisitorID, nil
 }
 
 // countVisit reports the pv and uv of the given hostname collection and path location.
-func countVisit(ctx context.Context, col *mongo.Collection, path string, mode string) (pv int64, uv int64, err error) {
+// The host mode only counts visits of the given hostname, which differs from
+// the site mode if the collection is shared by aliased hostnames.
+func countVisit(ctx context.Context, col *mongo.Collection, host, path string, mode string) (pv int64, uv int64, err error) {
+	err = retry(ctx, "count_"+mode, true, func(ctx context.Context) (err error) {
+		pv, uv, err = countVisitIn(ctx, col, host, path, mode)
+		return err
+	})
+	if err == nil {
+		compareShadow(ctx, "count_"+mode, [2]int64{pv, uv}, func(ctx context.Context, client *mongo.Client) (interface{}, error) {
+			c := client.Database(col.Database().Name()).Collection(col.Name())
+			pv, uv, err := countVisitIn(ctx, c, host, path, mode)
+			return [2]int64{pv, uv}, err
+		})
+	}
+	return
+}
+
+func countVisitIn(ctx context.Context, col *mongo.Collection, host, path string, mode string) (pv int64, uv int64, err error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
 	defer cancel()
 
+	field, err := uvFieldOf(ctx, col.Name())
+	if err != nil {
+		return
+	}
+	copts := options.Count().SetComment(requestID(ctx))
+	dopts := options.Distinct().SetComment(requestID(ctx))
 	switch mode {
 	case "site":
-		pv, err = col.CountDocuments(ctx, bson.M{})
+		if exactSitePV {
+			pv, err = col.CountDocuments(ctx, bson.M{}, copts)
+		} else {
+			pv, err = estimatedVisits(ctx, col)
+		}
 		if err != nil {
 			return
 		}
 
 		var result []interface{}
-		result, err = col.Distinct(ctx, "ip", bson.D{})
+		result, err = col.Distinct(ctx, field, bson.D{}, dopts)
 		if err != nil {
 			return
 		}
 		uv = int64(len(result))
 	case "page":
-		pv, err = col.CountDocuments(ctx, bson.M{"path": path})
+		pv, err = col.CountDocuments(ctx, bson.M{"path": path}, copts)
 		if err != nil {
 			return
 		}
 
 		var result []interface{}
-		result, err = col.Distinct(ctx, "ip", bson.D{
+		result, err = col.Distinct(ctx, field, bson.D{
 			{Key: "path", Value: bson.D{{Key: "$eq", Value: path}}},
-		})
+		}, dopts)
+		if err != nil {
+			return
+		}
+		uv = int64(len(result))
+	case "host":
+		// Visits of the hostname that owns the collection did not store
+		// their hostname before, see backfillHostnames.
+		filter := bson.M{"host": host}
+		if host == col.Name() {
+			filter = bson.M{"host": bson.M{"$in": bson.A{host, nil}}}
+		}
+		pv, err = col.CountDocuments(ctx, filter, copts)
+		if err != nil {
+			return
+		}
+
+		var result []interface{}
+		result, err = col.Distinct(ctx, field, filter, dopts)
 		if err != nil {
 			return
 		}
 		uv = int64(len(result))
 	}
 
+	// Page views without consent are counted separately.
+	anonymous := bson.M{"host": col.Name()}
+	switch mode {
+	case "page":
+		anonymous["path"] = path
+	case "host":
+		anonymous["name"] = host
+	}
+	var n int64
+	n, err = anonymousPV(ctx, anonymous)
+	pv += n
 	return
 }
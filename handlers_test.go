@@ -6,6 +6,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +18,241 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+func TestReportedURL(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		want    string
+	}{
+		{map[string]string{"urlstat-url": "https://changkun.de/blog/", "Referer": "https://golang.design/"}, "https://changkun.de/blog/"},
+		{map[string]string{"Referer": "https://golang.design/research/"}, "https://golang.design/research/"},
+		{map[string]string{"Origin": "https://golang.design"}, "https://golang.design/"},
+		{map[string]string{"Origin": "null"}, ""},
+		{map[string]string{}, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/urlstat", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		u, err := reportedURL(r)
+		if tt.want == "" {
+			if err == nil {
+				t.Fatalf("reportedURL(%v) want error, got %v", tt.headers, u)
+			}
+			continue
+		}
+		if err != nil || u.String() != tt.want {
+			t.Fatalf("reportedURL(%v) = %v, %v, want %v", tt.headers, u, err, tt.want)
+		}
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		url    string
+		want   bool
+	}{
+		{"", "https://changkun.de/blog/", true},
+		{"https://changkun.de", "https://changkun.de/blog/", true},
+		{"https://CHANGKUN.de", "https://changkun.de/", true},
+		{"https://golang.design", "https://changkun.de/", false},
+		{"null", "https://changkun.de/", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/urlstat", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		u, _ := url.Parse(tt.url)
+		if got := sameOrigin(r, u); got != tt.want {
+			t.Fatalf("sameOrigin(%q, %q) = %v, want %v", tt.origin, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestRecording(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{})
+
+	// The steps run in order against the same storage.
+	steps := []struct {
+		name    string
+		query   string
+		headers map[string]string
+		status  int
+		want    string
+		cookie  bool
+	}{
+		{
+			name:    "unregistered host",
+			headers: map[string]string{"urlstat-url": "https://golang.design/"},
+			status:  http.StatusForbidden,
+			want:    `"code":"host_not_registered"`,
+		},
+		{
+			name:    "origin not allowed",
+			headers: map[string]string{"urlstat-url": "https://example.com/"},
+			status:  http.StatusForbidden,
+			want:    `"code":"origin_not_allowed"`,
+		},
+		{
+			name:    "origin mismatch",
+			headers: map[string]string{"urlstat-url": "https://changkun.de/", "Origin": "https://golang.design"},
+			status:  http.StatusForbidden,
+			want:    `"code":"origin_mismatch"`,
+		},
+		{
+			name:    "invalid consent",
+			query:   "consent=maybe",
+			headers: map[string]string{"urlstat-url": "https://changkun.de/"},
+			status:  http.StatusBadRequest,
+			want:    `"code":"invalid_query"`,
+		},
+		{
+			name:    "new visitor",
+			query:   "report=page+site",
+			headers: map[string]string{"urlstat-url": "https://changkun.de/blog/", "Origin": "https://changkun.de"},
+			status:  http.StatusOK,
+			want:    `{"page_pv":1,"page_uv":1,"site_pv":1,"site_uv":1,"host_pv":0,"host_uv":0}`,
+			cookie:  true,
+		},
+		{
+			name:    "returning visitor",
+			query:   "report=page",
+			headers: map[string]string{"urlstat-url": "https://changkun.de/", "urlstat-vid": "0b8a0a5e-8c9f-4a35-9a8c-59d1b41b8e4b"},
+			status:  http.StatusOK,
+			want:    `{"page_pv":1,"page_uv":1,"site_pv":0,"site_uv":0,"host_pv":0,"host_uv":0}`,
+		},
+		{
+			name:    "prefetch",
+			query:   "report=site",
+			headers: map[string]string{"urlstat-url": "https://changkun.de/", "Sec-Purpose": "prefetch"},
+			status:  http.StatusOK,
+			want:    `{"page_pv":0,"page_uv":0,"site_pv":2,"site_uv":1,"host_pv":0,"host_uv":0}`,
+		},
+		{
+			name:    "consent denied",
+			query:   "report=page+host&consent=denied",
+			headers: map[string]string{"urlstat-url": "https://changkun.de/blog/"},
+			status:  http.StatusOK,
+			want:    `{"page_pv":2,"page_uv":1,"site_pv":0,"site_uv":0,"host_pv":3,"host_uv":1}`,
+		},
+	}
+	for _, s := range steps {
+		r := httptest.NewRequest("GET", "/urlstat?"+s.query, nil)
+		for k, v := range s.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		recording(w, r)
+
+		if w.Code != s.status || !strings.Contains(w.Body.String(), s.want) {
+			t.Fatalf("%s: got %d %s, want %d %s", s.name, w.Code, w.Body.String(), s.status, s.want)
+		}
+		if got := w.Header().Get("urlstat-vid") != ""; got != s.cookie {
+			t.Fatalf("%s: assigned visitor ID %v, want %v", s.name, got, s.cookie)
+		}
+		if origin := s.headers["Origin"]; origin != "" && w.Header().Get("Access-Control-Allow-Origin") != origin {
+			t.Fatalf("%s: missing CORS headers for %s", s.name, origin)
+		}
+	}
+	for _, v := range m.visits["changkun.de"] {
+		if v.Host != "changkun.de" {
+			t.Fatalf("visit of %s is stored with hostname %q", v.Path, v.Host)
+		}
+	}
+}
+
+func TestPrivateStats(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{Private: []string{"site", "page_uv"}})
+	t.Setenv("URLSTAT_ADMIN_TOKEN", "secret")
+
+	tests := []struct {
+		auth string
+		want string
+	}{
+		{"", `{"host_pv":0,"host_uv":0,"page_pv":1}`},
+		{"Bearer secret", `{"page_pv":2,"page_uv":1,"site_pv":2,"site_uv":1,"host_pv":0,"host_uv":0}`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/urlstat?report=page+site", nil)
+		r.Header.Set("urlstat-url", "https://changkun.de/")
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		recording(w, r)
+		if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != tt.want {
+			t.Fatalf("%q: got %d %s, want %s", tt.auth, w.Code, w.Body.String(), tt.want)
+		}
+	}
+
+	// Reports, GraphQL, and Grafana check the statistics they serve.
+	r := httptest.NewRequest("GET", "/urlstat/stats/timeseries?host=changkun.de", nil)
+	if err := checkPrivate(r, "changkun.de", reportStats...); !errors.Is(err, errForbidden) {
+		t.Fatalf("checkPrivate() of a report = %v, want forbidden", err)
+	}
+	if err := checkPrivate(r, "changkun.de", "page_pv"); err != nil {
+		t.Fatalf("checkPrivate() of page_pv = %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer secret")
+	if err := checkPrivate(r, "changkun.de", reportStats...); err != nil {
+		t.Fatalf("checkPrivate() of an admin = %v", err)
+	}
+
+	if err := (&siteSettings{Private: []string{"site_visitors"}}).validate(); err == nil {
+		t.Fatalf("unknown private statistic is accepted")
+	}
+}
+
+func TestGitHubBadge(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	defer func(f func(string) (string, error)) { githubRepo = f }(githubRepo)
+	githubRepo = func(loc string) (string, error) {
+		if loc != "changkun/urlstat" {
+			return "", errRepoNotFound
+		}
+		return "https://github.com/" + loc, nil
+	}
+
+	tests := []struct {
+		ua, repo string
+		status   int
+	}{
+		{"Mozilla/5.0", "changkun/urlstat", http.StatusForbidden},
+		{"github-camo (876de43e)", "changkun", http.StatusBadRequest},
+		{"github-camo (876de43e)", "someone/urlstat", http.StatusForbidden},
+		{"github-camo (876de43e)", "changkun/missing", http.StatusNotFound},
+		{"github-camo (876de43e)", "changkun/urlstat", http.StatusOK},
+		{"github-camo (876de43e)", "changkun/urlstat", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/urlstat?mode=github&repo="+tt.repo, nil)
+		r.Header.Set("User-Agent", tt.ua)
+		w := httptest.NewRecorder()
+		recording(w, r)
+		if w.Code != tt.status {
+			t.Fatalf("badge of %s by %s: got %d %s, want %d", tt.repo, tt.ua, w.Code, w.Body.String(), tt.status)
+		}
+	}
+
+	if n := len(m.visits["github.com"]); n != 2 {
+		t.Fatalf("recorded %d badge visits, want 2", n)
+	}
+	r := httptest.NewRequest("GET", "/urlstat?mode=github&repo=changkun/urlstat", nil)
+	r.Header.Set("User-Agent", "github-camo (876de43e)")
+	w := httptest.NewRecorder()
+	recording(w, r)
+	if ct := w.Header().Get("Content-Type"); ct != "image/svg+xml" || !strings.Contains(w.Body.String(), ">3<") {
+		t.Fatalf("badge is not an svg of 3 visitors: %s %s", ct, w.Body.String())
+	}
+}
+
 // FIXME: testable
 func BenchmarkCount(b *testing.B) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
@@ -28,10 +268,69 @@ func BenchmarkCount(b *testing.B) {
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			_, _, err := countVisit(context.Background(), col, "/urlstat/dashboard", "page")
+			_, _, err := countVisit(context.Background(), col, "localhost", "/urlstat/dashboard", "page")
 			if err != nil {
 				b.Fatalf("conection failed")
 			}
 		}
 	})
 }
+
+func TestIsPrefetch(t *testing.T) {
+	tests := []struct {
+		header, value string
+		want          bool
+	}{
+		{"Sec-Purpose", "prefetch", true},
+		{"Sec-Purpose", "prefetch;prerender", true},
+		{"Purpose", "prefetch", true},
+		{"X-Moz", "prefetch", true},
+		{"X-Purpose", "preview", true},
+		{"Accept", "*/*", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/urlstat", nil)
+		r.Header.Set(tt.header, tt.value)
+		if got := isPrefetch(r); got != tt.want {
+			t.Fatalf("isPrefetch(%s: %s) = %v, want %v", tt.header, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestReferer(t *testing.T) {
+	page, _ := url.Parse("https://changkun.de/blog/?utm_source=Twitter.com")
+	tests := []struct {
+		headers map[string]string
+		want    string
+	}{
+		{map[string]string{"urlstat-ref": "https://golang.design/", "Referer": "https://changkun.de/blog/"}, "https://golang.design/"},
+		{map[string]string{"urlstat-ref": "", "Referer": "https://changkun.de/blog/"}, ""},
+		// Older clients do not report the referrer of the page.
+		{map[string]string{"Referer": "https://changkun.de/"}, ""},
+		{map[string]string{"Referer": "https://golang.design/"}, "https://golang.design/"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/urlstat", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := referer(r, page); got != tt.want {
+			t.Fatalf("referer(%v) = %q, want %q", tt.headers, got, tt.want)
+		}
+	}
+
+	for query, want := range map[string]string{
+		"":                       "",
+		"utm_source=Twitter.com": "https://twitter.com/",
+		"ref=https://news.ycombinator.com/&utm_source=x": "https://news.ycombinator.com/",
+		"source=newsletter": "newsletter",
+	} {
+		u := &url.URL{Scheme: "https", Host: "changkun.de", Path: "/", RawQuery: query}
+		if got := campaignSource(u); got != want {
+			t.Fatalf("campaignSource(%q) = %q, want %q", query, got, want)
+		}
+	}
+	if c := channelOf(campaignSource(page), page.Host); c != channelSocial {
+		t.Fatalf("channel of a campaign of twitter.com: %s", c)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// health is the health of the database, which is shown in the operations
+// panel of the dashboard.
+type health struct {
+	Ping        time.Duration
+	Collections []collectionHealth
+}
+
+// collectionHealth is the size of a collection and its missing indexes.
+// Oldest and Newest are the times of the first and last visit of a visit
+// collection.
+type collectionHealth struct {
+	Database    string
+	Collection  string
+	Documents   int64 `bson:"count"`
+	Size        int64 `bson:"size"`
+	StorageSize int64 `bson:"storageSize"`
+	IndexSize   int64 `bson:"totalIndexSize"`
+	Missing     []string
+	Oldest      time.Time
+	Newest      time.Time
+}
+
+// DataSize returns the size of documents, e.g. 1.2 GiB.
+func (c collectionHealth) DataSize() string { return formatBytes(c.Size) }
+
+// DiskSize returns the size of documents and indexes on disk.
+func (c collectionHealth) DiskSize() string { return formatBytes(c.StorageSize + c.IndexSize) }
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// databaseHealth measures the ping latency of the database, and the
+// sizes of the collections of visits, of the meta database, and of the
+// trash. Indexes
+// are checked as by indexStatuses, and the first and last visit of each
+// host are found via the time index.
+func databaseHealth(ctx context.Context) (health, error) {
+	var h health
+	start := time.Now()
+	if err := db.Ping(ctx, nil); err != nil {
+		return h, fmt.Errorf("failed to ping database: %w", err)
+	}
+	h.Ping = time.Since(start)
+
+	statuses, err := indexStatuses(ctx)
+	if err != nil {
+		return h, err
+	}
+	missing := map[string][]string{}
+	for _, s := range statuses {
+		if s.Status != "present" {
+			key := s.Database + "." + s.Collection
+			missing[key] = append(missing[key], s.Index+" ("+s.Status+")")
+		}
+	}
+
+	for _, database := range []string{dbname, metaname, trashname} {
+		// Views of hosts in the single layout have no stats of their own,
+		// their visits are in colVisits.
+		cols, err := db.Database(database).ListCollectionNames(ctx, bson.M{
+			"type": "collection",
+			"name": bson.M{"$not": primitive.Regex{Pattern: `^system\.`}},
+		})
+		if err != nil {
+			return h, fmt.Errorf("failed to list collections: %w", err)
+		}
+		sort.Strings(cols)
+		for _, col := range cols {
+			c := collectionHealth{}
+			err := db.Database(database).RunCommand(ctx, bson.D{{Key: "collStats", Value: col}}).Decode(&c)
+			if err != nil {
+				return h, fmt.Errorf("failed to get stats of %s: %w", col, err)
+			}
+			c.Database, c.Collection = database, col
+			c.Missing = missing[database+"."+col]
+			if database == dbname {
+				c.Oldest, err = visitTime(ctx, col, 1)
+				if err == nil {
+					c.Newest, err = visitTime(ctx, col, -1)
+				}
+				if err != nil {
+					return h, fmt.Errorf("failed to find visits of %s: %w", col, err)
+				}
+			}
+			h.Collections = append(h.Collections, c)
+		}
+	}
+	return h, nil
+}
+
+// visitTime returns the time of the first visit of a host in the given
+// order of time, or the zero time if the host has no visits.
+func visitTime(ctx context.Context, host string, order int) (time.Time, error) {
+	var v visit
+	err := db.Database(dbname).Collection(host).FindOne(ctx, bson.M{},
+		options.FindOne().
+			SetSort(bson.D{{Key: "time", Value: order}}).
+			SetProjection(bson.M{"time": 1}).
+			SetComment(requestID(ctx))).Decode(&v)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, nil
+	}
+	return v.Time, err
+}
+
+// operations renders the operations panel of the dashboard as an HTML
+// fragment, which requires an admin API key, e.g. the cookie of the admin
+// interface. The dashboard hides the panel for other visitors.
+func operations(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	ok, err := isAdmin(ctx, adminKey(r))
+	if err != nil {
+		err = fmt.Errorf("failed to check admin key: %w", err)
+		return
+	}
+	if !ok {
+		err = errUnauthorized
+		return
+	}
+	h, err := databaseHealth(ctx)
+	if err != nil {
+		return
+	}
+
+	t, err := template.ParseFS(publicFS, "dashboard.html")
+	if err != nil {
+		err = fmt.Errorf("failed to parse dashboard.html: %w", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := t.ExecuteTemplate(w, "operations", h); err != nil {
+		l.Printf("%s failed to render operations: %v", requestID(ctx), err)
+	}
+}
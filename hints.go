@@ -0,0 +1,243 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// acceptCH are the high entropy client hints that browsers are asked to
+// send with later requests, see readClientHints. Browsers send the low
+// entropy hints, i.e. Sec-CH-UA, Sec-CH-UA-Mobile, and Sec-CH-UA-Platform,
+// with every request over HTTPS.
+const acceptCH = "Sec-CH-UA-Full-Version-List, Sec-CH-UA-Platform-Version, Sec-CH-UA-Model"
+
+// clientHints are the user agent client hints of a visit. Browsers that
+// send them freeze their user agent strings, e.g. Chrome reports Windows
+// 10 on Windows 11 and the same device model on every Android device,
+// and browsers based on Chromium, e.g. Brave, cannot be told apart by
+// their user agent strings.
+type clientHints struct {
+	// Brand is the browser, e.g. Google Chrome, and Version its major
+	// version, or its full version if the full hints are sampled.
+	Brand   string `json:"brand,omitempty"   bson:"brand,omitempty"`
+	Version string `json:"version,omitempty" bson:"version,omitempty"`
+	// Platform is the operating system, e.g. Windows or Android.
+	Platform string `json:"platform,omitempty" bson:"platform,omitempty"`
+	Mobile   bool   `json:"mobile,omitempty"   bson:"mobile,omitempty"`
+	// PlatformVersion and Model are only stored if the full hints are
+	// sampled, see siteSettings.ClientHints.
+	PlatformVersion string `json:"platform_version,omitempty" bson:"platform_version,omitempty"`
+	Model           string `json:"model,omitempty"            bson:"model,omitempty"`
+}
+
+// readClientHints returns the client hints of a request, or nil if the
+// browser does not send them. The full version of the browser, the
+// version of its platform, and the device model are only sent once the
+// browser was asked for them by acceptCH, and by cross-origin requests
+// only if the page delegates them to urlstat by its Permissions-Policy.
+func readClientHints(h http.Header) *clientHints {
+	brand, version := mainBrand(h.Get("Sec-CH-UA"))
+	if brand == "" {
+		return nil
+	}
+	ch := &clientHints{
+		Brand:           brand,
+		Version:         version,
+		Platform:        unquote(h.Get("Sec-CH-UA-Platform")),
+		Mobile:          h.Get("Sec-CH-UA-Mobile") == "?1",
+		PlatformVersion: unquote(h.Get("Sec-CH-UA-Platform-Version")),
+		Model:           unquote(h.Get("Sec-CH-UA-Model")),
+	}
+	if b, v := mainBrand(h.Get("Sec-CH-UA-Full-Version-List")); b == brand && v != "" {
+		ch.Version = v
+	}
+	return ch
+}
+
+// sample returns the hints that are stored of a visit. Without full, only
+// the low entropy hints are kept, i.e. the major version of the browser.
+func (ch *clientHints) sample(full bool) *clientHints {
+	if ch == nil || full {
+		return ch
+	}
+	low := &clientHints{Brand: ch.Brand, Version: ch.Version, Platform: ch.Platform, Mobile: ch.Mobile}
+	low.Version, _, _ = strings.Cut(low.Version, ".")
+	return low
+}
+
+// mainBrand returns the brand and version of the browser from a brand
+// list, e.g. "Chromium";v="118", "Google Chrome";v="118", "Not=A?Brand";v="99".
+// Browsers add a made up brand with Brand in its name, which is skipped,
+// and Chromium is only the brand of browsers that do not name another.
+func mainBrand(list string) (brand, version string) {
+	for _, item := range splitList(list) {
+		params := strings.Split(item, ";")
+		name := unquote(params[0])
+		if name == "" || strings.Contains(name, "Brand") {
+			continue
+		}
+		v := ""
+		for _, p := range params[1:] {
+			if k, val, ok := strings.Cut(strings.TrimSpace(p), "="); ok && k == "v" {
+				v = unquote(val)
+			}
+		}
+		if brand == "" || brand == "Chromium" {
+			brand, version = name, v
+		}
+	}
+	return brand, version
+}
+
+// splitList splits a structured header list by commas outside of quoted
+// strings.
+func splitList(s string) []string {
+	var items []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				items = append(items, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); rest != "" {
+		items = append(items, rest)
+	}
+	return items
+}
+
+// unquote returns a structured header string without its quotes.
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = strings.ReplaceAll(s[1:len(s)-1], `\"`, `"`)
+		s = strings.ReplaceAll(s, `\\`, `\`)
+	}
+	return s
+}
+
+// browserOf returns the browser of a user agent, for visits without client
+// hints.
+func browserOf(ua string) string {
+	switch {
+	case ua == "":
+		return "unknown"
+	case deviceOf(ua) == "bot":
+		return "bot"
+	case strings.Contains(ua, "Edg/") || strings.Contains(ua, "EdgA/") || strings.Contains(ua, "EdgiOS/"):
+		return "Microsoft Edge"
+	case strings.Contains(ua, "OPR/") || strings.Contains(ua, "Opera"):
+		return "Opera"
+	case strings.Contains(ua, "SamsungBrowser/"):
+		return "Samsung Internet"
+	case strings.Contains(ua, "Firefox/") || strings.Contains(ua, "FxiOS/"):
+		return "Firefox"
+	case strings.Contains(ua, "Chrome/") || strings.Contains(ua, "CriOS/"):
+		return "Google Chrome"
+	case strings.Contains(ua, "Safari/"):
+		return "Safari"
+	}
+	return "other"
+}
+
+// systemOf returns the operating system of a user agent, for visits
+// without client hints. The names are those of Sec-CH-UA-Platform.
+func systemOf(ua string) string {
+	switch {
+	case ua == "":
+		return "unknown"
+	case deviceOf(ua) == "bot":
+		return "bot"
+	case strings.Contains(ua, "Windows"):
+		return "Windows"
+	case strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad") || strings.Contains(ua, "iPod"):
+		return "iOS"
+	case strings.Contains(ua, "Mac OS X") || strings.Contains(ua, "Macintosh"):
+		return "macOS"
+	case strings.Contains(ua, "Android"):
+		return "Android"
+	case strings.Contains(ua, "CrOS"):
+		return "Chrome OS"
+	case strings.Contains(ua, "Linux"):
+		return "Linux"
+	}
+	return "other"
+}
+
+// clientShare is the number of visits of a browser or operating system,
+// and its percentage of all visits.
+type clientShare struct {
+	Name    string  `json:"name"`
+	Count   int64   `json:"count"`
+	Percent float64 `json:"percent"`
+}
+
+// clientSplit returns the number of visits of a host since the given day
+// until today per browser, or per operating system if system is set, most
+// visits first, of the visits with the given custom dimensions. Visits
+// with client hints are counted by their hints, the others by their user
+// agents, see browserOf and systemOf.
+func clientSplit(ctx context.Context, host string, dims map[string]string, since time.Time, system bool) ([]clientShare, error) {
+	field, of := "ch.brand", browserOf
+	if system {
+		field, of = "ch.platform", systemOf
+	}
+	filter := func(hinted bool) bson.M {
+		f := dimensionFilter(dims)
+		f["time"] = bson.M{"$gte": since, "$lt": time.Now().UTC().Truncate(day)}
+		f[field] = bson.M{"$exists": hinted}
+		return f
+	}
+	m := map[string]int64{}
+	hinted, err := groupVisits(ctx, host, field, since, filter(true))
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range hinted {
+		m[c.Name] += c.Count
+	}
+	uas, err := groupVisits(ctx, host, "ua", since, filter(false))
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range uas {
+		m[of(c.Name)] += c.Count
+	}
+	return clientShares(m), nil
+}
+
+// clientShares returns the shares of the counts, most visits first.
+func clientShares(m map[string]int64) []clientShare {
+	shares := []clientShare{}
+	var sum int64
+	for name, n := range m {
+		shares = append(shares, clientShare{Name: name, Count: n})
+		sum += n
+	}
+	for i := range shares {
+		shares[i].Percent = 100 * float64(shares[i].Count) / float64(sum)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].Count != shares[j].Count {
+			return shares[i].Count > shares[j].Count
+		}
+		return shares[i].Name < shares[j].Name
+	})
+	return shares
+}
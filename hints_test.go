@@ -0,0 +1,104 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestReadClientHints(t *testing.T) {
+	if ch := readClientHints(http.Header{}); ch != nil {
+		t.Fatalf("hints without headers: %+v", ch)
+	}
+
+	h := http.Header{}
+	h.Set("Sec-CH-UA", `"Chromium";v="118", "Brave";v="118", "Not=A?Brand";v="99"`)
+	h.Set("Sec-CH-UA-Mobile", "?0")
+	h.Set("Sec-CH-UA-Platform", `"Windows"`)
+	ch := readClientHints(h)
+	want := clientHints{Brand: "Brave", Version: "118", Platform: "Windows"}
+	if ch == nil || *ch != want {
+		t.Fatalf("readClientHints = %+v, want %+v", ch, want)
+	}
+
+	h.Set("Sec-CH-UA", `"Google Chrome";v="118", "Not=A?Brand";v="99", "Chromium";v="118"`)
+	h.Set("Sec-CH-UA-Full-Version-List", `"Google Chrome";v="118.0.5993.89", "Not=A?Brand";v="99.0.0.0", "Chromium";v="118.0.5993.89"`)
+	h.Set("Sec-CH-UA-Mobile", "?1")
+	h.Set("Sec-CH-UA-Platform", `"Android"`)
+	h.Set("Sec-CH-UA-Platform-Version", `"14.0.0"`)
+	h.Set("Sec-CH-UA-Model", `"Pixel 8"`)
+	ch = readClientHints(h)
+	want = clientHints{Brand: "Google Chrome", Version: "118.0.5993.89", Platform: "Android", Mobile: true, PlatformVersion: "14.0.0", Model: "Pixel 8"}
+	if ch == nil || *ch != want {
+		t.Fatalf("readClientHints = %+v, want %+v", ch, want)
+	}
+	low := clientHints{Brand: "Google Chrome", Version: "118", Platform: "Android", Mobile: true}
+	if got := ch.sample(false); *got != low {
+		t.Fatalf("sample(false) = %+v, want %+v", got, low)
+	}
+	if got := ch.sample(true); got != ch {
+		t.Fatalf("sample(true) = %+v, want %+v", got, ch)
+	}
+
+	if items := splitList(`"a,b";v="1", "c\"d";v="2"`); len(items) != 2 || items[0] != `"a,b";v="1"` || unquote(`"c\"d"`) != `c"d` {
+		t.Fatalf("splitList = %q", items)
+	}
+}
+
+func TestRecordClientHints(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{})
+	m.register("golang.design", siteSettings{ClientHints: 1})
+	m.register("qcrao.com", siteSettings{ClientHints: 1, Privacy: privacyReduced})
+
+	ch := &clientHints{Brand: "Google Chrome", Version: "118.0.5993.89", Platform: "Windows", PlatformVersion: "15.0.0"}
+	for _, host := range []string{"changkun.de", "golang.design", "qcrao.com"} {
+		u, _ := url.Parse("https://" + host + "/")
+		if _, err := recordVisit(context.Background(), visitReport{URL: u, IP: "203.0.113.1", Hints: ch}); err != nil {
+			t.Fatalf("cannot record visit: %v", err)
+		}
+	}
+	if got := m.visits["changkun.de"][0].Hints; got == nil || got.Version != "118" || got.PlatformVersion != "" {
+		t.Fatalf("low entropy hints: %+v", got)
+	}
+	if got := m.visits["golang.design"][0].Hints; got == nil || *got != *ch {
+		t.Fatalf("sampled hints: %+v", got)
+	}
+	if got := m.visits["qcrao.com"][0].Hints; got != nil {
+		t.Fatalf("hints under reduced privacy: %+v", got)
+	}
+	if err := (&siteSettings{ClientHints: 2}).validate(); err == nil {
+		t.Fatalf("client hints out of range are valid")
+	}
+}
+
+func TestClientOf(t *testing.T) {
+	for ua, want := range map[string][2]string{
+		"": {"unknown", "unknown"},
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                                                                {"bot", "bot"},
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36 Edg/118.0.2088.61":       {"Microsoft Edge", "Windows"},
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15":                   {"Safari", "macOS"},
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 16_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.1 Mobile/15E148 Safari/604.1": {"Safari", "iOS"},
+		"Mozilla/5.0 (Linux; Android 10; K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Mobile Safari/537.36":                         {"Google Chrome", "Android"},
+		"Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/119.0":                                                                  {"Firefox", "Linux"},
+		"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36":                          {"Google Chrome", "Chrome OS"},
+	} {
+		if got := browserOf(ua); got != want[0] {
+			t.Fatalf("browserOf(%q) = %s, want %s", ua, got, want[0])
+		}
+		if got := systemOf(ua); got != want[1] {
+			t.Fatalf("systemOf(%q) = %s, want %s", ua, got, want[1])
+		}
+	}
+
+	shares := clientShares(map[string]int64{"Firefox": 1, "Brave": 3, "Safari": 1})
+	if len(shares) != 3 || shares[0].Name != "Brave" || shares[0].Percent != 60 || shares[1].Name != "Firefox" {
+		t.Fatalf("unexpected shares: %+v", shares)
+	}
+}
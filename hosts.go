@@ -0,0 +1,252 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mergeHosts moves all visits of a host into another host, e.g. when a
+// site is renamed, and recomputes the derived data of the target host.
+// If the target host has no visits yet, the collection is renamed.
+func mergeHosts(ctx context.Context, from, to string) error {
+	if from == to {
+		return fmt.Errorf("%w: cannot merge %s into itself", errInvalidQuery, from)
+	}
+	names, err := db.Database(dbname).ListCollectionNames(ctx, bson.M{"name": bson.M{"$in": bson.A{from, to}}})
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	exists := map[string]bool{}
+	for _, n := range names {
+		exists[n] = true
+	}
+	if !exists[from] {
+		return fmt.Errorf("%w: host %s has no visits", errInvalidQuery, from)
+	}
+
+	switch {
+	case layout == layoutSingle:
+		// Visits only move to the view of the target, which is created
+		// when it is registered below.
+		stored, _ := storedVisits(from)
+		_, err = stored.UpdateMany(ctx, bson.M{"site": from}, bson.M{"$set": bson.M{"site": to}})
+		if err == nil {
+			err = db.Database(dbname).Collection(from).Drop(ctx)
+		}
+	case exists[to]:
+		_, err = migrateVisits(ctx,
+			db.Database(dbname).Collection(from),
+			db.Database(dbname).Collection(to), bson.M{})
+		if err != nil {
+			return fmt.Errorf("failed to copy visits: %w", err)
+		}
+		err = db.Database(dbname).Collection(from).Drop(ctx)
+	default:
+		err = db.Database("admin").RunCommand(ctx, bson.D{
+			{Key: "renameCollection", Value: dbname + "." + from},
+			{Key: "to", Value: dbname + "." + to},
+		}).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to move visits: %w", err)
+	}
+	// Moved visits that store their host take the target too.
+	stored, _ := storedVisits(to)
+	_, err = stored.UpdateMany(ctx, hostFilter(to, bson.M{"host": from}), bson.M{"$set": bson.M{"host": to}})
+	if err != nil {
+		return fmt.Errorf("failed to move visits: %w", err)
+	}
+
+	// Visitors keep the earliest first seen time of both hosts.
+	visitors := db.Database(metaname).Collection(colVisitors)
+	cur, err := visitors.Find(ctx, bson.M{"host": from})
+	if err != nil {
+		return fmt.Errorf("failed to find visitors: %w", err)
+	}
+	models := []mongo.WriteModel{}
+	for cur.Next(ctx) {
+		var v struct {
+			VisitorID string    `bson:"visitor_id"`
+			FirstSeen time.Time `bson:"first_seen"`
+		}
+		if err := cur.Decode(&v); err != nil {
+			cur.Close(ctx)
+			return fmt.Errorf("failed to decode visitor: %w", err)
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"host": to, "visitor_id": v.VisitorID}).
+			SetUpdate(bson.M{"$min": bson.M{"first_seen": v.FirstSeen}}).
+			SetUpsert(true))
+	}
+	cur.Close(ctx)
+	if len(models) > 0 {
+		_, err := visitors.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return fmt.Errorf("failed to merge visitors: %w", err)
+		}
+	}
+	_, err = db.Database(metaname).Collection(colAnonymous).UpdateMany(ctx,
+		bson.M{"host": from}, bson.M{"$set": bson.M{"host": to}})
+	if err != nil {
+		return fmt.Errorf("failed to merge anonymous counts: %w", err)
+	}
+	if err := deleteMeta(ctx, from, colRollups, colTotals, colCohorts, colVisitors, colSettings); err != nil {
+		return err
+	}
+	if err := registerHost(ctx, to); err != nil {
+		return fmt.Errorf("failed to register %s: %w", to, err)
+	}
+
+	// Rollups of the target are recomputed from the beginning.
+	if err := deleteMeta(ctx, to, colRollups); err != nil {
+		return err
+	}
+	if err := rollupHost(ctx, to, time.Time{}, time.Time{}); err != nil {
+		return fmt.Errorf("failed to roll up %s: %w", to, err)
+	}
+	if err := totalHost(ctx, to); err != nil {
+		return fmt.Errorf("failed to total %s: %w", to, err)
+	}
+	return nil
+}
+
+// deleteMeta deletes the documents of a host in the given collections of
+// the meta database.
+func deleteMeta(ctx context.Context, host string, cols ...string) error {
+	for _, c := range cols {
+		_, err := db.Database(metaname).Collection(c).DeleteMany(ctx, metaFilter(c, host))
+		if err != nil {
+			return fmt.Errorf("failed to delete %s of %s: %w", c, host, err)
+		}
+	}
+	settingsCache.Lock()
+	delete(settingsCache.m, host)
+	settingsCache.Unlock()
+	return nil
+}
+
+// metaFilter returns the filter of the documents of a host in a
+// collection of the meta database.
+func metaFilter(col, host string) bson.M {
+	// Totals and settings are keyed by host.
+	if col == colTotals || col == colSettings {
+		return bson.M{"_id": host}
+	}
+	return bson.M{"host": host}
+}
+
+// deleteHost deletes a host entirely, i.e. its visits and all its data in
+// the meta database, to decommission a site. The data is kept in the trash
+// for trashRetention, so that it can be restored, see restoreTombstone.
+func deleteHost(ctx context.Context, host string) error {
+	return buryHost(ctx, host)
+}
+
+// confirmTTL is how long a confirmation token is valid.
+const confirmTTL = 10 * time.Minute
+
+// confirmToken returns a token that confirms a destructive action on a
+// host. The token is signed with the admin key, hence it is valid on all
+// replicas but only for the holder of the key, and expires after
+// confirmTTL.
+func confirmToken(key, action, host string, now time.Time) string {
+	expires := strconv.FormatInt(now.Add(confirmTTL).Unix(), 10)
+	return expires + "." + signConfirm(key, action, host, expires)
+}
+
+// checkConfirmToken reports whether the token confirms the action on the
+// host and is not expired.
+func checkConfirmToken(key, action, host, token string, now time.Time) bool {
+	expires, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	t, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > t {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(signConfirm(key, action, host, expires)))
+}
+
+func signConfirm(key, action, host, expires string) string {
+	m := hmac.New(sha256.New, []byte(key))
+	m.Write([]byte(action + "\n" + host + "\n" + expires))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// adminHost deletes a host: DELETE /urlstat/admin/host/<host>. Without a
+// confirm query parameter, it responds a confirmation token instead,
+// which must be sent back as ?confirm=<token> within ten minutes.
+func adminHost(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+
+	key := adminKey(r)
+	ok, err := isAdmin(ctx, key)
+	if err != nil {
+		err = fmt.Errorf("failed to check admin key: %w", err)
+		return
+	}
+	if !ok {
+		err = errUnauthorized
+		return
+	}
+	host := strings.TrimPrefix(r.URL.Path, "/urlstat/admin/host/")
+	if r.Method != http.MethodDelete || host == "" || strings.Contains(host, "/") {
+		err = fmt.Errorf("%w: %s %s", errInvalidQuery, r.Method, r.URL.Path)
+		return
+	}
+
+	resp, err := confirmDeleteHost(r.WithContext(ctx), key, host)
+	if err != nil {
+		return
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// confirmDeleteHost deletes the host if the request confirms it with
+// ?confirm=<token>, otherwise it returns a confirmation token.
+func confirmDeleteHost(r *http.Request, key, host string) (interface{}, error) {
+	confirm := r.URL.Query().Get("confirm")
+	if confirm == "" {
+		return struct {
+			Confirm string `json:"confirm"`
+			Message string `json:"message"`
+		}{
+			confirmToken(key, "delete-host", host, time.Now()),
+			"repeat the request with ?confirm=<token> to delete " + host,
+		}, nil
+	}
+	return runAdmin(r, key, adminRequest{
+		Action:  "delete-host",
+		Value:   host,
+		Confirm: confirm,
+	})
+}
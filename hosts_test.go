@@ -0,0 +1,37 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfirmToken(t *testing.T) {
+	now := time.Now()
+	token := confirmToken("key", "delete-host", "example.com", now)
+
+	tests := []struct {
+		name             string
+		key, host, token string
+		now              time.Time
+		want             bool
+	}{
+		{"valid", "key", "example.com", token, now, true},
+		{"before expiry", "key", "example.com", token, now.Add(confirmTTL - time.Second), true},
+		{"expired", "key", "example.com", token, now.Add(confirmTTL + time.Second), false},
+		{"other host", "key", "other.com", token, now, false},
+		{"other key", "other", "example.com", token, now, false},
+		{"malformed", "key", "example.com", "token", now, false},
+		{"empty", "key", "example.com", "", now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkConfirmToken(tt.key, "delete-host", tt.host, tt.token, tt.now); got != tt.want {
+				t.Fatalf("checkConfirmToken() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// metaIndexes are the indexes of collections in the meta database.
+var metaIndexes = map[string][]mongo.IndexModel{
+	colRollups: {{
+		Keys:    bson.D{{Key: "host", Value: 1}, {Key: "day", Value: 1}, {Key: "path", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}},
+	colAnonymous: {{
+		Keys:    bson.D{{Key: "host", Value: 1}, {Key: "name", Value: 1}, {Key: "path", Value: 1}, {Key: "day", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}},
+	colAudit: {{
+		Keys: bson.D{{Key: "time", Value: -1}},
+	}},
+	colBlocked: {{
+		Keys: bson.D{{Key: "expires", Value: 1}},
+	}},
+	colInvites: {{
+		Keys: bson.D{{Key: "expires", Value: 1}},
+	}},
+	colCohorts: {{
+		Keys:    bson.D{{Key: "host", Value: 1}, {Key: "week", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}},
+	colCleanups: {{
+		Keys: bson.D{{Key: "policy", Value: 1}, {Key: "time", Value: -1}},
+	}},
+	colTombstones: {{
+		Keys: bson.D{{Key: "expires", Value: 1}},
+	}},
+	colVisitors: {{
+		Keys:    bson.D{{Key: "host", Value: 1}, {Key: "visitor_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}},
+}
+
+// visitIndexes are the indexes of every visit collection. They cover the
+// page and site uv, which are queried on every page view, time bounded
+// scans of reports, and pages of raw visits, which are ordered by time and
+// ID.
+var visitIndexes = []mongo.IndexModel{{
+	Keys: bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}},
+}, {
+	Keys: bson.D{{Key: "path", Value: 1}, {Key: "ip", Value: 1}},
+}, {
+	Keys: bson.D{{Key: "ip", Value: 1}},
+}}
+
+// ensureIndexes creates the indexes of the meta database and of all visit
+// collections if they do not exist yet.
+func ensureIndexes(ctx context.Context) error {
+	for col, models := range metaIndexes {
+		_, err := db.Database(metaname).Collection(col).Indexes().CreateMany(ctx, models)
+		if err != nil {
+			return fmt.Errorf("failed to create indexes of %s: %w", col, err)
+		}
+	}
+	if layout == layoutSingle {
+		return ensureViews(ctx)
+	}
+	hosts, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	for _, host := range hosts {
+		_, err := db.Database(dbname).Collection(host).Indexes().CreateMany(ctx, visitIndexes)
+		if err != nil {
+			return fmt.Errorf("failed to create indexes of %s: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// ensureViews creates the indexes of colVisits and the views of all hosts
+// that have visits in the single layout, e.g. after visits were migrated
+// from another database.
+func ensureViews(ctx context.Context) error {
+	col := db.Database(dbname).Collection(colVisits)
+	if _, err := col.Indexes().CreateMany(ctx, singleIndexes); err != nil {
+		return fmt.Errorf("failed to create indexes of %s: %w", colVisits, err)
+	}
+	sites, err := col.Distinct(ctx, "site", bson.M{})
+	if err != nil {
+		return fmt.Errorf("failed to list sites: %w", err)
+	}
+	for _, s := range sites {
+		host, ok := s.(string)
+		if !ok || host == "" {
+			continue
+		}
+		if err := createVisitStore(ctx, host); err != nil {
+			return fmt.Errorf("failed to create view of %s: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// indexStatus is the status of an index of a collection, which is one of
+// present, missing, or building.
+type indexStatus struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+	Index      string `json:"index"`
+	Status     string `json:"status"`
+}
+
+// indexStatuses reports the status of all indexes that ensureIndexes
+// creates.
+func indexStatuses(ctx context.Context) ([]indexStatus, error) {
+	building, err := buildingIndexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []indexStatus
+	check := func(database, col string, models []mongo.IndexModel) error {
+		cur, err := db.Database(database).Collection(col).Indexes().List(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list indexes of %s: %w", col, err)
+		}
+		var present []struct {
+			Name string `bson:"name"`
+		}
+		if err := cur.All(ctx, &present); err != nil {
+			return fmt.Errorf("failed to list indexes of %s: %w", col, err)
+		}
+		names := map[string]bool{}
+		for _, idx := range present {
+			names[idx.Name] = true
+		}
+		for _, m := range models {
+			s := indexStatus{
+				Database:   database,
+				Collection: col,
+				Index:      indexName(m),
+				Status:     "missing",
+			}
+			if building[database+"."+col+"."+s.Index] {
+				s.Status = "building"
+			} else if names[s.Index] {
+				s.Status = "present"
+			}
+			statuses = append(statuses, s)
+		}
+		return nil
+	}
+
+	for col, models := range metaIndexes {
+		if err := check(metaname, col, models); err != nil {
+			return nil, err
+		}
+	}
+	if layout == layoutSingle {
+		if err := check(dbname, colVisits, singleIndexes); err != nil {
+			return nil, err
+		}
+		return statuses, nil
+	}
+	hosts, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+	for _, host := range hosts {
+		if err := check(dbname, host, visitIndexes); err != nil {
+			return nil, err
+		}
+	}
+	return statuses, nil
+}
+
+// buildingIndexes returns the indexes that are currently being built,
+// as <database>.<collection>.<index>.
+func buildingIndexes(ctx context.Context) (map[string]bool, error) {
+	var result struct {
+		InProg []struct {
+			Command struct {
+				DB         string `bson:"$db"`
+				Collection string `bson:"createIndexes"`
+				Indexes    []struct {
+					Name string `bson:"name"`
+				} `bson:"indexes"`
+			} `bson:"command"`
+		} `bson:"inprog"`
+	}
+	err := db.Database("admin").RunCommand(ctx, bson.D{
+		{Key: "currentOp", Value: 1},
+		{Key: "command.createIndexes", Value: bson.M{"$exists": true}},
+	}).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list current operations: %w", err)
+	}
+	building := map[string]bool{}
+	for _, op := range result.InProg {
+		for _, idx := range op.Command.Indexes {
+			building[op.Command.DB+"."+op.Command.Collection+"."+idx.Name] = true
+		}
+	}
+	return building, nil
+}
+
+// indexName returns the name of an index, which is the default name of
+// MongoDB, e.g. host_1_day_1, unless the index is named explicitly.
+func indexName(m mongo.IndexModel) string {
+	if m.Options != nil && m.Options.Name != nil {
+		return *m.Options.Name
+	}
+	keys, _ := m.Keys.(bson.D)
+	parts := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		parts = append(parts, k.Key, fmt.Sprint(k.Value))
+	}
+	return strings.Join(parts, "_")
+}
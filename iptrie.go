@@ -0,0 +1,87 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipTrie is a binary radix tree of IP prefixes, which matches an address
+// against any number of prefixes in at most 128 steps. IPv4 prefixes are
+// stored as IPv4-mapped IPv6 prefixes, so that both families share a tree.
+type ipTrie struct {
+	root ipNode
+}
+
+type ipNode struct {
+	child [2]*ipNode
+	// terminal is set if the path to the node is a prefix of the tree.
+	terminal bool
+}
+
+// newIPTrie returns a tree of the given prefixes in CIDR notation. Plain
+// addresses are treated as single address prefixes.
+func newIPTrie(cidrs []string) (*ipTrie, error) {
+	t := &ipTrie{}
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", c)
+			}
+			if ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		t.insert(n)
+	}
+	return t, nil
+}
+
+func (t *ipTrie) insert(n *net.IPNet) {
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		ones += 96
+	}
+	ip := n.IP.To16()
+	node := &t.root
+	for i := 0; i < ones && !node.terminal; i++ {
+		b := ip[i/8] >> (7 - i%8) & 1
+		if node.child[b] == nil {
+			node.child[b] = &ipNode{}
+		}
+		node = node.child[b]
+	}
+	// A shorter prefix covers all longer ones.
+	node.terminal = true
+	node.child = [2]*ipNode{}
+}
+
+// contains reports whether the address is covered by any prefix.
+func (t *ipTrie) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	node := &t.root
+	for i := 0; i < 128; i++ {
+		if node.terminal {
+			return true
+		}
+		node = node.child[ip[i/8]>>(7-i%8)&1]
+		if node == nil {
+			return false
+		}
+	}
+	return node.terminal
+}
@@ -0,0 +1,40 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPTrie(t *testing.T) {
+	trie, err := newIPTrie([]string{"10.0.0.0/8", "192.168.1.0/24", "203.0.113.7", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.255", true},
+		{"192.168.2.1", false},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"::ffff:10.0.0.1", true},
+	}
+	for _, tt := range tests {
+		if got := trie.contains(net.ParseIP(tt.ip)); got != tt.want {
+			t.Fatalf("contains(%v) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	if _, err := newIPTrie([]string{"not an ip"}); err == nil {
+		t.Fatalf("newIPTrie with invalid address want error")
+	}
+}
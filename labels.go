@@ -0,0 +1,59 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// badgeLabels are the localized labels of badges by the language of the
+// lang parameter, e.g. /urlstat?mode=github&repo=changkun/urlstat&lang=de.
+var badgeLabels = map[string]string{
+	"de":    "Besucher",
+	"en":    "visitors",
+	"es":    "visitas",
+	"fr":    "visiteurs",
+	"ja":    "訪問者",
+	"ko":    "방문자",
+	"ru":    "посетители",
+	"zh":    "访问量",
+	"zh-tw": "訪問量",
+}
+
+// badgeLabel returns the label of the badge of the request in the language
+// of its lang parameter, which is English by default.
+func badgeLabel(q url.Values) (string, error) {
+	lang := strings.ToLower(q.Get("lang"))
+	if lang == "" {
+		lang = "en"
+	}
+	label, ok := badgeLabels[lang]
+	if !ok {
+		langs := make([]string, 0, len(badgeLabels))
+		for l := range badgeLabels {
+			langs = append(langs, l)
+		}
+		sort.Strings(langs)
+		return "", fmt.Errorf("%w: lang must be one of %s", errInvalidQuery, strings.Join(langs, ", "))
+	}
+	return label, nil
+}
+
+// badgeThemeOf returns the theme of the badge of the request by its theme
+// parameter, which is light by default.
+func badgeThemeOf(q url.Values) (badgeTheme, error) {
+	name := q.Get("theme")
+	if name == "" {
+		name = "light"
+	}
+	t, ok := badgeThemes[name]
+	if !ok {
+		return badgeTheme{}, fmt.Errorf("%w: theme must be light, dark, or auto", errInvalidQuery)
+	}
+	return t, nil
+}
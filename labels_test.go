@@ -0,0 +1,67 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBadgeLabel(t *testing.T) {
+	for lang, want := range map[string]string{"": "visitors", "de": "Besucher", "ZH": "访问量"} {
+		got, err := badgeLabel(url.Values{"lang": {lang}})
+		if err != nil || got != want {
+			t.Fatalf("lang %q: got %q, %v, want %q", lang, got, err, want)
+		}
+	}
+	if _, err := badgeLabel(url.Values{"lang": {"xx"}}); !errors.Is(err, errInvalidQuery) {
+		t.Fatalf("unknown lang: got %v", err)
+	}
+
+	// CJK glyphs are not covered by Vera and are as wide as the font size.
+	if got, want := drawer.measureString("访问量"), float64(3*fontsize+extraDx); got != want {
+		t.Fatalf("width of a CJK label: got %v, want %v", got, want)
+	}
+	if drawer.measureString("посетители") <= drawer.measureString("visitors") {
+		t.Fatalf("a Cyrillic label is measured narrower than a shorter Latin one")
+	}
+	b, err := drawer.RenderBytes("访问量", "42", colorBlue, badgeThemes["light"])
+	if err != nil || !strings.Contains(string(b), ">访问量<") {
+		t.Fatalf("failed to render a CJK badge: %v %s", err, b)
+	}
+}
+
+func TestBadgeTheme(t *testing.T) {
+	for _, tt := range []struct {
+		theme string
+		want  []string
+	}{
+		{"", []string{`fill="#555"`, `fill="#fff">visitors<`}},
+		{"dark", []string{`fill="#d0d7de"`, `fill="#24292f">visitors<`}},
+		{"auto", []string{`fill="#555"`, `@media (prefers-color-scheme: dark)`, `.subject { fill: #d0d7de }`}},
+	} {
+		theme, err := badgeThemeOf(url.Values{"theme": {tt.theme}})
+		if err != nil {
+			t.Fatalf("theme %q: %v", tt.theme, err)
+		}
+		b, err := drawer.RenderBytes("visitors", "42", colorBlue, theme)
+		if err != nil {
+			t.Fatalf("theme %q: failed to render: %v", tt.theme, err)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(string(b), w) {
+				t.Fatalf("theme %q: badge does not contain %s: %s", tt.theme, w, b)
+			}
+		}
+		if tt.theme != "auto" && strings.Contains(string(b), "<style>") {
+			t.Fatalf("theme %q: badge has a style: %s", tt.theme, b)
+		}
+	}
+	if _, err := badgeThemeOf(url.Values{"theme": {"blue"}}); !errors.Is(err, errInvalidQuery) {
+		t.Fatalf("unknown theme: got %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Storage layouts of visits, which are configured by URLSTAT_LAYOUT.
+const (
+	// layoutCollections stores the visits of each host in a collection
+	// of its own, which is the default.
+	layoutCollections = "collections"
+	// layoutSingle stores the visits of all hosts in colVisits, where
+	// the site field of a visit is the collection it belongs to. Each
+	// host has a read-only view of its visits of the same name as its
+	// collection would have, hence visits are read the same in both
+	// layouts, but they are written to colVisits, see storedVisits.
+	layoutSingle = "single"
+)
+
+// colVisits stores the visits of all hosts in the single layout. Its name
+// is not a hostname.
+const colVisits = "_visits"
+
+var layout = layoutCollections
+
+func init() {
+	switch v := os.Getenv("URLSTAT_LAYOUT"); v {
+	case "", layoutCollections:
+	case layoutSingle:
+		layout = v
+	default:
+		log.Fatalf("invalid URLSTAT_LAYOUT: %v", v)
+	}
+}
+
+// hostsFilter lists the collections, or views, of hosts in the visits
+// database, i.e. neither colVisits nor system collections.
+var hostsFilter = bson.M{"name": bson.M{"$not": primitive.Regex{Pattern: `^(_|system\.)`}}}
+
+// singleIndexes are the indexes of colVisits, which are the indexes of
+// visitIndexes per site, and the time of all visits for global queries
+// and retention.
+var singleIndexes = []mongo.IndexModel{{
+	Keys: bson.D{{Key: "site", Value: 1}, {Key: "time", Value: 1}, {Key: "_id", Value: 1}},
+}, {
+	Keys: bson.D{{Key: "site", Value: 1}, {Key: "path", Value: 1}, {Key: "ip", Value: 1}},
+}, {
+	Keys: bson.D{{Key: "site", Value: 1}, {Key: "ip", Value: 1}},
+}, {
+	Keys: bson.D{{Key: "time", Value: 1}},
+}}
+
+// storedVisits returns the collection that stores the visits of a host
+// and the filter of its visits in it. Visits are written there, and
+// updated or deleted with filters that include the filter of the host.
+func storedVisits(host string) (*mongo.Collection, bson.M) {
+	if layout == layoutSingle {
+		return db.Database(dbname).Collection(colVisits), bson.M{"site": host}
+	}
+	return db.Database(dbname).Collection(host), bson.M{}
+}
+
+// hostFilter returns the filter of the visits of a host that match the
+// filter in its stored collection, see storedVisits.
+func hostFilter(host string, filter bson.M) bson.M {
+	_, f := storedVisits(host)
+	for k, v := range filter {
+		f[k] = v
+	}
+	return f
+}
+
+// createVisitStore prepares the storage of the visits of a host, i.e. its
+// indexed collection, or its view in the single layout.
+func createVisitStore(ctx context.Context, host string) error {
+	if layout != layoutSingle {
+		_, err := db.Database(dbname).Collection(host).Indexes().CreateMany(ctx, visitIndexes)
+		return err
+	}
+	err := db.Database(dbname).RunCommand(ctx, bson.D{
+		{Key: "create", Value: host},
+		{Key: "viewOn", Value: colVisits},
+		{Key: "pipeline", Value: bson.A{bson.M{"$match": bson.M{"site": host}}}},
+	}).Err()
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceExists" {
+		return nil
+	}
+	return err
+}
+
+// estimatedVisits returns the number of visits of a collection of a host,
+// which is estimated from collection metadata in the collections layout,
+// and counted by the index of colVisits in the single layout, as views
+// have no metadata.
+func estimatedVisits(ctx context.Context, col *mongo.Collection) (int64, error) {
+	if layout == layoutSingle {
+		return col.CountDocuments(ctx, bson.M{}, options.Count().SetComment(requestID(ctx)))
+	}
+	return col.EstimatedDocumentCount(ctx, options.EstimatedDocumentCount().SetComment(requestID(ctx)))
+}
+
+// layoutCommand moves the visits of hosts from their collections into the
+// single layout, and replaces each collection by a view. Hosts are moved
+// one after another, and a host whose collection is a view already is
+// skipped, hence an interrupted move continues when it runs again. The
+// visits of a host cannot be read between the drop of its collection and
+// the creation of its view, which takes milliseconds.
+//
+// Usage:
+//
+//	URLSTAT_LAYOUT=single urlstat layout [-host 'blog.*' ...]
+func layoutCommand(args []string) error {
+	var hosts globs
+	flags := flag.NewFlagSet("layout", flag.ExitOnError)
+	flags.Var(&hosts, "host", "only move hosts matching the glob, can be repeated")
+	flags.Parse(args)
+
+	if layout != layoutSingle {
+		return errors.New("layout requires URLSTAT_LAYOUT=single")
+	}
+	ctx := context.Background()
+	if err := ensureIndexes(ctx); err != nil {
+		return err
+	}
+	specs, err := db.Database(dbname).ListCollectionSpecifications(ctx,
+		bson.M{"$and": bson.A{hostsFilter, bson.M{"type": "collection"}}})
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	for _, s := range specs {
+		if !hosts.match(s.Name) {
+			continue
+		}
+		start := time.Now()
+		n, err := moveToSingle(ctx, s.Name)
+		if err != nil {
+			return fmt.Errorf("failed to move %s: %w", s.Name, err)
+		}
+		l.Printf("moved %d visits of %s in %v", n, s.Name, time.Since(start))
+	}
+	return nil
+}
+
+// moveToSingle moves the visits of the collection of a host into
+// colVisits, and replaces the collection by the view of the host.
+func moveToSingle(ctx context.Context, host string) (int64, error) {
+	col := db.Database(dbname).Collection(host)
+	// Visits keep their IDs, which are unique across collections, hence
+	// a visit that was moved before is kept.
+	cur, err := col.Aggregate(ctx, mongo.Pipeline{
+		bson.D{{Key: "$set", Value: bson.M{"site": host}}},
+		bson.D{{Key: "$merge", Value: bson.M{
+			"into":           colVisits,
+			"on":             "_id",
+			"whenMatched":    "keepExisting",
+			"whenNotMatched": "insert",
+		}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, err
+	}
+	cur.Close(ctx)
+
+	n, err := col.EstimatedDocumentCount(ctx)
+	if err != nil {
+		return 0, err
+	}
+	moved, err := db.Database(dbname).Collection(colVisits).CountDocuments(ctx, bson.M{"site": host})
+	if err != nil {
+		return 0, err
+	}
+	// Visits that are recorded during the move are in the collection but
+	// not moved yet, hence the move is repeated.
+	if moved < n {
+		return 0, fmt.Errorf("moved %d of %d visits, please run again", moved, n)
+	}
+	if err := col.Drop(ctx); err != nil {
+		return 0, err
+	}
+	return moved, createVisitStore(ctx, host)
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestStoredVisits(t *testing.T) {
+	defer func(l string) { layout = l }(layout)
+
+	tests := []struct {
+		layout string
+		col    string
+		filter bson.M
+	}{
+		{layoutCollections, "changkun.de", bson.M{"path": "/"}},
+		{layoutSingle, colVisits, bson.M{"site": "changkun.de", "path": "/"}},
+	}
+	for _, tt := range tests {
+		layout = tt.layout
+		col, _ := storedVisits("changkun.de")
+		if col.Name() != tt.col {
+			t.Fatalf("%s: visits are stored in %s, want %s", tt.layout, col.Name(), tt.col)
+		}
+		if f := hostFilter("changkun.de", bson.M{"path": "/"}); !reflect.DeepEqual(f, tt.filter) {
+			t.Fatalf("%s: filter %v, want %v", tt.layout, f, tt.filter)
+		}
+	}
+}
+
+func TestHostsFilter(t *testing.T) {
+	re := regexp.MustCompile(hostsFilter["name"].(bson.M)["$not"].(primitive.Regex).Pattern)
+	for name, host := range map[string]bool{
+		"changkun.de":  true,
+		"github.com":   true,
+		colVisits:      false,
+		"system.views": false,
+	} {
+		if got := !re.MatchString(name); got != host {
+			t.Fatalf("%s is listed as host: %v, want %v", name, got, host)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colLeases stores the leases of background jobs, see acquireLease.
+const colLeases = "leases"
+
+// instanceID identifies this process among the replicas of a deployment.
+var instanceID = func() string {
+	host, _ := os.Hostname()
+	return host + "-" + uuid.New().String()[:8]
+}()
+
+// acquireLease acquires or renews the lease of the named job for this
+// instance, and reports whether this instance holds the lease. Replicas
+// share the database, hence a job that must run once per deployment,
+// e.g. the rollup worker that sends alerts, only runs on the holder of
+// its lease. If the holder stops, the lease expires after ttl and
+// another replica takes over.
+func acquireLease(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	_, err := db.Database(metaname).Collection(colLeases).UpdateOne(ctx,
+		bson.M{"_id": name, "$or": bson.A{
+			bson.M{"owner": instanceID},
+			bson.M{"expires": bson.M{"$lt": now}},
+		}},
+		bson.M{"$set": bson.M{"owner": instanceID, "expires": now.Add(ttl)}},
+		options.Update().SetUpsert(true))
+	// The upsert conflicts with the lease of another instance.
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
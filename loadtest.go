@@ -0,0 +1,243 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadtestCommand sends visits to /urlstat at a target rate and reports
+// latency percentiles and error rates, e.g. to plan the capacity of a
+// deployment:
+//
+//	urlstat loadtest -url http://localhost/urlstat -rps 200 -duration 1m
+//
+// Visits are synthetic by default, or replayed in a loop from JSON lines
+// that are exported by urlstat export -format jsonl, at the target rate
+// rather than their recorded times. The reported site must be
+// allowed by the target, hence it is best run against a deployment that is
+// not in production, which allows http://localhost. Note that the visits
+// are recorded like any other visit.
+func loadtestCommand(args []string) error {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	target := flags.String("url", "http://localhost/urlstat", "recording endpoint of the target")
+	site := flags.String("site", "http://localhost", "origin of the reported pages")
+	rps := flags.Float64("rps", 100, "target requests per second")
+	duration := flags.Duration("duration", 30*time.Second, "duration of the test")
+	concurrency := flags.Int("concurrency", 256, "maximum requests in flight, requests beyond are dropped")
+	report := flags.String("report", "page+site", "statistics to report, as client.js requests them")
+	replay := flags.String("replay", "", "JSON lines of visits to replay, synthetic visits if empty")
+	flags.Parse(args)
+
+	if *rps <= 0 || *concurrency < 1 {
+		return errors.New("rps and concurrency must be positive")
+	}
+	next := syntheticVisit
+	if *replay != "" {
+		visits, err := readVisits(*replay)
+		if err != nil {
+			return err
+		}
+		if len(visits) == 0 {
+			return fmt.Errorf("no visits in %s", *replay)
+		}
+		i := 0
+		next = func() visit {
+			v := visits[i%len(visits)]
+			i++
+			return v
+		}
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConns:        *concurrency,
+			MaxIdleConnsPerHost: *concurrency,
+		},
+	}
+	endpoint := *target
+	if *report != "" {
+		endpoint += "?report=" + *report
+	}
+
+	res := &loadResult{statuses: map[string]int{}}
+	inflight := make(chan struct{}, *concurrency)
+	wg := sync.WaitGroup{}
+	t := time.NewTicker(time.Duration(float64(time.Second) / *rps))
+	defer t.Stop()
+	start := time.Now()
+	for time.Since(start) < *duration {
+		<-t.C
+		select {
+		case inflight <- struct{}{}:
+		default:
+			res.add("dropped", 0)
+			continue
+		}
+		v := next()
+		wg.Add(1)
+		go func() {
+			defer func() { <-inflight; wg.Done() }()
+			res.add(sendVisit(client, endpoint, *site, v))
+		}()
+	}
+	wg.Wait()
+	res.print(os.Stdout, time.Since(start))
+	return nil
+}
+
+// sendVisit reports a visit as client.js does, and returns the status and
+// the latency of the request.
+func sendVisit(client *http.Client, endpoint, site string, v visit) (string, time.Duration) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "error", 0
+	}
+	req.Header.Set("Origin", site)
+	req.Header.Set("urlstat-url", site+v.Path)
+	req.Header.Set("urlstat-ua", v.UA)
+	req.Header.Set("X-Forwarded-For", v.IP)
+	if v.Referer != "" {
+		req.Header.Set("Referer", v.Referer)
+	}
+	if v.VisitorID != "" {
+		req.Header.Set("urlstat-vid", v.VisitorID)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "error", time.Since(start)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return fmt.Sprint(resp.StatusCode), time.Since(start)
+}
+
+var (
+	loadPaths = []string{"/", "/blog/", "/about/", "/research/", "/blog/2021/", "/blog/2022/", "/archive/", "/feed.xml"}
+	loadUAs   = []string{
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.1 Safari/605.1.15",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/108.0.0.0 Safari/537.36",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:107.0) Gecko/20100101 Firefox/107.0",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 16_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.1 Mobile/15E148 Safari/604.1",
+	}
+)
+
+// syntheticVisit returns a random visit. Popular paths are visited more
+// often, and visitors come from a pool of addresses in 198.18.0.0/15,
+// which is reserved for benchmarks.
+func syntheticVisit() visit {
+	p := rand.ExpFloat64() * 2
+	if p >= float64(len(loadPaths)) {
+		p = float64(len(loadPaths) - 1)
+	}
+	n := rand.Intn(1 << 12)
+	return visit{
+		Path: loadPaths[int(p)],
+		IP:   fmt.Sprintf("198.18.%d.%d", n>>8, n&0xff),
+		UA:   loadUAs[rand.Intn(len(loadUAs))],
+	}
+}
+
+// readVisits reads visits from a file of JSON lines.
+func readVisits(file string) ([]visit, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var visits []visit
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		var v visit
+		if err := json.Unmarshal(s.Bytes(), &v); err != nil {
+			return nil, fmt.Errorf("invalid visit %q: %w", s.Text(), err)
+		}
+		visits = append(visits, v)
+	}
+	return visits, s.Err()
+}
+
+// loadResult collects the statuses and latencies of a load test.
+type loadResult struct {
+	mu        sync.Mutex
+	statuses  map[string]int
+	latencies []time.Duration
+}
+
+func (r *loadResult) add(status string, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.statuses[status]++
+	if status != "dropped" {
+		r.latencies = append(r.latencies, latency)
+	}
+}
+
+func (r *loadResult) print(w io.Writer, elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	total, failed := 0, 0
+	statuses := make([]string, 0, len(r.statuses))
+	for s, n := range r.statuses {
+		statuses = append(statuses, s)
+		total += n
+		if s != "200" {
+			failed += n
+		}
+	}
+	sort.Strings(statuses)
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+
+	fmt.Fprintf(w, "requests: %d in %v (%.1f/s)\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	if total > 0 {
+		fmt.Fprintf(w, "errors:   %d (%.2f%%)\n", failed, 100*float64(failed)/float64(total))
+	}
+	for _, s := range statuses {
+		fmt.Fprintf(w, "  %-8s %d\n", s, r.statuses[s])
+	}
+	fmt.Fprintln(w, "latency:")
+	for _, p := range []float64{50, 90, 99, 99.9, 100} {
+		fmt.Fprintf(w, "  p%-6v %v\n", p, percentile(r.latencies, p).Round(time.Microsecond))
+	}
+}
+
+// percentile returns the p-th percentile of sorted durations using the
+// nearest rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
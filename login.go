@@ -0,0 +1,226 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Users log in with GitHub if an OAuth app is configured, which makes the
+// instance multi-user: reports are only visible to admins and the owners
+// of a site, see siteSettings.Owners. The OAuth app is configured by
+// environment variables:
+//
+//	URLSTAT_GITHUB_CLIENT_ID: the client ID of the OAuth app
+//	URLSTAT_GITHUB_CLIENT_SECRET: the client secret of the OAuth app
+//	URLSTAT_SESSION_SECRET: the secret that signs sessions, which must be the same on all replicas
+//
+// The callback URL of the app is https://<domain>/urlstat/login/callback.
+var (
+	githubClientID     = os.Getenv("URLSTAT_GITHUB_CLIENT_ID")
+	githubClientSecret = os.Getenv("URLSTAT_GITHUB_CLIENT_SECRET")
+	sessionSecret      = os.Getenv("URLSTAT_SESSION_SECRET")
+)
+
+func init() {
+	if githubClientID != "" && (githubClientSecret == "" || len(sessionSecret) < 16) {
+		log.Fatalf("URLSTAT_GITHUB_CLIENT_ID requires URLSTAT_GITHUB_CLIENT_SECRET and a URLSTAT_SESSION_SECRET of at least 16 bytes")
+	}
+}
+
+// multiUser reports whether users log in, see githubClientID.
+func multiUser() bool { return githubClientID != "" }
+
+const (
+	sessionCookie = "urlstat_session"
+	stateCookie   = "urlstat_oauth_state"
+	sessionTTL    = 7 * day
+)
+
+// login redirects to GitHub to log in: /urlstat/login. GitHub redirects
+// back to loginCallback.
+func login(w http.ResponseWriter, r *http.Request) {
+	if !multiUser() {
+		http.NotFound(w, r)
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	state := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/urlstat/login",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   source.Production,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "https://github.com/login/oauth/authorize?"+url.Values{
+		"client_id": {githubClientID},
+		"state":     {state},
+	}.Encode(), http.StatusFound)
+}
+
+// loginCallback logs in the GitHub user that authorized the OAuth app:
+// /urlstat/login/callback?code=...&state=...
+func loginCallback(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	if !multiUser() {
+		http.NotFound(w, r)
+		return
+	}
+	c, cerr := r.Cookie(stateCookie)
+	state := r.URL.Query().Get("state")
+	if cerr != nil || state == "" || !hmac.Equal([]byte(c.Value), []byte(state)) {
+		err = fmt.Errorf("%w: invalid OAuth state", errUnauthorized)
+		return
+	}
+	name, err := githubLogin(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/urlstat/login", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    newSession(name, time.Now()),
+		Path:     "/urlstat",
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   source.Production,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/urlstat/dashboard", http.StatusFound)
+}
+
+// logout ends the session of a user: /urlstat/logout.
+func logout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/urlstat", MaxAge: -1})
+	http.Redirect(w, r, "/urlstat/dashboard", http.StatusFound)
+}
+
+// githubLogin exchanges the code of an OAuth callback for an access token
+// and returns the lower case login of its user. Tests replace it.
+var githubLogin = func(ctx context.Context, code string) (string, error) {
+	if code == "" {
+		return "", fmt.Errorf("%w: missing OAuth code", errUnauthorized)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://github.com/login/oauth/access_token",
+		strings.NewReader(url.Values{
+			"client_id":     {githubClientID},
+			"client_secret": {githubClientSecret},
+			"code":          {code},
+		}.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := githubJSON(req, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("%w: %s", errUnauthorized, token.Error)
+	}
+
+	var user struct {
+		Login string `json:"login"`
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, "https://api.github.com/user", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	if err := githubJSON(req, &user); err != nil {
+		return "", err
+	}
+	if user.Login == "" {
+		return "", fmt.Errorf("%w: no login of GitHub user", errGitHubFailed)
+	}
+	return strings.ToLower(user.Login), nil
+}
+
+// githubJSON sends a request to GitHub and decodes its JSON response.
+func githubJSON(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errGitHubFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s %s", errGitHubFailed, req.URL, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", errGitHubFailed, err)
+	}
+	return nil
+}
+
+// newSession returns the value of the session cookie of a user, which is
+// its login and expiry signed with the session secret, so that replicas
+// need no session storage.
+func newSession(name string, now time.Time) string {
+	expires := strconv.FormatInt(now.Add(sessionTTL).Unix(), 10)
+	return name + "." + expires + "." + signSession(name, expires)
+}
+
+// sessionLogin returns the login of the session of the request, or an
+// empty string if there is none or it expired.
+func sessionLogin(r *http.Request, now time.Time) string {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	// GitHub logins have no dots.
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	name, expires, sig := parts[0], parts[1], parts[2]
+	t, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > t {
+		return ""
+	}
+	if !hmac.Equal([]byte(sig), []byte(signSession(name, expires))) {
+		return ""
+	}
+	return name
+}
+
+func signSession(name, expires string) string {
+	m := hmac.New(sha256.New, []byte(sessionSecret))
+	m.Write([]byte(name + "\n" + expires))
+	return hex.EncodeToString(m.Sum(nil))
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withLogin(t *testing.T) {
+	id, secret := githubClientID, sessionSecret
+	githubClientID, sessionSecret = "client", "0123456789abcdef"
+	t.Cleanup(func() { githubClientID, sessionSecret = id, secret })
+}
+
+func TestSession(t *testing.T) {
+	withLogin(t)
+	now := time.Now()
+	session := newSession("changkun", now)
+
+	tests := []struct {
+		value string
+		now   time.Time
+		want  string
+	}{
+		{session, now, "changkun"},
+		{session, now.Add(sessionTTL + time.Second), ""},
+		{"golang" + session[len("changkun"):], now, ""},
+		{session + "0", now, ""},
+		{"changkun", now, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/urlstat/dashboard", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.value})
+		if got := sessionLogin(r, tt.now); got != tt.want {
+			t.Fatalf("login of session %s: %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCanView(t *testing.T) {
+	withLogin(t)
+	settingsCache.Lock()
+	settingsCache.m["changkun.de"] = cachedSettings{
+		&siteSettings{Host: "changkun.de", Owners: []string{"changkun"}},
+		time.Now().Add(time.Hour),
+	}
+	settingsCache.Unlock()
+	t.Cleanup(func() {
+		settingsCache.Lock()
+		delete(settingsCache.m, "changkun.de")
+		settingsCache.Unlock()
+	})
+
+	tests := []struct {
+		viewer *viewer
+		want   bool
+	}{
+		{nil, false},
+		{&viewer{login: "changkun"}, true},
+		{&viewer{login: "golang"}, false},
+		{&viewer{admin: true}, true},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.viewer != nil {
+			ctx = context.WithValue(ctx, viewerKey{}, tt.viewer)
+		}
+		got, err := canView(ctx, "changkun.de")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Fatalf("viewer %+v views changkun.de: %v, want %v", tt.viewer, got, tt.want)
+		}
+	}
+}
+
+func TestGrafanaScoped(t *testing.T) {
+	withLogin(t)
+	settingsCache.Lock()
+	settingsCache.m["changkun.de"] = cachedSettings{
+		&siteSettings{Host: "changkun.de", Owners: []string{"changkun"}},
+		time.Now().Add(time.Hour),
+	}
+	settingsCache.Unlock()
+	t.Cleanup(func() {
+		settingsCache.Lock()
+		delete(settingsCache.m, "changkun.de")
+		settingsCache.Unlock()
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/urlstat/grafana/search", nil)
+	w := httptest.NewRecorder()
+	grafana(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous search: %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	body := `{"range":{"from":"2021-03-01T00:00:00Z","to":"2021-03-02T00:00:00Z"},"targets":[{"target":"pv:changkun.de"}]}`
+	r = httptest.NewRequest(http.MethodPost, "/urlstat/grafana/query", strings.NewReader(body))
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: newSession("golang", time.Now())})
+	w = httptest.NewRecorder()
+	grafana(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("query of another site: %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	t.Setenv("URLSTAT_GRAFANA_TOKEN", "secret")
+	r = httptest.NewRequest(http.MethodGet, "/urlstat/grafana/", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	grafana(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("request with token: %d, want %d", w.Code, http.StatusOK)
+	}
+}
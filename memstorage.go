@@ -0,0 +1,145 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memStorage stores visits in memory, so that handlers can be tested, and
+// the demo can run, without a database.
+type memStorage struct {
+	mu         sync.Mutex
+	registered map[string]*siteSettings
+	visits     map[string][]visit
+	anonymous  map[string][]visit
+	blocked    []blockedActor
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		registered: map[string]*siteSettings{},
+		visits:     map[string][]visit{},
+		anonymous:  map[string][]visit{},
+	}
+}
+
+// register registers a collection with the given settings.
+func (m *memStorage) register(col string, s siteSettings) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s.Host, s.registered = col, true
+	if err := s.validate(); err != nil {
+		panic(err)
+	}
+	m.registered[col] = &s
+}
+
+func (m *memStorage) settings(ctx context.Context, col string) (*siteSettings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.registered[col]; ok {
+		return s, nil
+	}
+	return &siteSettings{Host: col}, nil
+}
+
+func (m *memStorage) viewedRecently(ctx context.Context, col string, v *visit) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, w := range m.visits[col] {
+		if w.IP == v.IP && w.UA == v.UA && w.Path == v.Path && !w.Time.Before(v.Time.Add(-sessionGap)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memStorage) saveVisit(ctx context.Context, col string, v *visit) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v.VisitorID == "" {
+		v.VisitorID = uuid.New().String()
+	}
+	if v.Host == "" {
+		v.Host = col
+	}
+	v.New = true
+	for _, w := range m.visits[col] {
+		if w.VisitorID == v.VisitorID {
+			v.New = false
+			break
+		}
+	}
+	m.visits[col] = append(m.visits[col], *v)
+	return v.VisitorID, nil
+}
+
+func (m *memStorage) countAnonymous(ctx context.Context, col, host, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.anonymous[col] = append(m.anonymous[col], visit{Host: host, Path: path})
+	return nil
+}
+
+func (m *memStorage) countVisit(ctx context.Context, col, host, path, mode string) (pv, uv int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Visits of the hostname that owns the collection did not store their
+	// hostname before, anonymous page views always do.
+	match := func(v visit, anonymous bool) bool {
+		switch mode {
+		case "page":
+			return v.Path == path
+		case "host":
+			return v.Host == host || !anonymous && v.Host == "" && host == col
+		}
+		return true
+	}
+	ips := map[string]bool{}
+	for _, v := range m.visits[col] {
+		if match(v, false) {
+			pv++
+			ips[v.IP] = true
+		}
+	}
+	for _, v := range m.anonymous[col] {
+		if match(v, true) {
+			pv++
+		}
+	}
+	return pv, int64(len(ips)), nil
+}
+
+func (m *memStorage) countSince(ctx context.Context, col string, since time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for _, v := range m.visits[col] {
+		if !v.Time.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memStorage) blockActor(ctx context.Context, a *blockedActor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.blocked = append(m.blocked, *a)
+	return nil
+}
@@ -0,0 +1,13 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+// useMemStorage replaces the storage of handlers with an in-memory storage
+// until the returned function is called.
+func useMemStorage() (*memStorage, func()) {
+	m, old := newMemStorage(), store
+	store = m
+	return m, func() { store = old }
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// metrics exposes process metrics and per site counters in the Prometheus
+// text exposition format. Site counters are read from the totals that are
+// maintained by the rollup worker, hence scraping never scans visits.
+func metrics(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	cur, err := db.Database(metaname).Collection(colTotals).Find(ctx, bson.M{})
+	if err != nil {
+		err = fmt.Errorf("failed to find totals: %w", err)
+		return
+	}
+	var totals []total
+	if err = cur.All(ctx, &totals); err != nil {
+		err = fmt.Errorf("failed to find totals: %w", err)
+		return
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	b := &bytes.Buffer{}
+	fmt.Fprintln(b, "# HELP go_goroutines Number of goroutines that currently exist.")
+	fmt.Fprintln(b, "# TYPE go_goroutines gauge")
+	fmt.Fprintf(b, "go_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintln(b, "# HELP go_memstats_heap_alloc_bytes Number of heap bytes allocated and still in use.")
+	fmt.Fprintln(b, "# TYPE go_memstats_heap_alloc_bytes gauge")
+	fmt.Fprintf(b, "go_memstats_heap_alloc_bytes %d\n", ms.HeapAlloc)
+	fmt.Fprintln(b, "# HELP process_start_time_seconds Start time of the process since unix epoch in seconds.")
+	fmt.Fprintln(b, "# TYPE process_start_time_seconds gauge")
+	fmt.Fprintf(b, "process_start_time_seconds %d\n", startTime.Unix())
+
+	if err = writeSiteMetrics(b, r.WithContext(ctx), totals); err != nil {
+		return
+	}
+
+	fmt.Fprintln(b, "# HELP urlstat_ingest_in_flight Visits that are being recorded.")
+	fmt.Fprintln(b, "# TYPE urlstat_ingest_in_flight gauge")
+	fmt.Fprintf(b, "urlstat_ingest_in_flight %d\n", len(ingestLimiter.running))
+	fmt.Fprintln(b, "# HELP urlstat_ingest_queued Visits that are being recorded or wait to be recorded.")
+	fmt.Fprintln(b, "# TYPE urlstat_ingest_queued gauge")
+	fmt.Fprintf(b, "urlstat_ingest_queued %d\n", len(ingestLimiter.queued))
+	fmt.Fprintln(b, "# HELP urlstat_ingest_rejected_total Visits that were rejected because the service was overloaded.")
+	fmt.Fprintln(b, "# TYPE urlstat_ingest_rejected_total counter")
+	fmt.Fprintf(b, "urlstat_ingest_rejected_total{reason=\"queue_full\"} %d\n", ingestLimiter.rejected.Load())
+	fmt.Fprintf(b, "urlstat_ingest_rejected_total{reason=\"timeout\"} %d\n", ingestLimiter.timedOut.Load())
+	fmt.Fprintln(b, "# HELP urlstat_sink_dropped_total Saved visits that were not published to the sink.")
+	fmt.Fprintln(b, "# TYPE urlstat_sink_dropped_total counter")
+	fmt.Fprintf(b, "urlstat_sink_dropped_total %d\n", sinkDropped.Load())
+	fmt.Fprintln(b, "# HELP urlstat_sink_queued Saved visits that wait to be published to the sink.")
+	fmt.Fprintln(b, "# TYPE urlstat_sink_queued gauge")
+	fmt.Fprintf(b, "urlstat_sink_queued %d\n", sinkPending.Load())
+
+	if c, ok := store.(*countCache); ok {
+		fmt.Fprintln(b, "# HELP urlstat_count_cache_requests_total Counts of pages, sites, and hosts by cache result.")
+		fmt.Fprintln(b, "# TYPE urlstat_count_cache_requests_total counter")
+		fmt.Fprintf(b, "urlstat_count_cache_requests_total{result=\"hit\"} %d\n", c.hits.Load())
+		fmt.Fprintf(b, "urlstat_count_cache_requests_total{result=\"miss\"} %d\n", c.misses.Load())
+	}
+
+	retryCounts.Lock()
+	if len(retryCounts.retried)+len(retryCounts.failed) > 0 {
+		fmt.Fprintln(b, "# HELP urlstat_db_retries_total Database operations that were retried after a transient error.")
+		fmt.Fprintln(b, "# TYPE urlstat_db_retries_total counter")
+		for op, n := range retryCounts.retried {
+			fmt.Fprintf(b, "urlstat_db_retries_total{op=\"%s\"} %d\n", op, n)
+		}
+		fmt.Fprintln(b, "# HELP urlstat_db_retry_failures_total Database operations that failed after all retries.")
+		fmt.Fprintln(b, "# TYPE urlstat_db_retry_failures_total counter")
+		for op, n := range retryCounts.failed {
+			fmt.Fprintf(b, "urlstat_db_retry_failures_total{op=\"%s\"} %d\n", op, n)
+		}
+	}
+	retryCounts.Unlock()
+
+	if queries := shadowQueries(); len(queries) > 0 {
+		shadowCounts.Lock()
+		fmt.Fprintln(b, "# HELP urlstat_shadow_reads_total Reads compared against the shadow database.")
+		fmt.Fprintln(b, "# TYPE urlstat_shadow_reads_total counter")
+		for _, q := range queries {
+			fmt.Fprintf(b, "urlstat_shadow_reads_total{query=\"%s\"} %d\n", q, shadowCounts.compared[q])
+		}
+		fmt.Fprintln(b, "# HELP urlstat_shadow_mismatches_total Reads whose shadow result differs.")
+		fmt.Fprintln(b, "# TYPE urlstat_shadow_mismatches_total counter")
+		for _, q := range queries {
+			fmt.Fprintf(b, "urlstat_shadow_mismatches_total{query=\"%s\"} %d\n", q, shadowCounts.mismatched[q])
+		}
+		shadowCounts.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// writeSiteMetrics writes the counters of the sites of the totals. Those
+// that are private, see siteSettings.Private, are left out unless the
+// request sees them.
+func writeSiteMetrics(b *bytes.Buffer, r *http.Request, totals []total) error {
+	var pv, uv []total
+	for _, t := range totals {
+		settings, err := store.settings(r.Context(), t.Host)
+		if err != nil {
+			return fmt.Errorf("failed to load settings: %w", err)
+		}
+		seen := true
+		if settings.isPrivate("site_pv") || settings.isPrivate("site_uv") {
+			if seen, err = seesPrivate(r, settings); err != nil {
+				return err
+			}
+		}
+		if seen || !settings.isPrivate("site_pv") {
+			pv = append(pv, t)
+		}
+		if seen || !settings.isPrivate("site_uv") {
+			uv = append(uv, t)
+		}
+	}
+
+	fmt.Fprintln(b, "# HELP urlstat_site_pv_total Page views of a site.")
+	fmt.Fprintln(b, "# TYPE urlstat_site_pv_total counter")
+	for _, t := range pv {
+		fmt.Fprintf(b, "urlstat_site_pv_total{host=\"%s\"} %d\n", escapeLabel(t.Host), t.PV)
+	}
+	fmt.Fprintln(b, "# HELP urlstat_site_uv Unique visitors of a site.")
+	fmt.Fprintln(b, "# TYPE urlstat_site_uv gauge")
+	for _, t := range uv {
+		fmt.Fprintf(b, "urlstat_site_uv{host=\"%s\"} %d\n", escapeLabel(t.Host), t.UV)
+	}
+	return nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
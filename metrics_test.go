@@ -0,0 +1,55 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSiteMetricsPrivate(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{Private: []string{"site_uv"}})
+	m.register("golang.design", siteSettings{Private: []string{"site"}})
+	m.register("blog.changkun.de", siteSettings{})
+	t.Setenv("URLSTAT_ADMIN_TOKEN", "secret")
+
+	totals := []total{{Host: "changkun.de", PV: 1, UV: 2}, {Host: "golang.design", PV: 3, UV: 4}, {Host: "blog.changkun.de", PV: 5, UV: 6}}
+	tests := []struct {
+		admin bool
+		want  []string
+		not   []string
+	}{
+		{false,
+			[]string{`urlstat_site_pv_total{host="changkun.de"} 1`, `urlstat_site_pv_total{host="blog.changkun.de"} 5`, `urlstat_site_uv{host="blog.changkun.de"} 6`},
+			[]string{`urlstat_site_uv{host="changkun.de"}`, `host="golang.design"`}},
+		{true,
+			[]string{`urlstat_site_uv{host="changkun.de"} 2`, `urlstat_site_pv_total{host="golang.design"} 3`, `urlstat_site_uv{host="golang.design"} 4`},
+			nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/urlstat/metrics", nil)
+		if tt.admin {
+			r.Header.Set("Authorization", "Bearer secret")
+		}
+		b := &bytes.Buffer{}
+		if err := writeSiteMetrics(b, r, totals); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range tt.want {
+			if !strings.Contains(b.String(), s) {
+				t.Fatalf("admin %v: metrics miss %s:\n%s", tt.admin, s, b)
+			}
+		}
+		for _, s := range tt.not {
+			if strings.Contains(b.String(), s) {
+				t.Fatalf("admin %v: metrics reveal %s:\n%s", tt.admin, s, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migrateCommand copies visits from the database to another MongoDB
+// deployment, e.g. to move off the shared database. Visits keep their
+// IDs, hence an interrupted migration can be run again.
+//
+// Usage:
+//
+//	urlstat migrate -to mongodb://newdb:27017 [-host 'blog.*' ...] [-since 2021-01-01] [-until 2022-01-01]
+func migrateCommand(args []string) error {
+	var hosts globs
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := flags.String("to", "", "URI of the target MongoDB deployment")
+	flags.Var(&hosts, "host", "only migrate hosts matching the glob, can be repeated")
+	since := flags.String("since", "", "only migrate visits at or after the date, e.g. 2021-01-01 or RFC 3339")
+	until := flags.String("until", "", "only migrate visits before the date, e.g. 2022-01-01 or RFC 3339")
+	flags.Parse(args)
+
+	if *to == "" {
+		return errors.New("missing -to")
+	}
+	filter := bson.M{}
+	timeRange := bson.M{}
+	if *since != "" {
+		t, err := parseDate(*since)
+		if err != nil {
+			return fmt.Errorf("invalid -since: %w", err)
+		}
+		timeRange["$gte"] = t
+	}
+	if *until != "" {
+		t, err := parseDate(*until)
+		if err != nil {
+			return fmt.Errorf("invalid -until: %w", err)
+		}
+		timeRange["$lt"] = t
+	}
+	if len(timeRange) > 0 {
+		filter["time"] = timeRange
+	}
+
+	ctx := context.Background()
+	target, err := mongo.Connect(ctx, options.Client().ApplyURI(*to))
+	if err != nil {
+		return fmt.Errorf("cannot connect to target: %w", err)
+	}
+	defer target.Disconnect(ctx)
+
+	all, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	for _, h := range all {
+		if !hosts.match(h) {
+			continue
+		}
+		start := time.Now()
+		// Visits keep their site in the single layout, whose views are
+		// created when the target starts.
+		dst := target.Database(dbname).Collection(h)
+		if layout == layoutSingle {
+			dst = target.Database(dbname).Collection(colVisits)
+		}
+		n, err := migrateVisits(ctx, db.Database(dbname).Collection(h), dst, filter)
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", h, err)
+		}
+		l.Printf("migrated %d visits of %s in %v", n, h, time.Since(start))
+	}
+	return nil
+}
+
+// migrateVisits copies the visits of a collection that match the filter
+// to the target collection, skipping visits that already exist there.
+func migrateVisits(ctx context.Context, src, dst *mongo.Collection, filter bson.M) (int, error) {
+	cur, err := src.Find(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find visits: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	n := 0
+	docs := make([]interface{}, 0, insertBatch)
+	flush := func() error {
+		if len(docs) == 0 {
+			return nil
+		}
+		_, err := dst.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		if err != nil && !isOnlyDuplicateKeys(err) {
+			return err
+		}
+		n += len(docs)
+		docs = docs[:0]
+		return nil
+	}
+	for cur.Next(ctx) {
+		// Raw documents keep all fields, including the ones that are
+		// unknown to the visit type.
+		docs = append(docs, bson.Raw(append([]byte(nil), cur.Current...)))
+		if len(docs) == insertBatch {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+// isOnlyDuplicateKeys reports whether all write errors of a bulk write
+// are duplicate keys, i.e. the documents were migrated before.
+func isOnlyDuplicateKeys(err error) bool {
+	var e mongo.BulkWriteException
+	if !errors.As(err, &e) || e.WriteConcernError != nil {
+		return false
+	}
+	for _, we := range e.WriteErrors {
+		if we.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+// globs is a repeatable flag of glob patterns.
+type globs []string
+
+func (g *globs) String() string { return strings.Join(*g, ",") }
+
+func (g *globs) Set(v string) error {
+	if _, err := path.Match(v, ""); err != nil {
+		return err
+	}
+	*g = append(*g, v)
+	return nil
+}
+
+// match reports whether the name matches any pattern, or true if there
+// are no patterns.
+func (g globs) match(name string) bool {
+	if len(g) == 0 {
+		return true
+	}
+	for _, p := range g {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDate parses a date, e.g. 2021-01-01, or a time in RFC 3339.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
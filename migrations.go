@@ -0,0 +1,217 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colMigrations stores the applied schema migrations, see migration.
+const colMigrations = "migrations"
+
+// migration is a numbered change of stored data, e.g. a backfill of a new
+// field, which is applied once per database. Indexes are not migrations,
+// they are created on startup, see metaIndexes.
+//
+// Migrations are applied in order of their versions. A migration that
+// fails is applied again the next time, hence it must be idempotent.
+// Versions are never reused or reordered once released.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context) error
+}
+
+var migrations = []migration{
+	{1, "backfill first seen visitors", backfillVisitors},
+	{2, "register existing hosts", registerExistingHosts},
+	{3, "backfill hostnames of visits", backfillHostnames},
+}
+
+// appliedMigration is the record of an applied migration.
+type appliedMigration struct {
+	Version int       `bson:"_id"`
+	Name    string    `bson:"name"`
+	Applied time.Time `bson:"applied"`
+}
+
+// migrateSchemaCommand applies pending migrations, or lists all migrations and
+// whether they are applied.
+//
+// Usage:
+//
+//	urlstat migrate-schema [-list]
+func migrateSchemaCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate-schema", flag.ExitOnError)
+	list := flags.Bool("list", false, "list migrations instead of applying them")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	if !*list {
+		return migrate(ctx)
+	}
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		status := "pending"
+		if a, ok := applied[m.Version]; ok {
+			status = "applied " + a.Applied.Format(time.RFC3339)
+		}
+		fmt.Printf("%4d %-40s %s\n", m.Version, m.Name, status)
+	}
+	return nil
+}
+
+// migrate applies all pending migrations in order.
+func migrate(ctx context.Context) error {
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	col := db.Database(metaname).Collection(colMigrations)
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		start := time.Now()
+		if err := m.Up(ctx); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		_, err := col.InsertOne(ctx, appliedMigration{
+			Version: m.Version,
+			Name:    m.Name,
+			Applied: time.Now().UTC(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", m.Version, err)
+		}
+		l.Printf("applied migration %d (%s) in %v", m.Version, m.Name, time.Since(start))
+	}
+	return nil
+}
+
+func appliedMigrations(ctx context.Context) (map[int]appliedMigration, error) {
+	cur, err := db.Database(metaname).Collection(colMigrations).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find migrations: %w", err)
+	}
+	var all []appliedMigration
+	if err := cur.All(ctx, &all); err != nil {
+		return nil, fmt.Errorf("failed to find migrations: %w", err)
+	}
+	applied := make(map[int]appliedMigration, len(all))
+	for _, a := range all {
+		applied[a.Version] = a
+	}
+	return applied, nil
+}
+
+// backfillVisitors records when the visitors of visits that were saved
+// before visitors were tracked were first seen, so that they count as
+// returning visitors and belong to their cohorts.
+func backfillVisitors(ctx context.Context) error {
+	hosts, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	visitors := db.Database(metaname).Collection(colVisitors)
+	for _, host := range hosts {
+		p := mongo.Pipeline{
+			bson.D{{Key: "$match", Value: bson.M{"visitor_id": bson.M{"$nin": bson.A{"", nil}}}}},
+			bson.D{{Key: "$group", Value: bson.M{
+				"_id":        "$visitor_id",
+				"first_seen": bson.M{"$min": "$time"},
+			}}},
+		}
+		col := db.Database(dbname).Collection(host)
+		cur, err := col.Aggregate(ctx, p, options.Aggregate().SetAllowDiskUse(true))
+		if err != nil {
+			return err
+		}
+		models := make([]mongo.WriteModel, 0, insertBatch)
+		flush := func() error {
+			if len(models) == 0 {
+				return nil
+			}
+			_, err := visitors.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+			models = models[:0]
+			return err
+		}
+		for cur.Next(ctx) {
+			var v struct {
+				VisitorID string    `bson:"_id"`
+				FirstSeen time.Time `bson:"first_seen"`
+			}
+			if err := cur.Decode(&v); err != nil {
+				cur.Close(ctx)
+				return err
+			}
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"host": host, "visitor_id": v.VisitorID}).
+				SetUpdate(bson.M{"$min": bson.M{"first_seen": v.FirstSeen}}).
+				SetUpsert(true))
+			if len(models) == insertBatch {
+				if err := flush(); err != nil {
+					cur.Close(ctx)
+					return err
+				}
+			}
+		}
+		err = cur.Err()
+		cur.Close(ctx)
+		if err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerExistingHosts registers all hosts that have visits, which were
+// recorded before hosts had to be registered.
+func registerExistingHosts(ctx context.Context) error {
+	hosts, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	for _, host := range hosts {
+		if err := registerHost(ctx, host); err != nil {
+			return fmt.Errorf("failed to register %s: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// backfillHostnames stores the hostname of visits that were recorded
+// before visits stored their hostname, which is the hostname of their
+// collection, as visits of aliases always stored theirs. Then visits of
+// all hosts can be queried and aggregated by their hostname.
+func backfillHostnames(ctx context.Context) error {
+	hosts, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	for _, host := range hosts {
+		stored, _ := storedVisits(host)
+		_, err := stored.UpdateMany(ctx,
+			hostFilter(host, bson.M{"host": bson.M{"$in": bson.A{"", nil}}}),
+			bson.M{"$set": bson.M{"host": host}})
+		if err != nil {
+			return fmt.Errorf("failed to backfill %s: %w", host, err)
+		}
+	}
+	return nil
+}
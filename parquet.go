@@ -0,0 +1,313 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+)
+
+// This file implements a minimal Apache Parquet writer for visits, see:
+// https://github.com/apache/parquet-format
+//
+// A file contains row groups of up to parquetRowGroup visits, where each
+// column is stored as a single gzip compressed, plain encoded data page.
+// All columns are required, hence pages carry neither repetition nor
+// definition levels. The file metadata is serialized using the Thrift
+// compact protocol.
+
+const parquetMagic = "PAR1"
+
+// parquetRowGroup is the number of visits of a row group. Row groups are
+// written once they are full, hence files of any size are written with
+// the memory of a row group.
+const parquetRowGroup = 1 << 16
+
+// Parquet physical types, converted types, and enum values used by the writer.
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetRequired = 0
+	parquetPlain    = 0
+	parquetRLE      = 3
+	parquetGzip     = 2
+	parquetDataPage = 0
+)
+
+// parquetColumn is a column of visits.
+type parquetColumn struct {
+	name  string
+	typ   int32
+	ctype int32
+	value func(v *visit, w *bytes.Buffer)
+}
+
+var parquetVisitColumns = []parquetColumn{
+	{"visitor_id", parquetByteArray, parquetUTF8, func(v *visit, w *bytes.Buffer) { parquetString(w, v.VisitorID) }},
+	{"path", parquetByteArray, parquetUTF8, func(v *visit, w *bytes.Buffer) { parquetString(w, v.Path) }},
+	{"ip", parquetByteArray, parquetUTF8, func(v *visit, w *bytes.Buffer) { parquetString(w, v.IP) }},
+	{"ua", parquetByteArray, parquetUTF8, func(v *visit, w *bytes.Buffer) { parquetString(w, v.UA) }},
+	{"referer", parquetByteArray, parquetUTF8, func(v *visit, w *bytes.Buffer) { parquetString(w, v.Referer) }},
+	{"channel", parquetByteArray, parquetUTF8, func(v *visit, w *bytes.Buffer) { parquetString(w, v.Channel) }},
+	{"time", parquetInt64, parquetTimestampMillis, func(v *visit, w *bytes.Buffer) {
+		binary.Write(w, binary.LittleEndian, v.Time.UnixMilli())
+	}},
+}
+
+func parquetString(w *bytes.Buffer, s string) {
+	binary.Write(w, binary.LittleEndian, uint32(len(s)))
+	w.WriteString(s)
+}
+
+// parquetChunk is the location of a column of a row group in the file.
+type parquetChunk struct {
+	offset       int64
+	uncompressed int64
+	compressed   int64
+}
+
+// parquetGroup is a row group that is written to the file.
+type parquetGroup struct {
+	rows   int64
+	chunks []parquetChunk
+}
+
+// writeParquet writes the visits of next as a parquet file.
+func writeParquet(w io.Writer, next nextVisit) error {
+	var offset int64
+	write := func(b []byte) error {
+		n, err := w.Write(b)
+		offset += int64(n)
+		return err
+	}
+	if err := write([]byte(parquetMagic)); err != nil {
+		return err
+	}
+
+	var (
+		groups []parquetGroup
+		rows   int64
+	)
+	raws := make([]bytes.Buffer, len(parquetVisitColumns))
+	flush := func(n int64) error {
+		if n == 0 {
+			return nil
+		}
+		g := parquetGroup{rows: n, chunks: make([]parquetChunk, len(parquetVisitColumns))}
+		for i := range parquetVisitColumns {
+			raw := &raws[i]
+			data := &bytes.Buffer{}
+			zw := gzip.NewWriter(data)
+			zw.Write(raw.Bytes())
+			if err := zw.Close(); err != nil {
+				return err
+			}
+
+			header := &thriftWriter{}
+			header.i32(1, parquetDataPage)
+			header.i32(2, int32(raw.Len()))
+			header.i32(3, int32(data.Len()))
+			header.beginStruct(5)
+			header.i32(1, int32(n))
+			header.i32(2, parquetPlain)
+			header.i32(3, parquetRLE)
+			header.i32(4, parquetRLE)
+			header.endStruct()
+			header.stop()
+
+			g.chunks[i] = parquetChunk{
+				offset:       offset,
+				uncompressed: int64(header.buf.Len() + raw.Len()),
+				compressed:   int64(header.buf.Len() + data.Len()),
+			}
+			if err := write(header.buf.Bytes()); err != nil {
+				return err
+			}
+			if err := write(data.Bytes()); err != nil {
+				return err
+			}
+			raw.Reset()
+		}
+		groups = append(groups, g)
+		return nil
+	}
+	for {
+		v, err := next()
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			break
+		}
+		for i, c := range parquetVisitColumns {
+			c.value(v, &raws[i])
+		}
+		rows++
+		if rows%parquetRowGroup == 0 {
+			if err := flush(parquetRowGroup); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(rows % parquetRowGroup); err != nil {
+		return err
+	}
+
+	// FileMetaData
+	meta := &thriftWriter{}
+	meta.i32(1, 1)
+	meta.beginList(2, thriftStruct, len(parquetVisitColumns)+1)
+	meta.beginElem()
+	meta.str(4, "visit")
+	meta.i32(5, int32(len(parquetVisitColumns)))
+	meta.endElem()
+	for _, c := range parquetVisitColumns {
+		meta.beginElem()
+		meta.i32(1, c.typ)
+		meta.i32(3, parquetRequired)
+		meta.str(4, c.name)
+		meta.i32(6, c.ctype)
+		meta.endElem()
+	}
+	meta.endList()
+	meta.i64(3, rows)
+	meta.beginList(4, thriftStruct, len(groups))
+	for _, g := range groups {
+		meta.beginElem()
+		meta.beginList(1, thriftStruct, len(parquetVisitColumns))
+		var total int64
+		for i, c := range parquetVisitColumns {
+			meta.beginElem()
+			meta.i64(2, g.chunks[i].offset)
+			meta.beginStruct(3)
+			meta.i32(1, c.typ)
+			meta.beginList(2, thriftI32, 2)
+			meta.varint(uint64(zigzag(parquetPlain)))
+			meta.varint(uint64(zigzag(parquetRLE)))
+			meta.endList()
+			meta.beginList(3, thriftBinary, 1)
+			meta.varint(uint64(len(c.name)))
+			meta.buf.WriteString(c.name)
+			meta.endList()
+			meta.i32(4, parquetGzip)
+			meta.i64(5, g.rows)
+			meta.i64(6, g.chunks[i].uncompressed)
+			meta.i64(7, g.chunks[i].compressed)
+			meta.i64(9, g.chunks[i].offset)
+			meta.endStruct()
+			meta.endElem()
+			total += g.chunks[i].uncompressed
+		}
+		meta.endList()
+		meta.i64(2, total)
+		meta.i64(3, g.rows)
+		meta.endElem()
+	}
+	meta.endList()
+	meta.str(6, "changkun.de/x/urlstat")
+	meta.stop()
+
+	footer := &bytes.Buffer{}
+	footer.Write(meta.buf.Bytes())
+	binary.Write(footer, binary.LittleEndian, uint32(meta.buf.Len()))
+	footer.WriteString(parquetMagic)
+	return write(footer.Bytes())
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter serializes structs using the Thrift compact protocol. It
+// tracks the last written field ID per nesting level, which is required
+// to encode field headers as deltas.
+type thriftWriter struct {
+	buf   bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+func zigzag(v int64) int64 { return (v << 1) ^ (v >> 63) }
+
+func (t *thriftWriter) varint(v uint64) {
+	for v >= 0x80 {
+		t.buf.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	t.buf.WriteByte(byte(v))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(uint64(zigzag(int64(id))))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(uint64(zigzag(int64(v))))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(uint64(zigzag(v)))
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.stop()
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+// beginList writes a list header. Struct elements of the list are
+// written between beginElem and endElem.
+func (t *thriftWriter) beginList(id int16, elem byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		t.varint(uint64(size))
+	}
+	t.stack = append(t.stack, t.last)
+}
+
+func (t *thriftWriter) endList() {
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+func (t *thriftWriter) beginElem() { t.last = 0 }
+
+func (t *thriftWriter) endElem() { t.stop() }
+
+func (t *thriftWriter) stop() { t.buf.WriteByte(0) }
@@ -0,0 +1,68 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestWriteParquet(t *testing.T) {
+	visits := []visit{
+		{VisitorID: "a", Path: "/", IP: "127.0.0.1", Time: time.Unix(1, 0)},
+		{VisitorID: "b", Path: "/about", IP: "::1", UA: "curl", Time: time.Unix(2, 0)},
+	}
+	buf := &bytes.Buffer{}
+	if err := writeParquet(buf, sliceVisits(visits)); err != nil {
+		t.Fatalf("cannot write parquet: %v", err)
+	}
+
+	b := buf.Bytes()
+	if !bytes.HasPrefix(b, []byte(parquetMagic)) || !bytes.HasSuffix(b, []byte(parquetMagic)) {
+		t.Fatalf("missing parquet magic")
+	}
+	n := binary.LittleEndian.Uint32(b[len(b)-8:])
+	if int(n) >= len(b)-12 {
+		t.Fatalf("invalid footer length: %d", n)
+	}
+	footer := b[len(b)-8-int(n) : len(b)-8]
+	for _, c := range parquetVisitColumns {
+		if !bytes.Contains(footer, []byte(c.name)) {
+			t.Fatalf("footer misses column %s", c.name)
+		}
+	}
+}
+
+func TestWriteParquetRowGroups(t *testing.T) {
+	visits := make([]visit, parquetRowGroup+1)
+	for i := range visits {
+		visits[i] = visit{Path: "/", Time: time.Unix(int64(i), 0)}
+	}
+	buf := &bytes.Buffer{}
+	if err := writeParquet(buf, sliceVisits(visits)); err != nil {
+		t.Fatalf("cannot write parquet: %v", err)
+	}
+	b := buf.Bytes()
+	n := binary.LittleEndian.Uint32(b[len(b)-8:])
+	footer := b[len(b)-8-int(n) : len(b)-8]
+	// Each row group has a chunk of each column, which names its column.
+	if got := bytes.Count(footer, []byte("visitor_id")); got != 3 {
+		t.Fatalf("footer names visitor_id %d times, want once in the schema and once per row group", got)
+	}
+}
+
+// sliceVisits returns the visits of a slice one at a time.
+func sliceVisits(visits []visit) nextVisit {
+	return func() (*visit, error) {
+		if len(visits) == 0 {
+			return nil, nil
+		}
+		v := &visits[0]
+		visits = visits[1:]
+		return v, nil
+	}
+}
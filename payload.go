@@ -0,0 +1,85 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// protobufType is the media type of compact payloads, see applyPayload.
+const protobufType = "application/x-protobuf"
+
+// applyPayload applies a PageView message of urlstat.proto, which pages
+// POST instead of sending headers, to the request as if its fields were
+// sent as headers and query parameters, so that both are recorded the same
+// way. A PageView is a fraction of the size of the headers, which matters
+// for single page applications that report many views.
+func applyPayload(r *http.Request) error {
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, protobufType) {
+		return fmt.Errorf("%w: unsupported content type %q, require %s", errInvalidQuery, ct, protobufType)
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, grpcMaxMessage+1))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidQuery, err)
+	}
+	if len(b) > grpcMaxMessage {
+		return fmt.Errorf("%w: payload exceeds %d bytes", errInvalidQuery, grpcMaxMessage)
+	}
+	q := r.URL.Query()
+	dims := map[string]string{}
+	var derr error
+	err = parseProto(b, func(field int, s string, n uint64) {
+		switch field {
+		case 1:
+			r.Header.Set("urlstat-url", s)
+		case 2:
+			r.Header.Set("urlstat-ref", s)
+		case 3:
+			r.Header.Set("urlstat-vid", s)
+		case 4:
+			r.Header.Set("urlstat-ua", s)
+		case 5:
+			q.Set("consent", s)
+		case 6:
+			r.Header.Set("urlstat-status", strconv.FormatUint(n, 10))
+		case 7:
+			q.Add("report", s)
+		case 8:
+			r.Header.Set("urlstat-proto", s)
+		case 9:
+			if err := parseDimensionEntry(s, dims); err != nil {
+				derr = err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if derr != nil {
+		return derr
+	}
+	if len(dims) > 0 {
+		v := url.Values{}
+		for k, d := range dims {
+			v.Set(k, d)
+		}
+		r.Header.Set("urlstat-dims", v.Encode())
+	}
+	r.URL.RawQuery = q.Encode()
+	return nil
+}
+
+// appendStats appends the statistics as a GetStatsResponse message.
+func appendStats(b []byte, s stat) []byte {
+	for i, n := range []int64{s.PagePV, s.PageUV, s.SitePV, s.SiteUV, s.HostPV, s.HostUV} {
+		b = appendProtoInt(b, i+1, n)
+	}
+	return b
+}
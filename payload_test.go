@@ -0,0 +1,61 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestApplyPayload(t *testing.T) {
+	var b []byte
+	b = appendProtoString(b, 1, "https://changkun.de/blog/")
+	b = appendProtoString(b, 2, "https://golang.design/")
+	b = appendProtoString(b, 5, "granted")
+	b = binary.AppendUvarint(b, 6<<3)
+	b = binary.AppendUvarint(b, 404)
+	b = appendProtoString(b, 7, "page")
+	b = appendProtoString(b, 7, "site")
+
+	r := httptest.NewRequest("POST", "/urlstat", bytes.NewReader(b))
+	r.Header.Set("Content-Type", protobufType)
+	if err := applyPayload(r); err != nil {
+		t.Fatalf("cannot apply payload: %v", err)
+	}
+	if got := r.Header.Get("urlstat-url"); got != "https://changkun.de/blog/" {
+		t.Fatalf("url = %q", got)
+	}
+	if got := referer(r, &url.URL{Scheme: "https", Host: "changkun.de"}); got != "https://golang.design/" {
+		t.Fatalf("referer = %q", got)
+	}
+	if got := pageStatus(r.Header.Get("urlstat-status")); got != 404 {
+		t.Fatalf("status = %d, want 404", got)
+	}
+	q := r.URL.Query()
+	if q.Get("consent") != "granted" || !reflect.DeepEqual(q["report"], []string{"page", "site"}) {
+		t.Fatalf("query = %v", q)
+	}
+
+	r = httptest.NewRequest("POST", "/urlstat", bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/json")
+	if err := applyPayload(r); !errors.Is(err, errInvalidQuery) {
+		t.Fatalf("payload of another content type: got %v, want %v", err, errInvalidQuery)
+	}
+}
+
+func TestAppendStats(t *testing.T) {
+	got := map[int]uint64{}
+	err := parseProto(appendStats(nil, stat{PagePV: 3, PageUV: 2, HostPV: 7}), func(field int, _ string, n uint64) {
+		got[field] = n
+	})
+	if want := map[int]uint64{1: 3, 2: 2, 5: 7}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("appendStats = %v, %v, want %v", got, err, want)
+	}
+}
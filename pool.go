@@ -0,0 +1,138 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// clientOptions returns the options of a database client of the given URI.
+// The driver defaults suit neither a small VPS nor a busy deployment, hence
+// the connection pool can be configured by environment variables, which
+// take precedence over options of the URI:
+//
+//	URLSTAT_DB_MAX_POOL_SIZE: the maximum connections per server, defaults to 100
+//	URLSTAT_DB_MIN_POOL_SIZE: the connections kept open per server, defaults to 0
+//	URLSTAT_DB_MAX_CONNECTING: the connections established at a time, defaults to 2
+//	URLSTAT_DB_MAX_IDLE_TIME: the time after which idle connections are closed, e.g. 5m
+//	URLSTAT_DB_CONNECT_TIMEOUT: the timeout of establishing a connection, defaults to 30s
+//	URLSTAT_DB_SERVER_SELECTION_TIMEOUT: the timeout of finding a server, defaults to 30s
+func clientOptions(uri string) (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(uri)
+
+	uints := []struct {
+		env string
+		set func(uint64) *options.ClientOptions
+	}{
+		{"URLSTAT_DB_MAX_POOL_SIZE", opts.SetMaxPoolSize},
+		{"URLSTAT_DB_MIN_POOL_SIZE", opts.SetMinPoolSize},
+		{"URLSTAT_DB_MAX_CONNECTING", opts.SetMaxConnecting},
+	}
+	for _, o := range uints {
+		if v := os.Getenv(o.env); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", o.env, v)
+			}
+			o.set(n)
+		}
+	}
+
+	durations := []struct {
+		env string
+		set func(time.Duration) *options.ClientOptions
+	}{
+		{"URLSTAT_DB_MAX_IDLE_TIME", opts.SetMaxConnIdleTime},
+		{"URLSTAT_DB_CONNECT_TIMEOUT", opts.SetConnectTimeout},
+		{"URLSTAT_DB_SERVER_SELECTION_TIMEOUT", opts.SetServerSelectionTimeout},
+	}
+	for _, o := range durations {
+		if v := os.Getenv(o.env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid %s: %v", o.env, v)
+			}
+			o.set(d)
+		}
+	}
+
+	if opts.MaxPoolSize != nil && opts.MinPoolSize != nil &&
+		*opts.MaxPoolSize != 0 && *opts.MinPoolSize > *opts.MaxPoolSize {
+		return nil, fmt.Errorf("minimum pool size %d exceeds maximum pool size %d",
+			*opts.MinPoolSize, *opts.MaxPoolSize)
+	}
+	return opts, opts.Validate()
+}
+
+// analyticsOptions are the options of the databases of heavy aggregations,
+// i.e. rollups, cohorts, and the dashboard, so that they can run on
+// secondaries of a replica set instead of competing with recording visits
+// on the primary. They are configured by environment variables:
+//
+//	URLSTAT_ANALYTICS_READ_PREFERENCE: primary, primaryPreferred, secondary, secondaryPreferred, or nearest
+//	URLSTAT_ANALYTICS_MAX_STALENESS: the maximum replication lag of a secondary, at least 90s
+//	URLSTAT_ANALYTICS_READ_CONCERN: local, available, or majority
+//
+// By default, aggregations use the options of the client.
+var analyticsOptions = options.Database()
+
+func init() {
+	opts, err := parseAnalyticsOptions(
+		os.Getenv("URLSTAT_ANALYTICS_READ_PREFERENCE"),
+		os.Getenv("URLSTAT_ANALYTICS_MAX_STALENESS"),
+		os.Getenv("URLSTAT_ANALYTICS_READ_CONCERN"))
+	if err != nil {
+		log.Fatalf("invalid analytics options: %v", err)
+	}
+	analyticsOptions = opts
+}
+
+func parseAnalyticsOptions(pref, staleness, concern string) (*options.DatabaseOptions, error) {
+	opts := options.Database()
+	if pref != "" {
+		mode, err := readpref.ModeFromString(pref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URLSTAT_ANALYTICS_READ_PREFERENCE: %v", pref)
+		}
+		var rpOpts []readpref.Option
+		if staleness != "" {
+			d, err := time.ParseDuration(staleness)
+			if err != nil || d < 90*time.Second {
+				return nil, fmt.Errorf("invalid URLSTAT_ANALYTICS_MAX_STALENESS: %v", staleness)
+			}
+			rpOpts = append(rpOpts, readpref.WithMaxStaleness(d))
+		}
+		rp, err := readpref.New(mode, rpOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URLSTAT_ANALYTICS_READ_PREFERENCE: %w", err)
+		}
+		opts.SetReadPreference(rp)
+	} else if staleness != "" {
+		return nil, fmt.Errorf("URLSTAT_ANALYTICS_MAX_STALENESS requires URLSTAT_ANALYTICS_READ_PREFERENCE")
+	}
+	switch concern {
+	case "":
+	case "local", "available", "majority":
+		opts.SetReadConcern(readconcern.New(readconcern.Level(concern)))
+	default:
+		return nil, fmt.Errorf("invalid URLSTAT_ANALYTICS_READ_CONCERN: %v", concern)
+	}
+	return opts, nil
+}
+
+// analyticsDB returns the database of the given name for heavy
+// aggregations, see analyticsOptions.
+func analyticsDB(name string) *mongo.Database {
+	return db.Database(name, analyticsOptions)
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+func TestParseAnalyticsOptions(t *testing.T) {
+	opts, err := parseAnalyticsOptions("", "", "")
+	if err != nil || opts.ReadPreference != nil || opts.ReadConcern != nil {
+		t.Fatalf("default options = %+v, %v, want the options of the client", opts, err)
+	}
+
+	opts, err = parseAnalyticsOptions("secondaryPreferred", "120s", "majority")
+	if err != nil {
+		t.Fatalf("cannot parse options: %v", err)
+	}
+	if opts.ReadPreference.Mode() != readpref.SecondaryPreferredMode {
+		t.Fatalf("read preference = %v, want secondaryPreferred", opts.ReadPreference)
+	}
+	if d, ok := opts.ReadPreference.MaxStaleness(); !ok || d != 2*time.Minute {
+		t.Fatalf("max staleness = %v, want 2m", d)
+	}
+	if opts.ReadConcern.GetLevel() != "majority" {
+		t.Fatalf("read concern = %v, want majority", opts.ReadConcern.GetLevel())
+	}
+
+	for _, o := range [][3]string{
+		{"secondaries", "", ""},
+		{"secondary", "10s", ""},
+		{"", "120s", ""},
+		{"primary", "120s", ""},
+		{"", "", "snapshot"},
+	} {
+		if _, err := parseAnalyticsOptions(o[0], o[1], o[2]); err == nil {
+			t.Fatalf("parseAnalyticsOptions(%q) did not fail", o)
+		}
+	}
+}
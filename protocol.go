@@ -0,0 +1,76 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// pageProtocol returns the HTTP version of a page as HTTP/1.0, HTTP/1.1,
+// HTTP/2, or HTTP/3, or an empty string if it is unknown. client.js
+// reports the ALPN protocol ID of the navigation, e.g. h2 or h3, other
+// clients may report the version, e.g. HTTP/2.0.
+func pageProtocol(v string) string {
+	switch v = strings.ToLower(strings.TrimSpace(v)); {
+	case v == "http/1.0":
+		return "HTTP/1.0"
+	case v == "http/1.1":
+		return "HTTP/1.1"
+	case v == "h2" || v == "h2c" || v == "http/2" || v == "http/2.0":
+		return "HTTP/2"
+	case strings.HasPrefix(v, "h3") || v == "hq" || v == "http/3" || v == "http/3.0":
+		// Drafts of HTTP/3 are h3-29 and the like.
+		return "HTTP/3"
+	}
+	return ""
+}
+
+// protocolShare is the number of visits of pages that were served over an
+// HTTP version, with or without TLS, and their percentage of all visits
+// with a known protocol.
+type protocolShare struct {
+	Protocol string  `json:"protocol"`
+	TLS      bool    `json:"tls"`
+	Count    int64   `json:"count"`
+	Percent  float64 `json:"percent"`
+}
+
+// protocolSplit returns the number of visits of a host since the given day
+// until today per HTTP version of the page and whether it was served over
+// TLS, most visits first, of the visits with the given custom dimensions.
+// Visits of unknown protocols are not counted. Like
+// reports of rollups, it only changes once a day.
+func protocolSplit(ctx context.Context, host string, dims map[string]string, since time.Time) ([]protocolShare, error) {
+	today := time.Now().UTC().Truncate(day)
+	shares := []protocolShare{}
+	var sum int64
+	for _, tls := range []bool{true, false} {
+		filter := dimensionFilter(dims)
+		filter["time"] = bson.M{"$gte": since, "$lt": today}
+		filter["protocol"] = bson.M{"$gt": ""}
+		filter["tls"] = true
+		if !tls {
+			filter["tls"] = bson.M{"$ne": true}
+		}
+		counts, err := groupVisits(ctx, host, "protocol", since, filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range counts {
+			shares = append(shares, protocolShare{Protocol: c.Name, TLS: tls, Count: c.Count})
+			sum += c.Count
+		}
+	}
+	for i := range shares {
+		shares[i].Percent = 100 * float64(shares[i].Count) / float64(sum)
+	}
+	sort.SliceStable(shares, func(i, j int) bool { return shares[i].Count > shares[j].Count })
+	return shares, nil
+}
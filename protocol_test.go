@@ -0,0 +1,46 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestPageProtocol(t *testing.T) {
+	tests := map[string]string{
+		"h3":       "HTTP/3",
+		"h3-29":    "HTTP/3",
+		"h2":       "HTTP/2",
+		"HTTP/2.0": "HTTP/2",
+		"http/1.1": "HTTP/1.1",
+		"":         "",
+		"spdy/3":   "",
+	}
+	for v, want := range tests {
+		if got := pageProtocol(v); got != want {
+			t.Fatalf("pageProtocol(%q) = %q, want %q", v, got, want)
+		}
+	}
+}
+
+func TestRecordProtocol(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{})
+
+	for _, loc := range []string{"https://changkun.de/", "http://changkun.de/"} {
+		u, _ := url.Parse(loc)
+		_, err := recordVisit(context.Background(), visitReport{URL: u, IP: "203.0.113.1", Protocol: "HTTP/3"})
+		if err != nil {
+			t.Fatalf("cannot record visit: %v", err)
+		}
+	}
+	vs := m.visits["changkun.de"]
+	if vs[0].Protocol != "HTTP/3" || !vs[0].TLS || vs[1].TLS {
+		t.Fatalf("recorded protocols: %+v", vs)
+	}
+}
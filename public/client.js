@@ -1,6 +1,53 @@
 let endpoint = 'https://www.changkun.de/urlstat'
+// A site that serves urlstat as a first party under its own origin sets
+// data-endpoint on the script tag, e.g. data-endpoint="/p".
+if (document.currentScript !== null && document.currentScript.dataset.endpoint) {
+    endpoint = document.currentScript.dataset.endpoint
+}
+const batchEndpoint = endpoint + '/batch'
 let report = []
 
+// A site that asks for consent sets data-consent="granted" or "denied" on
+// the script tag, or window.urlstatConsent before the script runs. If
+// denied, only the page view is counted without any visitor information.
+let consent = window.urlstatConsent
+if (consent === undefined && document.currentScript !== null) {
+    consent = document.currentScript.dataset.consent
+}
+const anonymous = consent === 'denied'
+
+// Custom dimensions of a page, e.g. its author or category, are set as
+// window.urlstatDimensions = {author: 'changkun'}, or as
+// data-dimensions="author=changkun&category=go" on the script tag. Single
+// page applications update window.urlstatDimensions before a route change.
+function dimensions() {
+    let dims = window.urlstatDimensions
+    if (dims === undefined && document.currentScript !== null && document.currentScript.dataset.dimensions) {
+        dims = Object.fromEntries(new URLSearchParams(document.currentScript.dataset.dimensions))
+    }
+    return dims
+}
+const dims = dimensions()
+
+// An error page, e.g. a custom 404 page, sets data-status on the script
+// tag, or window.urlstatStatus, so that dead links can be found. Otherwise
+// the status of the navigation is used where the browser exposes it.
+let status = window.urlstatStatus
+if (status === undefined && document.currentScript !== null) {
+    status = document.currentScript.dataset.status
+}
+// The HTTP version of the page, e.g. h2 or h3, is reported as well.
+let proto
+if (window.performance !== undefined) {
+    const nav = performance.getEntriesByType('navigation')[0]
+    if (status === undefined && nav !== undefined && nav.responseStatus) {
+        status = nav.responseStatus
+    }
+    if (nav !== undefined && nav.nextHopProtocol) {
+        proto = nav.nextHopProtocol
+    }
+}
+
 const p = document.getElementById('urlstat-page-pv')
 const u = document.getElementById('urlstat-page-uv')
 if (p !== null || u !== null) {
@@ -13,27 +60,138 @@ if (sp !== null || su !== null) {
     report.push('site')
 }
 
+const hp = document.getElementById('urlstat-host-pv')
+const hu = document.getElementById('urlstat-host-uv')
+if (hp !== null || hu !== null) {
+    report.push('host')
+}
+
+let query = []
 if (report.length !== 0) {
-    endpoint += '?report=' + report.join('+')
+    query.push('report=' + report.join('+'))
+}
+if (consent === 'granted' || consent === 'denied') {
+    query.push('consent=' + consent)
+}
+if (query.length !== 0) {
+    endpoint += '?' + query.join('&')
 }
 
-const h = new Headers({'urlstat-url': window.location.href,'urlstat-ua': navigator.userAgent})
-const r = new Request(endpoint, {method: 'GET', headers: h})
-fetch(r).then(resp => {
-    if (!resp.ok) throw Error(resp.statusText)
-    return resp
-})
-.then(resp => resp.json()).then(resp => {
-    if (p !== null) {
-        p.textContent = resp.page_pv
+// The referrer of the page is always sent, even if it is empty, as the
+// Referer of this request is the page itself, or only its origin under the
+// default referrer policy of browsers.
+const h = new Headers({'urlstat-url': window.location.href, 'urlstat-ref': document.referrer})
+if (status !== undefined) {
+    h.set('urlstat-status', String(status))
+}
+if (proto !== undefined) {
+    h.set('urlstat-proto', proto)
+}
+if (dims !== undefined) {
+    h.set('urlstat-dims', new URLSearchParams(dims).toString())
+}
+if (!anonymous) {
+    h.set('urlstat-ua', navigator.userAgent)
+    try {
+        const vid = localStorage.getItem('urlstat-vid')
+        if (vid !== null) {
+            h.set('urlstat-vid', vid)
+        }
+    } catch (err) {}
+}
+
+// A prerendered page is only reported once the visitor activates it.
+function send() {
+    const r = new Request(endpoint, {method: 'GET', headers: h})
+    fetch(r).then(resp => {
+        if (!resp.ok) throw Error(resp.statusText)
+        const vid = resp.headers.get('urlstat-vid')
+        if (vid !== null && !anonymous) {
+            try { localStorage.setItem('urlstat-vid', vid) } catch (err) {}
+        }
+        return resp
+    })
+    .then(resp => resp.json()).then(resp => {
+        // Statistics that the site keeps private are not responded.
+        if (p !== null && resp.page_pv !== undefined) {
+            p.textContent = resp.page_pv
+        }
+        if (u !== null && resp.page_uv !== undefined) {
+            u.textContent = resp.page_uv
+        }
+        if (sp !== null && resp.site_pv !== undefined) {
+            sp.textContent = resp.site_pv
+        }
+        if (su !== null && resp.site_uv !== undefined) {
+            su.textContent = resp.site_uv
+        }
+        if (hp !== null && resp.host_pv !== undefined) {
+            hp.textContent = resp.host_pv
+        }
+        if (hu !== null && resp.host_uv !== undefined) {
+            hu.textContent = resp.host_uv
+        }
+    }).catch(err => console.error(err))
+}
+
+if (document.prerendering) {
+    document.addEventListener('prerenderingchange', send, {once: true})
+} else {
+    send()
+}
+
+// Route changes of single page applications are collected and sent in a
+// batch every 10 seconds, or when the page is hidden, instead of one
+// request per view.
+let views = []
+let current = window.location.href
+function track() {
+    const prev = new URL(current)
+    if (prev.pathname + prev.search === window.location.pathname + window.location.search) {
+        return
+    }
+    views.push({url: window.location.href, referrer: current, dimensions: window.urlstatDimensions || dims})
+    current = window.location.href
+}
+function flush(hidden) {
+    if (views.length === 0) {
+        return
+    }
+    const b = {views: views.splice(0, 50)}
+    if (consent === 'granted' || consent === 'denied') {
+        b.consent = consent
     }
-    if (u !== null) {
-        u.textContent = resp.page_uv
+    if (!anonymous) {
+        b.ua = navigator.userAgent
+        try { b.visitor_id = localStorage.getItem('urlstat-vid') || undefined } catch (err) {}
     }
-    if (sp !== null) {
-        sp.textContent = resp.site_pv
+    const body = JSON.stringify(b)
+    // A hidden page may never run again, only a beacon is still sent.
+    if (hidden && navigator.sendBeacon !== undefined && navigator.sendBeacon(batchEndpoint, body)) {
+        return
     }
-    if (su !== null) {
-        su.textContent = resp.site_uv
+    fetch(batchEndpoint, {method: 'POST', body: body, keepalive: true}).then(resp => {
+        if (!resp.ok) throw Error(resp.statusText)
+        return resp.json()
+    }).then(resp => {
+        if (resp.visitor_id !== undefined && !anonymous) {
+            try { localStorage.setItem('urlstat-vid', resp.visitor_id) } catch (err) {}
+        }
+    }).catch(err => console.error(err))
+}
+for (const method of ['pushState', 'replaceState']) {
+    const orig = history[method]
+    history[method] = function () {
+        const ret = orig.apply(this, arguments)
+        track()
+        return ret
+    }
+}
+window.addEventListener('popstate', track)
+window.addEventListener('pagehide', () => flush(true))
+document.addEventListener('visibilitychange', () => {
+    if (document.visibilityState === 'hidden') {
+        flush(true)
     }
-}).catch(err => console.error(err))
+})
+setInterval(() => flush(false), 10000)
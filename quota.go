@@ -0,0 +1,95 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Behaviors of a host over its quota, see siteSettings.Quota.
+const (
+	// overQuotaDrop does not record visits over the quota.
+	overQuotaDrop = "drop"
+	// overQuotaSample records quotaSampleRate of the visits over the
+	// quota.
+	overQuotaSample = "sample"
+	// overQuotaAlert records all visits, the quota only alerts.
+	overQuotaAlert = "alert"
+)
+
+// quotaSampleRate is the fraction of visits over the quota that are
+// recorded by overQuotaSample.
+const quotaSampleRate = 0.1
+
+// quotaSync is how often the visits of a month are counted in storage.
+// In between, a replica counts the visits it records itself, hence other
+// replicas may exceed the quota by the visits they record within this
+// duration.
+const quotaSync = time.Minute
+
+// quotaUsage is the number of visits of a collection in a month.
+type quotaUsage struct {
+	month   time.Time
+	visits  int64
+	synced  time.Time
+	alerted bool
+}
+
+var quotaUsages = struct {
+	sync.Mutex
+	m map[string]*quotaUsage
+}{m: map[string]*quotaUsage{}}
+
+// admitQuota reports whether a visit of a collection at the given time is
+// recorded under the quota of its settings, and counts it if so. A host
+// that exceeds its quota is notified once a month per replica.
+func admitQuota(ctx context.Context, col string, s *siteSettings, now time.Time) (bool, error) {
+	if s.Quota == 0 {
+		return true, nil
+	}
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	quotaUsages.Lock()
+	u, ok := quotaUsages.m[col]
+	if !ok || !u.month.Equal(month) {
+		u = &quotaUsage{month: month}
+		quotaUsages.m[col] = u
+	}
+	stale := now.Sub(u.synced) >= quotaSync
+	quotaUsages.Unlock()
+	if stale {
+		n, err := store.countSince(ctx, col, month)
+		if err != nil {
+			return false, fmt.Errorf("failed to count visits of the month: %w", err)
+		}
+		quotaUsages.Lock()
+		u.visits, u.synced = n, now
+		quotaUsages.Unlock()
+	}
+
+	quotaUsages.Lock()
+	over := u.visits >= s.Quota
+	alerted := u.alerted
+	u.alerted = u.alerted || over
+	admit := !over || s.OverQuota == overQuotaAlert ||
+		s.OverQuota == overQuotaSample && rand.Float64() < quotaSampleRate
+	if admit {
+		u.visits++
+	}
+	visits := u.visits
+	quotaUsages.Unlock()
+
+	if over && !alerted {
+		// Notifiers may be slow, the visit does not wait for them.
+		go notify(context.Background(), alert{
+			Host: col, Kind: "quota", Hour: month, PV: visits, Baseline: float64(s.Quota),
+		})
+	}
+	return admit, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{Quota: 2})
+	m.register("golang.design", siteSettings{Quota: 2, OverQuota: overQuotaAlert})
+
+	for _, host := range []string{"changkun.de", "golang.design"} {
+		for i := 0; i < 5; i++ {
+			_, err := recordVisit(context.Background(), visitReport{
+				URL: &url.URL{Scheme: "https", Host: host, Path: "/"},
+				IP:  "203.0.113.1",
+				UA:  "Mozilla/5.0",
+			})
+			if err != nil {
+				t.Fatalf("cannot record visit of %s: %v", host, err)
+			}
+		}
+	}
+	if n := len(m.visits["changkun.de"]); n != 2 {
+		t.Fatalf("dropped over quota: %d visits recorded, want 2", n)
+	}
+	if n := len(m.visits["golang.design"]); n != 5 {
+		t.Fatalf("alerted over quota: %d visits recorded, want 5", n)
+	}
+
+	s := siteSettings{Quota: 10, OverQuota: "throttle"}
+	if err := s.validate(); err == nil {
+		t.Fatalf("unknown over quota behavior is valid")
+	}
+}
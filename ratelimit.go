@@ -0,0 +1,118 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the requests per API key in fixed windows, so that a
+// single integration cannot monopolize the reporting queries. Each replica
+// limits the requests it serves.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu   sync.Mutex
+	keys map[string]*rateWindow
+}
+
+// rateWindow is the usage of a key in the window that started at start.
+type rateWindow struct {
+	start time.Time
+	used  int
+}
+
+// rateStatus is the usage of a key in its current window, which the API
+// responds as X-RateLimit-* headers and at /urlstat/api/v1/quota.
+type rateStatus struct {
+	Key       string    `json:"key"`
+	Window    string    `json:"window"`
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, keys: map[string]*rateWindow{}}
+}
+
+// take counts a request of the key, and reports whether it is within the
+// limit. Requests over the limit are not counted.
+func (rl *rateLimiter) take(key string, now time.Time) (rateStatus, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	win, ok := rl.keys[key]
+	if !ok || !now.Before(win.start.Add(rl.window)) {
+		// Windows of keys that are no longer used are dropped once in
+		// a while.
+		if len(rl.keys) > 1024 {
+			for k, w := range rl.keys {
+				if !now.Before(w.start.Add(rl.window)) {
+					delete(rl.keys, k)
+				}
+			}
+		}
+		win = &rateWindow{start: now}
+		rl.keys[key] = win
+	}
+	allowed := win.used < rl.limit
+	if allowed {
+		win.used++
+	}
+	return rateStatus{
+		Window:    rl.window.String(),
+		Limit:     rl.limit,
+		Used:      win.used,
+		Remaining: rl.limit - win.used,
+		Reset:     win.start.Add(rl.window).UTC(),
+	}, allowed
+}
+
+// setHeaders sets the X-RateLimit-* headers of the status, and the
+// Retry-After header if the limit is reached.
+func (s rateStatus) setHeaders(w http.ResponseWriter, now time.Time) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(s.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(s.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(s.Reset.Unix(), 10))
+	if s.Remaining == 0 {
+		// Rounded up, so that clients do not retry too early.
+		secs := int((s.Reset.Sub(now) + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+}
+
+// apiLimiter limits the requests to the versioned API per key. It is
+// configured by environment variables:
+//
+//	URLSTAT_API_RATE: requests per key per window, defaults to 600
+//	URLSTAT_API_RATE_WINDOW: the window, defaults to 1m
+var apiLimiter *rateLimiter
+
+func init() {
+	limit, window := 600, time.Minute
+	if v := os.Getenv("URLSTAT_API_RATE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid URLSTAT_API_RATE: %v", v)
+		}
+		limit = n
+	}
+	if v := os.Getenv("URLSTAT_API_RATE_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second {
+			log.Fatalf("invalid URLSTAT_API_RATE_WINDOW: %v", v)
+		}
+		window = d
+	}
+	apiLimiter = newRateLimiter(limit, window)
+}
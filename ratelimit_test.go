@@ -0,0 +1,50 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, time.Minute)
+	now := time.Date(2021, 3, 30, 12, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		key       string
+		after     time.Duration
+		allowed   bool
+		remaining int
+	}{
+		{"a", 0, true, 1},
+		{"a", time.Second, true, 0},
+		{"a", 2 * time.Second, false, 0},
+		{"b", 2 * time.Second, true, 1},
+		{"a", time.Minute, true, 1},
+	}
+	for i, s := range steps {
+		st, ok := rl.take(s.key, now.Add(s.after))
+		if ok != s.allowed || st.Remaining != s.remaining {
+			t.Fatalf("step %d: allowed %v with %d remaining, want %v with %d", i, ok, st.Remaining, s.allowed, s.remaining)
+		}
+	}
+
+	st, _ := rl.take("b", now.Add(3*time.Second))
+	w := httptest.NewRecorder()
+	st.setHeaders(w, now.Add(3*time.Second))
+	want := map[string]string{
+		"X-RateLimit-Limit":     "2",
+		"X-RateLimit-Remaining": "0",
+		"X-RateLimit-Reset":     "1617105662",
+		"Retry-After":           "59",
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Fatalf("%s: %q, want %q", k, got, v)
+		}
+	}
+}
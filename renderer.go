@@ -8,6 +8,8 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/golang/freetype/truetype"
 	"golang.org/x/image/font"
@@ -58,11 +60,15 @@ const (
 
 var drawer *badgeDrawer
 
-func mustNewFontDrawer(size, dpi float64) *font.Drawer {
-	ttf, err := truetype.Parse(veraSans)
+func mustParseFont(data []byte) *truetype.Font {
+	ttf, err := truetype.Parse(data)
 	if err != nil {
 		panic(err)
 	}
+	return ttf
+}
+
+func mustNewFontDrawer(ttf *truetype.Font, size, dpi float64) *font.Drawer {
 	return &font.Drawer{
 		Face: truetype.NewFace(ttf, &truetype.Options{
 			Size:    size,
@@ -76,9 +82,30 @@ type badge struct {
 	Subject string
 	Status  string
 	Color   color
+	Theme   badgeTheme
 	Bounds  bounds
 }
 
+// badgeTheme is the palette of the subject of a badge, the status is
+// drawn in the color of the badge.
+type badgeTheme struct {
+	Name string
+	// Subject is the background of the subject, Text its text, and
+	// Shadow the shadow of all text.
+	Subject string
+	Text    string
+	Shadow  string
+}
+
+// badgeThemes are the themes of badges by the theme parameter. The light
+// theme is the default, which is hard to read on dark pages, and the auto
+// theme is light or dark by the color scheme of the viewer.
+var badgeThemes = map[string]badgeTheme{
+	"light": {Name: "light", Subject: "#555", Text: "#fff", Shadow: "#010101"},
+	"dark":  {Name: "dark", Subject: "#d0d7de", Text: "#24292f", Shadow: "#fff"},
+	"auto":  {Name: "auto", Subject: "#555", Text: "#fff", Shadow: "#010101"},
+}
+
 type bounds struct {
 	// SubjectDx is the width of subject string of the badge.
 	SubjectDx float64
@@ -93,12 +120,14 @@ func (b bounds) Dx() float64 {
 }
 
 type badgeDrawer struct {
-	fd    *font.Drawer
+	fd *font.Drawer
+	// font is the font of fd, which tells the glyphs it covers.
+	font  *truetype.Font
 	tmpl  *template.Template
 	mutex *sync.Mutex
 }
 
-func (d *badgeDrawer) Render(subject, status string, color color, w io.Writer) error {
+func (d *badgeDrawer) Render(subject, status string, color color, theme badgeTheme, w io.Writer) error {
 	d.mutex.Lock()
 	subjectDx := d.measureString(subject)
 	statusDx := d.measureString(status)
@@ -108,6 +137,7 @@ func (d *badgeDrawer) Render(subject, status string, color color, w io.Writer) e
 		Subject: subject,
 		Status:  status,
 		Color:   color,
+		Theme:   theme,
 		Bounds: bounds{
 			SubjectDx: subjectDx,
 			SubjectX:  subjectDx/2.0 + 1,
@@ -118,16 +148,94 @@ func (d *badgeDrawer) Render(subject, status string, color color, w io.Writer) e
 	return d.tmpl.Execute(w, bdg)
 }
 
-func (d *badgeDrawer) RenderBytes(subject, status string, color color) ([]byte, error) {
+func (d *badgeDrawer) RenderBytes(subject, status string, color color, theme badgeTheme) ([]byte, error) {
 	buf := &bytes.Buffer{}
-	err := d.Render(subject, status, color, buf)
+	err := d.Render(subject, status, color, theme, buf)
 	return buf.Bytes(), err
 }
 
+// measureString measures the width of a string. Vera only covers Latin
+// scripts, other glyphs are drawn by fallback fonts of the viewer, hence
+// their width is estimated by script, see fallbackAdvance. Runs of covered
+// glyphs are measured by the font including their kerning.
 func (d *badgeDrawer) measureString(s string) float64 {
-	sm := d.fd.MeasureString(s)
+	var width float64
+	run := 0
+	for i, r := range s {
+		if d.font.Index(r) != 0 {
+			continue
+		}
+		width += d.measureRun(s[run:i]) + fallbackAdvance(r)
+		run = i + utf8.RuneLen(r)
+	}
+	return width + d.measureRun(s[run:]) + extraDx
+}
+
+// measureRun measures the width of glyphs that Vera covers.
+func (d *badgeDrawer) measureRun(s string) float64 {
+	if s == "" {
+		return 0
+	}
 	// this 64 is weird but it's the way I've found how to convert fixed.Int26_6 to float64
-	return float64(sm)/64 + extraDx
+	return float64(d.fd.MeasureString(s)) / 64
+}
+
+// fallbackAdvances are the estimated widths of glyphs of scripts that Vera
+// does not cover in em, i.e. relative to the font size, which are about
+// their average widths in common fallback fonts, e.g. DejaVu Sans and
+// Noto. The first matching script applies.
+var fallbackAdvances = []struct {
+	script *unicode.RangeTable
+	em     float64
+}{
+	// Marks combine with the previous glyph, and format characters, such
+	// as joiners and direction marks, are not drawn.
+	{unicode.Mn, 0},
+	{unicode.Me, 0},
+	{unicode.Cf, 0},
+	// CJK glyphs are square, and so are fullwidth forms and emoji.
+	{unicode.Han, 1},
+	{unicode.Hiragana, 1},
+	{unicode.Katakana, 1},
+	{unicode.Hangul, 1},
+	{unicode.Bopomofo, 1},
+	{wideSymbols, 1},
+	{unicode.Cyrillic, 0.62},
+	{unicode.Greek, 0.6},
+	{unicode.Armenian, 0.6},
+	{unicode.Georgian, 0.6},
+	{unicode.Devanagari, 0.6},
+	{unicode.Bengali, 0.6},
+	{unicode.Thai, 0.55},
+	{unicode.Hebrew, 0.55},
+	{unicode.Arabic, 0.5},
+}
+
+// wideSymbols are the CJK symbols, fullwidth forms, and emoji that are not
+// in a script.
+var wideSymbols = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x3000, Hi: 0x303f, Stride: 1},
+		{Lo: 0xff01, Hi: 0xff60, Stride: 1},
+		{Lo: 0xffe0, Hi: 0xffe6, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f300, Hi: 0x1f64f, Stride: 1},
+		{Lo: 0x1f680, Hi: 0x1f6ff, Stride: 1},
+		{Lo: 0x1f900, Hi: 0x1faff, Stride: 1},
+	},
+}
+
+// fallbackAdvance estimates the width of a glyph that Vera does not cover,
+// which is about as wide as an average Latin glyph unless its script is
+// known to be narrower or wider, see fallbackAdvances.
+func fallbackAdvance(r rune) float64 {
+	for _, a := range fallbackAdvances {
+		if unicode.Is(a.script, r) {
+			return a.em * fontsize
+		}
+	}
+	return 0.6 * fontsize
 }
 
 // shield.io uses Verdana.ttf to measure text width with an extra 10px.
@@ -143,8 +251,10 @@ func init() {
 		log.Fatalf("Couldn't decode base64 font data: %s\n", err)
 	}
 
+	ttf := mustParseFont(veraSans)
 	drawer = &badgeDrawer{
-		fd:    mustNewFontDrawer(fontsize, dpi),
+		fd:    mustNewFontDrawer(ttf, fontsize, dpi),
+		font:  ttf,
 		tmpl:  template.Must(template.New("flat-template").Parse(flatTemplate)),
 		mutex: &sync.Mutex{},
 	}
@@ -152,6 +262,9 @@ func init() {
 
 var flatTemplate = strings.TrimSpace(`
 <svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="{{.Bounds.Dx}}" height="20">
+  {{- if eq .Theme.Name "auto"}}
+  <style>@media (prefers-color-scheme: dark) { .subject { fill: #d0d7de } .text { fill: #24292f } .shadow { fill: #fff } }</style>
+  {{- end}}
   <linearGradient id="smooth" x2="0" y2="100%">
     <stop offset="0" stop-color="#bbb" stop-opacity=".1"/>
     <stop offset="1" stop-opacity=".1"/>
@@ -160,13 +273,13 @@ var flatTemplate = strings.TrimSpace(`
     <rect width="{{.Bounds.Dx}}" height="20" rx="3" fill="#fff"/>
   </mask>
   <g mask="url(#round)">
-    <rect width="{{.Bounds.SubjectDx}}" height="20" fill="#555"/>
+    <rect class="subject" width="{{.Bounds.SubjectDx}}" height="20" fill="{{.Theme.Subject}}"/>
     <rect x="{{.Bounds.SubjectDx}}" width="{{.Bounds.StatusDx}}" height="20" fill="{{or .Color "#4c1" | html}}"/>
     <rect width="{{.Bounds.Dx}}" height="20" fill="url(#smooth)"/>
   </g>
   <g fill="#fff" text-anchor="middle" font-family="DejaVu Sans,Verdana,Geneva,sans-serif" font-size="11">
-    <text x="{{.Bounds.SubjectX}}" y="15" fill="#010101" fill-opacity=".3">{{.Subject | html}}</text>
-    <text x="{{.Bounds.SubjectX}}" y="14">{{.Subject | html}}</text>
+    <text class="shadow" x="{{.Bounds.SubjectX}}" y="15" fill="{{.Theme.Shadow}}" fill-opacity=".3">{{.Subject | html}}</text>
+    <text class="text" x="{{.Bounds.SubjectX}}" y="14" fill="{{.Theme.Text}}">{{.Subject | html}}</text>
     <text x="{{.Bounds.StatusX}}" y="15" fill="#010101" fill-opacity=".3">{{.Status | html}}</text>
     <text x="{{.Bounds.StatusX}}" y="14">{{.Status | html}}</text>
   </g>
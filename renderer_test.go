@@ -0,0 +1,32 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestMeasureString(t *testing.T) {
+	latin := func(s string) float64 { return float64(drawer.fd.MeasureString(s)) / 64 }
+	tests := []struct {
+		s    string
+		want float64
+	}{
+		{"", extraDx},
+		{"visitors", latin("visitors") + extraDx},
+		// Runs of Latin glyphs are measured apart around other scripts.
+		{"pv访问量uv", latin("pv") + 3*fontsize + latin("uv") + extraDx},
+		{"Besucher 🎉", latin("Besucher ") + fontsize + extraDx},
+		{"мир", 3*0.62*fontsize + extraDx},
+		{"שלום", 4*0.55*fontsize + extraDx},
+		// Joiners are not drawn.
+		{"👍‍👍", 2*fontsize + extraDx},
+		// Scripts without an estimate are about as wide as Latin glyphs.
+		{"ᚠᚢ", 2*0.6*fontsize + extraDx},
+	}
+	for _, tt := range tests {
+		if got := drawer.measureString(tt.s); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// Database operations are retried with exponential backoff on transient
+// errors, e.g. a failover of the replica set or a dropped connection,
+// which is configured by environment variables:
+//
+//	URLSTAT_DB_RETRIES: the retries after the first attempt, defaults to 3
+//	URLSTAT_DB_RETRY_BACKOFF: the backoff of the first retry, defaults to 50ms
+//
+// The backoff doubles for each retry up to retryMaxBackoff, and a random
+// jitter of up to the backoff itself is added, so that replicas do not
+// retry in lockstep.
+var (
+	retries         = 3
+	retryBackoff    = 50 * time.Millisecond
+	retryMaxBackoff = 2 * time.Second
+)
+
+func init() {
+	if v := os.Getenv("URLSTAT_DB_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid URLSTAT_DB_RETRIES: %v", v)
+		}
+		retries = n
+	}
+	if v := os.Getenv("URLSTAT_DB_RETRY_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid URLSTAT_DB_RETRY_BACKOFF: %v", v)
+		}
+		retryBackoff = d
+	}
+}
+
+// retryCounts counts retries and operations that failed after all
+// retries, per operation.
+var retryCounts = struct {
+	sync.Mutex
+	retried map[string]int64
+	failed  map[string]int64
+}{retried: map[string]int64{}, failed: map[string]int64{}}
+
+// retry runs the operation until it succeeds, fails with a permanent
+// error, runs out of retries, or the context is done.
+//
+// An operation that is not idempotent, i.e. may apply twice if it is
+// repeated, is only retried if the error guarantees that it was not
+// applied, such as failing to select a server.
+func retry(ctx context.Context, op string, idempotent bool, fn func(ctx context.Context) error) error {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !isTransient(err, idempotent) {
+			return err
+		}
+		if attempt == retries {
+			retryCounts.Lock()
+			retryCounts.failed[op]++
+			retryCounts.Unlock()
+			return err
+		}
+
+		t := time.NewTimer(backoff + time.Duration(rand.Int63n(int64(backoff))))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		retryCounts.Lock()
+		retryCounts.retried[op]++
+		retryCounts.Unlock()
+		l.Printf("%s retrying %s after: %v", requestID(ctx), op, err)
+
+		backoff *= 2
+		if backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// isTransient reports whether an operation that failed with the error may
+// succeed if it is retried.
+func isTransient(err error, idempotent bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var sse topology.ServerSelectionError
+	if errors.As(err, &sse) {
+		return true
+	}
+	var se mongo.ServerError
+	if errors.As(err, &se) && se.HasErrorLabel("RetryableWriteError") {
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err) ||
+		(errors.As(err, &se) && se.HasErrorLabel("TransientTransactionError"))
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+func TestRetry(t *testing.T) {
+	defer func(n int, d time.Duration) { retries, retryBackoff = n, d }(retries, retryBackoff)
+	retries, retryBackoff = 2, time.Millisecond
+
+	transient := topology.ServerSelectionError{Wrapped: errors.New("no primary")}
+	permanent := errors.New("invalid document")
+	tests := []struct {
+		name     string
+		errs     []error
+		want     error
+		attempts int
+	}{
+		{"success", []error{nil}, nil, 1},
+		{"transient", []error{transient, transient, nil}, nil, 3},
+		{"exhausted", []error{transient, transient, transient, nil}, transient, 3},
+		{"permanent", []error{permanent, nil}, permanent, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := retry(context.Background(), "test", false, func(ctx context.Context) error {
+				err := tt.errs[attempts]
+				attempts++
+				return err
+			})
+			// Server selection errors are not comparable.
+			if (err == nil) != (tt.want == nil) || err != nil && err.Error() != tt.want.Error() || attempts != tt.attempts {
+				t.Fatalf("retry() = %v after %d attempts, want %v after %d", err, attempts, tt.want, tt.attempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// colInvites stores the pending invites to sites, see invite.
+const colInvites = "invites"
+
+// Roles of users of a site on a multi-user instance. Viewers view the
+// reports of the site, admins also change its settings, delete its data,
+// and invite other users.
+const (
+	roleViewer = "viewer"
+	roleAdmin  = "admin"
+)
+
+// inviteTTL is how long an invite link is valid.
+const inviteTTL = 7 * day
+
+// roleOf returns the role of the user of the GitHub login on the site, or
+// an empty string if it has none.
+func (s *siteSettings) roleOf(login string) string {
+	if s.ownedBy(login) {
+		return roleAdmin
+	}
+	for _, v := range s.Viewers {
+		if v == login {
+			return roleViewer
+		}
+	}
+	return ""
+}
+
+// canManage reports whether the viewer of the context administrates the
+// site of a host, which instance admins do for all sites.
+func canManage(ctx context.Context, host string) (bool, error) {
+	v, _ := ctx.Value(viewerKey{}).(*viewer)
+	if v == nil {
+		return false, nil
+	}
+	if v.admin {
+		return true, nil
+	}
+	s, err := settingsOf(ctx, host)
+	if err != nil {
+		return false, fmt.Errorf("failed to load settings: %w", err)
+	}
+	return s.roleOf(v.login) == roleAdmin, nil
+}
+
+// invite is a single-use link that grants a role on a site to the user
+// that opens it. Its ID is the random token of the link.
+type invite struct {
+	ID      string    `json:"-"       bson:"_id"`
+	Host    string    `json:"host"    bson:"host"`
+	Role    string    `json:"role"    bson:"role"`
+	Creator string    `json:"creator" bson:"creator"`
+	Expires time.Time `json:"expires" bson:"expires"`
+	URL     string    `json:"url"     bson:"-"`
+}
+
+// createInvite creates an invite to a role on the site of a host.
+func createInvite(ctx context.Context, host, role, creator string, now time.Time) (*invite, error) {
+	if role != roleViewer && role != roleAdmin {
+		return nil, fmt.Errorf("%w: unknown role %q", errInvalidQuery, role)
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	inv := &invite{
+		ID:      hex.EncodeToString(b),
+		Host:    host,
+		Role:    role,
+		Creator: creator,
+		Expires: now.Add(inviteTTL).UTC(),
+	}
+	_, err := db.Database(metaname).Collection(colInvites).InsertOne(ctx, inv)
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// acceptInvite grants the role of an invite to the user of the GitHub
+// login and deletes the invite. A user has a single role per site, hence
+// accepting an invite replaces the previous role.
+func acceptInvite(ctx context.Context, token, login string, now time.Time) (*invite, error) {
+	inv := &invite{}
+	err := db.Database(metaname).Collection(colInvites).FindOneAndDelete(ctx,
+		bson.M{"_id": token, "expires": bson.M{"$gt": now}}).Decode(inv)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid or expired invite", errNoInvite)
+	}
+	add, remove := "viewers", "owners"
+	if inv.Role == roleAdmin {
+		add, remove = remove, add
+	}
+	// Only registered sites are updated, as creating their settings would
+	// register them.
+	res, err := db.Database(metaname).Collection(colSettings).UpdateOne(ctx,
+		bson.M{"_id": inv.Host},
+		bson.M{"$addToSet": bson.M{add: login}, "$pull": bson.M{remove: login}})
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, fmt.Errorf("%w: %s", errHostUnregistered, inv.Host)
+	}
+	settingsCache.Lock()
+	delete(settingsCache.m, inv.Host)
+	settingsCache.Unlock()
+	return inv, nil
+}
+
+// acceptInviteLink accepts the invite of a link: /urlstat/invite/<token>.
+// Users that are not logged in are asked to log in and open it again.
+func acceptInviteLink(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	if !multiUser() {
+		http.NotFound(w, r)
+		return
+	}
+	name := sessionLogin(r, time.Now())
+	if name == "" {
+		http.Redirect(w, r, "/urlstat/login", http.StatusFound)
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, "/urlstat/invite/")
+	inv, err := acceptInvite(r.Context(), token, name, time.Now())
+	if err != nil {
+		return
+	}
+	audit(r.Context(), auditEntry{
+		Actor:  "github:" + name,
+		IP:     readIP(r),
+		Action: "accept-invite",
+		Value:  inv.Host,
+		Result: fmt.Sprintf("%s by %s", inv.Role, inv.Creator),
+	})
+	http.Redirect(w, r, "/urlstat/dashboard", http.StatusFound)
+}
+
+// siteAPI serves the endpoints that site admins use to manage their sites,
+// which require a session of a site admin or an admin API key:
+//
+//	GET    /urlstat/sites/<host>/settings  ingest settings
+//	PUT    /urlstat/sites/<host>/settings  replace ingest settings, except the quota
+//	POST   /urlstat/sites/<host>/invites   {"role": "viewer"}, an invite link
+//	DELETE /urlstat/sites/<host>           delete the site, see adminHost
+func siteAPI(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	if !multiUser() {
+		http.NotFound(w, r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	host, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/urlstat/sites/"), "/")
+	ok, err := canManage(ctx, host)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = fmt.Errorf("%w: %s", errForbidden, host)
+		return
+	}
+	v := ctx.Value(viewerKey{}).(*viewer)
+	// Site admins act with a key of their own, which signs their
+	// confirmation tokens, see runAdmin.
+	key := adminKey(r)
+	if !v.admin {
+		key = sessionSecret + ":" + v.login
+	}
+
+	var resp interface{}
+	switch {
+	case rest == "" && r.Method == http.MethodDelete:
+		resp, err = confirmDeleteHost(r, key, host)
+	case rest == "settings" && r.Method == http.MethodGet:
+		resp, err = settingsOf(ctx, host)
+	case rest == "settings" && r.Method == http.MethodPut:
+		settings := &siteSettings{}
+		if err = json.NewDecoder(r.Body).Decode(settings); err != nil {
+			err = fmt.Errorf("%w: %v", errInvalidQuery, err)
+			return
+		}
+		// The quota protects the storage of the instance from its sites,
+		// hence only instance admins change it.
+		if !v.admin {
+			var old *siteSettings
+			if old, err = settingsOf(ctx, host); err != nil {
+				return
+			}
+			settings.Quota, settings.OverQuota = old.Quota, old.OverQuota
+		}
+		resp, err = runAdmin(r, key, adminRequest{
+			Action:   "update-settings",
+			Value:    host,
+			Settings: settings,
+		})
+	case rest == "invites" && r.Method == http.MethodPost:
+		var req struct {
+			Role string `json:"role"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			err = fmt.Errorf("%w: %v", errInvalidQuery, err)
+			return
+		}
+		var inv *invite
+		inv, err = createInvite(ctx, host, req.Role, actorOf(ctx, key), time.Now())
+		if err != nil {
+			return
+		}
+		scheme := "https"
+		if !source.Production {
+			scheme = "http"
+		}
+		inv.URL = (&url.URL{Scheme: scheme, Host: r.Host, Path: "/urlstat/invite/" + inv.ID}).String()
+		resp = inv
+	default:
+		err = fmt.Errorf("%w: %s %s", errInvalidQuery, r.Method, r.URL.Path)
+	}
+	if err != nil {
+		return
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// actorOf returns the actor of the audit log of a request with the key,
+// which is the GitHub login of site admins.
+func actorOf(ctx context.Context, key string) string {
+	if v, _ := ctx.Value(viewerKey{}).(*viewer); v != nil && !v.admin && v.login != "" {
+		return "github:" + v.login
+	}
+	return actor(key)
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRoles(t *testing.T) {
+	withLogin(t)
+	s := &siteSettings{
+		Host:    "changkun.de",
+		Owners:  []string{"Changkun"},
+		Viewers: []string{"golang"},
+	}
+	if err := s.validate(); err != nil {
+		t.Fatal(err)
+	}
+	settingsCache.Lock()
+	settingsCache.m[s.Host] = cachedSettings{s, time.Now().Add(time.Hour)}
+	settingsCache.Unlock()
+	t.Cleanup(func() {
+		settingsCache.Lock()
+		delete(settingsCache.m, s.Host)
+		settingsCache.Unlock()
+	})
+
+	tests := []struct {
+		viewer       *viewer
+		role         string
+		view, manage bool
+	}{
+		{&viewer{login: "changkun"}, roleAdmin, true, true},
+		{&viewer{login: "golang"}, roleViewer, true, false},
+		{&viewer{login: "gopher"}, "", false, false},
+		{&viewer{admin: true}, "", true, true},
+	}
+	for _, tt := range tests {
+		if got := s.roleOf(tt.viewer.login); got != tt.role {
+			t.Fatalf("role of %s: %q, want %q", tt.viewer.login, got, tt.role)
+		}
+		ctx := context.WithValue(context.Background(), viewerKey{}, tt.viewer)
+		view, err := canView(ctx, s.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manage, err := canManage(ctx, s.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if view != tt.view || manage != tt.manage {
+			t.Fatalf("viewer %+v views %v and manages %v, want %v and %v", tt.viewer, view, manage, tt.view, tt.manage)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Rollups are pre-aggregated statistics that are periodically computed
+// from raw visits by the rollup worker, so that reports can be served
+// without scanning visit collections. They are stored in the meta
+// database, because every collection in the visit database is a host.
+const (
+	// colRollups stores daily pv/uv per host and path, see rollup.
+	colRollups = "rollups"
+	// colTotals stores all-time pv/uv per host, see total.
+	colTotals = "totals"
+)
+
+// rollup is the pv and uv of a path of a host on a day. The rollup of the
+// whole site has an empty path, its uv is not the sum of path uvs.
+// Entries and exits are the number of sessions that started or ended
+// with the path on the day. New and returning visitors are only counted
+// for the whole site.
+type rollup struct {
+	Host      string    `json:"host"      bson:"host"`
+	Path      string    `json:"path"      bson:"path"`
+	Day       time.Time `json:"day"       bson:"day"`
+	PV        int64     `json:"pv"        bson:"pv"`
+	UV        int64     `json:"uv"        bson:"uv"`
+	Entries   int64     `json:"entries"   bson:"entries"`
+	Exits     int64     `json:"exits"     bson:"exits"`
+	New       int64     `json:"new"       bson:"new"`
+	Returning int64     `json:"returning" bson:"returning"`
+}
+
+// total is the all-time pv and uv of a host.
+type total struct {
+	Host    string    `json:"host"    bson:"_id"`
+	PV      int64     `json:"pv"      bson:"pv"`
+	UV      int64     `json:"uv"      bson:"uv"`
+	Updated time.Time `json:"updated" bson:"updated"`
+	// Version is the time the rollups or cohorts of the host were last
+	// computed, see statsVersion.
+	Version time.Time `json:"-" bson:"version"`
+}
+
+const day = 24 * time.Hour
+
+// rollupWorker periodically computes the rollups of recent days and the
+// totals of all hosts until the context is canceled. The interval can be
+// configured by URLSTAT_ROLLUP_INTERVAL and defaults to one hour. Cohorts
+// are computed once a day, as they scan visits of several weeks. If any
+// notifier is configured, the traffic of each complete hour is checked
+// for anomalies.
+//
+// If multiple replicas run, only the holder of the rollup lease does the
+// work, so that alerts are sent once.
+func rollupWorker(ctx context.Context) {
+	interval := time.Hour
+	if v := os.Getenv("URLSTAT_ROLLUP_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			l.Fatalf("invalid URLSTAT_ROLLUP_INTERVAL: %v", err)
+		}
+		interval = d
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var cohortDay, anomalyHour time.Time
+	for {
+		leader, err := acquireLease(ctx, "rollup", 2*interval)
+		if err != nil {
+			l.Printf("failed to acquire rollup lease: %v", err)
+		}
+		if !leader {
+			// Another replica may compute cohorts in the meantime.
+			cohortDay = time.Time{}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				continue
+			}
+		}
+
+		// Always recompute yesterday as well, visits of yesterday may
+		// have arrived after the previous run.
+		today := time.Now().UTC().Truncate(day)
+		if err := runRollups(ctx, today.Add(-day)); err != nil {
+			l.Printf("failed to compute rollups: %v", err)
+		}
+		if !today.Equal(cohortDay) {
+			if err := runCohorts(ctx, time.Now()); err != nil {
+				l.Printf("failed to compute cohorts: %v", err)
+			} else {
+				cohortDay = today
+			}
+		}
+		if hour := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour); len(notifiers) > 0 && !hour.Equal(anomalyHour) {
+			if err := runAnomalies(ctx, hour); err != nil {
+				l.Printf("failed to detect anomalies: %v", err)
+			}
+			anomalyHour = hour
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// runRollups computes the daily rollups since the given day and the totals
+// of all hosts. A host that fails does not hold up the others, and the
+// errors of all failed hosts are returned.
+func runRollups(ctx context.Context, since time.Time) error {
+	hosts, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	var errs []error
+	for _, host := range hosts {
+		start := time.Now()
+		err := rollupHost(ctx, host, since, time.Time{})
+		if err != nil {
+			err = fmt.Errorf("failed to roll up %s: %w", host, err)
+		} else if err = totalHost(ctx, host); err != nil {
+			err = fmt.Errorf("failed to total %s: %w", host, err)
+		}
+		if err != nil {
+			l.Printf("%v", err)
+			errs = append(errs, err)
+			continue
+		}
+		l.Printf("rolling up host %v took %v", host, time.Since(start))
+	}
+	return joinErrors(errs...)
+}
+
+// rollupHost computes the daily rollups of all paths and the whole site
+// of a host since the given day until the given day, or the end if it is
+// zero.
+func rollupHost(ctx context.Context, host string, since, until time.Time) error {
+	field, err := uvFieldOf(ctx, host)
+	if err != nil {
+		return err
+	}
+	col := analyticsDB(dbname).Collection(host)
+	match := bson.D{{Key: "$match", Value: bson.M{"time": timeRange(since, until)}}}
+	dayExpr := bucketExpr(day.Milliseconds())
+
+	type key struct {
+		day  time.Time
+		path string
+	}
+	rollups := map[key]*rollup{}
+	for _, groupPath := range []bool{true, false} {
+		group := bson.M{"day": dayExpr, "uv": "$" + field}
+		if groupPath {
+			group["path"] = "$path"
+		}
+		p := mongo.Pipeline{
+			match,
+			bson.D{{Key: "$group", Value: bson.M{
+				"_id":   group,
+				"count": bson.M{"$sum": 1},
+			}}},
+			bson.D{{Key: "$group", Value: bson.M{
+				"_id": bson.M{"day": "$_id.day", "path": "$_id.path"},
+				"uv":  bson.M{"$sum": 1},
+				"pv":  bson.M{"$sum": "$count"},
+			}}},
+		}
+		cur, err := col.Aggregate(ctx, p, options.Aggregate().SetAllowDiskUse(true))
+		if err != nil {
+			return err
+		}
+		var results []struct {
+			ID struct {
+				Day  int64  `bson:"day"`
+				Path string `bson:"path"`
+			} `bson:"_id"`
+			PV int64 `bson:"pv"`
+			UV int64 `bson:"uv"`
+		}
+		if err := cur.All(ctx, &results); err != nil {
+			return err
+		}
+		for _, r := range results {
+			d := time.UnixMilli(r.ID.Day).UTC()
+			rollups[key{d, r.ID.Path}] = &rollup{
+				Host: host,
+				Path: r.ID.Path,
+				Day:  d,
+				PV:   r.PV,
+				UV:   r.UV,
+			}
+		}
+	}
+
+	// Visitors are new on the day of their first visit, and returning on
+	// other days.
+	p := mongo.Pipeline{
+		match,
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"day": dayExpr, "vid": "$visitor_id"},
+			"new": bson.M{"$max": bson.M{"$cond": bson.A{"$new", 1, 0}}},
+		}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id":      "$_id.day",
+			"visitors": bson.M{"$sum": 1},
+			"new":      bson.M{"$sum": "$new"},
+		}}},
+	}
+	cur, err := col.Aggregate(ctx, p, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	var visitors []struct {
+		Day      int64 `bson:"_id"`
+		Visitors int64 `bson:"visitors"`
+		New      int64 `bson:"new"`
+	}
+	if err := cur.All(ctx, &visitors); err != nil {
+		return err
+	}
+	for _, v := range visitors {
+		if r, ok := rollups[key{time.UnixMilli(v.Day).UTC(), ""}]; ok {
+			r.New = v.New
+			r.Returning = v.Visitors - v.New
+		}
+	}
+
+	// Sessions count as entry on the day they started and as exit on the
+	// day they ended.
+	err = forEachSession(ctx, col, since, until, func(session []visit) {
+		first, last := session[0], session[len(session)-1]
+		if r, ok := rollups[key{first.Time.UTC().Truncate(day), first.Path}]; ok {
+			r.Entries++
+		}
+		if r, ok := rollups[key{last.Time.UTC().Truncate(day), last.Path}]; ok {
+			r.Exits++
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	all := make([]rollup, 0, len(rollups))
+	for _, r := range rollups {
+		all = append(all, *r)
+	}
+	return saveRollups(ctx, all)
+}
+
+// saveRollups upserts the given rollups.
+func saveRollups(ctx context.Context, rollups []rollup) error {
+	if len(rollups) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(rollups))
+	for _, r := range rollups {
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"host": r.Host, "day": r.Day, "path": r.Path}).
+			SetReplacement(r).
+			SetUpsert(true))
+	}
+	col := db.Database(metaname).Collection(colRollups)
+	_, err := col.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// totalHost computes the all-time pv and uv of a host.
+func totalHost(ctx context.Context, host string) error {
+	field, err := uvFieldOf(ctx, host)
+	if err != nil {
+		return err
+	}
+	col := analyticsDB(dbname).Collection(host)
+	pv, err := estimatedVisits(ctx, col)
+	if err != nil {
+		return err
+	}
+	p := mongo.Pipeline{
+		bson.D{{Key: "$group", Value: bson.M{"_id": "$" + field}}},
+		bson.D{{Key: "$count", Value: "uv"}},
+	}
+	cur, err := col.Aggregate(ctx, p, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	var results []struct {
+		UV int64 `bson:"uv"`
+	}
+	if err := cur.All(ctx, &results); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	t := total{Host: host, PV: pv, Updated: now, Version: now}
+	if len(results) > 0 {
+		t.UV = results[0].UV
+	}
+	_, err = db.Database(metaname).Collection(colTotals).ReplaceOne(ctx,
+		bson.M{"_id": host}, t, options.Replace().SetUpsert(true))
+	return err
+}
+
+// bucketExpr returns an aggregation expression that truncates the time of
+// a visit to the given interval in milliseconds, resulting a unix
+// timestamp in milliseconds.
+func bucketExpr(interval int64) bson.M {
+	ms := bson.M{"$toLong": "$time"}
+	return bson.M{"$subtract": bson.A{ms, bson.M{"$mod": bson.A{ms, interval}}}}
+}
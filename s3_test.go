@@ -0,0 +1,49 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObjectStoreSignedPath(t *testing.T) {
+	var s *objectStore
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// S3 signs the path as it is received, which must be the
+		// encoding of signature version 4.
+		path, _, _ := strings.Cut(r.RequestURI, "?")
+		if want := uriEncode(r.URL.Path, false); path != want {
+			t.Errorf("sent path %s, want %s", path, want)
+		}
+		now, err := time.Parse("20060102T150405Z", r.Header.Get("x-amz-date"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRequest(r.Method, "http://"+r.Host+r.RequestURI, nil)
+		s.sign(rr, nil, now)
+		if got, want := r.Header.Get("Authorization"), rr.Header.Get("Authorization"); got != want {
+			t.Errorf("signature of the sent path %s differs: %s, want %s", path, got, want)
+		}
+	}))
+	defer srv.Close()
+	s = &objectStore{
+		endpoint:  srv.URL,
+		bucket:    "urlstat-archive",
+		region:    "eu-central-1",
+		accessKey: "AKIA",
+		secretKey: "secret",
+		client:    srv.Client(),
+	}
+	for _, key := range []string{"changkun.de/2021-03-1.jsonl.gz", "localhost:8080/2021-03 (1).jsonl.gz"} {
+		if err := s.del(context.Background(), key); err != nil {
+			t.Fatalf("cannot delete %s: %v", key, err)
+		}
+	}
+}
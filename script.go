@@ -0,0 +1,433 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ingestScript is a script of rules that drop, tag, or rewrite visits at
+// ingest, so that a deployment has rules of its own sites without a fork.
+// Rules are written in a small rule language rather than run by an
+// embedded JavaScript or WebAssembly interpreter, hence they have no
+// loops or functions and cannot fail or run long at ingest. A rule is a
+// line of the script, and rules run in order on each visit after the
+// enrichment pipeline, see enrich:
+//
+//	# Comments start with #.
+//	drop if ua contains "HeadlessChrome" or path ~ "^/(admin|preview)/"
+//	tag section "blog" if host == "changkun.de" and path startswith "/blog/"
+//	set referer "" if referer contains "localhost"
+//	rewrite path "/index\.html$" "/"
+//
+// drop stops the script and does not record the visit. tag sets a custom
+// dimension, set a field, and rewrite replaces the matches of a regular
+// expression in a field, where $1 is the first submatch. The fields of
+// conditions are host, path, referer, ua, ip, country, channel, browser,
+// os, and dim.<key> of custom dimensions, those of set and rewrite are
+// path, referer, and ua. Conditions compare by ==, !=, ~ and !~ (regular
+// expressions), contains, and startswith, and are combined by not, and,
+// or, and parentheses.
+type ingestScript struct {
+	rules []scriptRule
+}
+
+// scriptRule is a rule of an ingest script.
+type scriptRule struct {
+	action string // drop, tag, set, or rewrite
+	// field is the field of set and rewrite, or the dimension of tag, and
+	// value is its value, or the replacement of rewrite.
+	field, value string
+	re           *regexp.Regexp
+	// cond is the condition of the rule, or nil if it always applies.
+	cond scriptExpr
+}
+
+// scriptExpr is a condition of a rule.
+type scriptExpr interface {
+	eval(v *visit) bool
+}
+
+type (
+	scriptAnd struct{ l, r scriptExpr }
+	scriptOr  struct{ l, r scriptExpr }
+	scriptNot struct{ e scriptExpr }
+	// scriptCmp compares a field with a string, or matches it against
+	// a regular expression.
+	scriptCmp struct {
+		field, op, value string
+		re               *regexp.Regexp
+	}
+)
+
+func (e scriptAnd) eval(v *visit) bool { return e.l.eval(v) && e.r.eval(v) }
+func (e scriptOr) eval(v *visit) bool  { return e.l.eval(v) || e.r.eval(v) }
+func (e scriptNot) eval(v *visit) bool { return !e.e.eval(v) }
+
+func (e scriptCmp) eval(v *visit) bool {
+	s := scriptField(v, e.field)
+	switch e.op {
+	case "==":
+		return s == e.value
+	case "!=":
+		return s != e.value
+	case "~":
+		return e.re.MatchString(s)
+	case "!~":
+		return !e.re.MatchString(s)
+	case "contains":
+		return strings.Contains(s, e.value)
+	case "startswith":
+		return strings.HasPrefix(s, e.value)
+	}
+	return false
+}
+
+// scriptFields are the fields of visits that conditions read.
+var scriptFields = map[string]func(v *visit) *string{
+	"host":    func(v *visit) *string { return &v.Host },
+	"path":    func(v *visit) *string { return &v.Path },
+	"referer": func(v *visit) *string { return &v.Referer },
+	"ua":      func(v *visit) *string { return &v.UA },
+	"ip":      func(v *visit) *string { return &v.IP },
+	"country": func(v *visit) *string { return &v.Country },
+	"channel": func(v *visit) *string { return &v.Channel },
+	"browser": func(v *visit) *string { return &v.Browser },
+	"os":      func(v *visit) *string { return &v.System },
+}
+
+// scriptWritable are the fields that set and rewrite change.
+var scriptWritable = map[string]bool{"path": true, "referer": true, "ua": true}
+
+// scriptField returns a field of a visit.
+func scriptField(v *visit, field string) string {
+	if k := strings.TrimPrefix(field, "dim."); k != field {
+		return v.Dimensions[k]
+	}
+	return *scriptFields[field](v)
+}
+
+// run runs the script on a visit, and reports whether the visit is kept.
+func (s *ingestScript) run(v *visit) bool {
+	if s == nil {
+		return true
+	}
+	for _, r := range s.rules {
+		if r.cond != nil && !r.cond.eval(v) {
+			continue
+		}
+		switch r.action {
+		case "drop":
+			return false
+		case "tag":
+			if _, ok := v.Dimensions[r.field]; !ok && len(v.Dimensions) >= maxDimensions {
+				continue
+			}
+			if v.Dimensions == nil {
+				v.Dimensions = map[string]string{}
+			}
+			v.Dimensions[r.field] = r.value
+		case "set":
+			*scriptFields[r.field](v) = r.value
+		case "rewrite":
+			f := scriptFields[r.field](v)
+			*f = r.re.ReplaceAllString(*f, r.value)
+		}
+	}
+	return true
+}
+
+// script is the ingest script of the deployment, which is read from the
+// file of URLSTAT_INGEST_SCRIPT, or nil if there is none.
+var script *ingestScript
+
+func init() {
+	file := os.Getenv("URLSTAT_INGEST_SCRIPT")
+	if file == "" {
+		return
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatalf("failed to read URLSTAT_INGEST_SCRIPT: %v", err)
+	}
+	script, err = parseIngestScript(string(b))
+	if err != nil {
+		log.Fatalf("invalid URLSTAT_INGEST_SCRIPT: %v", err)
+	}
+}
+
+// parseIngestScript parses an ingest script.
+func parseIngestScript(src string) (*ingestScript, error) {
+	s := &ingestScript{}
+	for i, line := range strings.Split(src, "\n") {
+		toks, err := scanScript(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if len(toks) == 0 {
+			continue
+		}
+		p := &scriptParser{toks: toks}
+		r, err := p.rule()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		s.rules = append(s.rules, r)
+	}
+	return s, nil
+}
+
+// scriptToken is a token of a line of a script. Strings are unquoted.
+type scriptToken struct {
+	text   string
+	quoted bool
+}
+
+// scanScript splits a line of a script into tokens: words, quoted strings,
+// parentheses, and operators. A # outside of strings starts a comment.
+func scanScript(line string) ([]scriptToken, error) {
+	var toks []scriptToken
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			return toks, nil
+		case c == '"':
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated string %s", line[i:])
+			}
+			// Backslashes of regular expressions are kept as they are,
+			// only quotes and backslashes are escaped.
+			s := strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(line[i+1 : j])
+			toks = append(toks, scriptToken{text: s, quoted: true})
+			i = j + 1
+		case c == '(' || c == ')' || c == '~':
+			toks = append(toks, scriptToken{text: line[i : i+1]})
+			i++
+		case c == '=' || c == '!':
+			if i+1 < len(line) && (line[i+1] == '=' || line[i+1] == '~') {
+				toks = append(toks, scriptToken{text: line[i : i+2]})
+				i += 2
+				continue
+			}
+			return nil, fmt.Errorf("unexpected %q", c)
+		default:
+			j := i
+			for j < len(line) && !strings.ContainsRune(" \t\r#\"()~=!", rune(line[j])) {
+				j++
+			}
+			toks = append(toks, scriptToken{text: line[i:j]})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// scriptParser parses a rule from the tokens of its line.
+type scriptParser struct {
+	toks []scriptToken
+	pos  int
+}
+
+func (p *scriptParser) peek() (scriptToken, bool) {
+	if p.pos >= len(p.toks) {
+		return scriptToken{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+func (p *scriptParser) next() (scriptToken, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, fmt.Errorf("unexpected end of line")
+	}
+	p.pos++
+	return t, nil
+}
+
+// keyword reports whether the next token is the given unquoted word, and
+// consumes it if so.
+func (p *scriptParser) keyword(w string) bool {
+	if t, ok := p.peek(); ok && !t.quoted && t.text == w {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// str returns the next token, which must be a string.
+func (p *scriptParser) str() (string, error) {
+	t, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if !t.quoted {
+		return "", fmt.Errorf("expected a string, got %s", t.text)
+	}
+	return t.text, nil
+}
+
+// word returns the next token, which must not be a string.
+func (p *scriptParser) word() (string, error) {
+	t, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if t.quoted {
+		return "", fmt.Errorf("unexpected string %s", strconv.Quote(t.text))
+	}
+	return t.text, nil
+}
+
+func (p *scriptParser) rule() (scriptRule, error) {
+	var r scriptRule
+	var err error
+	r.action, err = p.word()
+	if err != nil {
+		return r, err
+	}
+	switch r.action {
+	case "drop":
+	case "tag":
+		if r.field, err = p.word(); err != nil {
+			return r, err
+		}
+		if !isDimensionKey(r.field) {
+			return r, fmt.Errorf("invalid dimension %q", r.field)
+		}
+		if r.value, err = p.str(); err != nil {
+			return r, err
+		}
+		if r.value == "" || len(r.value) > maxDimensionValue {
+			return r, fmt.Errorf("dimension %s must have 1 to %d bytes", r.field, maxDimensionValue)
+		}
+	case "set", "rewrite":
+		if r.field, err = p.word(); err != nil {
+			return r, err
+		}
+		if !scriptWritable[r.field] {
+			return r, fmt.Errorf("cannot %s %s", r.action, r.field)
+		}
+		if r.action == "rewrite" {
+			expr, err := p.str()
+			if err != nil {
+				return r, err
+			}
+			if r.re, err = regexp.Compile(expr); err != nil {
+				return r, err
+			}
+		}
+		if r.value, err = p.str(); err != nil {
+			return r, err
+		}
+	default:
+		return r, fmt.Errorf("unknown action %s", r.action)
+	}
+	if p.keyword("if") {
+		if r.cond, err = p.or(); err != nil {
+			return r, err
+		}
+	}
+	if t, ok := p.peek(); ok {
+		return r, fmt.Errorf("unexpected %s", t.text)
+	}
+	return r, nil
+}
+
+func (p *scriptParser) or() (scriptExpr, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = scriptOr{l, r}
+	}
+	return l, nil
+}
+
+func (p *scriptParser) and() (scriptExpr, error) {
+	l, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		r, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l = scriptAnd{l, r}
+	}
+	return l, nil
+}
+
+func (p *scriptParser) not() (scriptExpr, error) {
+	if p.keyword("not") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return scriptNot{e}, nil
+	}
+	if p.keyword("(") {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return e, nil
+	}
+	return p.cmp()
+}
+
+func (p *scriptParser) cmp() (scriptExpr, error) {
+	var c scriptCmp
+	var err error
+	if c.field, err = p.word(); err != nil {
+		return nil, err
+	}
+	if k := strings.TrimPrefix(c.field, "dim."); k != c.field {
+		if !isDimensionKey(k) {
+			return nil, fmt.Errorf("invalid dimension %q", k)
+		}
+	} else if _, ok := scriptFields[c.field]; !ok {
+		return nil, fmt.Errorf("unknown field %s", c.field)
+	}
+	if c.op, err = p.word(); err != nil {
+		return nil, err
+	}
+	switch c.op {
+	case "==", "!=", "~", "!~", "contains", "startswith":
+	default:
+		return nil, fmt.Errorf("unknown operator %s", c.op)
+	}
+	if c.value, err = p.str(); err != nil {
+		return nil, err
+	}
+	if c.op == "~" || c.op == "!~" {
+		if c.re, err = regexp.Compile(c.value); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
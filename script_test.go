@@ -0,0 +1,135 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestIngestScript(t *testing.T) {
+	s, err := parseIngestScript(`
+# Comments start with #.
+drop if ua contains "HeadlessChrome" or path ~ "^/(admin|preview)/"
+drop if not (host == "changkun.de" or host == "blog.changkun.de")
+tag section "blog" if path startswith "/blog/" and dim.lang != "zh"
+tag quote "say \"hi\"" if referer ~ "^https://t\.co/"
+set referer "" if referer contains "localhost" # local development
+rewrite path "/index\.html$" "/"
+rewrite path "^/p/(\d+)$" "/posts/$1"
+`)
+	if err != nil {
+		t.Fatalf("failed to parse script: %v", err)
+	}
+	if len(s.rules) != 7 {
+		t.Fatalf("unexpected rules: %+v", s.rules)
+	}
+
+	for _, tt := range []struct {
+		in, want visit
+		keep     bool
+	}{
+		{visit{Host: "changkun.de", Path: "/admin/"}, visit{}, false},
+		{visit{Host: "changkun.de", Path: "/", UA: "Mozilla/5.0 HeadlessChrome/118"}, visit{}, false},
+		{visit{Host: "golang.design", Path: "/"}, visit{}, false},
+		{
+			visit{Host: "changkun.de", Path: "/blog/index.html", Referer: "http://localhost:1313/"},
+			visit{Host: "changkun.de", Path: "/blog/", Dimensions: map[string]string{"section": "blog"}},
+			true,
+		},
+		{
+			visit{Host: "blog.changkun.de", Path: "/blog/", Referer: "https://t.co/x", Dimensions: map[string]string{"lang": "zh"}},
+			visit{Host: "blog.changkun.de", Path: "/blog/", Referer: "https://t.co/x", Dimensions: map[string]string{"lang": "zh", "quote": `say "hi"`}},
+			true,
+		},
+		{visit{Host: "changkun.de", Path: "/p/42"}, visit{Host: "changkun.de", Path: "/posts/42"}, true},
+	} {
+		v := tt.in
+		if keep := s.run(&v); keep != tt.keep {
+			t.Fatalf("run(%+v) = %v, want %v", tt.in, keep, tt.keep)
+		}
+		if !tt.keep {
+			continue
+		}
+		if v.Path != tt.want.Path || v.Referer != tt.want.Referer || len(v.Dimensions) != len(tt.want.Dimensions) {
+			t.Fatalf("run(%+v) = %+v, want %+v", tt.in, v, tt.want)
+		}
+		for k, d := range tt.want.Dimensions {
+			if v.Dimensions[k] != d {
+				t.Fatalf("run(%+v) = %+v, want %+v", tt.in, v, tt.want)
+			}
+		}
+	}
+
+	for _, src := range []string{
+		"block",
+		"drop if",
+		"drop if path",
+		"drop if path == /admin/",
+		"drop if path is \"/\"",
+		"drop if cookie == \"x\"",
+		"drop if path ~ \"(\"",
+		"drop if (path == \"/\"",
+		"drop if path == \"/\" and",
+		"drop \"now\"",
+		"tag Section \"blog\"",
+		"tag section \"\"",
+		"set host \"changkun.de\"",
+		"rewrite path \"/\"",
+		"drop if path == \"/",
+		"drop if path = \"/\"",
+	} {
+		if _, err := parseIngestScript(src); err == nil {
+			t.Fatalf("invalid script %q is accepted", src)
+		}
+	}
+}
+
+func TestRecordIngestScript(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{})
+	old := script
+	defer func() { script = old }()
+	script, _ = parseIngestScript(`drop if path startswith "/drafts/"`)
+
+	for _, loc := range []string{"https://changkun.de/drafts/a", "https://changkun.de/b"} {
+		u, _ := url.Parse(loc)
+		if _, err := recordVisit(context.Background(), visitReport{URL: u, IP: "203.0.113.1"}); err != nil {
+			t.Fatalf("cannot record visit: %v", err)
+		}
+	}
+	if vs := m.visits["changkun.de"]; len(vs) != 1 || vs[0].Path != "/b" {
+		t.Fatalf("recorded visits: %+v", vs)
+	}
+}
+
+func TestRecordIngestScriptRewrites(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{UV: uvFingerprint})
+	old, oldPipeline := script, pipeline
+	defer func() { script, pipeline = old, oldPipeline }()
+	pipeline, _ = parsePipeline("channel,client")
+	script, _ = parseIngestScript(`set referer "https://www.google.com/" if channel == "direct"
+rewrite ua "^Bot$" "Mozilla/5.0 (X11; Linux x86_64) Firefox/118.0"`)
+
+	u, _ := url.Parse("https://changkun.de/b")
+	if _, err := recordVisit(context.Background(), visitReport{URL: u, IP: "203.0.113.1", UA: "Bot"}); err != nil {
+		t.Fatalf("cannot record visit: %v", err)
+	}
+	vs := m.visits["changkun.de"]
+	if len(vs) != 1 {
+		t.Fatalf("recorded visits: %+v", vs)
+	}
+	v := vs[0]
+	if v.Channel != channelSearch || v.Browser != browserOf(v.UA) || v.System != systemOf(v.UA) {
+		t.Fatalf("visit is not enriched after the script: %+v", v)
+	}
+	if want := fingerprint("changkun.de", v.IP, v.UA, v.Time); v.Fingerprint != want {
+		t.Fatalf("fingerprint %s, want %s of the rewritten user agent", v.Fingerprint, want)
+	}
+}
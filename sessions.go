@@ -0,0 +1,70 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// timeRange returns the filter of times since the given time until the
+// given time, or the end if it is zero.
+func timeRange(since, until time.Time) bson.M {
+	r := bson.M{"$gte": since}
+	if !until.IsZero() {
+		r["$lt"] = until
+	}
+	return r
+}
+
+// sessionGap is the maximum idle time between two visits of a visitor
+// in the same session.
+const sessionGap = 30 * time.Minute
+
+// forEachSession calls fn with the visits of each session in the
+// collection since the given time until the given time, or the end if it
+// is zero, in chronological order. Visitors are
+// identified by their IP and user agent, because visitor IDs are rarely
+// sent by cross-origin requests, and a session ends after an idle time of
+// sessionGap.
+func forEachSession(ctx context.Context, col *mongo.Collection, since, until time.Time, fn func(session []visit)) error {
+	opts := options.Find().
+		SetProjection(bson.M{"ip": 1, "ua": 1, "path": 1, "time": 1}).
+		SetSort(bson.D{{Key: "ip", Value: 1}, {Key: "ua", Value: 1}, {Key: "time", Value: 1}}).
+		SetAllowDiskUse(true).
+		SetComment(requestID(ctx))
+	cur, err := col.Find(ctx, bson.M{"time": timeRange(since, until)}, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	var session []visit
+	for cur.Next(ctx) {
+		var v visit
+		if err := cur.Decode(&v); err != nil {
+			return err
+		}
+		if n := len(session); n > 0 {
+			prev := session[n-1]
+			if v.IP != prev.IP || v.UA != prev.UA || v.Time.Sub(prev.Time) > sessionGap {
+				fn(session)
+				session = session[:0]
+			}
+		}
+		session = append(session, v)
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	if len(session) > 0 {
+		fn(session)
+	}
+	return nil
+}
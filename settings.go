@@ -0,0 +1,382 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colSettings stores the ingest settings per host, see siteSettings.
+const colSettings = "settings"
+
+// Counting modes of a site.
+const (
+	// countAll records every page view.
+	countAll = "all"
+	// countUnique ignores page views of a visitor on a path that was
+	// viewed within the session gap, e.g. reloads.
+	countUnique = "unique"
+)
+
+// Privacy levels of a site.
+const (
+	// privacyFull stores visits as reported.
+	privacyFull = "full"
+	// privacyReduced truncates IP addresses to their network, i.e. /24
+	// for IPv4 and /48 for IPv6, and does not store user agents.
+	privacyReduced = "reduced"
+	// privacyAnonymous only counts page views, as if visitors denied
+	// consent.
+	privacyAnonymous = "anonymous"
+)
+
+// siteSettings is the ingest behavior of a host. The zero value of each
+// field is the default behavior, hence hosts without settings behave as
+// before.
+type siteSettings struct {
+	Host    string `json:"host"    bson:"_id"`
+	Count   string `json:"count"   bson:"count"`
+	Privacy string `json:"privacy" bson:"privacy"`
+	// Exclude lists IP addresses and CIDR ranges whose visits of the
+	// host are not recorded, in addition to the global exclude list.
+	Exclude []string `json:"exclude" bson:"exclude"`
+	// ExcludePaths lists path prefixes that are not recorded.
+	ExcludePaths []string `json:"exclude_paths" bson:"exclude_paths"`
+	// ExcludeCountries lists ISO 3166-1 alpha-2 codes of countries whose
+	// visits are not recorded, see readCountry.
+	ExcludeCountries []string `json:"exclude_countries" bson:"exclude_countries"`
+	// SampleRate is the fraction of visits that are recorded, in (0, 1].
+	// Zero means all visits are recorded.
+	SampleRate float64 `json:"sample_rate" bson:"sample_rate"`
+	// ClientHints is the fraction of recorded visits whose full client
+	// hints are stored, in [0, 1], see clientHints. The low entropy hints
+	// are stored of every visit that has them.
+	ClientHints float64 `json:"client_hints" bson:"client_hints"`
+	// Quota is the maximum number of visits that are recorded per
+	// calendar month, so that a single busy host cannot use up the
+	// storage of a shared instance. Zero means no quota.
+	Quota int64 `json:"quota" bson:"quota"`
+	// OverQuota is the behavior over the quota, which is drop by
+	// default, see admitQuota.
+	OverQuota string `json:"over_quota" bson:"over_quota"`
+	// UV is what identifies a unique visitor, see uvField. Visits recorded
+	// before it changed are recounted by the recompute-uv command.
+	UV string `json:"uv" bson:"uv"`
+	// Private lists the statistics that are only reported to admins and
+	// viewers of the site, see isPrivate. Pages get the others only.
+	Private []string `json:"private" bson:"private"`
+	// GroupIPv6 counts IPv6 addresses by their /64 network, as devices
+	// rotate the interface IDs of their addresses, see visitorIP.
+	GroupIPv6 bool `json:"group_ipv6" bson:"group_ipv6"`
+	// RetentionDays is how many days visits of the host are kept by the
+	// retention policies, see cleanupRetention. Zero keeps them as long
+	// as the policy does, and keepForever keeps them forever.
+	RetentionDays int `json:"retention_days" bson:"retention_days"`
+	// Owners and Viewers are the GitHub logins of the admins and viewers
+	// of the site on a multi-user instance, see roleOf.
+	Owners  []string `json:"owners"  bson:"owners"`
+	Viewers []string `json:"viewers" bson:"viewers"`
+	// ContentGroups are the sections of the site, see contentGroup.
+	ContentGroups []contentGroup `json:"content_groups" bson:"content_groups"`
+
+	// registered is set if the host has a settings document, i.e. the
+	// host is registered and its visits are recorded.
+	registered bool
+	excluded   *ipTrie
+}
+
+// validate checks the settings and compiles the exclude list.
+func (s *siteSettings) validate() error {
+	switch s.Count {
+	case "", countAll, countUnique:
+	default:
+		return fmt.Errorf("unknown count mode %q", s.Count)
+	}
+	switch s.Privacy {
+	case "", privacyFull, privacyReduced, privacyAnonymous:
+	default:
+		return fmt.Errorf("unknown privacy level %q", s.Privacy)
+	}
+	switch s.UV {
+	case "", uvIP, uvVisitor, uvFingerprint:
+	default:
+		return fmt.Errorf("unknown uv basis %q", s.UV)
+	}
+	for _, p := range s.Private {
+		if !isStatName(p) {
+			return fmt.Errorf("unknown statistic %q", p)
+		}
+	}
+	if s.SampleRate < 0 || s.SampleRate > 1 {
+		return errors.New("sample rate must be between 0 and 1")
+	}
+	if s.ClientHints < 0 || s.ClientHints > 1 {
+		return errors.New("client hints must be between 0 and 1")
+	}
+	for i, c := range s.ExcludeCountries {
+		code := parseCountry(c)
+		if code == "" {
+			return fmt.Errorf("invalid country code %q", c)
+		}
+		s.ExcludeCountries[i] = code
+	}
+	for _, logins := range [][]string{s.Owners, s.Viewers} {
+		for i, o := range logins {
+			if o == "" || strings.ContainsAny(o, ". /") {
+				return fmt.Errorf("invalid GitHub login %q", o)
+			}
+			logins[i] = strings.ToLower(o)
+		}
+	}
+	for _, g := range s.ContentGroups {
+		if err := g.validate(); err != nil {
+			return err
+		}
+	}
+	if s.RetentionDays < keepForever {
+		return fmt.Errorf("retention days must be positive, 0 for the policy, or %d to keep forever", keepForever)
+	}
+	if s.Quota < 0 {
+		return errors.New("quota must not be negative")
+	}
+	switch s.OverQuota {
+	case "", overQuotaDrop, overQuotaSample, overQuotaAlert:
+	default:
+		return fmt.Errorf("unknown over quota behavior %q", s.OverQuota)
+	}
+	var err error
+	s.excluded, err = newIPTrie(s.Exclude)
+	return err
+}
+
+// excludes reports whether a visit of the IP address from the country on
+// the path is not recorded.
+func (s *siteSettings) excludes(ip, country, path string) bool {
+	if addr := net.ParseIP(ip); addr != nil && s.excluded != nil && s.excluded.contains(addr) {
+		return true
+	}
+	for _, c := range s.ExcludeCountries {
+		if c == country {
+			return true
+		}
+	}
+	for _, p := range s.ExcludePaths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepForever is the RetentionDays of a site whose visits are never
+// deleted by retention policies.
+const keepForever = -1
+
+// retention returns how long visits of the site are kept under a retention
+// policy that keeps them for the given duration, or zero if they are kept
+// forever.
+func (s *siteSettings) retention(policy time.Duration) time.Duration {
+	switch {
+	case s.RetentionDays == keepForever:
+		return 0
+	case s.RetentionDays > 0:
+		return time.Duration(s.RetentionDays) * day
+	}
+	return policy
+}
+
+// ownedBy reports whether the user of the GitHub login owns the site.
+func (s *siteSettings) ownedBy(login string) bool {
+	for _, o := range s.Owners {
+		if o == login {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivate reports whether the statistic of the JSON name, e.g. site_pv,
+// is private, i.e. it or its mode, e.g. site, is listed in Private.
+func (s *siteSettings) isPrivate(name string) bool {
+	mode, _, _ := strings.Cut(name, "_")
+	for _, p := range s.Private {
+		if p == name || p == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled reports whether a visit is recorded under the sample rate.
+func (s *siteSettings) sampled() bool {
+	return s.SampleRate == 0 || rand.Float64() < s.SampleRate
+}
+
+// sampledHints reports whether the full client hints of a visit are
+// stored.
+func (s *siteSettings) sampledHints() bool {
+	return s.ClientHints > 0 && rand.Float64() < s.ClientHints
+}
+
+// visitorIP returns the IP address of a visitor that is stored, i.e. its
+// canonical form, or its /64 network if IPv6 addresses are grouped. A
+// household that rotates the interface IDs of its addresses, e.g. by
+// privacy extensions, would otherwise count as many visitors.
+func (s *siteSettings) visitorIP(ip string) string {
+	ip = normalizeIP(ip)
+	if !s.GroupIPv6 {
+		return ip
+	}
+	if addr := net.ParseIP(ip); addr != nil && addr.To4() == nil {
+		return addr.Mask(net.CIDRMask(64, 128)).String()
+	}
+	return ip
+}
+
+// reduce applies the privacy level to a visit.
+func (s *siteSettings) reduce(v *visit) {
+	if s.Privacy != privacyReduced {
+		return
+	}
+	if ip := net.ParseIP(v.IP); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			v.IP = ip4.Mask(net.CIDRMask(24, 32)).String()
+		} else {
+			v.IP = ip.Mask(net.CIDRMask(48, 128)).String()
+		}
+	}
+	v.UA = ""
+	v.Hints = nil
+}
+
+// settingsTTL is how long settings are cached. Replicas see changes of
+// each other after at most this duration.
+const settingsTTL = 30 * time.Second
+
+var settingsCache = struct {
+	sync.Mutex
+	m map[string]cachedSettings
+}{m: map[string]cachedSettings{}}
+
+type cachedSettings struct {
+	s       *siteSettings
+	expires time.Time
+}
+
+// settingsOf returns the settings of a host, which are the defaults if
+// the host has none.
+func settingsOf(ctx context.Context, host string) (*siteSettings, error) {
+	settingsCache.Lock()
+	c, ok := settingsCache.m[host]
+	settingsCache.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.s, nil
+	}
+
+	s := &siteSettings{Host: host}
+	err := db.Database(metaname).Collection(colSettings).FindOne(ctx, bson.M{"_id": host},
+		options.FindOne().SetComment(requestID(ctx))).Decode(s)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	s.registered = err == nil
+	// Hosts that have visits were recorded before hosts had to be
+	// registered, and are registered on their first use, so that an
+	// upgrade does not stop recording them until the migrations run.
+	if !s.registered {
+		s.registered, err = registerExisting(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("invalid settings of %s: %w", host, err)
+	}
+
+	settingsCache.Lock()
+	settingsCache.m[host] = cachedSettings{s, time.Now().Add(settingsTTL)}
+	settingsCache.Unlock()
+	return s, nil
+}
+
+// saveSettings validates and saves the settings of a host.
+func saveSettings(ctx context.Context, s *siteSettings) error {
+	if err := s.validate(); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidQuery, err)
+	}
+	_, err := db.Database(metaname).Collection(colSettings).ReplaceOne(ctx,
+		bson.M{"_id": s.Host}, s, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	settingsCache.Lock()
+	delete(settingsCache.m, s.Host)
+	settingsCache.Unlock()
+	return nil
+}
+
+// registerHost registers a host with default settings if it is not
+// registered yet. Visits of a host are only recorded once it is
+// registered, so that allowed origins cannot create collections of
+// arbitrary hosts.
+func registerHost(ctx context.Context, host string) error {
+	_, err := db.Database(metaname).Collection(colSettings).UpdateOne(ctx,
+		bson.M{"_id": host},
+		bson.M{"$setOnInsert": bson.M{"_id": host}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	settingsCache.Lock()
+	delete(settingsCache.m, host)
+	settingsCache.Unlock()
+
+	// Index the collection before its first visit, which is cheap, rather
+	// than on the next startup.
+	return createVisitStore(ctx, host)
+}
+
+// registerExisting registers a host if it has a collection of visits,
+// and reports whether it has.
+func registerExisting(ctx context.Context, host string) (bool, error) {
+	names, err := db.Database(dbname).ListCollectionNames(ctx, bson.M{"name": host})
+	if err != nil {
+		return false, fmt.Errorf("failed to list collections: %w", err)
+	}
+	if len(names) == 0 {
+		return false, nil
+	}
+	_, err = db.Database(metaname).Collection(colSettings).UpdateOne(ctx,
+		bson.M{"_id": host},
+		bson.M{"$setOnInsert": bson.M{"_id": host}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return false, fmt.Errorf("failed to register %s: %w", host, err)
+	}
+	return true, nil
+}
+
+// viewedRecently reports whether the visitor of the visit viewed the same
+// path within the session gap.
+func viewedRecently(ctx context.Context, col *mongo.Collection, v *visit) (bool, error) {
+	n, err := col.CountDocuments(ctx, bson.M{
+		"ip":   v.IP,
+		"ua":   v.UA,
+		"path": v.Path,
+		"time": bson.M{"$gte": v.Time.Add(-sessionGap)},
+	}, options.Count().SetLimit(1).SetComment(requestID(ctx)))
+	return n > 0, err
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// shadow is a second database that reads are compared against, e.g. the
+// target of urlstat migrate, to gain confidence before switching to it.
+// It is configured by URLSTAT_SHADOW_URI. Shadow reads run in the
+// background and never affect responses.
+var shadow *mongo.Client
+
+func init() {
+	uri := os.Getenv("URLSTAT_SHADOW_URI")
+	if uri == "" {
+		return
+	}
+	opts, err := clientOptions(uri)
+	if err != nil {
+		log.Fatalf("invalid shadow database options: %v", err)
+	}
+	shadow, err = mongo.Connect(context.Background(), opts)
+	if err != nil {
+		log.Fatalf("cannot connect to shadow database: %v", err)
+	}
+}
+
+// shadowCounts are the number of compared and mismatched shadow reads
+// per query, which are exposed as metrics.
+var shadowCounts = struct {
+	sync.Mutex
+	compared   map[string]int64
+	mismatched map[string]int64
+}{compared: map[string]int64{}, mismatched: map[string]int64{}}
+
+// compareShadow runs a query against the shadow database in the
+// background, and logs and counts a mismatch if its result differs from
+// the result of the primary database. Results are compared deeply.
+func compareShadow(ctx context.Context, query string, primary interface{}, run func(ctx context.Context, client *mongo.Client) (interface{}, error)) {
+	if shadow == nil {
+		return
+	}
+	id := requestID(ctx)
+	go func() {
+		// The request may be done before the shadow read.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		ctx = context.WithValue(ctx, requestIDKey{}, id)
+
+		got, err := run(ctx, shadow)
+		if err != nil {
+			l.Printf("%s shadow %s failed: %v", id, query, err)
+			return
+		}
+		shadowCounts.Lock()
+		shadowCounts.compared[query]++
+		mismatch := !reflect.DeepEqual(primary, got)
+		if mismatch {
+			shadowCounts.mismatched[query]++
+		}
+		shadowCounts.Unlock()
+		if mismatch {
+			l.Printf("%s shadow %s mismatch: primary %+v, shadow %+v", id, query, primary, got)
+		}
+	}()
+}
+
+// shadowQueries returns the queries that were compared, sorted.
+func shadowQueries() []string {
+	shadowCounts.Lock()
+	defer shadowCounts.Unlock()
+	queries := make([]string, 0, len(shadowCounts.compared))
+	for q := range shadowCounts.compared {
+		queries = append(queries, q)
+	}
+	sort.Strings(queries)
+	return queries
+}
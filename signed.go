@@ -0,0 +1,165 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// badgeSecret signs badge URLs if it is set by URLSTAT_BADGE_SECRET, which
+// must be the same on all replicas. Then only badges of signed URLs are
+// served, so that strangers cannot embed badges of allowed users that
+// record and count visits. Owners of badges get signed URLs from
+// signBadge.
+var badgeSecret = os.Getenv("URLSTAT_BADGE_SECRET")
+
+// badgeSignature returns the signature of the query of a badge URL, which
+// covers all its parameters except the signature itself.
+func badgeSignature(q url.Values) string {
+	q2 := url.Values{}
+	for k, v := range q {
+		if k != "sig" {
+			q2[k] = v
+		}
+	}
+	m := hmac.New(sha256.New, []byte(badgeSecret))
+	m.Write([]byte(q2.Encode()))
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// checkBadgeSignature returns errBadSignature if badge URLs are signed and
+// the query of a badge URL is not.
+func checkBadgeSignature(q url.Values) error {
+	if badgeSecret == "" {
+		return nil
+	}
+	sig := q.Get("sig")
+	if sig == "" || !hmac.Equal([]byte(sig), []byte(badgeSignature(q))) {
+		return fmt.Errorf("%w: %s", errBadSignature, q.Encode())
+	}
+	return nil
+}
+
+// badgeOwner returns the GitHub login that owns the badge of the query,
+// i.e. the user of a GitHub repository or a Go module on GitHub, or the
+// scope of an npm package. It is empty if the owner is unknown, e.g. of
+// Go modules of other domains, whose badges only admins sign.
+func badgeOwner(q url.Values) string {
+	var owner string
+	switch q.Get("mode") {
+	case "github":
+		owner, _, _ = strings.Cut(q.Get("repo"), "/")
+	case "go":
+		if m := strings.Split(q.Get("module"), "/"); len(m) > 1 && m[0] == "github.com" {
+			owner = m[1]
+		}
+	case "npm":
+		if scope, _, ok := strings.Cut(q.Get("package"), "/"); ok {
+			owner = strings.TrimPrefix(scope, "@")
+		}
+	}
+	return strings.ToLower(owner)
+}
+
+// signBadge responds the signed URL of the badge of the query, e.g.
+// /urlstat/badges/sign?mode=github&repo=changkun/urlstat. Admins sign any
+// badge, and users that are logged in sign the badges they own, see
+// badgeOwner.
+func signBadge(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	if badgeSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	q.Del("sig")
+	// Charts and counts are signed by ?endpoint=chart or count, and
+	// belong to the admins of their sites rather than to the owners of
+	// badges.
+	path, site := "/urlstat", ""
+	switch endpoint := q.Get("endpoint"); endpoint {
+	case "":
+		mode := q.Get("mode")
+		if _, ok := docSites[mode]; !ok && mode != "github" {
+			err = fmt.Errorf("%w: unknown badge mode %q", errInvalidQuery, mode)
+			return
+		}
+	case "chart", "count":
+		q.Del("endpoint")
+		path += "/" + endpoint
+		if site = embedSite(q); site == "" {
+			err = fmt.Errorf("%w: missing site of %s", errInvalidQuery, endpoint)
+			return
+		}
+	default:
+		err = fmt.Errorf("%w: unknown endpoint %q", errInvalidQuery, endpoint)
+		return
+	}
+	ok, err := isAdmin(r.Context(), adminKey(r))
+	if err != nil {
+		return
+	}
+	if !ok && multiUser() {
+		login := sessionLogin(r, time.Now())
+		if login == "" {
+			err = errUnauthorized
+			return
+		}
+		if site == "" {
+			ok = login == badgeOwner(q)
+		} else {
+			var settings *siteSettings
+			settings, err = store.settings(r.Context(), site)
+			if err != nil {
+				return
+			}
+			ok = settings.roleOf(login) == roleAdmin
+		}
+	}
+	if !ok {
+		err = fmt.Errorf("%w: %s", errForbidden, q.Encode())
+		return
+	}
+
+	q.Set("sig", badgeSignature(q))
+	scheme := "https"
+	if !source.Production {
+		scheme = "http"
+	}
+	u := &url.URL{Scheme: scheme, Host: r.Host, Path: path, RawQuery: q.Encode()}
+	b, _ := json.Marshal(struct {
+		URL string `json:"url"`
+	}{u.String()})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// embedSite returns the site of the query of a chart, i.e. its host, or of
+// a count, i.e. the host of its URL.
+func embedSite(q url.Values) string {
+	if h := q.Get("host"); h != "" {
+		return h
+	}
+	if u, err := url.Parse(q.Get("url")); err == nil && u.Host != "" {
+		return source.collection(u.Host)
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBadgeSignature(t *testing.T) {
+	if err := checkBadgeSignature(url.Values{"mode": {"github"}}); err != nil {
+		t.Fatalf("unsigned badge is rejected without a secret: %v", err)
+	}
+	defer func(s string) { badgeSecret = s }(badgeSecret)
+	badgeSecret = "secret"
+
+	q := url.Values{"mode": {"github"}, "repo": {"changkun/urlstat"}}
+	q.Set("sig", badgeSignature(q))
+	if err := checkBadgeSignature(q); err != nil {
+		t.Fatalf("signed badge is rejected: %v", err)
+	}
+	for _, tamper := range []func(url.Values){
+		func(q url.Values) { q.Del("sig") },
+		func(q url.Values) { q.Set("repo", "changkun/other") },
+		func(q url.Values) { q.Set("mode", "go") },
+		func(q url.Values) { q.Add("repo", "golang/go") },
+	} {
+		q2 := url.Values{}
+		for k, v := range q {
+			q2[k] = append([]string(nil), v...)
+		}
+		tamper(q2)
+		if err := checkBadgeSignature(q2); !errors.Is(err, errBadSignature) {
+			t.Fatalf("tampered badge %s is accepted: %v", q2.Encode(), err)
+		}
+	}
+}
+
+func TestBadgeOwner(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"mode=github&repo=Changkun/urlstat", "changkun"},
+		{"mode=go&module=github.com/changkun/urlstat", "changkun"},
+		{"mode=go&module=golang.design/x/reflect", ""},
+		{"mode=npm&package=@changkun/pkg", "changkun"},
+		{"mode=npm&package=pkg", ""},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		if got := badgeOwner(q); got != tt.want {
+			t.Fatalf("owner of %s: %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSignBadge(t *testing.T) {
+	withLogin(t)
+	defer func(s string) { badgeSecret = s }(badgeSecret)
+	badgeSecret = "secret"
+
+	tests := []struct {
+		login  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"golang", http.StatusForbidden},
+		{"changkun", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/urlstat/badges/sign?mode=github&repo=changkun/urlstat", nil)
+		if tt.login != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: newSession(tt.login, time.Now())})
+		}
+		w := httptest.NewRecorder()
+		signBadge(w, r)
+		if w.Code != tt.status {
+			t.Fatalf("%q signs badge: %d %s, want %d", tt.login, w.Code, w.Body.String(), tt.status)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(resp.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkBadgeSignature(u.Query()); err != nil || u.Path != "/urlstat" {
+			t.Fatalf("signed URL %s is not valid: %v", resp.URL, err)
+		}
+	}
+}
+
+func TestSignEmbed(t *testing.T) {
+	withLogin(t)
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{Owners: []string{"changkun"}})
+	defer func(s string) { badgeSecret = s }(badgeSecret)
+	badgeSecret = "secret"
+
+	tests := []struct {
+		login  string
+		query  string
+		path   string
+		status int
+	}{
+		{"golang", "endpoint=chart&host=changkun.de", "", http.StatusForbidden},
+		{"changkun", "endpoint=chart&host=changkun.de&days=30", "/urlstat/chart", http.StatusOK},
+		{"changkun", "endpoint=count&url=https://changkun.de/blog/", "/urlstat/count", http.StatusOK},
+		{"changkun", "endpoint=count", "", http.StatusBadRequest},
+		{"changkun", "endpoint=badge&host=changkun.de", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/urlstat/badges/sign?"+tt.query, nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: newSession(tt.login, time.Now())})
+		w := httptest.NewRecorder()
+		signBadge(w, r)
+		if w.Code != tt.status {
+			t.Fatalf("%q signs %s: %d %s, want %d", tt.login, tt.query, w.Code, w.Body.String(), tt.status)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(resp.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkBadgeSignature(u.Query()); err != nil || u.Path != tt.path || u.Query().Has("endpoint") {
+			t.Fatalf("signed URL %s is not valid: %v", resp.URL, err)
+		}
+	}
+
+	for _, h := range []struct {
+		target string
+		serve  http.HandlerFunc
+	}{
+		{"/urlstat/chart?host=changkun.de", chart},
+		{"/urlstat/count?url=https://changkun.de/blog/", count},
+	} {
+		w := httptest.NewRecorder()
+		h.serve(w, httptest.NewRequest(http.MethodGet, h.target, nil))
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("unsigned %s: %d, want %d", h.target, w.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// snapshotPrefix is the prefix of daily snapshots, see snapshot.
+const snapshotPrefix = "/urlstat/snapshot/"
+
+// daySnapshot is the pv and uv of every page of a host on a day.
+type daySnapshot struct {
+	Host string `json:"host"`
+	Day  string `json:"day"`
+	// Final is set once the rollups of the day were computed after the
+	// day closed, hence the snapshot does not change anymore.
+	Final bool           `json:"final"`
+	Pages []pageSnapshot `json:"pages"`
+}
+
+// pageSnapshot is the pv and uv of a page on a day. Private statistics of
+// the site are omitted, see siteSettings.Private.
+type pageSnapshot struct {
+	Path string `json:"path"    bson:"path"`
+	PV   int64  `json:"pv,omitempty" bson:"pv"`
+	UV   int64  `json:"uv,omitempty" bson:"uv"`
+}
+
+// snapshot serves the pv and uv of every page of a host on a past day,
+// which static site generators bake into pages at build time:
+//
+//	GET /urlstat/snapshot/<host>/2021-03-29.json  the pages on the day
+//	GET /urlstat/snapshot/<host>/latest.json      redirects to yesterday
+//
+// The snapshot of a day is read from rollups, and is final once the
+// rollups of the day were computed after the day closed. Final snapshots
+// are immutable and cached for a year, others are revalidated. Rollups
+// that are recomputed later, e.g. by recompute-uv, are not seen by cached
+// snapshots.
+func snapshot(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	host, name, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, snapshotPrefix), "/")
+	if !ok || host == "" || !strings.HasSuffix(name, ".json") {
+		err = fmt.Errorf("%w: require %s<host>/<YYYY-MM-DD>.json", errInvalidQuery, snapshotPrefix)
+		return
+	}
+	today := time.Now().UTC().Truncate(day)
+	if name == "latest.json" {
+		w.Header().Set("Cache-Control", "max-age=300")
+		http.Redirect(w, r, snapshotPrefix+host+"/"+today.Add(-day).Format("2006-01-02")+".json", http.StatusFound)
+		return
+	}
+	d, err := time.Parse("2006-01-02", strings.TrimSuffix(name, ".json"))
+	if err != nil {
+		err = fmt.Errorf("%w: invalid day %q", errInvalidQuery, name)
+		return
+	}
+	if !d.Before(today) {
+		err = fmt.Errorf("%w: %s is not closed yet", errInvalidQuery, d.Format("2006-01-02"))
+		return
+	}
+	if err = checkView(r.Context(), host); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	settings, err := store.settings(ctx, host)
+	if err != nil {
+		err = fmt.Errorf("failed to load settings: %w", err)
+		return
+	}
+	showPV, showUV := !settings.isPrivate("page_pv"), !settings.isPrivate("page_uv")
+	if !showPV || !showUV {
+		ok, err = seesPrivate(r, settings)
+		if err != nil {
+			return
+		}
+		if ok {
+			showPV, showUV = true, true
+		}
+	}
+	if !showPV && !showUV {
+		err = fmt.Errorf("%w: statistics of pages of %s are private", errForbidden, host)
+		return
+	}
+
+	version, err := statsVersion(ctx, host)
+	if err != nil {
+		err = fmt.Errorf("failed to find version of %s: %w", host, err)
+		return
+	}
+	snap := daySnapshot{Host: host, Day: d.Format("2006-01-02"), Final: !version.Before(d.Add(day))}
+	snap.Pages, err = pageSnapshots(ctx, host, d)
+	if err != nil {
+		err = fmt.Errorf("failed to find rollups: %w", err)
+		return
+	}
+	for i := range snap.Pages {
+		if !showPV {
+			snap.Pages[i].PV = 0
+		}
+		if !showUV {
+			snap.Pages[i].UV = 0
+		}
+	}
+
+	switch {
+	case len(settings.Private) > 0:
+		// Snapshots with private statistics must not be cached by shared
+		// caches.
+		w.Header().Set("Cache-Control", "private, no-cache")
+	case snap.Final:
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	b, _ := json.Marshal(snap)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// pageSnapshots returns the pv and uv of the pages of a host on a day from
+// rollups, most viewed first.
+func pageSnapshots(ctx context.Context, host string, d time.Time) ([]pageSnapshot, error) {
+	opts := options.Find().
+		SetProjection(bson.M{"path": 1, "pv": 1, "uv": 1}).
+		SetSort(bson.D{{Key: "pv", Value: -1}, {Key: "path", Value: 1}}).
+		SetComment(requestID(ctx))
+	cur, err := db.Database(metaname).Collection(colRollups).Find(ctx, bson.M{
+		"host": host,
+		"day":  d,
+		"path": bson.M{"$ne": ""},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	pages := []pageSnapshot{}
+	if err := cur.All(ctx, &pages); err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{Private: []string{"page"}})
+
+	today := time.Now().UTC().Format("2006-01-02")
+	yesterday := time.Now().UTC().Truncate(day).Add(-day).Format("2006-01-02")
+	for _, tt := range []struct {
+		url  string
+		code int
+	}{
+		{"/urlstat/snapshot/", http.StatusBadRequest},
+		{"/urlstat/snapshot/changkun.de", http.StatusBadRequest},
+		{"/urlstat/snapshot/changkun.de/2021-03-29", http.StatusBadRequest},
+		{"/urlstat/snapshot/changkun.de/yesterday.json", http.StatusBadRequest},
+		{"/urlstat/snapshot/changkun.de/" + today + ".json", http.StatusBadRequest},
+		{"/urlstat/snapshot/changkun.de/2021-03-29.json", http.StatusForbidden},
+		{"/urlstat/snapshot/changkun.de/latest.json", http.StatusFound},
+	} {
+		w := httptest.NewRecorder()
+		snapshot(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.code {
+			t.Fatalf("%s: got %d, want %d: %s", tt.url, w.Code, tt.code, w.Body)
+		}
+		if tt.code == http.StatusFound {
+			if loc := w.Header().Get("Location"); loc != "/urlstat/snapshot/changkun.de/"+yesterday+".json" {
+				t.Fatalf("unexpected redirect: %s", loc)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sparkDays is the number of recent days of the sparklines of pages.
+const sparkDays = 30
+
+// Sizes of a sparkline in pixels.
+const (
+	sparkWidth  = 90
+	sparkHeight = 18
+)
+
+// pathSeries returns the daily pv of the pages of a host in the sparkDays
+// days since the given day, which are read from rollups. Days without
+// rollups have no views.
+func pathSeries(ctx context.Context, host string, since time.Time) (map[string][]int64, error) {
+	col := db.Database(metaname).Collection(colRollups)
+	opts := options.Find().
+		SetProjection(bson.M{"path": 1, "day": 1, "pv": 1}).
+		SetComment(requestID(ctx))
+	cur, err := col.Find(ctx, bson.M{
+		"host": host,
+		"day":  bson.M{"$gte": since},
+		"path": bson.M{"$ne": ""},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var rollups []rollup
+	if err := cur.All(ctx, &rollups); err != nil {
+		return nil, err
+	}
+	series := map[string][]int64{}
+	for _, r := range rollups {
+		addSeries(series, r.Path, since, r.Day, r.PV)
+	}
+	return series, nil
+}
+
+// addSeries adds the pv of a path on a day to its series since the given
+// day. Days out of the range of the series are ignored.
+func addSeries(series map[string][]int64, path string, since, t time.Time, pv int64) {
+	i := int(t.UTC().Sub(since) / day)
+	if i < 0 || i >= sparkDays {
+		return
+	}
+	s, ok := series[path]
+	if !ok {
+		s = make([]int64, sparkDays)
+		series[path] = s
+	}
+	s[i] += pv
+}
+
+// seriesOf returns the series of a path, which has no views if the path
+// has no rollups.
+func seriesOf(series map[string][]int64, path string) []int64 {
+	if s, ok := series[path]; ok {
+		return s
+	}
+	return make([]int64, sparkDays)
+}
+
+// sparkline renders the daily pv of a page as an inline SVG polyline,
+// which is scaled to the largest pv of the series. The line is drawn in
+// the current text color.
+func sparkline(pv []int64) template.HTML {
+	if len(pv) == 0 {
+		return ""
+	}
+	var max int64
+	for _, v := range pv {
+		if v > max {
+			max = v
+		}
+	}
+	var step float64
+	if len(pv) > 1 {
+		step = float64(sparkWidth) / float64(len(pv)-1)
+	}
+	points := make([]string, len(pv))
+	for i, v := range pv {
+		y := float64(sparkHeight - 1)
+		if max > 0 {
+			y -= float64(v) / float64(max) * float64(sparkHeight-2)
+		}
+		points[i] = fmt.Sprintf("%.1f,%.1f", float64(i)*step, y)
+	}
+	// The points are formatted numbers only, hence the SVG is safe.
+	return template.HTML(fmt.Sprintf(
+		`<svg class="spark" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="%d views in %d days">`+
+			`<polyline fill="none" stroke="currentColor" stroke-width="1" points="%s"/></svg>`,
+		sparkWidth, sparkHeight, sparkWidth, sparkHeight, sumInt64(pv), len(pv), strings.Join(points, " ")))
+}
+
+// sumInt64 returns the sum of the values.
+func sumInt64(vs []int64) int64 {
+	var sum int64
+	for _, v := range vs {
+		sum += v
+	}
+	return sum
+}
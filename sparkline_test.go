@@ -0,0 +1,41 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSparkline(t *testing.T) {
+	since := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	series := map[string][]int64{}
+	addSeries(series, "/", since, since, 2)
+	addSeries(series, "/", since, since.Add(29*day), 4)
+	addSeries(series, "/", since, since.Add(30*day), 8)
+	addSeries(series, "/", since, since.Add(-day), 8)
+
+	s := seriesOf(series, "/")
+	if len(s) != sparkDays || s[0] != 2 || s[29] != 4 || sumInt64(s) != 6 {
+		t.Fatalf("unexpected series: %v", s)
+	}
+	if s := seriesOf(series, "/about"); len(s) != sparkDays || sumInt64(s) != 0 {
+		t.Fatalf("unexpected series without rollups: %v", s)
+	}
+
+	svg := string(sparkline(s))
+	for _, want := range []string{`<svg class="spark"`, `aria-label="6 views in 30 days"`, `points="0.0,9.0 3.1,17.0`, ` 90.0,1.0"`} {
+		if !strings.Contains(svg, want) {
+			t.Fatalf("sparkline does not contain %s: %s", want, svg)
+		}
+	}
+	if svg := sparkline(nil); svg != "" {
+		t.Fatalf("unexpected sparkline of no days: %s", svg)
+	}
+	if svg := string(sparkline([]int64{0})); !strings.Contains(svg, `points="0.0,17.0"`) {
+		t.Fatalf("unexpected sparkline of a day: %s", svg)
+	}
+}
@@ -0,0 +1,417 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// statsQuery is the query of a stats report. An empty path refers to
+// the whole site.
+type statsQuery struct {
+	Host  string
+	Path  string
+	Since time.Time
+	Limit int
+	// Dimension is the custom dimension of the dimensions report, and
+	// Dimensions filters the visits of reports that are computed from
+	// visits by custom dimensions.
+	Dimension  string
+	Dimensions map[string]string
+}
+
+// statsReports are the reports served by the stats API.
+var statsReports = map[string]func(ctx context.Context, q statsQuery) (interface{}, error){
+	"entries": func(ctx context.Context, q statsQuery) (interface{}, error) {
+		return topPages(ctx, q.Host, "entries", q.Since, q.Limit)
+	},
+	"exits": func(ctx context.Context, q statsQuery) (interface{}, error) {
+		return topPages(ctx, q.Host, "exits", q.Since, q.Limit)
+	},
+	"cohorts": func(ctx context.Context, q statsQuery) (interface{}, error) {
+		return recentCohorts(ctx, q.Host)
+	},
+	"timeseries": func(ctx context.Context, q statsQuery) (interface{}, error) {
+		return dailyRollups(ctx, q.Host, q.Path, q.Since)
+	},
+	"dimensions": func(ctx context.Context, q statsQuery) (interface{}, error) {
+		return dimensionCounts(ctx, q.Host, q.Dimension, q.Dimensions, q.Since, q.Limit)
+	},
+	"groups": func(ctx context.Context, q statsQuery) (interface{}, error) {
+		return contentGroupCounts(ctx, q.Host, q.Dimensions, q.Since)
+	},
+	"browsers": func(ctx context.Context, q statsQuery) (interface{}, error) {
+		return clientSplit(ctx, q.Host, q.Dimensions, q.Since, false)
+	},
+	"systems": func(ctx context.Context, q statsQuery) (interface{}, error) {
+		return clientSplit(ctx, q.Host, q.Dimensions, q.Since, true)
+	},
+	"protocols": func(ctx context.Context, q statsQuery) (interface{}, error) {
+		return protocolSplit(ctx, q.Host, q.Dimensions, q.Since)
+	},
+	"trending": func(ctx context.Context, q statsQuery) (interface{}, error) {
+		return trendingPages(ctx, q.Host, time.Now(), q.Limit)
+	},
+}
+
+// stats serves reports of a host that are computed from rollups:
+//
+//	/urlstat/stats/<report>?host=golang.design&days=30&limit=10
+//
+// Reports are JSON by default, or CSV or XML if requested by ?format= or
+// the Accept header, see respond.
+func stats(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		respondError(w, r, err)
+	}()
+
+	q, err := parseStatsQuery(r)
+	if err != nil {
+		return
+	}
+	if err = checkView(r.Context(), q.Host); err != nil {
+		return
+	}
+	err = serveReport(w, r, strings.TrimPrefix(r.URL.Path, "/urlstat/stats/"), q)
+}
+
+// serveReport serves a report. Reports only change when rollups are
+// computed, hence they carry a weak ETag and the time of the last rollup
+// as Last-Modified, and conditional requests of unchanged reports are
+// responded with 304 Not Modified without querying the report.
+func serveReport(w http.ResponseWriter, r *http.Request, name string, q statsQuery) error {
+	report, ok := statsReports[name]
+	if !ok {
+		return fmt.Errorf("%w: unknown report %s", errInvalidQuery, name)
+	}
+	format, err := negotiateFormat(r)
+	if err != nil {
+		return err
+	}
+	if err := checkPrivate(r, q.Host, reportStats...); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	version, err := statsVersion(ctx, q.Host)
+	if err != nil {
+		return fmt.Errorf("failed to find version of %s: %w", q.Host, err)
+	}
+	if !version.IsZero() {
+		etag := reportETag(name, format, q, version)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", version.Format(http.TimeFormat))
+		if notModified(r, etag, version) {
+			w.Header().Add("Vary", "Accept")
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+
+	resp, err := report(ctx, q)
+	if err != nil {
+		return fmt.Errorf("failed to report %s: %w", name, err)
+	}
+	return respond(w, r, resp)
+}
+
+// statsVersion returns the time the rollups or cohorts of a host were
+// last computed, or the zero time if they were never computed.
+func statsVersion(ctx context.Context, host string) (time.Time, error) {
+	var t total
+	err := db.Database(metaname).Collection(colTotals).FindOne(ctx, bson.M{"_id": host},
+		options.FindOne().SetProjection(bson.M{"version": 1, "updated": 1}).SetComment(requestID(ctx))).Decode(&t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	// Totals that were computed before versions have no version.
+	if t.Version.IsZero() {
+		return t.Updated, nil
+	}
+	return t.Version, nil
+}
+
+// summary is the all-time pv and uv of every host and of all hosts. The
+// uv of all hosts is the sum of the uv of each host, i.e. a visitor of two
+// hosts counts twice.
+type summary struct {
+	PV    int64   `json:"pv"`
+	UV    int64   `json:"uv"`
+	Hosts []total `json:"hosts"`
+}
+
+// summarize returns the summary of all hosts from their totals, which is
+// cheap as the totals are counted by the rollup worker rather than
+// aggregated from visits.
+func summarize(ctx context.Context) (summary, error) {
+	cur, err := db.Database(metaname).Collection(colTotals).Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetComment(requestID(ctx)))
+	if err != nil {
+		return summary{}, fmt.Errorf("failed to find totals: %w", err)
+	}
+	s := summary{Hosts: []total{}}
+	if err := cur.All(ctx, &s.Hosts); err != nil {
+		return summary{}, fmt.Errorf("failed to find totals: %w", err)
+	}
+	for _, t := range s.Hosts {
+		s.PV += t.PV
+		s.UV += t.UV
+	}
+	return s, nil
+}
+
+// of returns the summary of the given hosts, which are sorted.
+func (s summary) of(hosts []string) summary {
+	sub := summary{Hosts: []total{}}
+	for _, t := range s.Hosts {
+		if i := sort.SearchStrings(hosts, t.Host); i < len(hosts) && hosts[i] == t.Host {
+			sub.Hosts = append(sub.Hosts, t)
+			sub.PV += t.PV
+			sub.UV += t.UV
+		}
+	}
+	return sub
+}
+
+// reportETag returns the weak ETag of a report in a format. The first
+// day is part of it, as the range of a report moves every day.
+func reportETag(name, format string, q statsQuery, version time.Time) string {
+	h := fnv.New64a()
+	dims := url.Values{}
+	for k, v := range q.Dimensions {
+		dims.Set(k, v)
+	}
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%d\x00%d\x00%d\x00%s\x00%s",
+		name, format, q.Host, q.Path, q.Since.Unix(), q.Limit, version.UnixNano(), q.Dimension, dims.Encode())
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// notModified reports whether the copy of a conditional request is still
+// fresh. If-None-Match takes precedence over If-Modified-Since, and ETags
+// are compared weakly.
+func notModified(r *http.Request, etag string, version time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// Last-Modified has a precision of seconds.
+	return !version.Truncate(time.Second).After(ims)
+}
+
+func parseStatsQuery(r *http.Request) (statsQuery, error) {
+	v := r.URL.Query()
+	return parseStatsValues(v.Get("host"), v)
+}
+
+// parseStatsValues parses the query of a report of the host from the
+// path, days, limit, dimension, and dim.<key> parameters.
+func parseStatsValues(host string, v url.Values) (statsQuery, error) {
+	q := statsQuery{Host: host, Path: v.Get("path"), Limit: 10}
+	if q.Host == "" {
+		return q, fmt.Errorf("%w: missing host", errInvalidQuery)
+	}
+	days := 30
+	if s := v.Get("days"); s != "" {
+		d, err := strconv.Atoi(s)
+		if err != nil || d < 1 {
+			return q, fmt.Errorf("%w: invalid days", errInvalidQuery)
+		}
+		days = d
+	}
+	q.Since = time.Now().UTC().Truncate(day).Add(-time.Duration(days-1) * day)
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 1000 {
+			return q, fmt.Errorf("%w: limit must be between 1 and 1000", errInvalidQuery)
+		}
+		q.Limit = n
+	}
+	q.Dimension = v.Get("dimension")
+	dims, err := queryDimensions(v)
+	if err != nil {
+		return q, err
+	}
+	q.Dimensions = dims
+	return q, nil
+}
+
+// pageCount is a counter of a page.
+type pageCount struct {
+	Path  string `json:"path"  bson:"_id"`
+	Count int64  `json:"count" bson:"count"`
+}
+
+// topPages returns the n pages of a host with the highest sum of the given
+// rollup field since the given day, e.g. the top landing pages are the
+// pages with most entries.
+func topPages(ctx context.Context, host, field string, since time.Time, n int) ([]pageCount, error) {
+	p := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{
+			"host": host,
+			"day":  bson.M{"$gte": since},
+			"path": bson.M{"$ne": ""},
+		}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id":   "$path",
+			"count": bson.M{"$sum": "$" + field},
+		}}},
+		bson.D{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 0}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: n}},
+	}
+	col := db.Database(metaname).Collection(colRollups)
+	cur, err := col.Aggregate(ctx, p, options.Aggregate().SetComment(requestID(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	pages := []pageCount{}
+	if err := cur.All(ctx, &pages); err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+// dailyRollups returns the daily rollups of a path of a host since the
+// given day in chronological order.
+func dailyRollups(ctx context.Context, host, path string, since time.Time) ([]rollup, error) {
+	col := db.Database(metaname).Collection(colRollups)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "day", Value: 1}}).
+		SetComment(requestID(ctx))
+	cur, err := col.Find(ctx, bson.M{
+		"host": host,
+		"path": path,
+		"day":  bson.M{"$gte": since},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	rollups := []rollup{}
+	if err := cur.All(ctx, &rollups); err != nil {
+		return nil, err
+	}
+	return rollups, nil
+}
+
+// trend is the pv of a page in the last 24 hours and in the 24 hours
+// before.
+type trend struct {
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	PV       int64  `json:"pv"`
+	PriorPV  int64  `json:"prior_pv"`
+	Increase int64  `json:"increase"`
+}
+
+// trendingPages returns the n pages with the largest pv increase in the
+// last 24 hours over the 24 hours before, of a host or of all hosts if
+// host is empty.
+//
+// Rollups are daily, hence the pv of the last 24 hours is approximated
+// from the rollups of today and of the two days before, assuming that
+// visits of a day are spread evenly over it.
+func trendingPages(ctx context.Context, host string, now time.Time, n int) ([]trend, error) {
+	today := now.UTC().Truncate(day)
+	filter := bson.M{
+		"day":  bson.M{"$gte": today.Add(-2 * day)},
+		"path": bson.M{"$ne": ""},
+	}
+	if host != "" {
+		filter["host"] = host
+	}
+	col := db.Database(metaname).Collection(colRollups)
+	cur, err := col.Find(ctx, filter, options.Find().
+		SetProjection(bson.M{"host": 1, "path": 1, "day": 1, "pv": 1}).
+		SetComment(requestID(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	var rollups []rollup
+	if err := cur.All(ctx, &rollups); err != nil {
+		return nil, err
+	}
+	return trends(rollups, now, n), nil
+}
+
+// trends computes the trending pages of the given rollups of the last
+// three days, see trendingPages.
+func trends(rollups []rollup, now time.Time, n int) []trend {
+	type page struct{ host, path string }
+	// The pv of today, yesterday, and the day before of each page.
+	days := map[page]*[3]float64{}
+	today := now.UTC().Truncate(day)
+	for _, r := range rollups {
+		i := int(today.Sub(r.Day.UTC()) / day)
+		if i < 0 || i > 2 {
+			continue
+		}
+		p := page{r.Host, r.Path}
+		if days[p] == nil {
+			days[p] = &[3]float64{}
+		}
+		days[p][i] += float64(r.PV)
+	}
+
+	f := float64(now.UTC().Sub(today)) / float64(day)
+	all := make([]trend, 0, len(days))
+	for p, d := range days {
+		last := d[0] + (1-f)*d[1]
+		prior := f*d[1] + (1-f)*d[2]
+		t := trend{
+			Host:    p.host,
+			Path:    p.path,
+			PV:      int64(math.Round(last)),
+			PriorPV: int64(math.Round(prior)),
+		}
+		t.Increase = t.PV - t.PriorPV
+		if t.Increase > 0 {
+			all = append(all, t)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Increase != all[j].Increase {
+			return all[i].Increase > all[j].Increase
+		}
+		if all[i].Host != all[j].Host {
+			return all[i].Host < all[j].Host
+		}
+		return all[i].Path < all[j].Path
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
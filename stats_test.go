@@ -0,0 +1,72 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	version := time.Date(2021, 3, 1, 12, 0, 0, 5e8, time.UTC)
+	q := statsQuery{Host: "golang.design", Since: version.Truncate(day), Limit: 10}
+	etag := reportETag("entries", "json", q, version)
+	if other := reportETag("entries", "csv", q, version); other == etag {
+		t.Fatalf("ETags of JSON and CSV are both %s", etag)
+	}
+	if later := reportETag("entries", "json", q, version.Add(time.Hour)); later == etag {
+		t.Fatalf("ETags of two versions are both %s", etag)
+	}
+
+	tests := []struct {
+		header, value string
+		want          bool
+	}{
+		{"", "", false},
+		{"If-None-Match", etag, true},
+		{"If-None-Match", `"x", ` + etag[2:], true},
+		{"If-None-Match", "*", true},
+		{"If-None-Match", `W/"x"`, false},
+		{"If-Modified-Since", version.Format(http.TimeFormat), true},
+		{"If-Modified-Since", version.Add(-time.Second).Format(http.TimeFormat), false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/urlstat/stats/entries", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if got := notModified(r, etag, version); got != tt.want {
+			t.Fatalf("notModified(%s: %s) = %v, want %v", tt.header, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestTrends(t *testing.T) {
+	today := time.Date(2021, 3, 3, 0, 0, 0, 0, time.UTC)
+	rollups := []rollup{
+		{Host: "golang.design", Path: "/a", Day: today, PV: 30},
+		{Host: "golang.design", Path: "/a", Day: today.Add(-day), PV: 20},
+		{Host: "golang.design", Path: "/a", Day: today.Add(-2 * day), PV: 40},
+		{Host: "golang.design", Path: "/b", Day: today, PV: 5},
+		{Host: "golang.design", Path: "/c", Day: today.Add(-2 * day), PV: 100},
+		{Host: "golang.design", Path: "/d", Day: today.Add(-3 * day), PV: 100},
+	}
+	// A quarter of today has passed, hence the last 24 hours are today and
+	// three quarters of yesterday.
+	got := trends(rollups, today.Add(6*time.Hour), 10)
+	want := []trend{
+		{Host: "golang.design", Path: "/a", PV: 45, PriorPV: 35, Increase: 10},
+		{Host: "golang.design", Path: "/b", PV: 5, PriorPV: 0, Increase: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("trends() = %+v, want %+v", got, want)
+	}
+	if got := trends(rollups, today.Add(6*time.Hour), 1); len(got) != 1 || got[0].Path != "/a" {
+		t.Fatalf("trends() with limit 1 = %+v", got)
+	}
+}
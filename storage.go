@@ -0,0 +1,84 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// storage is the storage that recording a visit relies on. Visits are
+// stored per collection, which is the host or the host that an alias
+// shares the collection of.
+type storage interface {
+	// settings returns the ingest settings of a collection.
+	settings(ctx context.Context, col string) (*siteSettings, error)
+	// viewedRecently reports whether the visitor of the visit viewed the
+	// same path within the session gap.
+	viewedRecently(ctx context.Context, col string, v *visit) (bool, error)
+	// saveVisit saves a visit and returns its visitor ID, which is
+	// assigned if the visit has none.
+	saveVisit(ctx context.Context, col string, v *visit) (string, error)
+	// countAnonymous counts a page view without consent.
+	countAnonymous(ctx context.Context, col, host, path string) error
+	// countVisit reports the pv and uv of a collection in the given mode,
+	// which is page, site, or host.
+	countVisit(ctx context.Context, col, host, path, mode string) (pv, uv int64, err error)
+	// countSince counts the visits of a collection since the given time,
+	// which enforces quotas.
+	countSince(ctx context.Context, col string, since time.Time) (int64, error)
+	// blockActor saves an actor that is shadow-blocked.
+	blockActor(ctx context.Context, a *blockedActor) error
+}
+
+// store is the storage of the recording handlers. Tests replace it with
+// an in-memory storage to test handlers without a database.
+var store storage = dbStorage{}
+
+// dbStorage stores visits in the database.
+type dbStorage struct{}
+
+func (dbStorage) settings(ctx context.Context, col string) (*siteSettings, error) {
+	return settingsOf(ctx, col)
+}
+
+func (dbStorage) viewedRecently(ctx context.Context, col string, v *visit) (bool, error) {
+	return viewedRecently(ctx, db.Database(dbname).Collection(col), v)
+}
+
+func (dbStorage) saveVisit(ctx context.Context, col string, v *visit) (string, error) {
+	if sinkOnly {
+		return sinkVisit(ctx, col, v)
+	}
+	vid, err := saveVisit(ctx, db.Database(dbname).Collection(col), v)
+	if err != nil {
+		return "", err
+	}
+	// The visit is saved already, hence it is published in the background
+	// and a visit that is missing in the stream does not fail the
+	// recording.
+	queueVisit(col, v)
+	return vid, nil
+}
+
+func (dbStorage) countAnonymous(ctx context.Context, col, host, path string) error {
+	return countAnonymous(ctx, col, host, path)
+}
+
+func (dbStorage) countVisit(ctx context.Context, col, host, path, mode string) (int64, int64, error) {
+	return countVisit(ctx, db.Database(dbname).Collection(col), host, path, mode)
+}
+
+func (dbStorage) countSince(ctx context.Context, col string, since time.Time) (int64, error) {
+	return db.Database(dbname).Collection(col).CountDocuments(ctx,
+		bson.M{"time": bson.M{"$gte": since}}, options.Count().SetComment(requestID(ctx)))
+}
+
+func (dbStorage) blockActor(ctx context.Context, a *blockedActor) error {
+	return blockActor(ctx, a)
+}
@@ -0,0 +1,237 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colTombstones records deleted data that can be restored, see tombstone.
+const colTombstones = "tombstones"
+
+// trashname is the database of deleted data. Collections of a tombstone
+// are prefixed by its ID, e.g. <id>.visits and <id>.rollups.
+const trashname = "urlstat_trash"
+
+// hostMeta are the collections of the meta database with data of a host,
+// which are deleted and restored with the host.
+var hostMeta = []string{colRollups, colTotals, colCohorts, colVisitors, colAnonymous, colSettings}
+
+// trashRetention is how long deleted data can be restored, which is
+// configured by URLSTAT_TRASH_RETENTION, e.g. 168h.
+var trashRetention = 30 * day
+
+func init() {
+	v := os.Getenv("URLSTAT_TRASH_RETENTION")
+	if v == "" {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < time.Hour {
+		log.Fatalf("invalid URLSTAT_TRASH_RETENTION: %v", v)
+	}
+	trashRetention = d
+}
+
+// tombstone is data that a deletion, i.e. delete-host or a cleanup,
+// moved into the trash database instead of deleting it. It is restored by
+// restoreTombstone, or purged once it expires.
+type tombstone struct {
+	ID      string    `json:"id"      bson:"_id"`
+	Host    string    `json:"host"    bson:"host"`
+	Action  string    `json:"action"  bson:"action"`
+	Visits  int64     `json:"visits"  bson:"visits"`
+	Time    time.Time `json:"time"    bson:"time"`
+	Expires time.Time `json:"expires" bson:"expires"`
+}
+
+// newTombstone records a tombstone of the deletion of data of a host,
+// before any data is moved, so that partially moved data can be restored
+// as well.
+func newTombstone(ctx context.Context, host, action string) (*tombstone, error) {
+	now := time.Now().UTC()
+	t := &tombstone{
+		ID:      primitive.NewObjectIDFromTimestamp(now).Hex(),
+		Host:    host,
+		Action:  action,
+		Time:    now,
+		Expires: now.Add(trashRetention),
+	}
+	_, err := db.Database(metaname).Collection(colTombstones).InsertOne(ctx, t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record tombstone: %w", err)
+	}
+	return t, nil
+}
+
+// collection returns the trash collection of the tombstone of the given
+// name, i.e. visits or a collection of hostMeta.
+func (t *tombstone) collection(name string) *mongo.Collection {
+	return db.Database(trashname).Collection(t.ID + "." + name)
+}
+
+// buryHost moves the visits of a host and its data in the meta database
+// into the trash database, see deleteHost.
+func buryHost(ctx context.Context, host string) error {
+	t, err := newTombstone(ctx, host, "delete-host")
+	if err != nil {
+		return err
+	}
+	t.Visits, err = estimatedVisits(ctx, db.Database(dbname).Collection(host))
+	if err != nil {
+		return fmt.Errorf("failed to count visits: %w", err)
+	}
+	if err := buryVisits(ctx, t, host); err != nil {
+		return fmt.Errorf("failed to move visits: %w", err)
+	}
+	for _, c := range hostMeta {
+		_, err := migrateVisits(ctx, db.Database(metaname).Collection(c), t.collection(c), metaFilter(c, host))
+		if err != nil {
+			return fmt.Errorf("failed to move %s: %w", c, err)
+		}
+	}
+	_, err = db.Database(metaname).Collection(colTombstones).UpdateOne(ctx,
+		bson.M{"_id": t.ID}, bson.M{"$set": bson.M{"visits": t.Visits}})
+	if err != nil {
+		return fmt.Errorf("failed to update tombstone: %w", err)
+	}
+	return deleteMeta(ctx, host, hostMeta...)
+}
+
+// buryVisits moves the visits of a host into the trash collection of the
+// tombstone, which renames the collection of the host, or moves its visits
+// out of colVisits and drops its view in the single layout.
+func buryVisits(ctx context.Context, t *tombstone, host string) error {
+	if layout == layoutSingle {
+		stored, filter := storedVisits(host)
+		if _, err := migrateVisits(ctx, stored, t.collection("visits"), filter); err != nil {
+			return err
+		}
+		if _, err := stored.DeleteMany(ctx, filter); err != nil {
+			return err
+		}
+		return db.Database(dbname).Collection(host).Drop(ctx)
+	}
+	err := db.Database("admin").RunCommand(ctx, bson.D{
+		{Key: "renameCollection", Value: dbname + "." + host},
+		{Key: "to", Value: trashname + "." + t.ID + ".visits"},
+	}).Err()
+	// A registered host without visits has no collection.
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceNotFound") {
+		return err
+	}
+	return nil
+}
+
+// tombstones returns the tombstones that can be restored, latest first.
+func tombstones(ctx context.Context) ([]tombstone, error) {
+	cur, err := db.Database(metaname).Collection(colTombstones).Find(ctx,
+		bson.M{"expires": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "time", Value: -1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find tombstones: %w", err)
+	}
+	ts := []tombstone{}
+	if err := cur.All(ctx, &ts); err != nil {
+		return nil, fmt.Errorf("failed to decode tombstones: %w", err)
+	}
+	return ts, nil
+}
+
+// restoreTombstone moves the data of a tombstone back. Visits are merged
+// into the visits of the host that were recorded since, hence a deleted
+// host that is used again is restored as well. Restoring twice is safe,
+// as documents that exist already are skipped.
+func restoreTombstone(ctx context.Context, id string) (*tombstone, error) {
+	t := &tombstone{}
+	err := db.Database(metaname).Collection(colTombstones).FindOne(ctx,
+		bson.M{"_id": id, "expires": bson.M{"$gt": time.Now()}}).Decode(t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("%w: %s", errNoTombstone, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find tombstone: %w", err)
+	}
+
+	// Buried visits keep their site in the single layout.
+	stored, _ := storedVisits(t.Host)
+	_, err = migrateVisits(ctx, t.collection("visits"), stored, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore visits: %w", err)
+	}
+	if t.Action == "delete-host" {
+		for _, c := range hostMeta {
+			_, err := migrateVisits(ctx, t.collection(c), db.Database(metaname).Collection(c), bson.M{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to restore %s: %w", c, err)
+			}
+		}
+		settingsCache.Lock()
+		delete(settingsCache.m, t.Host)
+		settingsCache.Unlock()
+		if err := registerHost(ctx, t.Host); err != nil {
+			return nil, fmt.Errorf("failed to register %s: %w", t.Host, err)
+		}
+		// Visits recorded since the deletion are not in the restored
+		// rollups and totals.
+		if err := deleteMeta(ctx, t.Host, colRollups); err != nil {
+			return nil, err
+		}
+		if err := rollupHost(ctx, t.Host, time.Time{}, time.Time{}); err != nil {
+			return nil, fmt.Errorf("failed to roll up %s: %w", t.Host, err)
+		}
+		if err := totalHost(ctx, t.Host); err != nil {
+			return nil, fmt.Errorf("failed to total %s: %w", t.Host, err)
+		}
+	}
+	return t, purgeTombstone(ctx, t)
+}
+
+// purgeTombstone drops the trash collections of a tombstone and deletes
+// it.
+func purgeTombstone(ctx context.Context, t *tombstone) error {
+	for _, c := range append([]string{"visits"}, hostMeta...) {
+		if err := t.collection(c).Drop(ctx); err != nil {
+			return fmt.Errorf("failed to drop %s of tombstone %s: %w", c, t.ID, err)
+		}
+	}
+	_, err := db.Database(metaname).Collection(colTombstones).DeleteOne(ctx, bson.M{"_id": t.ID})
+	if err != nil {
+		return fmt.Errorf("failed to delete tombstone %s: %w", t.ID, err)
+	}
+	return nil
+}
+
+// purgeTombstones purges the expired tombstones, which runs with the
+// cleanup policies.
+func purgeTombstones(ctx context.Context) error {
+	cur, err := db.Database(metaname).Collection(colTombstones).Find(ctx,
+		bson.M{"expires": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		return fmt.Errorf("failed to find expired tombstones: %w", err)
+	}
+	var ts []tombstone
+	if err := cur.All(ctx, &ts); err != nil {
+		return fmt.Errorf("failed to decode tombstones: %w", err)
+	}
+	for i := range ts {
+		if err := purgeTombstone(ctx, &ts[i]); err != nil {
+			return err
+		}
+		l.Printf("purged tombstone %s of %s", ts[i].ID, ts[i].Host)
+	}
+	return nil
+}
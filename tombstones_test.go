@@ -0,0 +1,77 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestRestoreTombstone deletes a host and restores it from its tombstone,
+// which requires a database, e.g. URLSTAT_DB_URIS=mongodb://0.0.0.0:27017.
+func TestRestoreTombstone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	pctx, pcancel := context.WithTimeout(ctx, time.Second)
+	defer pcancel()
+	if err := db.Ping(pctx, nil); err != nil {
+		t.Skipf("database is not available: %v", err)
+	}
+	defer func(l string) { layout = l }(layout)
+	layout = layoutCollections
+
+	const host = "tombstone.urlstat.test"
+	defer func() {
+		db.Database(dbname).Collection(host).Drop(ctx)
+		deleteMeta(ctx, host, hostMeta...)
+	}()
+	if err := registerHost(ctx, host); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	col := db.Database(dbname).Collection(host)
+	if _, err := col.InsertMany(ctx, []interface{}{
+		visit{Path: "/a", IP: "203.0.113.1", Time: now},
+		visit{Path: "/b", IP: "203.0.113.2", Time: now},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deleteHost(ctx, host); err != nil {
+		t.Fatalf("cannot delete host: %v", err)
+	}
+	if n, _ := col.CountDocuments(ctx, bson.M{}); n != 0 {
+		t.Fatalf("%d visits are left after deleting the host", n)
+	}
+	ts, err := tombstones(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	for _, ts := range ts {
+		if ts.Host == host && ts.Action == "delete-host" && ts.Visits == 2 {
+			id = ts.ID
+		}
+	}
+	if id == "" {
+		t.Fatalf("no tombstone of 2 visits of %s in %+v", host, ts)
+	}
+
+	if _, err := restoreTombstone(ctx, id); err != nil {
+		t.Fatalf("cannot restore tombstone: %v", err)
+	}
+	if n, _ := col.CountDocuments(ctx, bson.M{}); n != 2 {
+		t.Fatalf("restored %d visits, want 2", n)
+	}
+	if n, _ := db.Database(metaname).Collection(colSettings).CountDocuments(ctx, bson.M{"_id": host}); n != 1 {
+		t.Fatal("settings are not restored")
+	}
+	if _, err := restoreTombstone(ctx, id); err == nil {
+		t.Fatal("tombstone is restored twice")
+	}
+}
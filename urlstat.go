@@ -7,16 +7,16 @@ package main
 import (
 	"context"
 	"embed"
-	"io"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
@@ -25,12 +25,20 @@ var (
 	publicFS fs.FS
 	l        *log.Logger
 	db       *mongo.Client
+	// dbURI is the URI of the connected database, see dbURIs.
+	dbURI string
+	// startTime is the time when the process started.
+	startTime = time.Now()
 )
 
 const (
 	dbname = "urlstat"
+	// metaname is the database of internal collections, e.g. rollups,
+	// because every collection in dbname is a host.
+	metaname = "urlstat_meta"
 	// FIXME: This service currently depends on an external project for database.
 	// We can't afford instances to run two mongodb containers.
+	// dburi is the default database, see dbURIs.
 	dburi = "mongodb://redirdb:27017"
 )
 
@@ -43,25 +51,101 @@ func init() {
 		l.Fatalf("cannot access sub file system: %v", err)
 	}
 
+	// The demo runs without a database.
+	if demo {
+		return
+	}
+
 	// initialize database connection
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
-	db, err = mongo.Connect(ctx, options.Client().ApplyURI(dburi))
+	db, dbURI, err = connectDB(ctx, dbURIs())
 	if err != nil {
 		l.Fatalf("cannot connect to database: %v", err)
 	}
-	log.Printf("connected to database %v", dburi)
+	log.Printf("connected to database %v", redactURI(dbURI))
+}
+
+// commands are maintenance tasks that run against the database instead of
+// serving HTTP, e.g. urlstat import -host example.com export.csv.
+var commands = map[string]func(args []string) error{
+	"import":         importCommand,
+	"archive":        archiveCommand,
+	"restore":        restoreCommand,
+	"export":         exportCommand,
+	"migrate":        migrateCommand,
+	"migrate-schema": migrateSchemaCommand,
+	"loadtest":       loadtestCommand,
+	"rollup":         rollupCommand,
+	"recompute-uv":   recomputeUVCommand,
+	"layout":         layoutCommand,
+	"sink-write":     sinkWriteCommand,
 }
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		cmd, ok := commands[os.Args[1]]
+		if !ok {
+			l.Fatalf("unknown command: %s", os.Args[1])
+		}
+		if err := cmd(os.Args[2:]); err != nil {
+			l.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+	if demo {
+		runDemo()
+		return
+	}
+
+	// URLSTAT_MODE runs only a part of the service, so that the write and
+	// read path can run as separate processes that share the database,
+	// and heavy reporting queries never degrade recording visits.
+	var ingest, report bool
+	switch mode := os.Getenv("URLSTAT_MODE"); mode {
+	case "", "all":
+		ingest, report = true, true
+	case "ingest":
+		ingest = true
+	case "report":
+		report = true
+	default:
+		l.Fatalf("unknown URLSTAT_MODE: %s", mode)
+	}
+
 	r := http.NewServeMux()
-	r.HandleFunc("/urlstat", recording)
-	r.HandleFunc("/urlstat/dashboard", dashboard)
-	r.HandleFunc("/urlstat/client.js", func(w http.ResponseWriter, r *http.Request) {
-		f, _ := publicFS.Open("client.js")
-		b, _ := io.ReadAll(f)
-		w.Write(b)
-	})
+	if ingest {
+		r.HandleFunc("/urlstat", ingestLimiter.limit(recording))
+		r.HandleFunc("/urlstat/admin/drain", adminDrain)
+		r.HandleFunc("/urlstat/batch", recordBatch)
+		r.HandleFunc("/urlstat/client.js", serveClient(""))
+		handleFirstParty(r)
+	}
+	if report {
+		r.HandleFunc("/urlstat/admin", admin)
+		r.HandleFunc("/urlstat/admin/api/", adminAPI)
+		r.HandleFunc("/urlstat/admin/host/", adminHost)
+		r.HandleFunc(apiPrefix, api)
+		r.HandleFunc("/urlstat/api/docs", apiDocs)
+		r.HandleFunc("/urlstat/badges/sign", signBadge)
+		r.HandleFunc("/urlstat/chart", chart)
+		r.HandleFunc("/urlstat/count", count)
+		r.HandleFunc("/urlstat/dashboard", scoped(dashboard))
+		r.HandleFunc("/urlstat/dashboard/flow", scoped(flow))
+		r.HandleFunc("/urlstat/dashboard/fragment/", scoped(dashboardFragment))
+		r.HandleFunc("/urlstat/dashboard/operations", operations)
+		r.HandleFunc("/urlstat/grafana/", grafana)
+		r.HandleFunc("/urlstat/graphql", scoped(graphql))
+		r.HandleFunc("/urlstat/graphql/schema", graphql)
+		r.HandleFunc("/urlstat/invite/", acceptInviteLink)
+		r.HandleFunc("/urlstat/login", login)
+		r.HandleFunc("/urlstat/login/callback", loginCallback)
+		r.HandleFunc("/urlstat/logout", logout)
+		r.HandleFunc("/urlstat/metrics", metrics)
+		r.HandleFunc("/urlstat/sites/", scoped(siteAPI))
+		r.HandleFunc(snapshotPrefix, scoped(snapshot))
+		r.HandleFunc("/urlstat/stats/", scoped(stats))
+	}
 
 	addr := os.Getenv("URLSTAT_ADDR")
 	if len(addr) == 0 {
@@ -70,27 +154,88 @@ func main() {
 
 	s := &http.Server{
 		Addr:         addr,
-		Handler:      logging(l)(r),
+		Handler:      requestIDs(logging(l)(r)),
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: time.Minute,
 		IdleTimeout:  time.Minute,
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	// Indexes of large collections take long to build, hence they are
+	// created in the background while the server starts.
+	go func() {
+		if err := ensureIndexes(ctx); err != nil {
+			l.Printf("cannot ensure indexes: %v", err)
+		}
+	}()
+	if os.Getenv("URLSTAT_MIGRATE") == "true" {
+		if err := migrate(ctx); err != nil {
+			l.Fatalf("cannot migrate: %v", err)
+		}
+	}
+	go watchAllowed(ctx, allowedFile, 30*time.Second)
+	if ingest {
+		go abuseWorker(ctx)
+	}
+	if report {
+		go rollupWorker(ctx)
+		go cleanupWorker(ctx)
+		if bigquery != nil {
+			go bigqueryWorker(ctx)
+		}
+	}
+
+	// The gRPC service runs on a separate port, as it requires TLS.
+	var gs *http.Server
+	if gaddr := os.Getenv("URLSTAT_GRPC_ADDR"); gaddr != "" {
+		gs = &http.Server{
+			Addr:         gaddr,
+			Handler:      requestIDs(logging(l)(http.HandlerFunc(serveGRPC))),
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: time.Minute,
+			IdleTimeout:  time.Minute,
+		}
+		go func() {
+			l.Printf("changkun.de/urlstat is serving gRPC on %s", gaddr)
+			err := gs.ListenAndServeTLS(os.Getenv("URLSTAT_GRPC_CERT"), os.Getenv("URLSTAT_GRPC_KEY"))
+			if err != nil && err != http.ErrServerClosed {
+				l.Fatalf("cannot serve gRPC on %s, err: %v\n", gaddr, err)
+			}
+		}()
+	}
+
 	done := make(chan bool)
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if watchDB(ctx, dbURI, dbURIs()) {
+			quit <- syscall.SIGTERM
+		}
+	}()
 
 	go func() {
 		<-quit
 		l.Println("changkun.de/urlstat is shutting down...")
+		cancel()
 
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
+		// Visits that are being recorded are saved before the server
+		// stops, and new visits are rejected meanwhile.
+		if n := drain(ctx); n > 0 {
+			l.Printf("shutting down with %d visits still queued", n)
+		}
+
 		s.SetKeepAlivesEnabled(false)
 		if err := s.Shutdown(ctx); err != nil {
 			l.Fatalf("cannot gracefully shutdown changkun.de/urlstat: %v", err)
 		}
+		if gs != nil {
+			if err := gs.Shutdown(ctx); err != nil {
+				l.Fatalf("cannot gracefully shutdown gRPC: %v", err)
+			}
+		}
 		close(done)
 	}()
 
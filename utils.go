@@ -5,10 +5,13 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
 	"net/http"
 	"strings"
+
+	"github.com/google/uuid"
 )
 
 // logging is a basic logger that prints the request history.
@@ -16,13 +19,37 @@ func logging(logger *log.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			defer func() {
-				logger.Println(readIP(r), r.Method, r.URL.Path)
+				logger.Println(readIP(r), r.Method, r.URL.Path, requestID(r.Context()))
 			}()
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+type requestIDKey struct{}
+
+// requestIDs assigns an ID to each request, which is included in logs,
+// error responses, and database operations of the request, to correlate
+// them. An X-Request-Id set by a reverse proxy is reused.
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 128 {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-Id", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestID returns the request ID of the given context, or an empty
+// string if the context does not belong to a request.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
 // readIP implements a best effort approach to return the real client IP,
 // it parses X-Real-IP and X-Forwarded-For in order to work properly with
 // reverse-proxies such us: nginx or haproxy. Use X-Forwarded-For before
@@ -34,14 +61,31 @@ func readIP(r *http.Request) string {
 		clientIP = strings.TrimSpace(r.Header.Get("X-Real-Ip"))
 	}
 	if clientIP != "" {
-		return clientIP
+		return normalizeIP(clientIP)
 	}
 	if addr := r.Header.Get("X-Appengine-Remote-Addr"); addr != "" {
-		return addr
+		return normalizeIP(addr)
 	}
 	ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
 	if err != nil {
 		return "unknown" // use unknown to guarantee non empty string
 	}
-	return ip
+	return normalizeIP(ip)
+}
+
+// normalizeIP returns the canonical form of an IP address, so that the
+// same address is stored and counted the same however it is written, e.g.
+// 2001:DB8:0:0::1 and [2001:db8::1]:443 are 2001:db8::1, and the
+// IPv4-mapped ::ffff:192.0.2.1 is 192.0.2.1. Other strings are returned
+// as they are.
+func normalizeIP(s string) string {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			return ip.String()
+		}
+	}
+	return s
 }
@@ -0,0 +1,236 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UV bases of a site, i.e. what identifies a unique visitor.
+const (
+	// uvIP counts IP addresses, which is the default.
+	uvIP = "ip"
+	// uvVisitor counts visitor IDs, which are kept in a cookie and
+	// survive changes of the IP address.
+	uvVisitor = "visitor"
+	// uvFingerprint counts daily fingerprints of the IP address and user
+	// agent, see fingerprint, hence a visitor counts again every day.
+	uvFingerprint = "fingerprint"
+)
+
+// uvField returns the field of visits that identifies unique visitors
+// under the UV basis of the site.
+func (s *siteSettings) uvField() string {
+	switch s.UV {
+	case uvVisitor:
+		return "visitor_id"
+	case uvFingerprint:
+		return "fp"
+	}
+	return "ip"
+}
+
+// uvFieldOf returns the field of visits that identifies unique visitors of
+// a host, see siteSettings.uvField.
+func uvFieldOf(ctx context.Context, host string) (string, error) {
+	s, err := settingsOf(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("failed to load settings: %w", err)
+	}
+	return s.uvField(), nil
+}
+
+// fingerprint returns the daily fingerprint of a visitor of a host, which
+// changes every day, so that visitors cannot be followed across days.
+func fingerprint(host, ip, ua string, t time.Time) string {
+	h := sha256.Sum256([]byte(t.UTC().Format("2006-01-02") + "\n" + host + "\n" + ip + "\n" + ua))
+	return hex.EncodeToString(h[:8])
+}
+
+// recomputeUVCommand recomputes the uv of hosts under their current UV
+// basis, so that charts have no discontinuity when the basis changes. It
+// backfills what the basis needs of visits recorded before: IPv6 addresses
+// are normalized, see siteSettings.visitorIP, visits without a visitor ID
+// get one derived from their IP address, and visits without a fingerprint
+// get theirs. Then all rollups and the totals of the host are recomputed,
+// see backfillHost.
+//
+// Usage:
+//
+//	urlstat recompute-uv [-host 'blog.*' ...] [-chunk 7]
+func recomputeUVCommand(args []string) error {
+	var hosts globs
+	flags := flag.NewFlagSet("recompute-uv", flag.ExitOnError)
+	flags.Var(&hosts, "host", "only recompute hosts matching the glob, can be repeated")
+	chunk := flags.Int("chunk", 7, "the number of days that are computed at a time")
+	flags.Parse(args)
+
+	if *chunk < 1 {
+		return errors.New("-chunk must be positive")
+	}
+	ctx := context.Background()
+	all, err := db.Database(dbname).ListCollectionNames(ctx, hostsFilter)
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+	// Rollups of today are computed as well, the rollup worker computes
+	// them again anyway.
+	until := time.Now().UTC().Truncate(day).Add(day)
+	for _, h := range all {
+		if !hosts.match(h) {
+			continue
+		}
+		s, err := settingsOf(ctx, h)
+		if err != nil {
+			return fmt.Errorf("failed to load settings of %s: %w", h, err)
+		}
+		start := time.Now()
+		col := analyticsDB(dbname).Collection(h)
+		ips, err := normalizeIPs(ctx, col, s)
+		if err != nil {
+			return fmt.Errorf("failed to normalize IP addresses of %s: %w", h, err)
+		}
+		n, err := backfillUV(ctx, col, s.UV)
+		if err != nil {
+			return fmt.Errorf("failed to backfill %s: %w", h, err)
+		}
+		if err := backfillHost(ctx, h, time.Time{}, until, *chunk, true); err != nil {
+			return fmt.Errorf("failed to recompute %s: %w", h, err)
+		}
+		l.Printf("recomputed uv of %s by %s in %v, normalized %d and backfilled %d visits", h, s.uvField(), time.Since(start), ips, n)
+	}
+	return nil
+}
+
+// normalizeIPs rewrites the IPv6 addresses of visits that were stored
+// before they were normalized or grouped, and returns the number of
+// updated visits.
+func normalizeIPs(ctx context.Context, col *mongo.Collection, s *siteSettings) (int64, error) {
+	// IPv4 addresses are stored in their canonical form already, except
+	// IPv4-mapped IPv6 addresses, which contain a colon too.
+	cur, err := col.Find(ctx, bson.M{"ip": bson.M{"$regex": ":"}},
+		options.Find().SetProjection(bson.M{"ip": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	// Visits are read from col, which is a view in the single layout, and
+	// updated where they are stored.
+	stored, _ := storedVisits(col.Name())
+	var n int64
+	models := make([]mongo.WriteModel, 0, insertBatch)
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		res, err := stored.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+		n += res.ModifiedCount
+		models = models[:0]
+		return nil
+	}
+	for cur.Next(ctx) {
+		var v struct {
+			ID interface{} `bson:"_id"`
+			IP string      `bson:"ip"`
+		}
+		if err := cur.Decode(&v); err != nil {
+			return n, err
+		}
+		ip := s.visitorIP(v.IP)
+		if ip == v.IP {
+			continue
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": v.ID}).
+			SetUpdate(bson.M{"$set": bson.M{"ip": ip}}))
+		if len(models) == insertBatch {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+// backfillUV sets the field of the UV basis of visits that do not have
+// it, and returns the number of updated visits.
+func backfillUV(ctx context.Context, col *mongo.Collection, basis string) (int64, error) {
+	stored, _ := storedVisits(col.Name())
+	switch basis {
+	case uvVisitor:
+		res, err := stored.UpdateMany(ctx,
+			hostFilter(col.Name(), bson.M{"visitor_id": bson.M{"$in": bson.A{"", nil}}}),
+			mongo.Pipeline{bson.D{{Key: "$set", Value: bson.M{
+				"visitor_id": bson.M{"$concat": bson.A{"ip:", "$ip"}},
+			}}}})
+		if err != nil {
+			return 0, err
+		}
+		return res.ModifiedCount, nil
+	case uvFingerprint:
+		cur, err := col.Find(ctx, bson.M{"fp": bson.M{"$exists": false}},
+			options.Find().SetProjection(bson.M{"ip": 1, "ua": 1, "time": 1}))
+		if err != nil {
+			return 0, err
+		}
+		defer cur.Close(ctx)
+
+		var n int64
+		models := make([]mongo.WriteModel, 0, insertBatch)
+		flush := func() error {
+			if len(models) == 0 {
+				return nil
+			}
+			res, err := stored.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+			if err != nil {
+				return err
+			}
+			n += res.ModifiedCount
+			models = models[:0]
+			return nil
+		}
+		for cur.Next(ctx) {
+			var v struct {
+				ID   interface{} `bson:"_id"`
+				IP   string      `bson:"ip"`
+				UA   string      `bson:"ua"`
+				Time time.Time   `bson:"time"`
+			}
+			if err := cur.Decode(&v); err != nil {
+				return n, err
+			}
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": v.ID}).
+				SetUpdate(bson.M{"$set": bson.M{"fp": fingerprint(col.Name(), v.IP, v.UA, v.Time)}}))
+			if len(models) == insertBatch {
+				if err := flush(); err != nil {
+					return n, err
+				}
+			}
+		}
+		if err := cur.Err(); err != nil {
+			return n, err
+		}
+		return n, flush()
+	}
+	return 0, nil
+}
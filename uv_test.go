@@ -0,0 +1,102 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+	morning := time.Date(2021, 3, 1, 8, 0, 0, 0, time.UTC)
+	fp := fingerprint("changkun.de", "203.0.113.1", "Mozilla/5.0", morning)
+	if len(fp) != 16 {
+		t.Fatalf("fingerprint %q is not 16 hex digits", fp)
+	}
+	if got := fingerprint("changkun.de", "203.0.113.1", "Mozilla/5.0", morning.Add(15*time.Hour)); got != fp {
+		t.Fatalf("fingerprint changed within the day: %s, want %s", got, fp)
+	}
+	for _, other := range []string{
+		fingerprint("changkun.de", "203.0.113.1", "Mozilla/5.0", morning.Add(day)),
+		fingerprint("golang.design", "203.0.113.1", "Mozilla/5.0", morning),
+		fingerprint("changkun.de", "203.0.113.2", "Mozilla/5.0", morning),
+		fingerprint("changkun.de", "203.0.113.1", "curl/7.64.1", morning),
+	} {
+		if other == fp {
+			t.Fatalf("fingerprints of different visitors are equal: %s", fp)
+		}
+	}
+}
+
+func TestUVField(t *testing.T) {
+	for basis, want := range map[string]string{
+		"":            "ip",
+		uvIP:          "ip",
+		uvVisitor:     "visitor_id",
+		uvFingerprint: "fp",
+	} {
+		s := &siteSettings{UV: basis}
+		if err := s.validate(); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.uvField(); got != want {
+			t.Fatalf("uv field of %q: %s, want %s", basis, got, want)
+		}
+	}
+	if err := (&siteSettings{UV: "cookie"}).validate(); err == nil {
+		t.Fatal("unknown uv basis is valid")
+	}
+}
+
+func TestVisitorIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		grouped bool
+		want    string
+	}{
+		{"192.0.2.1", false, "192.0.2.1"},
+		{"::ffff:192.0.2.1", false, "192.0.2.1"},
+		{"2001:DB8:0:0:0:0:0:1", false, "2001:db8::1"},
+		{"[2001:db8::1]:443", false, "2001:db8::1"},
+		{"unknown", false, "unknown"},
+		{"2001:db8:1:2:a1b2:c3d4:e5f6:1", true, "2001:db8:1:2::"},
+		{"2001:DB8:1:2:9999::1", true, "2001:db8:1:2::"},
+		{"192.0.2.1", true, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		s := &siteSettings{GroupIPv6: tt.grouped}
+		if got := s.visitorIP(tt.ip); got != tt.want {
+			t.Fatalf("visitor IP of %s (grouped: %v): %s, want %s", tt.ip, tt.grouped, got, tt.want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/urlstat", nil)
+	r.Header.Set("X-Forwarded-For", "2001:DB8::0:1, 10.0.0.1")
+	if got := readIP(r); got != "2001:db8::1" {
+		t.Fatalf("IP of request: %s, want 2001:db8::1", got)
+	}
+}
+
+func TestCookielessVisitorID(t *testing.T) {
+	m, restore := useMemStorage()
+	defer restore()
+	m.register("changkun.de", siteSettings{UV: uvVisitor})
+
+	u, _ := url.Parse("https://changkun.de/")
+	for _, vid := range []string{"", "", "0b2c8f6e-4c1a-4d3e-9a6b-7f8e9d0c1b2a"} {
+		if _, err := recordVisit(context.Background(), visitReport{URL: u, IP: "203.0.113.1", VisitorID: vid}); err != nil {
+			t.Fatalf("cannot record visit: %v", err)
+		}
+	}
+	vs := m.visits["changkun.de"]
+	if len(vs) != 3 || vs[0].VisitorID != "ip:203.0.113.1" || vs[1].VisitorID != vs[0].VisitorID ||
+		vs[2].VisitorID != "0b2c8f6e-4c1a-4d3e-9a6b-7f8e9d0c1b2a" {
+		t.Fatalf("recorded visits: %+v", vs)
+	}
+}
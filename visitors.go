@@ -0,0 +1,31 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// colVisitors stores when a visitor was first seen on a host, which
+// classifies visits as new or returning.
+const colVisitors = "visitors"
+
+// firstSeen records the visitor of a host as seen at the given time,
+// and reports whether the visitor was never seen before.
+func firstSeen(ctx context.Context, host, vid string, t time.Time) (bool, error) {
+	col := db.Database(metaname).Collection(colVisitors)
+	r, err := col.UpdateOne(ctx,
+		bson.M{"host": host, "visitor_id": vid},
+		bson.M{"$setOnInsert": bson.M{"first_seen": t}},
+		options.Update().SetUpsert(true).SetComment(requestID(ctx)))
+	if err != nil {
+		return false, err
+	}
+	return r.UpsertedCount == 1, nil
+}